@@ -592,6 +592,7 @@ systemctl enable bbbfancontrol.service
 ## bbbsupervisor
 ## see https://github.com/digitalbitbox/bitbox-base/tree/master/tools/bbbsupervisor
 cp /opt/shift/bin/go/bbbsupervisor /usr/local/sbin/
+importFile "/etc/bbbsupervisor/rules.json"
 importFile "/etc/systemd/system/bbbsupervisor.service"
 systemctl enable bbbsupervisor.service
 
@@ -628,6 +629,9 @@ if ! echo "${NODE_EXPORTER_CHKSUM}  node_exporter-${NODE_EXPORTER_VERSION}.linux
 tar --strip-components 1 -xzf node_exporter-${NODE_EXPORTER_VERSION}.linux-arm64.tar.gz
 cp node_exporter /usr/local/bin
 
+# textfile collector directory, e.g. for the bbbfancontrol metrics
+mkdir -p /var/lib/prometheus/node-exporter
+
 importFile "/etc/systemd/system/prometheus-node-exporter.service"
 systemctl enable prometheus-node-exporter.service
 
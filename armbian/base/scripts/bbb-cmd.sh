@@ -18,6 +18,7 @@ possible commands:
   restore       <sysconfig|hsm_secret>
   reset         <auth|config|image|ssd>
   mender-update <install|commit>
+  cleanup       <rootfs|ssd>
 
 "
 }
@@ -463,6 +464,40 @@ case "${MODULE}" in
         esac
         ;;
 
+    CLEANUP)
+        # possible commands, called by bbbsupervisor when disk space runs low
+        #   cleanup rootfs: rotate logs, delete old rotated logs and prune temporary directories
+        #   cleanup ssd:    vacuum the systemd journal, which is stored on the ssd
+
+        case "${COMMAND}" in
+            ROOTFS)
+                checkMockMode
+
+                # force log rotation and delete rotated logs older than a week
+                logrotate -f /etc/logrotate.conf || echo "WARN: (CLEANUP) log rotation failed"
+                find /var/log -type f \( -name "*.gz" -o -name "*.[0-9]" -o -name "*.old" \) -mtime +7 -delete
+
+                # prune files in temporary directories not accessed for two days
+                find /tmp /var/tmp -xdev -type f -atime +2 -delete
+
+                echo "Command ${MODULE} ${COMMAND} successfully executed."
+                ;;
+
+            SSD)
+                checkMockMode
+
+                # the journal is retained on the ssd, see /var/log/journal
+                journalctl --vacuum-size=200M --vacuum-time=4weeks
+
+                echo "Command ${MODULE} ${COMMAND} successfully executed."
+                ;;
+
+            *)
+                echo "Invalid argument for module ${MODULE}: command ${COMMAND} unknown."
+                errorExit CMD_SCRIPT_INVALID_ARG
+        esac
+        ;;
+
     RESET)
         # possbile commands
         #   reset auth:     reset authentication for running BitBoxApp setup wizard again
@@ -23,6 +23,7 @@ possible commands:
   set       <hostname|loginpw|wifi_ssid|wifi_pw>
             bitcoin_network         <mainnet|testnet>
             bitcoin_dbcache         int (MB)
+            fan_profile             <silent|balanced|performance>
             other arguments         string
 
 "
@@ -126,10 +127,10 @@ case "${COMMAND}" in
                 checkMockMode
 
                 redis_set "bitcoind:listen" "${ENABLE}"
-                generateConfig "bitcoin.conf.template"
+                generateConfigs "bitcoin.conf.template"
 
-                # only restart bitcoind if system has been configured with setup routine
-                if [[ "$(redis_get 'base:setup')" -eq 1 ]]; then
+                # only restart bitcoind if config changed and system has been configured with setup routine
+                if [[ ${CONFIG_CHANGED} -eq 1 ]] && [[ "$(redis_get 'base:setup')" -eq 1 ]]; then
                     echo "INFO: restarting bitcoind"
                     systemctl restart bitcoind
                 fi
@@ -288,8 +289,10 @@ case "${COMMAND}" in
                     errorExit CONFIG_SCRIPT_INVALID_ARG
                 fi
 
-                generateConfig "torrc.template"
-                systemctl restart tor.service
+                generateConfigs "torrc.template"
+                if [[ ${CONFIG_CHANGED} -eq 1 ]]; then
+                    systemctl restart tor.service
+                fi
 
                 updateTorOnions
                 ;;
@@ -384,12 +387,8 @@ case "${COMMAND}" in
                         errorExit SET_BITCOINETWORK_INVALID_VALUE
                 esac
 
-                generateConfig "bashrc-custom.template"
-                generateConfig "torrc.template"
-                generateConfig "bitcoin.conf.template"
-                generateConfig "lightningd.conf.template"
-                generateConfig "electrs.conf.template"
-                generateConfig "bbbmiddleware.conf.template"
+                generateConfigs "bashrc-custom.template" "torrc.template" "bitcoin.conf.template" \
+                                "lightningd.conf.template" "electrs.conf.template" "bbbmiddleware.conf.template"
                 echo "System configuration ${SETTING} will be enabled on next boot."
                 ;;
 
@@ -457,6 +456,21 @@ case "${COMMAND}" in
                 fi
                 ;;
 
+            FAN_PROFILE)
+                case "${3}" in
+                    silent|balanced|performance)
+                        checkMockMode
+
+                        # applied live by bbbfancontrol
+                        redis_set "fan:profile" "${3}"
+                        ;;
+
+                    *)
+                        echo "Invalid argument: '${3}' must be 'silent', 'balanced' or 'performance'."
+                        errorExit SET_FANPROFILE_INVALID_VALUE
+                esac
+                ;;
+
             HOSTNAME)
                 # check that hostname is valid
                 regex='^[a-z][a-z0-9-]{0,22}[a-z0-9]$'
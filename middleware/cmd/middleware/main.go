@@ -6,6 +6,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	middleware "github.com/digitalbitbox/bitbox-base/middleware/src"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/configuration"
@@ -31,6 +32,8 @@ func main() {
 	imageUpdateInfoURL := flag.String("updateinfourl", "https://shiftcrypto.ch/updates/base.json", "URL to query information about Base image updates from")
 	notificationNamedPipePath := flag.String("notificationNamedPipePath", "/tmp/middleware-notification.pipe", "Path where the Middleware creates a named pipe to receive notifications from other processes on the BitBoxBase")
 	hsmSerialPort := flag.String("hsmserialport", "/dev/ttyS0", "Serial port used to communicate with the HSM")
+	accessTokenLifetime := flag.Duration("accesstokenlifetime", 24*time.Hour, "Duration the JSON web access tokens are valid for")
+	refreshTokenLifetime := flag.Duration("refreshtokenlifetime", 30*24*time.Hour, "Duration the JSON web refresh tokens are valid for, a refresh token can be exchanged for new tokens with the RefreshToken RPC")
 	flag.Parse()
 
 	hsm := hsm.NewHSM(*hsmSerialPort)
@@ -43,6 +46,7 @@ func main() {
 
 	config := configuration.NewConfiguration(
 		configuration.Args{
+			AccessTokenLifetime:       *accessTokenLifetime,
 			BBBCmdScript:              *bbbCmdScript,
 			BBBConfigScript:           *bbbConfigScript,
 			BBBSystemctlScript:        *bbbSystemctlScript,
@@ -55,6 +59,7 @@ func main() {
 			PrometheusURL:             *prometheusURL,
 			RedisMock:                 *redisMock,
 			RedisPort:                 *redisPort,
+			RefreshTokenLifetime:      *refreshTokenLifetime,
 		},
 	)
 
@@ -0,0 +1,193 @@
+package authentication
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+)
+
+const (
+	// freeAttempts is the number of failed authentication attempts before a backoff is required.
+	freeAttempts = 3
+	// baseBackoff is the backoff after the first failed attempt exceeding the free attempts. It doubles with each further failed attempt.
+	baseBackoff = time.Second
+	// lockoutAttempts is the number of failed authentication attempts after which the user or client is locked out.
+	lockoutAttempts = 10
+	// lockoutDuration is the duration of a lockout. The failed attempts are reset once it is over.
+	lockoutDuration = 15 * time.Minute
+	// attemptsResetInterval is the duration after the last failed attempt after which the failed attempts are forgotten.
+	attemptsResetInterval = 24 * time.Hour
+)
+
+// attempts holds the failed authentication attempts of a single user or client.
+type attempts struct {
+	Failures int `json:"failures"`
+	// LastFailure is the time of the last failed attempt.
+	LastFailure time.Time `json:"lastFailure"`
+	// BlockedUntil is the time until which no further attempts are allowed.
+	BlockedUntil time.Time `json:"blockedUntil"`
+}
+
+// expired returns true if the failed attempts should be forgotten, because a lockout is over or the last failed attempt is too long ago.
+func (a *attempts) expired(now time.Time) bool {
+	if a.BlockedUntil.After(now) {
+		return false
+	}
+	return a.Failures >= lockoutAttempts || now.Sub(a.LastFailure) > attemptsResetInterval
+}
+
+// AttemptLimiter tracks the failed authentication attempts per user and per client to protect against brute-force attacks.
+// After a few failed attempts, each further attempt requires an exponentially increasing backoff, until the user or client
+// is temporarily locked out. The attempts are persisted in redis, so that restarting the middleware does not reset them.
+type AttemptLimiter struct {
+	redisClient redis.Redis
+	// attempts maps "user:<username>" and "client:<hex encoded noise static pubkey>" to the failed attempts.
+	attempts map[string]*attempts
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// NewAttemptLimiter returns a new AttemptLimiter with the failed attempts loaded from redis.
+func NewAttemptLimiter(redisClient redis.Redis) *AttemptLimiter {
+	limiter := &AttemptLimiter{
+		redisClient: redisClient,
+		attempts:    make(map[string]*attempts),
+		now:         time.Now,
+	}
+	attemptsString, err := redisClient.GetString(redis.MiddlewareAuthAttempts)
+	if err != nil {
+		log.Printf("Warning: could not load the failed authentication attempts from redis: %s", err)
+	} else if attemptsString != "" {
+		if err := json.Unmarshal([]byte(attemptsString), &limiter.attempts); err != nil {
+			log.Printf("Warning: could not parse the failed authentication attempts from redis: %s", err)
+		}
+	}
+	return limiter
+}
+
+// SetClock replaces the function returning the current time, so that tests can step the time forward instead of sleeping.
+func (limiter *AttemptLimiter) SetClock(now func() time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.now = now
+}
+
+// attemptKeys returns the keys the attempts of a user and client are tracked under. An empty username or client is omitted.
+func attemptKeys(username string, clientPubkey string) []string {
+	keys := []string{}
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	if clientPubkey != "" {
+		keys = append(keys, "client:"+clientPubkey)
+	}
+	return keys
+}
+
+// RetryAfter returns the duration until the next authentication attempt of the user from the client is allowed.
+// Zero is returned if an attempt is allowed now.
+func (limiter *AttemptLimiter) RetryAfter(username string, clientPubkey string) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	var retryAfter time.Duration
+	for _, key := range attemptKeys(username, clientPubkey) {
+		a, ok := limiter.attempts[key]
+		if !ok {
+			continue
+		}
+		blockedFor := a.BlockedUntil.Sub(now)
+		if blockedFor > retryAfter {
+			retryAfter = blockedFor
+		}
+	}
+	return retryAfter
+}
+
+// Reserve checks whether an authentication attempt of the user from the client is allowed and, if so, records it as failed
+// before the password is checked, so that parallel attempts can't bypass the backoff. A successful attempt is reported with
+// RecordSuccess, which resets the failed attempts. If the attempt is allowed, ok is true and retryAfter is the duration
+// until the next attempt is allowed, in case this attempt fails. Otherwise retryAfter is the remaining backoff.
+// The username should be empty for unknown users, so that arbitrary usernames are not tracked.
+func (limiter *AttemptLimiter) Reserve(username string, clientPubkey string) (retryAfter time.Duration, ok bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	keys := attemptKeys(username, clientPubkey)
+	for _, key := range keys {
+		if a, ok := limiter.attempts[key]; ok && a.BlockedUntil.After(now) {
+			if blockedFor := a.BlockedUntil.Sub(now); blockedFor > retryAfter {
+				retryAfter = blockedFor
+			}
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+
+	for _, key := range keys {
+		a, ok := limiter.attempts[key]
+		if !ok || a.expired(now) {
+			a = &attempts{}
+			limiter.attempts[key] = a
+		}
+		a.Failures++
+		a.LastFailure = now
+
+		var backoff time.Duration
+		switch {
+		case a.Failures >= lockoutAttempts:
+			backoff = lockoutDuration
+		case a.Failures > freeAttempts:
+			backoff = baseBackoff << uint(a.Failures-freeAttempts-1)
+		}
+		a.BlockedUntil = now.Add(backoff)
+		if backoff > retryAfter {
+			retryAfter = backoff
+		}
+	}
+	limiter.store()
+	return retryAfter, true
+}
+
+// RecordSuccess resets the failed authentication attempts of the user and the client after a successful authentication.
+func (limiter *AttemptLimiter) RecordSuccess(username string, clientPubkey string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	changed := false
+	for _, key := range attemptKeys(username, clientPubkey) {
+		if _, ok := limiter.attempts[key]; ok {
+			delete(limiter.attempts, key)
+			changed = true
+		}
+	}
+	if changed {
+		limiter.store()
+	}
+}
+
+// store prunes the expired attempts and writes the attempts to redis. The caller must hold the lock.
+func (limiter *AttemptLimiter) store() {
+	now := limiter.now()
+	for key, a := range limiter.attempts {
+		if a.expired(now) {
+			delete(limiter.attempts, key)
+		}
+	}
+	attemptsString, err := json.Marshal(limiter.attempts)
+	if err != nil {
+		log.Printf("Warning: could not marshal the failed authentication attempts: %s", err)
+		return
+	}
+	err = limiter.redisClient.SetString(redis.MiddlewareAuthAttempts, string(attemptsString))
+	if err != nil {
+		log.Printf("Warning: could not store the failed authentication attempts in redis: %s", err)
+	}
+}
@@ -0,0 +1,110 @@
+package authentication_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	authentication "github.com/digitalbitbox/bitbox-base/middleware/src/authentication"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	redisClient := redis.NewMockClient("")
+	limiter := authentication.NewAttemptLimiter(redisClient)
+	now := time.Now()
+	clock := func() time.Time { return now }
+	limiter.SetClock(clock)
+	require.Equal(t, time.Duration(0), limiter.RetryAfter("admin", "aabb"))
+
+	// the first attempts are free
+	for i := 0; i < 3; i++ {
+		retryAfter, ok := limiter.Reserve("admin", "aabb")
+		require.True(t, ok)
+		require.Equal(t, time.Duration(0), retryAfter)
+	}
+	require.Equal(t, time.Duration(0), limiter.RetryAfter("admin", "aabb"))
+
+	// then each attempt requires a backoff, which doubles with each failed attempt
+	retryAfter, ok := limiter.Reserve("admin", "aabb")
+	require.True(t, ok)
+	require.Equal(t, time.Second, retryAfter)
+	retryAfter, ok = limiter.Reserve("admin", "aabb")
+	require.False(t, ok)
+	require.Equal(t, time.Second, retryAfter)
+
+	// the backoff applies to the user from other clients and to other users from the client
+	require.True(t, limiter.RetryAfter("admin", "ccdd") > 0)
+	require.True(t, limiter.RetryAfter("family", "aabb") > 0)
+	require.Equal(t, time.Duration(0), limiter.RetryAfter("family", "ccdd"))
+
+	// the failed attempts are persisted
+	restartedLimiter := authentication.NewAttemptLimiter(redisClient)
+	restartedLimiter.SetClock(clock)
+	require.Equal(t, time.Second, restartedLimiter.RetryAfter("admin", "aabb"))
+
+	now = now.Add(time.Second)
+	retryAfter, ok = limiter.Reserve("admin", "aabb")
+	require.True(t, ok)
+	require.Equal(t, 2*time.Second, retryAfter)
+
+	// a successful authentication resets the failed attempts
+	limiter.RecordSuccess("admin", "aabb")
+	require.Equal(t, time.Duration(0), limiter.RetryAfter("admin", "aabb"))
+	retryAfter, ok = limiter.Reserve("admin", "aabb")
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), retryAfter)
+
+	// unknown users are only tracked per client
+	for i := 0; i < 3; i++ {
+		limiter.Reserve("", "eeff")
+	}
+	retryAfter, ok = limiter.Reserve("", "eeff")
+	require.True(t, ok)
+	require.Equal(t, time.Second, retryAfter)
+	require.Equal(t, time.Duration(0), limiter.RetryAfter("", ""))
+}
+
+func TestAttemptLimiterLockout(t *testing.T) {
+	// after too many failed attempts, the user and client are locked out
+	redisClient := redis.NewMockClient("")
+	persistedAttempts, err := json.Marshal(map[string]interface{}{
+		"user:admin": map[string]interface{}{"failures": 9, "lastFailure": time.Now(), "blockedUntil": time.Now()},
+	})
+	require.NoError(t, err)
+	require.NoError(t, redisClient.SetString(redis.MiddlewareAuthAttempts, string(persistedAttempts)))
+
+	limiter := authentication.NewAttemptLimiter(redisClient)
+	retryAfter, ok := limiter.Reserve("admin", "aabb")
+	require.True(t, ok)
+	require.Equal(t, 15*time.Minute, retryAfter)
+	require.True(t, limiter.RetryAfter("admin", "") > 14*time.Minute)
+	_, ok = limiter.Reserve("admin", "ccdd")
+	require.False(t, ok)
+}
+
+func TestAttemptLimiterParallel(t *testing.T) {
+	// parallel attempts are recorded before the password is checked, so they can't bypass the backoff
+	limiter := authentication.NewAttemptLimiter(redis.NewMockClient(""))
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := limiter.Reserve("admin", "aabb"); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// the three free attempts and the first attempt with a backoff
+	require.Equal(t, 4, allowed)
+}
@@ -3,34 +3,152 @@ package authentication
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
 )
 
+// The roles a middleware user can have. Admins can use all RPCs, while viewers can only use the RPCs that do not change the Base.
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+const (
+	// defaultAccessTokenLifetime is the duration an access token is valid for, if no lifetime is configured. It is the
+	// lifetime of the tokens before refresh tokens were introduced, so that clients not refreshing their tokens keep working.
+	defaultAccessTokenLifetime = 24 * time.Hour
+	// defaultRefreshTokenLifetime is the duration a refresh token is valid for, if no lifetime is configured.
+	defaultRefreshTokenLifetime = 30 * 24 * time.Hour
+	// keyRotationInterval is the duration after which a new signing key is generated. The previous keys are kept
+	// until all tokens signed with them are expired.
+	keyRotationInterval = 7 * 24 * time.Hour
+)
+
+// ErrRoleNotPermitted is returned if a valid token is used for an action its role is not permitted to do.
+var ErrRoleNotPermitted = errors.New("the role of the json web token is not permitted to do this")
+
+// ErrTokenRevoked is returned if a token has been revoked, e.g. by a logout or a password change.
+var ErrTokenRevoked = errors.New("the json web token has been revoked")
+
+// ErrTokenClientMismatch is returned if a refresh token is used by another noise client than it was issued to.
+var ErrTokenClientMismatch = errors.New("the json web token was issued to another client")
+
+// ErrTokenUserMismatch is returned if a refresh token is revoked by another user than it was issued to.
+var ErrTokenUserMismatch = errors.New("the json web token was issued to another user")
+
+// The token types. Access tokens authenticate the RPCs and refresh tokens can only be used to get new tokens.
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+// IsValidRole returns true if the role is one of the known user roles.
+func IsValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleViewer
+}
+
 // Claims is a struct that is consumed by the jwt-go that includes the claims that need to be included into a json web token.
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role"`
+	// Generation is the token generation of the user when the token was issued. All tokens of a user are revoked by
+	// increasing the user's generation.
+	Generation int `json:"generation"`
+	// Type is either "access" or "refresh".
+	Type string `json:"type"`
+	// ClientPubkey is the hex encoded noise static pubkey of the client a refresh token is bound to.
+	ClientPubkey string `json:"clientPubkey,omitempty"`
 	jwt.StandardClaims
 }
 
-// JwtAuth is a struct holding the jwtKey. The key is generated once when starting the middleware.
+// signingKey is a key used to sign json web tokens. The id is set as the `kid` header of the tokens signed with the key.
+type signingKey struct {
+	ID      string `json:"id"`
+	Key     string `json:"key"`
+	Created int64  `json:"created"`
+}
+
+// revocations holds the revoked tokens. Tokens are revoked individually by their id (the `jti` claim) or all tokens of a
+// user by increasing the user's token generation.
+type revocations struct {
+	// Tokens maps the id of a revoked token to its expiry as unix timestamp. Expired tokens are pruned.
+	Tokens map[string]int64 `json:"tokens"`
+	// UserGenerations maps a username to its current token generation.
+	UserGenerations map[string]int `json:"userGenerations"`
+}
+
+// JwtAuth is a struct holding the jwt signing keys and the revoked tokens. Both are persisted in redis, so that tokens
+// stay valid across middleware restarts.
 type JwtAuth struct {
-	jwtKey string
+	redisClient          redis.Redis
+	accessTokenLifetime  time.Duration
+	refreshTokenLifetime time.Duration
+	// keys holds the signing keys, the newest key is last and used to sign new tokens.
+	keys        []signingKey
+	revocations revocations
+	mu          sync.Mutex
 }
 
-// NewJwtAuth returns a new JwtAuth struct if the jwt key generation is successful, or an error, if it is not.
-func NewJwtAuth() (*JwtAuth, error) {
-	jwtAuth := &JwtAuth{}
-	// generate random string with 32 bytes of entropy and use it as the signing key
-	JwtKey, err := jwtAuth.generateRandomString(32)
-	if err != nil {
-		log.Println("could not get enough entropy to generate key")
-		return &JwtAuth{}, err
+// NewJwtAuth returns a new JwtAuth struct issuing tokens with the given lifetimes. A lifetime of zero uses the default lifetime.
+// The signing keys and revocations are loaded from redis. If no key is found a new key is generated and stored. An error is
+// returned if the keys or revocations can't be loaded, so that they are not overwritten, or if no key can be generated and stored.
+func NewJwtAuth(redisClient redis.Redis, accessTokenLifetime time.Duration, refreshTokenLifetime time.Duration) (*JwtAuth, error) {
+	if accessTokenLifetime <= 0 {
+		accessTokenLifetime = defaultAccessTokenLifetime
+	}
+	if refreshTokenLifetime <= 0 {
+		refreshTokenLifetime = defaultRefreshTokenLifetime
+	}
+	jwtAuth := &JwtAuth{
+		redisClient:          redisClient,
+		accessTokenLifetime:  accessTokenLifetime,
+		refreshTokenLifetime: refreshTokenLifetime,
+		revocations: revocations{
+			Tokens:          make(map[string]int64),
+			UserGenerations: make(map[string]int),
+		},
+	}
+
+	keysString, err := redisClient.GetString(redis.MiddlewareJWTKeys)
+	if err != nil && err != redis.ErrKeyNotFound {
+		return &JwtAuth{}, fmt.Errorf("could not load the jwt signing keys from redis: %v", err)
+	}
+	if keysString != "" {
+		if err := json.Unmarshal([]byte(keysString), &jwtAuth.keys); err != nil {
+			return &JwtAuth{}, fmt.Errorf("could not parse the jwt signing keys from redis: %v", err)
+		}
+	}
+
+	revocationsString, err := redisClient.GetString(redis.MiddlewareJWTRevocations)
+	if err != nil && err != redis.ErrKeyNotFound {
+		return &JwtAuth{}, fmt.Errorf("could not load the revoked jwt tokens from redis: %v", err)
+	}
+	if revocationsString != "" {
+		if err := json.Unmarshal([]byte(revocationsString), &jwtAuth.revocations); err != nil {
+			return &JwtAuth{}, fmt.Errorf("could not parse the revoked jwt tokens from redis: %v", err)
+		}
+	}
+	if jwtAuth.revocations.Tokens == nil {
+		jwtAuth.revocations.Tokens = make(map[string]int64)
+	}
+	if jwtAuth.revocations.UserGenerations == nil {
+		jwtAuth.revocations.UserGenerations = make(map[string]int)
+	}
+
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+	if len(jwtAuth.keys) == 0 {
+		if err := jwtAuth.rotateKey(); err != nil {
+			return &JwtAuth{}, err
+		}
 	}
-	jwtAuth.jwtKey = JwtKey
 	return jwtAuth, nil
 }
 
@@ -56,22 +174,118 @@ func (jwtAuth *JwtAuth) generateRandomString(s int) (string, error) {
 	return base64.URLEncoding.EncodeToString(b), err
 }
 
-// GenerateToken generates a jwt token. It is the callers job to ensure that the username has been verified in the database first.
-func (jwtAuth *JwtAuth) GenerateToken(username string) (string, error) {
-	jwtStaticKey := []byte(jwtAuth.jwtKey)
+// rotateKey generates a new signing key used for new tokens and prunes keys that can't have signed a valid token anymore.
+// The keys are stored in redis. If they can't be stored, the current keys are kept. The caller must hold the lock.
+func (jwtAuth *JwtAuth) rotateKey() error {
+	// generate random string with 32 bytes of entropy and use it as the signing key
+	key, err := jwtAuth.generateRandomString(32)
+	if err != nil {
+		log.Println("could not get enough entropy to generate key")
+		return err
+	}
+	id, err := jwtAuth.generateRandomString(8)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	keys := []signingKey{}
+	for i, k := range jwtAuth.keys {
+		// A key is used for signing until the next key is created, so the tokens signed with it expire at most
+		// the longest token lifetime after that. The newest key is kept, since it was used until now.
+		if i+1 < len(jwtAuth.keys) && now.Sub(time.Unix(jwtAuth.keys[i+1].Created, 0)) > jwtAuth.maxTokenLifetime() {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	keys = append(keys, signingKey{ID: id, Key: key, Created: now.Unix()})
+	if err := jwtAuth.storeKeys(keys); err != nil {
+		return err
+	}
+	jwtAuth.keys = keys
+	log.Printf("Generated a new jwt signing key with the id %q", id)
+	return nil
+}
+
+// maxTokenLifetime returns the longest lifetime of the issued tokens.
+func (jwtAuth *JwtAuth) maxTokenLifetime() time.Duration {
+	if jwtAuth.refreshTokenLifetime > jwtAuth.accessTokenLifetime {
+		return jwtAuth.refreshTokenLifetime
+	}
+	return jwtAuth.accessTokenLifetime
+}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
+// storeKeys writes the signing keys to redis. The caller must hold the lock.
+func (jwtAuth *JwtAuth) storeKeys(keys []signingKey) error {
+	keysString, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	err = jwtAuth.redisClient.SetString(redis.MiddlewareJWTKeys, string(keysString))
+	if err != nil {
+		return fmt.Errorf("could not store the jwt signing keys in redis: %v", err)
+	}
+	return nil
+}
 
-	claims := &Claims{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+// storeRevocations prunes the expired revoked tokens and writes the revocations to redis. The caller must hold the lock.
+func (jwtAuth *JwtAuth) storeRevocations() error {
+	now := time.Now().Unix()
+	for id, expiresAt := range jwtAuth.revocations.Tokens {
+		if expiresAt < now {
+			delete(jwtAuth.revocations.Tokens, id)
+		}
+	}
+	revocationsString, err := json.Marshal(jwtAuth.revocations)
+	if err != nil {
+		return err
+	}
+	return jwtAuth.redisClient.SetString(redis.MiddlewareJWTRevocations, string(revocationsString))
+}
+
+// GenerateToken generates a short-lived access token for a user with the given role. It is the callers job to ensure that the
+// username has been verified in the database first.
+func (jwtAuth *JwtAuth) GenerateToken(username string, role string) (string, error) {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+	return jwtAuth.generateToken(&Claims{Username: username, Role: role, Type: tokenTypeAccess}, jwtAuth.accessTokenLifetime)
+}
+
+// GenerateRefreshToken generates a long-lived refresh token for a user with the given role. The token is bound to the hex encoded
+// noise static pubkey of the client and can only be used by this client to get new tokens.
+func (jwtAuth *JwtAuth) GenerateRefreshToken(username string, role string, clientPubkey string) (string, error) {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+	return jwtAuth.generateToken(&Claims{Username: username, Role: role, Type: tokenTypeRefresh, ClientPubkey: clientPubkey}, jwtAuth.refreshTokenLifetime)
+}
+
+// generateToken completes the claims and signs them with the current signing key. The signing key is rotated first, if it is older
+// than the rotation interval. The caller must hold the lock.
+func (jwtAuth *JwtAuth) generateToken(claims *Claims, lifetime time.Duration) (string, error) {
+	currentKey := jwtAuth.keys[len(jwtAuth.keys)-1]
+	if time.Since(time.Unix(currentKey.Created, 0)) > keyRotationInterval {
+		if err := jwtAuth.rotateKey(); err != nil {
+			log.Printf("could not rotate the jwt signing key, continuing with the current key: %s", err)
+		}
+		currentKey = jwtAuth.keys[len(jwtAuth.keys)-1]
+	}
+
+	tokenID, err := jwtAuth.generateRandomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims.Generation = jwtAuth.revocations.UserGenerations[claims.Username]
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        tokenID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtStaticKey)
+	token.Header["kid"] = currentKey.ID
+	tokenString, err := token.SignedString([]byte(currentKey.Key))
 	if err != nil {
-		log.Println("error generating new tokenString from middleware jwt static session key")
+		log.Println("error generating new tokenString from middleware jwt signing key")
 		return "", err
 	}
 	return tokenString, nil
@@ -79,21 +293,142 @@ func (jwtAuth *JwtAuth) GenerateToken(username string) (string, error) {
 
 // ValidateToken takes a jwt token string as an argument and returns an error if the validation fails. If the validation is successful, nil is returned
 func (jwtAuth *JwtAuth) ValidateToken(tokenStr string) error {
-	jwtStaticKey := []byte(jwtAuth.jwtKey)
+	_, err := jwtAuth.ParseToken(tokenStr)
+	return err
+}
+
+// ValidateAdminToken validates a jwt token string like ValidateToken and additionally returns ErrRoleNotPermitted
+// if the token does not belong to an admin.
+func (jwtAuth *JwtAuth) ValidateAdminToken(tokenStr string) error {
+	claims, err := jwtAuth.ParseToken(tokenStr)
+	if err != nil {
+		return err
+	}
+	if claims.Role != RoleAdmin {
+		log.Printf("User %q with role %q is not permitted to do admin actions", claims.Username, claims.Role)
+		return ErrRoleNotPermitted
+	}
+	return nil
+}
+
+// ParseToken validates an access token string and returns its claims. An error is returned if the validation fails
+// or ErrTokenRevoked if the token has been revoked.
+func (jwtAuth *JwtAuth) ParseToken(tokenStr string) (*Claims, error) {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+
+	claims, err := jwtAuth.parseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != tokenTypeAccess {
+		return nil, errors.New("the json web token is not an access token")
+	}
+	return claims, nil
+}
+
+// UseRefreshToken validates a refresh token string of the client with the given hex encoded noise static pubkey and returns
+// its claims. A refresh token can only be used once, so it is revoked. ErrTokenClientMismatch is returned if the token was
+// issued to another client.
+func (jwtAuth *JwtAuth) UseRefreshToken(tokenStr string, clientPubkey string) (*Claims, error) {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
 
+	claims, err := jwtAuth.parseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != tokenTypeRefresh {
+		return nil, errors.New("the json web token is not a refresh token")
+	}
+	if claims.ClientPubkey != clientPubkey {
+		log.Printf("Refresh token of user %q used by another client", claims.Username)
+		return nil, ErrTokenClientMismatch
+	}
+	jwtAuth.revocations.Tokens[claims.Id] = claims.ExpiresAt
+	if err := jwtAuth.storeRevocations(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// parseToken validates a jwt token string of any type and returns its claims. The caller must hold the lock.
+func (jwtAuth *JwtAuth) parseToken(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtStaticKey, nil
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		keyID, _ := token.Header["kid"].(string)
+		for _, key := range jwtAuth.keys {
+			if key.ID == keyID {
+				return []byte(key.Key), nil
+			}
+		}
+		return nil, fmt.Errorf("unknown signing key id %q", keyID)
 	})
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
 			log.Println("Invalid Signature")
 		}
-		return err
+		return nil, err
 	}
 	if !token.Valid {
 		log.Println("Invalid token received, breaking connection with: ", token.Claims)
-		return errors.New("invalid jwt token received")
+		return nil, errors.New("invalid jwt token received")
 	}
-	return nil
+	if _, revoked := jwtAuth.revocations.Tokens[claims.Id]; revoked {
+		return nil, ErrTokenRevoked
+	}
+	if claims.Generation != jwtAuth.revocations.UserGenerations[claims.Username] {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// RevokeToken revokes a single valid access or refresh token, e.g. on a logout.
+func (jwtAuth *JwtAuth) RevokeToken(tokenStr string) error {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+
+	claims, err := jwtAuth.parseToken(tokenStr)
+	if err != nil {
+		return err
+	}
+	jwtAuth.revocations.Tokens[claims.Id] = claims.ExpiresAt
+	return jwtAuth.storeRevocations()
+}
+
+// RevokeRefreshToken revokes a single valid refresh token of the user and the client with the given hex encoded noise static
+// pubkey, e.g. on a logout. ErrTokenUserMismatch or ErrTokenClientMismatch is returned if the token was issued to another
+// user or client.
+func (jwtAuth *JwtAuth) RevokeRefreshToken(tokenStr string, username string, clientPubkey string) error {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+
+	claims, err := jwtAuth.parseToken(tokenStr)
+	if err != nil {
+		return err
+	}
+	if claims.Type != tokenTypeRefresh {
+		return errors.New("the json web token is not a refresh token")
+	}
+	if claims.Username != username {
+		log.Printf("Refresh token of user %q revoked by user %q", claims.Username, username)
+		return ErrTokenUserMismatch
+	}
+	if claims.ClientPubkey != clientPubkey {
+		log.Printf("Refresh token of user %q revoked by another client", claims.Username)
+		return ErrTokenClientMismatch
+	}
+	jwtAuth.revocations.Tokens[claims.Id] = claims.ExpiresAt
+	return jwtAuth.storeRevocations()
+}
+
+// RevokeUserTokens revokes all tokens issued to a user so far, e.g. after a password change.
+func (jwtAuth *JwtAuth) RevokeUserTokens(username string) error {
+	jwtAuth.mu.Lock()
+	defer jwtAuth.mu.Unlock()
+	jwtAuth.revocations.UserGenerations[username]++
+	return jwtAuth.storeRevocations()
 }
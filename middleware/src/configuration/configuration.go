@@ -2,6 +2,8 @@
 // values to the Middleware.
 package configuration
 
+import "time"
+
 // Args has the same fields as the `Configuration` struct, but the fields in
 // `Args` are public. The struct is used as parameter to the `NewConfiguration()`
 // factory function. The struct needs public fields to be settable the `main`
@@ -15,6 +17,7 @@ package configuration
 // configuration. Using the `Args` helps, because a Go struct can be initialized
 // with named fields.
 type Args struct {
+	AccessTokenLifetime       time.Duration
 	BBBCmdScript              string
 	BBBConfigScript           string
 	BBBSystemctlScript        string
@@ -27,6 +30,7 @@ type Args struct {
 	PrometheusURL             string
 	RedisMock                 bool
 	RedisPort                 string
+	RefreshTokenLifetime      time.Duration
 }
 
 // Configuration holds the configuration options for the Middleware.
@@ -34,6 +38,7 @@ type Args struct {
 // Note: adding / removing a field in this struct requires an update to the
 // `Args` struct as well.
 type Configuration struct {
+	accessTokenLifetime       time.Duration
 	bbbCmdScript              string
 	bbbConfigScript           string
 	bbbSystemctlScript        string
@@ -46,6 +51,7 @@ type Configuration struct {
 	prometheusURL             string
 	redisMock                 bool
 	redisPort                 string
+	refreshTokenLifetime      time.Duration
 }
 
 // NewConfiguration returns a new Configuration instance.
@@ -54,6 +60,7 @@ type Configuration struct {
 // named parameters. The struct helps avoiding switched parameters.
 func NewConfiguration(args Args) Configuration {
 	config := Configuration{
+		accessTokenLifetime:       args.AccessTokenLifetime,
 		bbbCmdScript:              args.BBBCmdScript,
 		bbbConfigScript:           args.BBBConfigScript,
 		bbbSystemctlScript:        args.BBBSystemctlScript,
@@ -66,6 +73,7 @@ func NewConfiguration(args Args) Configuration {
 		prometheusURL:             args.PrometheusURL,
 		redisMock:                 args.RedisMock,
 		redisPort:                 args.RedisPort,
+		refreshTokenLifetime:      args.RefreshTokenLifetime,
 	}
 	return config
 }
@@ -130,3 +138,13 @@ func (config *Configuration) GetNetwork() string {
 func (config *Configuration) GetElectrsRPCPort() string {
 	return config.electrsRPCPort
 }
+
+// GetAccessTokenLifetime is a getter for the duration the json web access tokens are valid for.
+func (config *Configuration) GetAccessTokenLifetime() time.Duration {
+	return config.accessTokenLifetime
+}
+
+// GetRefreshTokenLifetime is a getter for the duration the json web refresh tokens are valid for.
+func (config *Configuration) GetRefreshTokenLifetime() time.Duration {
+	return config.refreshTokenLifetime
+}
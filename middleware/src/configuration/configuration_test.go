@@ -2,6 +2,7 @@ package configuration_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/digitalbitbox/bitbox-base/middleware/src/configuration"
 	"github.com/stretchr/testify/require"
@@ -24,9 +25,14 @@ func TestConfiguration(t *testing.T) {
 		redisMock                 bool   = false
 		redisPort                 string = "6379"
 	)
+	const (
+		accessTokenLifetime  time.Duration = 15 * time.Minute
+		refreshTokenLifetime time.Duration = 30 * 24 * time.Hour
+	)
 
 	config := configuration.NewConfiguration(
 		configuration.Args{
+			AccessTokenLifetime:       accessTokenLifetime,
 			BBBCmdScript:              bbbCmdScript,
 			BBBConfigScript:           bbbConfigScript,
 			BBBSystemctlScript:        bbbSystemctlScript,
@@ -39,6 +45,7 @@ func TestConfiguration(t *testing.T) {
 			PrometheusURL:             prometheusURL,
 			RedisMock:                 redisMock,
 			RedisPort:                 redisPort,
+			RefreshTokenLifetime:      refreshTokenLifetime,
 		},
 	)
 
@@ -53,4 +60,6 @@ func TestConfiguration(t *testing.T) {
 	require.Equal(t, notificationNamedPipePath, config.GetNotificationNamedPipePath())
 	require.Equal(t, prometheusURL, config.GetPrometheusURL())
 	require.Equal(t, redisPort, config.GetRedisPort())
+	require.Equal(t, accessTokenLifetime, config.GetAccessTokenLifetime())
+	require.Equal(t, refreshTokenLifetime, config.GetRefreshTokenLifetime())
 }
@@ -0,0 +1,127 @@
+// Package eventqueue implements a bounded queue of events for the clients of the Middleware. Each event is delivered
+// exactly once to each client, even if the client is not connected when the event occurs. The queue and the delivered
+// events are persisted in redis, so that they survive Middleware restarts.
+package eventqueue
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+)
+
+// DefaultMaxEvents is the default number of events kept in the queue. If the queue is full, the oldest event is dropped.
+const DefaultMaxEvents = 32
+
+// Event is a queued event with its sequence number. The sequence numbers start at 1 and increase with each event.
+type Event struct {
+	Seq        uint64 `json:"seq"`
+	Identifier []byte `json:"identifier"`
+	Payload    []byte `json:"payload,omitempty"`
+}
+
+// state is the part of the queue persisted in redis.
+type state struct {
+	LastSeq uint64  `json:"lastSeq"`
+	Events  []Event `json:"events"`
+}
+
+// Queue holds the latest events and the sequence number of the last event delivered to each client.
+type Queue struct {
+	redisClient redis.Redis
+	maxEvents   int
+	state       state
+	// delivered maps a client id, e.g. the hex encoded noise static pubkey, to the sequence number of the last event delivered to it.
+	delivered map[string]uint64
+	mu        sync.Mutex
+}
+
+// NewQueue returns a new Queue keeping at most maxEvents events. The queued events and the delivered sequence numbers
+// are loaded from redis.
+func NewQueue(redisClient redis.Redis, maxEvents int) *Queue {
+	queue := &Queue{
+		redisClient: redisClient,
+		maxEvents:   maxEvents,
+		delivered:   make(map[string]uint64),
+	}
+
+	stateString, err := redisClient.GetString(redis.MiddlewareEventQueue)
+	if err != nil {
+		log.Printf("Warning: could not load the event queue from redis: %s", err)
+	} else if stateString != "" {
+		if err := json.Unmarshal([]byte(stateString), &queue.state); err != nil {
+			log.Printf("Warning: could not parse the event queue from redis: %s", err)
+		}
+	}
+
+	deliveredString, err := redisClient.GetString(redis.MiddlewareEventsDelivered)
+	if err != nil {
+		log.Printf("Warning: could not load the delivered events from redis: %s", err)
+	} else if deliveredString != "" {
+		if err := json.Unmarshal([]byte(deliveredString), &queue.delivered); err != nil {
+			log.Printf("Warning: could not parse the delivered events from redis: %s", err)
+		}
+	}
+	return queue
+}
+
+// Add appends a new event to the queue and returns its sequence number. If the queue is full, the oldest event is dropped.
+func (queue *Queue) Add(identifier []byte, payload []byte) uint64 {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.state.LastSeq++
+	queue.state.Events = append(queue.state.Events, Event{
+		Seq:        queue.state.LastSeq,
+		Identifier: identifier,
+		Payload:    payload,
+	})
+	if len(queue.state.Events) > queue.maxEvents {
+		dropped := queue.state.Events[0]
+		queue.state.Events = queue.state.Events[1:]
+		log.Printf("Event queue full, dropped the event %q with the sequence number %d", dropped.Identifier, dropped.Seq)
+	}
+	queue.store(redis.MiddlewareEventQueue, queue.state)
+	return queue.state.LastSeq
+}
+
+// Pending returns the queued events not yet delivered to the client, ordered by their sequence number.
+func (queue *Queue) Pending(client string) []Event {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	pending := []Event{}
+	for _, event := range queue.state.Events {
+		if event.Seq > queue.delivered[client] {
+			pending = append(pending, event)
+		}
+	}
+	return pending
+}
+
+// MarkDelivered records that the events up to the sequence number have been delivered to the client.
+func (queue *Queue) MarkDelivered(client string, seq uint64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if seq <= queue.delivered[client] {
+		return
+	}
+	queue.delivered[client] = seq
+	queue.store(redis.MiddlewareEventsDelivered, queue.delivered)
+}
+
+// store writes the JSON encoded value to the redis key. Errors are only logged, since the queue keeps working in memory.
+// The caller must hold the lock.
+func (queue *Queue) store(key redis.BaseRedisKey, value interface{}) {
+	valueString, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Warning: could not marshal the event queue: %s", err)
+		return
+	}
+	err = queue.redisClient.SetString(key, string(valueString))
+	if err != nil {
+		log.Printf("Warning: could not store the event queue in redis: %s", err)
+	}
+}
@@ -0,0 +1,46 @@
+package eventqueue_test
+
+import (
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/eventqueue"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	redisClient := redis.NewMockClient("")
+	queue := eventqueue.NewQueue(redisClient, 3)
+	require.Empty(t, queue.Pending("client1"))
+
+	require.Equal(t, uint64(1), queue.Add([]byte("a"), nil))
+	require.Equal(t, uint64(2), queue.Add([]byte("b"), []byte(`{}`)))
+	require.Equal(t, []eventqueue.Event{
+		{Seq: 1, Identifier: []byte("a")},
+		{Seq: 2, Identifier: []byte("b"), Payload: []byte(`{}`)},
+	}, queue.Pending("client1"))
+
+	// each client gets each event once
+	queue.MarkDelivered("client1", 2)
+	require.Empty(t, queue.Pending("client1"))
+	require.Len(t, queue.Pending("client2"), 2)
+	queue.MarkDelivered("client2", 1)
+	require.Equal(t, uint64(2), queue.Pending("client2")[0].Seq)
+	// the delivered sequence number never decreases
+	queue.MarkDelivered("client1", 1)
+	require.Empty(t, queue.Pending("client1"))
+
+	// the queue and the delivered events survive a restart
+	restartedQueue := eventqueue.NewQueue(redisClient, 3)
+	require.Empty(t, restartedQueue.Pending("client1"))
+	require.Len(t, restartedQueue.Pending("client2"), 1)
+	require.Equal(t, uint64(3), restartedQueue.Add([]byte("c"), nil))
+
+	// the oldest events are dropped if the queue is full
+	restartedQueue.Add([]byte("d"), nil)
+	restartedQueue.Add([]byte("e"), nil)
+	pending := restartedQueue.Pending("client3")
+	require.Len(t, pending, 3)
+	require.Equal(t, uint64(3), pending[0].Seq)
+	require.Equal(t, uint64(5), pending[2].Seq)
+}
@@ -0,0 +1,8 @@
+package middleware
+
+import "time"
+
+// SetAttemptLimiterClock replaces the clock of the brute-force protection, so that tests can step the time forward.
+func (middleware *Middleware) SetAttemptLimiterClock(now func() time.Time) {
+	middleware.attemptLimiter.SetClock(now)
+}
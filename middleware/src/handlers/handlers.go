@@ -23,6 +23,8 @@ type Middleware interface {
 	/* --- RPCs --- */
 	BackupHSMSecret() rpcmessages.ErrorResponse
 	BackupSysconfig() rpcmessages.ErrorResponse
+	CreateUser(rpcmessages.CreateUserArgs) rpcmessages.ErrorResponse
+	DeleteUser(rpcmessages.DeleteUserArgs) rpcmessages.ErrorResponse
 	EnableClearnetIBD(rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse
 	EnableRootLogin(rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse
 	EnableSSHPasswordLogin(rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse
@@ -33,14 +35,19 @@ type Middleware interface {
 	FinalizeSetupWizard() rpcmessages.ErrorResponse
 	GetBaseInfo() rpcmessages.GetBaseInfoResponse
 	GetBaseUpdateProgress() rpcmessages.GetBaseUpdateProgressResponse
+	GetFanStatus() rpcmessages.GetFanStatusResponse
 	GetServiceInfo() rpcmessages.GetServiceInfoResponse
 	GetServiceStatus() rpcmessages.GetServiceStatusResponse
 	IsBaseUpdateAvailable() rpcmessages.IsBaseUpdateAvailableResponse
+	ListUsers() rpcmessages.ListUsersResponse
+	Logout(rpcmessages.LogoutArgs) rpcmessages.ErrorResponse
 	RebootBase() rpcmessages.ErrorResponse
+	RefreshToken(rpcmessages.RefreshTokenArgs) rpcmessages.UserAuthenticateResponse
 	ReindexBitcoin() rpcmessages.ErrorResponse
 	RestoreHSMSecret() rpcmessages.ErrorResponse
 	RestoreSysconfig() rpcmessages.ErrorResponse
 	ResyncBitcoin() rpcmessages.ErrorResponse
+	SetFanProfile(rpcmessages.SetFanProfileArgs) rpcmessages.ErrorResponse
 	SetHostname(rpcmessages.SetHostnameArgs) rpcmessages.ErrorResponse
 	SetLoginPassword(rpcmessages.SetLoginPasswordArgs) rpcmessages.ErrorResponse
 	SetupStatus() rpcmessages.SetupStatusResponse
@@ -52,7 +59,11 @@ type Middleware interface {
 	/* --- RPCs end --- */
 
 	GetMiddlewareVersion() string
+	MarkEventDelivered(clientPubkey []byte, seq uint64)
+	PendingEvents(clientPubkey []byte) []Event
+	TokenUsername(token string) (string, error)
 	ValidateToken(token string) error
+	ValidateAdminToken(token string) error
 	VerifyAppMiddlewarePairing(channelHash []byte) (bool, error)
 }
 
@@ -63,19 +74,87 @@ type Handlers struct {
 	upgrader         websocket.Upgrader
 	middleware       Middleware
 	middlewareEvents <-chan Event
-	eventQueue       []Event
 
+	// noiseConfig holds the noise static keypair and the paired clients, which are shared by all connections.
+	// Each connection has its own noisemanager.NoiseSession.
 	noiseConfig *noisemanager.NoiseConfig
 	nClients    int
-	clientsMap  map[int]chan<- []byte
+	clientsMap  map[int]*wsClient
 	mu          sync.Mutex
 }
 
+// eventChanSize is the number of events buffered for each client. It is larger than the event queue of the middleware,
+// so that all pending events can be replayed to a reconnecting client.
+const eventChanSize = 64
+
+// wsClient is a connected websocket client with the rpc server of its connection.
+type wsClient struct {
+	// eventChan buffers the events for the write loop of the client, so that a slow client does not block the other clients.
+	eventChan chan outgoingEvent
+	rpcServer *rpcserver.RPCServer
+	// clientPubkey is the noise static pubkey of the client.
+	clientPubkey []byte
+	// lastSeq is the sequence number of the last queued event sent to the client.
+	lastSeq uint64
+	// queueStalled is set once a queued event was dropped. No further queued events are sent to the client, so that they stay
+	// in order and are replayed on the next connection.
+	queueStalled bool
+}
+
+// outgoingEvent is an encoded event waiting in the buffer of a client, with the sequence number of a queued event.
+type outgoingEvent struct {
+	message []byte
+	seq     uint64
+}
+
 // Event represents a Event the middleware passes to the handlers to be send to
 // a client.
 type Event struct {
-	Identifier      []byte
-	QueueIfNoClient bool
+	Identifier []byte
+	// Payload is the optional JSON encoded data of the event, e.g. the changed GetServiceInfoResponse.
+	// It is only sent to clients that enabled event payloads.
+	Payload []byte
+	// Seq is the sequence number of an event queued by the middleware, which is delivered exactly once to each client,
+	// even if the client is not connected when the event occurs. It is zero for events only sent to the connected clients.
+	Seq uint64
+}
+
+// Encode returns the message sent to a client for the event. If the client enabled event payloads and the event
+// carries a payload, the opcode is followed by the payload version and the payload. Otherwise only the opcode is sent.
+func (event Event) Encode(withPayload bool) []byte {
+	if !withPayload || event.Payload == nil {
+		return event.Identifier
+	}
+	message := append([]byte{}, event.Identifier...)
+	message = append(message, rpcmessages.EventPayloadVersion)
+	return append(message, event.Payload...)
+}
+
+// send sends the event to the client, with the payload if the client enabled event payloads. It does not block and
+// returns false if the event was dropped, because the buffer of the client is full.
+func (client *wsClient) send(event Event) bool {
+	select {
+	case client.eventChan <- outgoingEvent{message: event.Encode(client.rpcServer.EventPayloadsEnabled()), seq: event.Seq}:
+		return true
+	default:
+		log.Printf("Event buffer of a client full, dropping the event %q", event.Identifier)
+		return false
+	}
+}
+
+// sendQueued sends a queued event to the client, unless it was already sent. The event is marked as delivered by the
+// write loop once it was written to the websocket, so that events lost with the connection are replayed.
+// The caller must hold the handlers lock.
+func (handlers *Handlers) sendQueued(client *wsClient, event Event) {
+	if event.Seq <= client.lastSeq || client.queueStalled {
+		return
+	}
+	if !client.send(event) {
+		// the event stays pending and is sent again on the next connection of the client
+		client.queueStalled = true
+		return
+	}
+	client.lastSeq = event.Seq
 }
 
 // NewHandlers returns a handler instance.
@@ -89,8 +168,7 @@ func NewHandlers(middlewareInstance Middleware, dataDir string) *Handlers {
 		noiseConfig: noisemanager.NewNoiseConfig(
 			dataDir, middlewareInstance.VerifyAppMiddlewarePairing),
 		nClients:   0,
-		clientsMap: make(map[int]chan<- []byte),
-		eventQueue: make([]Event, 0),
+		clientsMap: make(map[int]*wsClient),
 	}
 
 	handlers.Router.HandleFunc("/", handlers.rootHandler).Methods("GET")
@@ -107,14 +185,13 @@ func (handlers *Handlers) listenEvents() {
 		event := <-handlers.middlewareEvents
 
 		handlers.mu.Lock()
-		if len(handlers.clientsMap) == 0 && event.QueueIfNoClient {
-			handlers.eventQueue = append(handlers.eventQueue, event)
-		} else {
-			for k := range handlers.clientsMap {
-				handlers.clientsMap[k] <- event.Identifier
+		for _, client := range handlers.clientsMap {
+			if event.Seq == 0 {
+				client.send(event)
+			} else {
+				handlers.sendQueued(client, event)
 			}
 		}
-
 		handlers.mu.Unlock()
 	}
 }
@@ -163,29 +240,37 @@ func (handlers *Handlers) wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = handlers.noiseConfig.InitializeNoise(ws)
+	noiseSession := handlers.noiseConfig.NewSession()
+	err = noiseSession.InitializeNoise(ws)
 	if err != nil {
 		log.Printf("Noise connection failed to initialize: %s", err)
 		return
 	}
 
-	server := rpcserver.NewRPCServer(handlers.middleware)
+	server := rpcserver.NewRPCServer(handlers.middleware, pairingStore{handlers.noiseConfig}, noiseSession.ClientStaticPubkey())
+
+	client := &wsClient{
+		eventChan:    make(chan outgoingEvent, eventChanSize),
+		rpcServer:    server,
+		clientPubkey: noiseSession.ClientStaticPubkey(),
+	}
 
 	handlers.mu.Lock()
-	handlers.clientsMap[handlers.nClients] = server.RPCConnection.WriteChan()
-	handlers.runWebsocket(ws, server.RPCConnection.ReadChan(), server.RPCConnection.WriteChan(), handlers.nClients)
+	// replay the queued events the client missed, while holding the lock no new events are sent
+	for _, event := range handlers.middleware.PendingEvents(client.clientPubkey) {
+		handlers.sendQueued(client, event)
+	}
+	handlers.clientsMap[handlers.nClients] = client
+	delivered := func(seq uint64) { handlers.middleware.MarkEventDelivered(client.clientPubkey, seq) }
+	handlers.runWebsocket(ws, noiseSession, server.RPCConnection.ReadChan(), server.RPCConnection.WriteChan(), client.eventChan, delivered, handlers.nClients)
 	handlers.nClients++
 	handlers.mu.Unlock()
 
+	if noiseSession.JSONRPC() {
+		go server.ServeJSONRPC()
+		return
+	}
 	go func() {
 		_ = server.Serve(true /* dummy arg 1 */, nil /* dummy pointer */)
 	}()
-
-	handlers.mu.Lock()
-	for _, event := range handlers.eventQueue {
-		for k := range handlers.clientsMap {
-			handlers.clientsMap[k] <- event.Identifier
-		}
-	}
-	handlers.mu.Unlock()
 }
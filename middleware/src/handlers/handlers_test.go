@@ -4,13 +4,21 @@ import (
 	middleware "github.com/digitalbitbox/bitbox-base/middleware/src"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/configuration"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/handlers"
+	noisemanager "github.com/digitalbitbox/bitbox-base/middleware/src/noise"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
 	"github.com/stretchr/testify/require"
 
 	"github.com/flynn/noise"
 
 	"crypto/rand"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gorilla/websocket"
@@ -98,7 +106,8 @@ func TestWebsocketHandler(t *testing.T) {
 	require.NoError(t, err)
 
 	//initialize noise
-	_, sendCipher := initializeNoise(ws, t)
+	_, sendCipher, err := initializeNoise(ws)
+	require.NoError(t, err)
 
 	// do not do any pairing verification
 	err = ws.WriteMessage(1, []byte("m"))
@@ -123,7 +132,8 @@ func TestWebsocketHandler(t *testing.T) {
 	}()
 
 	//initialize noise
-	_, _ = initializeNoise(ws, t)
+	_, _, err = initializeNoise(ws)
+	require.NoError(t, err)
 
 	//do the pairing verificaion
 	err = ws.WriteMessage(1, []byte(opICanHasPairinVerificashun))
@@ -134,13 +144,210 @@ func TestWebsocketHandler(t *testing.T) {
 	require.Equal(t, string(responseBytes), string(responseSuccess))
 }
 
+func TestEventEncode(t *testing.T) {
+	event := handlers.Event{
+		Identifier: []byte(rpcmessages.OpBaseUpdateProgressChanged),
+		Payload:    []byte(`{"State":1}`),
+	}
+	// older clients only receive the opcode
+	require.Equal(t, []byte("u"), event.Encode(false))
+	require.Equal(t, []byte("u\x01{\"State\":1}"), event.Encode(true))
+
+	eventWithoutPayload := handlers.Event{Identifier: []byte(rpcmessages.OpBaseUpdateSuccess)}
+	require.Equal(t, []byte("a"), eventWithoutPayload.Encode(false))
+	require.Equal(t, []byte("a"), eventWithoutPayload.Encode(true))
+}
+
+// TestWebsocketHandlerConcurrentClients connects multiple clients at the same time. Each client does its own
+// handshake and pairing, and then calls a RPC encrypted with its own cipher states.
+func TestWebsocketHandlerConcurrentClients(t *testing.T) {
+	const numClients = 5
+
+	dataDir, err := ioutil.TempDir("", "middleware-handlers-test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dataDir))
+	}()
+
+	middlewareInstance := setupTestMiddleware(t)
+	handlers := handlers.NewHandlers(middlewareInstance, dataDir)
+	rr := httptest.NewServer(handlers.Router)
+	defer rr.Close()
+
+	u := "ws://" + rr.Listener.Addr().String() + "/ws"
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, numClients)
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errChan <- runPairedClient(u)
+		}()
+	}
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		require.NoError(t, err)
+	}
+
+	// every client has been paired and the static keypair was only generated once
+	var config struct {
+		MiddlewareNoiseStaticKeypair interface{}   `json:"appNoiseStaticKeypair"`
+		PairedClients                []interface{} `json:"pairedClients"`
+	}
+	require.NoError(t, noisemanager.NewFile(dataDir, "base.json").ReadJSON(&config))
+	require.NotNil(t, config.MiddlewareNoiseStaticKeypair)
+	require.Len(t, config.PairedClients, numClients)
+}
+
+// pairClient connects a new client and pairs it. It returns the websocket connection and a rpc client using the noise
+// encrypted channel. Like initializeNoise, it returns an error instead of failing the test.
+func pairClient(u string) (*websocket.Conn, *rpc.Client, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	receiveCipher, sendCipher, err := initializeNoise(ws)
+	if err != nil {
+		ws.Close()
+		return nil, nil, err
+	}
+	err = ws.WriteMessage(1, []byte(opICanHasPairinVerificashun))
+	if err != nil {
+		ws.Close()
+		return nil, nil, err
+	}
+	_, responseBytes, err := ws.ReadMessage()
+	if err != nil {
+		ws.Close()
+		return nil, nil, err
+	}
+	if string(responseBytes) != responseSuccess {
+		ws.Close()
+		return nil, nil, fmt.Errorf("unexpected pairing verification response %q", responseBytes)
+	}
+
+	return ws, rpc.NewClient(&noiseRPCConn{ws: ws, sendCipher: sendCipher, receiveCipher: receiveCipher}), nil
+}
+
+// runPairedClient connects a new client, pairs it and calls the GetSetupStatus RPC over the noise encrypted channel.
+func runPairedClient(u string) error {
+	ws, client, err := pairClient(u)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var reply rpcmessages.SetupStatusResponse
+	return client.Call("RPCServer.GetSetupStatus", true, &reply)
+}
+
+func TestPairedClientsRPC(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "middleware-handlers-test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dataDir))
+	}()
+
+	middlewareInstance := setupTestMiddleware(t)
+	handlers := handlers.NewHandlers(middlewareInstance, dataDir)
+	rr := httptest.NewServer(handlers.Router)
+	defer rr.Close()
+
+	ws, client, err := pairClient("ws://" + rr.Listener.Addr().String() + "/ws")
+	require.NoError(t, err)
+	defer ws.Close()
+
+	var authenticateReply rpcmessages.UserAuthenticateResponse
+	authenticateArgs := rpcmessages.UserAuthenticateArgs{Username: "admin", Password: middlewareInstance.InitialAdminPassword()}
+	require.NoError(t, client.Call("RPCServer.UserAuthenticate", authenticateArgs, &authenticateReply))
+	require.True(t, authenticateReply.ErrorResponse.Success)
+	token := authenticateReply.Token
+
+	// the paired clients of the noise config are converted to the rpcmessages
+	var listReply rpcmessages.ListPairedClientsResponse
+	require.NoError(t, client.Call("RPCServer.ListPairedClients", rpcmessages.AuthGenericRequest{Token: token}, &listReply))
+	require.True(t, listReply.ErrorResponse.Success)
+	require.Len(t, listReply.PairedClients, 1)
+	pubkey := listReply.PairedClients[0].Pubkey
+	require.Len(t, pubkey, 64)
+	require.True(t, listReply.PairedClients[0].IsConnected)
+
+	var labelReply rpcmessages.ErrorResponse
+	labelArgs := rpcmessages.SetPairedClientLabelArgs{Pubkey: pubkey, Label: "phone", Token: token}
+	require.NoError(t, client.Call("RPCServer.SetPairedClientLabel", labelArgs, &labelReply))
+	require.True(t, labelReply.Success)
+	require.NoError(t, client.Call("RPCServer.ListPairedClients", rpcmessages.AuthGenericRequest{Token: token}, &listReply))
+	require.Equal(t, "phone", listReply.PairedClients[0].Label)
+
+	// the errors of the noise config are converted to error codes
+	labelArgs.Label = strings.Repeat("a", 65)
+	require.NoError(t, client.Call("RPCServer.SetPairedClientLabel", labelArgs, &labelReply))
+	require.Equal(t, rpcmessages.ErrorPairedClientLabelTooLong, labelReply.Code)
+
+	var revokeReply rpcmessages.ErrorResponse
+	revokeArgs := rpcmessages.RevokePairedClientArgs{Pubkey: "invalid", Token: token}
+	require.NoError(t, client.Call("RPCServer.RevokePairedClient", revokeArgs, &revokeReply))
+	require.Equal(t, rpcmessages.ErrorPairedClientInvalidPubkey, revokeReply.Code)
+	revokeArgs.Pubkey = strings.Repeat("00", 32)
+	require.NoError(t, client.Call("RPCServer.RevokePairedClient", revokeArgs, &revokeReply))
+	require.Equal(t, rpcmessages.ErrorPairedClientNotFound, revokeReply.Code)
+}
+
+// noiseRPCConn implements io.ReadWriteCloser for a rpc client on top of a noise encrypted websocket connection.
+type noiseRPCConn struct {
+	ws            *websocket.Conn
+	sendCipher    *noise.CipherState
+	receiveCipher *noise.CipherState
+	buffer        []byte
+}
+
+// Read reads and decrypts the next RPC response. Other messages, e.g. notifications, are skipped.
+func (conn *noiseRPCConn) Read(p []byte) (int, error) {
+	for len(conn.buffer) == 0 {
+		_, msg, err := conn.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		msg, err = conn.receiveCipher.Decrypt(nil, nil, msg)
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) > 0 && string(msg[0]) == rpcmessages.OpRPCCall {
+			conn.buffer = msg[1:]
+		}
+	}
+	n := copy(p, conn.buffer)
+	conn.buffer = conn.buffer[n:]
+	return n, nil
+}
+
+// Write encrypts and sends a RPC request.
+func (conn *noiseRPCConn) Write(p []byte) (int, error) {
+	err := conn.ws.WriteMessage(websocket.BinaryMessage, conn.sendCipher.Encrypt(nil, nil, p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements io.ReadWriteCloser. The websocket connection is closed by the caller.
+func (conn *noiseRPCConn) Close() error {
+	return nil
+}
+
 // initializeNoise sets up a new noise connection. First a fresh keypair is generated if none is locally found.
 // Afterwards a XX handshake is performed. This is a three part handshake required to authenticate both parties.
 // The resulting pairing code is then displayed to the user to check if it matches what is displayed on the other party's device.
-func initializeNoise(client *websocket.Conn, t *testing.T) (*noise.CipherState, *noise.CipherState) {
+// It returns an error instead of failing the test, so that it can be called from other goroutines than the test goroutine.
+func initializeNoise(client *websocket.Conn) (*noise.CipherState, *noise.CipherState, error) {
 	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
 	kp, err := cipherSuite.GenerateKeypair(rand.Reader)
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	handshake, err := noise.NewHandshakeState(noise.Config{
 		CipherSuite:   cipherSuite,
 		Random:        rand.Reader,
@@ -149,32 +356,56 @@ func initializeNoise(client *websocket.Conn, t *testing.T) (*noise.CipherState,
 		Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
 		Initiator:     true,
 	})
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	//Ask the BitBoxBase to begin the noise 'XX' handshake
 	err = client.WriteMessage(1, []byte(opICanHasHandShaek))
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	_, responseBytes, err := client.ReadMessage()
-	require.NoError(t, err)
-	require.Equal(t, string(responseBytes), string(responseSuccess))
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(responseBytes) != responseSuccess {
+		return nil, nil, fmt.Errorf("unexpected handshake response %q", responseBytes)
+	}
 	// Do 3 part noise 'XX' handshake.
 	msg, _, _, err := handshake.WriteMessage(nil, nil)
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	err = client.WriteMessage(websocket.BinaryMessage, msg)
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	_, responseBytes, err = client.ReadMessage()
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	_, _, _, err = handshake.ReadMessage(nil, responseBytes)
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	msg, receiveCipher, sendCipher, err := handshake.WriteMessage(nil, nil)
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 	err = client.WriteMessage(websocket.BinaryMessage, msg)
-	require.NoError(t, err)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	//read the pairing verification request
 	_, responseBytes, err = client.ReadMessage()
-	require.NoError(t, err)
-	require.Equal(t, string(responseBytes), string(responseNeedsPairing))
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(responseBytes) != responseNeedsPairing {
+		return nil, nil, fmt.Errorf("unexpected pairing verification request %q", responseBytes)
+	}
 
-	return receiveCipher, sendCipher
+	return receiveCipher, sendCipher, nil
 }
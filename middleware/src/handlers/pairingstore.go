@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/hex"
+
+	noisemanager "github.com/digitalbitbox/bitbox-base/middleware/src/noise"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
+)
+
+// pairingStore implements the rpcserver.PairingStore interface on top of the noise config, converting the paired
+// clients and errors of the noise package to the rpcmessages.
+type pairingStore struct {
+	noiseConfig *noisemanager.NoiseConfig
+}
+
+// decodePubkey decodes a hex encoded noise static pubkey. It returns an ErrorResponse if the pubkey is invalid.
+func decodePubkey(pubkeyHex string) ([]byte, *rpcmessages.ErrorResponse) {
+	pubkey, err := hex.DecodeString(pubkeyHex)
+	if err != nil || len(pubkey) != 32 {
+		return nil, &rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "expected a hex encoded 32 byte noise static pubkey",
+			Code:    rpcmessages.ErrorPairedClientInvalidPubkey,
+		}
+	}
+	return pubkey, nil
+}
+
+// pairingErrorResponse converts an error of the noise config to an ErrorResponse.
+func pairingErrorResponse(err error) rpcmessages.ErrorResponse {
+	switch err {
+	case nil:
+		return rpcmessages.ErrorResponse{Success: true}
+	case noisemanager.ErrClientNotPaired:
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    rpcmessages.ErrorPairedClientNotFound,
+		}
+	case noisemanager.ErrLabelTooLong:
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    rpcmessages.ErrorPairedClientLabelTooLong,
+		}
+	default:
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    rpcmessages.ErrorPairedClientStoreFailed,
+		}
+	}
+}
+
+// ListPairedClients returns all clients paired with the middleware.
+func (store pairingStore) ListPairedClients() rpcmessages.ListPairedClientsResponse {
+	pairedClients := []rpcmessages.PairedClient{}
+	for _, client := range store.noiseConfig.PairedClients() {
+		pairedClients = append(pairedClients, rpcmessages.PairedClient{
+			Pubkey:      hex.EncodeToString(client.Pubkey),
+			Label:       client.Label,
+			FirstPaired: client.FirstPaired,
+			LastSeen:    client.LastSeen,
+			IsConnected: client.IsConnected,
+		})
+	}
+	return rpcmessages.ListPairedClientsResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		PairedClients: pairedClients,
+	}
+}
+
+// SetPairedClientLabel sets a human readable label for a paired client.
+func (store pairingStore) SetPairedClientLabel(args rpcmessages.SetPairedClientLabelArgs) rpcmessages.ErrorResponse {
+	pubkey, errorResponse := decodePubkey(args.Pubkey)
+	if errorResponse != nil {
+		return *errorResponse
+	}
+	return pairingErrorResponse(store.noiseConfig.SetPairedClientLabel(pubkey, args.Label))
+}
+
+// RevokePairedClient removes the pairing of a client and drops its connections.
+func (store pairingStore) RevokePairedClient(args rpcmessages.RevokePairedClientArgs) rpcmessages.ErrorResponse {
+	pubkey, errorResponse := decodePubkey(args.Pubkey)
+	if errorResponse != nil {
+		return *errorResponse
+	}
+	return pairingErrorResponse(store.noiseConfig.RevokePairedClient(pubkey))
+}
@@ -2,17 +2,21 @@ package handlers
 
 import (
 	"log"
+	"time"
 
+	noisemanager "github.com/digitalbitbox/bitbox-base/middleware/src/noise"
 	"github.com/gorilla/websocket"
 )
 
 // runWebsocket sets up loops for sending/receiving, abstracting away the low level details about
 // timeouts, clients closing, etc.
 // It returns four channels: one to send messages to the client, one which notifies when the
-// It takes four arguments, a websocket connection, a read and a write channel.
+// It takes seven arguments, a websocket connection, the noise session of the connection, a read and a write channel for the rpc messages,
+// a channel for the events sent to the client, a callback called with the sequence number of each queued event written to the client
+// and the client id.
 //
 // The goroutines close client upon exit or dues to a send/receive error.
-func (handlers *Handlers) runWebsocket(client *websocket.Conn, readChan chan<- []byte, writeChan <-chan []byte, clientID int) {
+func (handlers *Handlers) runWebsocket(client *websocket.Conn, noiseSession *noisemanager.NoiseSession, readChan chan<- []byte, writeChan <-chan []byte, eventChan <-chan outgoingEvent, delivered func(seq uint64), clientID int) {
 	const maxMessageSize = 512
 	// this channel is used to break the write loop, when the read loop breaks
 	closeChan := make(chan struct{})
@@ -21,6 +25,7 @@ func (handlers *Handlers) runWebsocket(client *websocket.Conn, readChan chan<- [
 		defer func() {
 			_ = client.Close()
 			handlers.removeClient(clientID)
+			handlers.noiseConfig.RemoveSession(noiseSession)
 			close(closeChan)
 			log.Printf("Closed Read Loop for client %v", clientID)
 		}()
@@ -40,18 +45,75 @@ func (handlers *Handlers) runWebsocket(client *websocket.Conn, readChan chan<- [
 				continue
 			}
 
-			messageDecrypted, err := handlers.noiseConfig.Decrypt(msg)
+			messageDecrypted, err := noiseSession.Decrypt(msg)
+			if err == noisemanager.ErrNonceExhausted {
+				log.Println("Noise receive nonces exhausted, closing the connection")
+				closeNonceExhausted(client)
+				return
+			}
 			if err != nil {
 				log.Println("Error, websocket could not decrypt incoming packages")
 				return
 			}
+			// the rekey message has an empty payload and is handled by the noise session
+			if len(messageDecrypted) == 0 {
+				continue
+			}
 			log.Println(string(messageDecrypted))
 			readChan <- messageDecrypted
 		}
 	}
 
+	// rekeyIfRequired sends the rekey message to the client, if the send cipher state is due to be rekeyed.
+	// It returns false if the connection should be closed.
+	rekeyIfRequired := func() bool {
+		if !noiseSession.RekeyRequired() {
+			return true
+		}
+		rekeyMessage, err := noiseSession.Rekey()
+		if err == noisemanager.ErrNonceExhausted {
+			log.Println("Noise send nonces exhausted, closing the connection")
+			closeNonceExhausted(client)
+			return false
+		}
+		if err != nil {
+			log.Printf("Error, could not rekey the noise session: %v", err)
+			return false
+		}
+		err = client.WriteMessage(websocket.TextMessage, rekeyMessage)
+		if err != nil {
+			log.Println("Error, websocket closed unexpectedly in the writing loop")
+			return false
+		}
+		return true
+	}
+
+	// writeMessage encrypts and sends a message to the client. It returns false if the connection should be closed.
+	writeMessage := func(message []byte) bool {
+		messageEncrypted, err := noiseSession.Encrypt(message)
+		if err != nil {
+			log.Println("Noise send nonces exhausted, closing the connection")
+			closeNonceExhausted(client)
+			return false
+		}
+		err = client.WriteMessage(websocket.TextMessage, messageEncrypted)
+		if err != nil {
+			log.Println("Error, websocket closed unexpectedly in the writing loop")
+			_ = client.WriteMessage(websocket.CloseMessage, []byte{})
+			return false
+		}
+		return rekeyIfRequired()
+	}
+
 	writeLoop := func() {
+		// check at least every minute, if the rekey interval elapsed
+		rekeyCheckInterval := time.Minute
+		if handlers.noiseConfig.RekeyInterval() < rekeyCheckInterval {
+			rekeyCheckInterval = handlers.noiseConfig.RekeyInterval()
+		}
+		rekeyTicker := time.NewTicker(rekeyCheckInterval)
 		defer func() {
+			rekeyTicker.Stop()
 			_ = client.Close()
 			handlers.removeClient(clientID)
 			log.Printf("Closed Write Loop for %v", clientID)
@@ -73,12 +135,29 @@ func (handlers *Handlers) runWebsocket(client *websocket.Conn, readChan chan<- [
 						_ = client.WriteMessage(websocket.CloseMessage, []byte{})
 						return
 					}
-					err := client.WriteMessage(websocket.TextMessage, handlers.noiseConfig.Encrypt(message))
-					if err != nil {
-						log.Println("Error, websocket closed unexpectedly in the writing loop")
-						_ = client.WriteMessage(websocket.CloseMessage, []byte{})
+					if !writeMessage(message) {
+						return
+					}
+
+				case event := <-eventChan:
+					if !writeMessage(event.message) {
+						return
+					}
+					// queued events count as delivered only once written, otherwise they are replayed on the next connection
+					if event.seq != 0 {
+						delivered(event.seq)
+					}
+
+				case <-rekeyTicker.C:
+					if !rekeyIfRequired() {
 						return
 					}
+
+				case <-noiseSession.Revoked():
+					log.Printf("Pairing of client %v revoked, closing the connection", clientID)
+					closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "pairing revoked")
+					_ = client.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+					return
 				}
 			}
 		}
@@ -87,3 +166,13 @@ func (handlers *Handlers) runWebsocket(client *websocket.Conn, readChan chan<- [
 	go readLoop()
 	go writeLoop()
 }
+
+// closeNonceExhausted cleanly closes the websocket connection to the client once the noise nonces ran out.
+// The client can then reconnect and do a new handshake.
+func closeNonceExhausted(client *websocket.Conn) {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "noise nonces exhausted")
+	err := client.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	if err != nil {
+		log.Printf("Error, could not send the close message to the client: %v", err)
+	}
+}
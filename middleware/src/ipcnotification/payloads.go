@@ -15,3 +15,18 @@ func ParseMenderUpdatePayload(payload interface{}) (menderUpdateSuccess bool, ok
 	}
 	return false, false
 }
+
+// ParseSupervisorEscalationPayload parses payloads from notifications with the
+// topic `supervisor-escalation`, which the supervisor sends after stopping a unit
+// that exceeded its restart budget. The payload should have the following JSON structure:
+//  {"unit": "electrs", "reason": "4 restarts within 1h0m0s"}
+func ParseSupervisorEscalationPayload(payload interface{}) (unit string, ok bool) {
+	if payloadMap, ok := payload.(map[string]interface{}); ok {
+		if val, ok := payloadMap["unit"]; ok {
+			if unit, ok := val.(string); ok && unit != "" {
+				return unit, true
+			}
+		}
+	}
+	return "", false
+}
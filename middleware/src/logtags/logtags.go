@@ -16,7 +16,7 @@ const (
 	LogTagMWUpdateSuccess string = "LogTag:Middleware:Base_Image_Update_Success"
 
 	// LogTagMWUpdateFailure is logged by the middleware when the update progress
-	// ends with the success case. This triggers the supervisor to set the
+	// ends with the failure case. This triggers the supervisor to set the
 	// `BitBoxBaseHeartbeatRequest_DOWNLOAD_UPDATE` descriptionCode to inactive
 	// and sets the `BitBoxBaseHeartbeatRequest_UPDATE_FAILED` descriptionCode to
 	// active.
@@ -33,4 +33,25 @@ const (
 	// `BitBoxBaseHeartbeatRequest_SHUTDOWN` to active. This descriptionCode is
 	// reset on every start of the Supervisor.
 	LogTagMWShutdown string = "LogTag:Middleware:Base_Shutdown"
+
+	// LogTagMWAuthenticationFailed is logged by the middleware on every failed
+	// UserAuthenticate attempt and every UserChangePassword attempt with an
+	// incorrect current password, including attempts rejected because of a
+	// backoff or lockout. The username and the client are logged as well, so
+	// that brute-force attempts can be traced in the logs. The supervisor has
+	// no rule for it, as the middleware enforces the backoff itself.
+	LogTagMWAuthenticationFailed string = "LogTag:Middleware:Authentication_Failed"
+
+	// LogTagSVRebootOutOfMemory is logged by the supervisor before it reboots
+	// the Base, because the kernel killed a process as no memory was left or
+	// the available memory and swap are exhausted. The supervisor sets the
+	// descriptionCode `BitBoxBaseHeartbeatRequest_REBOOT` to active before
+	// rebooting.
+	LogTagSVRebootOutOfMemory string = "LogTag:Supervisor:Base_Reboot_Out_Of_Memory"
+
+	// LogTagSVRebootZramFailure is logged by the supervisor before it reboots
+	// the Base, because the kernel failed to decompress a page from the zram
+	// swap. The supervisor sets the descriptionCode
+	// `BitBoxBaseHeartbeatRequest_REBOOT` to active before rebooting.
+	LogTagSVRebootZramFailure string = "LogTag:Supervisor:Base_Reboot_Zram_Failure"
 )
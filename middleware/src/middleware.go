@@ -3,21 +3,28 @@ package middleware
 
 import (
 	"bufio"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/digitalbitbox/bitbox-base/middleware/src/authentication"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/configuration"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/eventqueue"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/handlers"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/ipcnotification"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/logtags"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/prometheus"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
 	"github.com/digitalbitbox/bitbox02-api-go/api/firmware"
 	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
 	"github.com/digitalbitbox/bitbox02-api-go/util/semver"
@@ -40,14 +47,21 @@ type Middleware struct {
 	prometheusClient    prometheus.Client
 	redisClient         redis.Redis
 	jwtAuth             *authentication.JwtAuth
+	attemptLimiter      *authentication.AttemptLimiter
+	eventQueue          *eventqueue.Queue
 	serviceInfo         rpcmessages.GetServiceInfoResponse
 	baseUpdateProgress  rpcmessages.GetBaseUpdateProgressResponse
 	baseUpdateAvailable rpcmessages.IsBaseUpdateAvailableResponse
 	baseVersion         *semver.SemVer
+	// baseStatus is the last overall Base status, used to notify the clients when it changes.
+	baseStatus rpcmessages.BaseStatus
 	// Saves state for the setup process
 	isMiddlewarePasswordSet bool
 	isBaseSetupDone         bool
 
+	// usersMu guards changes to the user authentication structure in redis
+	usersMu sync.Mutex
+
 	hsmFirmware *firmware.Device
 }
 
@@ -87,6 +101,7 @@ func NewMiddleware(config configuration.Configuration, hsmFirmware *firmware.Dev
 	} else {
 		middleware.redisClient = redis.NewMockClient("")
 	}
+	middleware.eventQueue = eventqueue.NewQueue(middleware.redisClient, eventqueue.DefaultMaxEvents)
 
 	err := middleware.checkMiddlewareSetup()
 	if err != nil {
@@ -100,7 +115,7 @@ func NewMiddleware(config configuration.Configuration, hsmFirmware *firmware.Dev
 			log.Println("Failed to generate new standard password")
 			return nil, err
 		}
-		usersMap["admin"] = UserAuthStruct{BCryptedPassword: string(bcryptedPassword), Role: "admin"}
+		usersMap["admin"] = UserAuthStruct{BCryptedPassword: string(bcryptedPassword), Role: authentication.RoleAdmin}
 
 		authStructureString, err := json.Marshal(&usersMap)
 		if err != nil {
@@ -114,11 +129,13 @@ func NewMiddleware(config configuration.Configuration, hsmFirmware *firmware.Dev
 		}
 	}
 
-	middleware.jwtAuth, err = authentication.NewJwtAuth()
+	middleware.jwtAuth, err = authentication.NewJwtAuth(
+		middleware.redisClient, middleware.config.GetAccessTokenLifetime(), middleware.config.GetRefreshTokenLifetime())
 	// return if there is an error, this should not really happen though on our device and in our dev environments, low entropy is usually common in embedded environments
 	if err != nil {
 		return nil, err
 	}
+	middleware.attemptLimiter = authentication.NewAttemptLimiter(middleware.redisClient)
 
 	return middleware, nil
 }
@@ -130,11 +147,18 @@ func (middleware *Middleware) IsBaseUpdateAvailable() rpcmessages.IsBaseUpdateAv
 
 // rpcLoop gets new data from the various rpc connections of the middleware and emits events if new data is available
 func (middleware *Middleware) rpcLoop() {
+	// The overall Base status is checked less often, since it queries systemd and prometheus for several services.
+	const timeBetweenServiceStatusChecks time.Duration = 30 * time.Second
+	var lastServiceStatusCheck time.Time
+
 	for {
 		if middleware.didServiceInfoChange() {
-			middleware.events <- handlers.Event{
-				Identifier:      []byte(rpcmessages.OpServiceInfoChanged),
-				QueueIfNoClient: false,
+			middleware.events <- middleware.newEvent(rpcmessages.OpServiceInfoChanged, middleware.serviceInfo, false)
+		}
+		if time.Since(lastServiceStatusCheck) >= timeBetweenServiceStatusChecks {
+			lastServiceStatusCheck = time.Now()
+			if serviceStatus, changed := middleware.didServiceStatusChange(); changed {
+				middleware.events <- middleware.newEvent(rpcmessages.OpServiceStatusChanged, serviceStatus, false)
 			}
 		}
 		time.Sleep(5 * time.Second)
@@ -167,21 +191,19 @@ func (middleware *Middleware) updateCheckLoop() {
 			log.Printf("A Base image update is available from version %s to %s.\n", middleware.baseVersion.String(), newVersion.String())
 			middleware.baseUpdateAvailable.UpdateAvailable = true
 			middleware.baseUpdateAvailable.UpdateInfo = updateInfo
-			middleware.events <- handlers.Event{
-				Identifier:      []byte(rpcmessages.OpBaseUpdateIsAvailable),
-				QueueIfNoClient: false,
-			}
+			middleware.events <- middleware.newEvent(rpcmessages.OpBaseUpdateIsAvailable, middleware.baseUpdateAvailable, false)
 		}
 
 		time.Sleep(timeBetweenUpdateChecks)
 	}
 }
 
-// hsmHeartbeatLoop
+// hsmHeartbeatLoop sends a heartbeat with the active description code with the highest priority and its state code to
+// the HSM, which shows them on the screen and with the LED.
 func (middleware *Middleware) hsmHeartbeatLoop() {
 	for {
-		// TODO(@0xB10C) fetch the `stateCode` and `descriptionCode` from redis keys set byt the supervisor
-		err := middleware.hsmFirmware.BitBoxBaseHeartbeat(messages.BitBoxBaseHeartbeatRequest_IDLE, messages.BitBoxBaseHeartbeatRequest_EMPTY)
+		descriptionCode, stateCode := middleware.heartbeatCodes()
+		err := middleware.hsmFirmware.BitBoxBaseHeartbeat(stateCode, descriptionCode)
 		if err != nil {
 			log.Printf("Received an error from the HSM: %s\n", err)
 			time.Sleep(time.Second)
@@ -192,6 +214,35 @@ func (middleware *Middleware) hsmHeartbeatLoop() {
 	}
 }
 
+// heartbeatCodes returns the description code with the highest priority, which is set by the supervisor or the Middleware in
+// redis, and its state code, which is ERROR while the supervisor marked a unit as failed. If redis can't be read, the
+// REDIS_ERROR description code is returned.
+func (middleware *Middleware) heartbeatCodes() (messages.BitBoxBaseHeartbeatRequest_DescriptionCode, messages.BitBoxBaseHeartbeatRequest_StateCode) {
+	descriptionCode, stateCode, err := systemstate.GetHeartbeatCodes(middleware.redisClient)
+	if err != nil {
+		log.Printf("Error: could not get the description code for the HSM heartbeat from redis: %s", err)
+		descriptionCode = messages.BitBoxBaseHeartbeatRequest_REDIS_ERROR
+		return descriptionCode, systemstate.MapDescriptionCodeStateCode[descriptionCode]
+	}
+	return descriptionCode, stateCode
+}
+
+// PendingEvents returns the queued events not yet delivered to the client with the given noise static pubkey.
+func (middleware *Middleware) PendingEvents(clientPubkey []byte) []handlers.Event {
+	pending := middleware.eventQueue.Pending(hex.EncodeToString(clientPubkey))
+	events := make([]handlers.Event, 0, len(pending))
+	for _, event := range pending {
+		events = append(events, handlers.Event{Identifier: event.Identifier, Payload: event.Payload, Seq: event.Seq})
+	}
+	return events
+}
+
+// MarkEventDelivered records that the queued events up to the sequence number have been delivered to the client with the
+// given noise static pubkey.
+func (middleware *Middleware) MarkEventDelivered(clientPubkey []byte, seq uint64) {
+	middleware.eventQueue.MarkDelivered(hex.EncodeToString(clientPubkey), seq)
+}
+
 // Start gives a trigger for the handler to start the rpc event loop
 func (middleware *Middleware) Start() <-chan handlers.Event {
 	if middleware.hsmFirmware != nil {
@@ -251,19 +302,21 @@ func (middleware *Middleware) ipcNotificationLoop(reader *ipcnotification.Reader
 			if success, ok := ipcnotification.ParseMenderUpdatePayload(notification.Payload); ok {
 				switch success {
 				case true:
-					middleware.events <- handlers.Event{
-						Identifier:      []byte(rpcmessages.OpBaseUpdateSuccess),
-						QueueIfNoClient: true,
-					}
+					middleware.events <- middleware.newEvent(rpcmessages.OpBaseUpdateSuccess, nil, true)
 				case false:
-					middleware.events <- handlers.Event{
-						Identifier:      []byte(rpcmessages.OpBaseUpdateFailure),
-						QueueIfNoClient: true,
-					}
+					middleware.events <- middleware.newEvent(rpcmessages.OpBaseUpdateFailure, nil, true)
 				}
 			} else {
 				log.Printf("Could not parse %s notification payload: %v\n", notification.Topic, notification.Payload)
 			}
+		case "supervisor-escalation":
+			if unit, ok := ipcnotification.ParseSupervisorEscalationPayload(notification.Payload); ok {
+				log.Printf("The supervisor stopped the unit %s after too many restarts\n", unit)
+				serviceStatus, _ := middleware.didServiceStatusChange()
+				middleware.events <- middleware.newEvent(rpcmessages.OpServiceStatusChanged, serviceStatus, false)
+			} else {
+				log.Printf("Could not parse %s notification payload: %v\n", notification.Topic, notification.Payload)
+			}
 		default:
 			log.Printf("Dropping IPC notification with unknown topic: %s\n", notification.String())
 		}
@@ -453,8 +506,21 @@ func (middleware *Middleware) UserAuthenticate(args rpcmessages.UserAuthenticate
 		}
 	}
 
-	if _, ok := usersMap[args.Username]; !ok {
+	// the attempt is recorded as failed before the password is checked, so that parallel attempts can't bypass the backoff
+	_, userExists := usersMap[args.Username]
+	trackedUsername := args.Username
+	if !userExists {
+		trackedUsername = ""
+	}
+	retryAfter, ok := middleware.attemptLimiter.Reserve(trackedUsername, args.ClientPubkey)
+	if !ok {
+		log.Printf("%s: rejected authentication attempt of user %q from client %q, retry after %s", logtags.LogTagMWAuthenticationFailed, args.Username, args.ClientPubkey, retryAfter)
+		return rateLimitedResponse(retryAfter)
+	}
+
+	if !userExists {
 		log.Printf("User %s not found in database", args.Username)
+		logAuthenticationFailure("", args.ClientPubkey, retryAfter)
 		//TODO: Once we support multiple users work over the ErrorAuthenticationUsernameNotFound ErrorResponse message. It reveals information about the database.
 		return rpcmessages.UserAuthenticateResponse{
 			ErrorResponse: &rpcmessages.ErrorResponse{
@@ -469,6 +535,7 @@ func (middleware *Middleware) UserAuthenticate(args rpcmessages.UserAuthenticate
 	err = bcrypt.CompareHashAndPassword([]byte(passwordFromStorage), []byte(args.Password))
 	if err != nil {
 		log.Println("Hash and password did not match")
+		logAuthenticationFailure(args.Username, args.ClientPubkey, retryAfter)
 		return rpcmessages.UserAuthenticateResponse{
 			ErrorResponse: &rpcmessages.ErrorResponse{
 				Success: false,
@@ -478,7 +545,47 @@ func (middleware *Middleware) UserAuthenticate(args rpcmessages.UserAuthenticate
 		}
 	}
 
-	jwtTokenStr, err := middleware.jwtAuth.GenerateToken(args.Username)
+	middleware.attemptLimiter.RecordSuccess(args.Username, args.ClientPubkey)
+	return middleware.generateTokens(args.Username, usersMap[args.Username].Role, args.ClientPubkey)
+}
+
+// logAuthenticationFailure logs a failed authentication attempt with a logtag. The attempt was already recorded by the
+// brute-force protection. The username is empty if the user does not exist.
+func logAuthenticationFailure(username string, clientPubkey string, retryAfter time.Duration) {
+	log.Printf("%s: failed authentication attempt of user %q from client %q, retry after %s", logtags.LogTagMWAuthenticationFailed, username, clientPubkey, retryAfter)
+}
+
+// rateLimitedErrorResponse returns the ErrorResponse for an attempt rejected by the brute-force protection.
+func rateLimitedErrorResponse(retryAfter time.Duration) rpcmessages.ErrorResponse {
+	return rpcmessages.ErrorResponse{
+		Success: false,
+		Message: fmt.Sprintf("authentication unsuccessful, too many failed attempts, retry after %d seconds", int(math.Ceil(retryAfter.Seconds()))),
+		Code:    rpcmessages.ErrorAuthenticationRateLimited,
+	}
+}
+
+// rateLimitedResponse returns the UserAuthenticateResponse for an authentication attempt rejected by the brute-force protection.
+func rateLimitedResponse(retryAfter time.Duration) rpcmessages.UserAuthenticateResponse {
+	errorResponse := rateLimitedErrorResponse(retryAfter)
+	return rpcmessages.UserAuthenticateResponse{
+		ErrorResponse: &errorResponse,
+		RetryAfter:    int(math.Ceil(retryAfter.Seconds())),
+	}
+}
+
+// generateTokens returns a UserAuthenticateResponse with a new access token and a new refresh token bound to the client pubkey.
+func (middleware *Middleware) generateTokens(username string, role string, clientPubkey string) rpcmessages.UserAuthenticateResponse {
+	jwtTokenStr, err := middleware.jwtAuth.GenerateToken(username, role)
+	if err != nil {
+		return rpcmessages.UserAuthenticateResponse{
+			ErrorResponse: &rpcmessages.ErrorResponse{
+				Success: false,
+				Message: "authentication unsuccessful, jwt error",
+				Code:    rpcmessages.ErrorAuthenticationFailed,
+			},
+		}
+	}
+	refreshTokenStr, err := middleware.jwtAuth.GenerateRefreshToken(username, role, clientPubkey)
 	if err != nil {
 		return rpcmessages.UserAuthenticateResponse{
 			ErrorResponse: &rpcmessages.ErrorResponse{
@@ -493,8 +600,44 @@ func (middleware *Middleware) UserAuthenticate(args rpcmessages.UserAuthenticate
 		ErrorResponse: &rpcmessages.ErrorResponse{
 			Success: true,
 		},
-		Token: jwtTokenStr,
+		Token:        jwtTokenStr,
+		RefreshToken: refreshTokenStr,
+	}
+}
+
+// RefreshToken returns a UserAuthenticateResponse struct in response to a rpcserver request.
+// It exchanges a valid refresh token of the client for a new access token and a new refresh token. The used refresh token is revoked.
+// The role is read from redis, so that role changes are applied on the next refresh.
+func (middleware *Middleware) RefreshToken(args rpcmessages.RefreshTokenArgs) rpcmessages.UserAuthenticateResponse {
+	invalidResponse := rpcmessages.UserAuthenticateResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "token refresh unsuccessful, the refresh token is invalid",
+			Code:    rpcmessages.ErrorRefreshTokenInvalid,
+		},
+	}
+	claims, err := middleware.jwtAuth.UseRefreshToken(args.RefreshToken, args.ClientPubkey)
+	if err != nil {
+		log.Printf("Failed to use the refresh token: %s", err)
+		return invalidResponse
+	}
+
+	usersMap, err := middleware.getAuthStructure()
+	if err != nil {
+		return rpcmessages.UserAuthenticateResponse{
+			ErrorResponse: &rpcmessages.ErrorResponse{
+				Success: false,
+				Message: "token refresh unsuccessful, see middleware logs for more information",
+				Code:    rpcmessages.ErrorAuthenticationFailed,
+			},
+		}
+	}
+	user, ok := usersMap[claims.Username]
+	if !ok {
+		log.Printf("User %s of the refresh token not found in database", claims.Username)
+		return invalidResponse
 	}
+	return middleware.generateTokens(claims.Username, user.Role, args.ClientPubkey)
 }
 
 // UserChangePassword returns an ErrorResponse struct in response to a rpcserver request
@@ -509,6 +652,9 @@ func (middleware *Middleware) UserChangePassword(args rpcmessages.UserChangePass
 		}
 	}
 
+	middleware.usersMu.Lock()
+	defer middleware.usersMu.Unlock()
+
 	usersMap, err := middleware.getAuthStructure()
 	if err != nil {
 		return rpcmessages.ErrorResponse{
@@ -518,25 +664,38 @@ func (middleware *Middleware) UserChangePassword(args rpcmessages.UserChangePass
 		}
 	}
 
-	//TODO: Once we support multiple users work over the ErrorPasswordChangeUsernameNotExist message. It reveals information about the database.
-	if _, ok := usersMap[args.Username]; !ok {
-		return rpcmessages.ErrorResponse{
-			Success: false,
-			Message: "username does not exist",
-			Code:    rpcmessages.ErrorPasswordChangeUsernameNotExist,
-		}
+	// the same response is returned for unknown users and incorrect passwords, so that usernames can't be discovered
+	incorrectResponse := rpcmessages.ErrorResponse{
+		Success: false,
+		Message: "password change unsuccessful, the username or current password is incorrect",
+		Code:    rpcmessages.ErrorPasswordChangePasswordIncorrect,
 	}
 
-	passwordFromStorage := usersMap[args.Username].BCryptedPassword
-	err = bcrypt.CompareHashAndPassword([]byte(passwordFromStorage), []byte(args.Password))
+	// the current password is checked with the same brute-force protection as UserAuthenticate
+	user, userExists := usersMap[args.Username]
+	trackedUsername := args.Username
+	if !userExists {
+		trackedUsername = ""
+	}
+	retryAfter, ok := middleware.attemptLimiter.Reserve(trackedUsername, args.ClientPubkey)
+	if !ok {
+		log.Printf("%s: rejected password change attempt of user %q from client %q, retry after %s", logtags.LogTagMWAuthenticationFailed, args.Username, args.ClientPubkey, retryAfter)
+		return rateLimitedErrorResponse(retryAfter)
+	}
+
+	if !userExists {
+		log.Printf("User %s not found in database", args.Username)
+		logAuthenticationFailure("", args.ClientPubkey, retryAfter)
+		return incorrectResponse
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.BCryptedPassword), []byte(args.Password))
 	if err != nil {
 		log.Println("Hash and password did not match")
-		return rpcmessages.ErrorResponse{
-			Success: false,
-			Message: "password change unsuccessful, current password was incorrect",
-			Code:    rpcmessages.ErrorPasswordChangePasswordIncorrect,
-		}
+		logAuthenticationFailure(args.Username, args.ClientPubkey, retryAfter)
+		return incorrectResponse
 	}
+	middleware.attemptLimiter.RecordSuccess(args.Username, args.ClientPubkey)
 
 	bcryptedPassword, err := bcrypt.GenerateFromPassword([]byte(args.NewPassword), 12)
 	if err != nil {
@@ -547,27 +706,22 @@ func (middleware *Middleware) UserChangePassword(args rpcmessages.UserChangePass
 		}
 	}
 
-	userAuthSecrets := usersMap[args.Username]
-	userAuthSecrets.BCryptedPassword = string(bcryptedPassword)
-	userAuthSecrets.Role = "admin"
-	usersMap[args.Username] = userAuthSecrets
-	usersMapByteStr, err := json.Marshal(usersMap)
+	user.BCryptedPassword = string(bcryptedPassword)
+	usersMap[args.Username] = user
+	err = middleware.storeAuthStructure(usersMap)
 	if err != nil {
-		log.Println("Failed marshaling the new user data for redis")
+		log.Println("Failed committing the new password to redis")
 		return rpcmessages.ErrorResponse{
 			Success: false,
 			Message: "password change unsuccessful",
 			Code:    rpcmessages.ErrorPasswordChangeFailed,
 		}
 	}
-	err = middleware.redisClient.SetString(redis.MiddlewareAuth, string(usersMapByteStr))
+
+	// tokens issued with the old password should not be usable anymore
+	err = middleware.jwtAuth.RevokeUserTokens(args.Username)
 	if err != nil {
-		log.Println("Failed committing the new password to redis")
-		return rpcmessages.ErrorResponse{
-			Success: false,
-			Message: "password change unsuccessful",
-			Code:    rpcmessages.ErrorPasswordChangeFailed,
-		}
+		log.Printf("Failed to persist the revocation of the tokens of user %q: %s", args.Username, err)
 	}
 
 	if !middleware.isMiddlewarePasswordSet {
@@ -580,11 +734,204 @@ func (middleware *Middleware) UserChangePassword(args rpcmessages.UserChangePass
 	return rpcmessages.ErrorResponse{Success: true}
 }
 
+// Logout returns an ErrorResponse struct in response to a rpcserver request.
+// It revokes the passed json web token and the refresh token, if set, so that they can't be used anymore. The refresh token
+// is only revoked if it was issued to the same user and client.
+func (middleware *Middleware) Logout(args rpcmessages.LogoutArgs) rpcmessages.ErrorResponse {
+	failedResponse := rpcmessages.ErrorResponse{
+		Success: false,
+		Message: "logout unsuccessful, the token could not be revoked",
+		Code:    rpcmessages.ErrorLogoutFailed,
+	}
+	claims, err := middleware.jwtAuth.ParseToken(args.Token)
+	if err != nil {
+		log.Printf("Failed to revoke the token on logout: %s", err)
+		return failedResponse
+	}
+	// the refresh token is revoked first, so that the access token stays valid if the refresh token belongs to someone else
+	if args.RefreshToken != "" {
+		err := middleware.jwtAuth.RevokeRefreshToken(args.RefreshToken, claims.Username, args.ClientPubkey)
+		if err != nil {
+			log.Printf("Failed to revoke the refresh token on logout: %s", err)
+			return failedResponse
+		}
+	}
+	err = middleware.jwtAuth.RevokeToken(args.Token)
+	if err != nil {
+		log.Printf("Failed to revoke the token on logout: %s", err)
+		return failedResponse
+	}
+	return rpcmessages.ErrorResponse{Success: true}
+}
+
+// CreateUser returns an ErrorResponse struct in response to a rpcserver request.
+// It creates a new user with the given password and role. The role is either "admin" or "viewer".
+func (middleware *Middleware) CreateUser(args rpcmessages.CreateUserArgs) rpcmessages.ErrorResponse {
+	var usernameRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	if !usernameRegex.MatchString(args.Username) {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful, the username is invalid",
+			Code:    rpcmessages.ErrorUserInvalidUsername,
+		}
+	}
+	if !authentication.IsValidRole(args.Role) {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful, the role needs to be either admin or viewer",
+			Code:    rpcmessages.ErrorUserInvalidRole,
+		}
+	}
+	if len(args.Password) < 8 {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful, the password needs to be at least 8 characters in length",
+			Code:    rpcmessages.ErrorPasswordTooShort,
+		}
+	}
+
+	middleware.usersMu.Lock()
+	defer middleware.usersMu.Unlock()
+
+	usersMap, err := middleware.getAuthStructure()
+	if err != nil {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful, see middleware logs for more information",
+			Code:    rpcmessages.ErrorUserStoreFailed,
+		}
+	}
+	if _, ok := usersMap[args.Username]; ok {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful, the username already exists",
+			Code:    rpcmessages.ErrorUserAlreadyExists,
+		}
+	}
+
+	bcryptedPassword, err := bcrypt.GenerateFromPassword([]byte(args.Password), 12)
+	if err != nil {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful",
+			Code:    rpcmessages.ErrorUserStoreFailed,
+		}
+	}
+	usersMap[args.Username] = UserAuthStruct{BCryptedPassword: string(bcryptedPassword), Role: args.Role}
+	err = middleware.storeAuthStructure(usersMap)
+	if err != nil {
+		log.Println("Failed committing the new user to redis")
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user creation unsuccessful",
+			Code:    rpcmessages.ErrorUserStoreFailed,
+		}
+	}
+	log.Printf("Created the user %q with the role %q", args.Username, args.Role)
+	return rpcmessages.ErrorResponse{Success: true}
+}
+
+// DeleteUser returns an ErrorResponse struct in response to a rpcserver request.
+// It deletes the given user. The last user with the admin role can't be deleted.
+func (middleware *Middleware) DeleteUser(args rpcmessages.DeleteUserArgs) rpcmessages.ErrorResponse {
+	middleware.usersMu.Lock()
+	defer middleware.usersMu.Unlock()
+
+	usersMap, err := middleware.getAuthStructure()
+	if err != nil {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user deletion unsuccessful, see middleware logs for more information",
+			Code:    rpcmessages.ErrorUserStoreFailed,
+		}
+	}
+	user, ok := usersMap[args.Username]
+	if !ok {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user deletion unsuccessful, the username does not exist",
+			Code:    rpcmessages.ErrorUserNotFound,
+		}
+	}
+	if user.Role == authentication.RoleAdmin {
+		admins := 0
+		for _, u := range usersMap {
+			if u.Role == authentication.RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return rpcmessages.ErrorResponse{
+				Success: false,
+				Message: "user deletion unsuccessful, the last admin can't be deleted",
+				Code:    rpcmessages.ErrorUserDeleteLastAdmin,
+			}
+		}
+	}
+
+	delete(usersMap, args.Username)
+	err = middleware.storeAuthStructure(usersMap)
+	if err != nil {
+		log.Println("Failed committing the user deletion to redis")
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "user deletion unsuccessful",
+			Code:    rpcmessages.ErrorUserStoreFailed,
+		}
+	}
+	err = middleware.jwtAuth.RevokeUserTokens(args.Username)
+	if err != nil {
+		log.Printf("Failed to revoke the tokens of the deleted user %q: %s", args.Username, err)
+	}
+	log.Printf("Deleted the user %q", args.Username)
+	return rpcmessages.ErrorResponse{Success: true}
+}
+
+// ListUsers returns a ListUsersResponse struct in response to a rpcserver request.
+// It contains the usernames and roles of all users sorted by username.
+func (middleware *Middleware) ListUsers() rpcmessages.ListUsersResponse {
+	usersMap, err := middleware.getAuthStructure()
+	if err != nil {
+		return rpcmessages.ListUsersResponse{
+			ErrorResponse: &rpcmessages.ErrorResponse{
+				Success: false,
+				Message: "listing the users unsuccessful, see middleware logs for more information",
+				Code:    rpcmessages.ErrorRedisError,
+			},
+		}
+	}
+
+	users := make([]rpcmessages.UserInfo, 0, len(usersMap))
+	for username, user := range usersMap {
+		users = append(users, rpcmessages.UserInfo{Username: username, Role: user.Role})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return rpcmessages.ListUsersResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		Users:         users,
+	}
+}
+
+// TokenUsername validates a jwt token string like ValidateToken and returns the username the token was issued to.
+func (middleware *Middleware) TokenUsername(token string) (string, error) {
+	claims, err := middleware.jwtAuth.ParseToken(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.Username, nil
+}
+
 // ValidateToken validates a jwt token string and returns an error if not valid and nil otherwise.
 func (middleware *Middleware) ValidateToken(token string) error {
 	return middleware.jwtAuth.ValidateToken(token)
 }
 
+// ValidateAdminToken validates a jwt token string and returns an error if not valid and nil otherwise.
+// If the token is valid, but does not belong to an admin, authentication.ErrRoleNotPermitted is returned.
+func (middleware *Middleware) ValidateAdminToken(token string) error {
+	return middleware.jwtAuth.ValidateAdminToken(token)
+}
+
 // SetHostname sets the systems hostname
 func (middleware *Middleware) SetHostname(args rpcmessages.SetHostnameArgs) rpcmessages.ErrorResponse {
 	log.Println("Setting the hostname via the config script")
@@ -613,6 +960,35 @@ func (middleware *Middleware) SetHostname(args rpcmessages.SetHostnameArgs) rpcm
 	return rpcmessages.ErrorResponse{Success: false, Message: "invalid hostname"}
 }
 
+// fanProfiles are the fan control profiles of bbbfancontrol.
+var fanProfiles = map[string]bool{"silent": true, "balanced": true, "performance": true}
+
+// SetFanProfile sets the fan control profile via the config script. bbbfancontrol applies it immediately.
+func (middleware *Middleware) SetFanProfile(args rpcmessages.SetFanProfileArgs) rpcmessages.ErrorResponse {
+	log.Printf("Setting the fan profile %q via the config script.\n", args.Profile)
+	if !fanProfiles[args.Profile] {
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "invalid fan profile",
+			Code:    rpcmessages.ErrorSetFanProfileInvalidValue,
+		}
+	}
+
+	out, err := middleware.runBBBConfigScript([]string{"set", "fan_profile", args.Profile})
+	if err != nil {
+		errorCode := handleBBBScriptErrorCode(out, err, []rpcmessages.ErrorCode{
+			rpcmessages.ErrorSetFanProfileInvalidValue,
+		})
+
+		return rpcmessages.ErrorResponse{
+			Success: false,
+			Message: strings.Join(out, "\n"),
+			Code:    errorCode,
+		}
+	}
+	return rpcmessages.ErrorResponse{Success: true}
+}
+
 // EnableTor enables/disables the tor.service and configures bitcoind and lightningd based on the passed ToggleSettingArgsEnable/Disable argument
 // and returns a ErrorResponse indicating if the call was successful.
 func (middleware *Middleware) EnableTor(toggleAction rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse {
@@ -721,6 +1097,7 @@ func (middleware *Middleware) ShutdownBase() rpcmessages.ErrorResponse {
 		}
 	}
 
+	log.Printf("%s: shutting down the Base via RPC", logtags.LogTagMWShutdown)
 	go func(delay time.Duration) {
 		time.Sleep(delay)
 		cmd := exec.Command("shutdown", "now")
@@ -755,6 +1132,7 @@ func (middleware *Middleware) RebootBase() rpcmessages.ErrorResponse {
 		}
 	}
 
+	log.Printf("%s: rebooting the Base via RPC", logtags.LogTagMWReboot)
 	go func(delay time.Duration) {
 		time.Sleep(delay)
 		cmd := exec.Command("reboot")
@@ -837,6 +1215,7 @@ func (middleware *Middleware) UpdateBase(args rpcmessages.UpdateBaseArgs) rpcmes
 			Code:    rpcmessages.ErrorMenderUpdateInstallFailed,
 		}
 	}
+	log.Printf("%s: started the Base update to version %s", logtags.LogTagMWUpdateStart, args.Version)
 
 	errOutLines := make([]string, 0)
 	// This goroutine uses the bufio.Scanner to .Scan() `stderr` lines.
@@ -887,6 +1266,7 @@ func (middleware *Middleware) UpdateBase(args rpcmessages.UpdateBaseArgs) rpcmes
 		} else {
 			if stdoutScanner.Err() != nil {
 				log.Printf("GetBaseUpdateProgress: Could not read from stdout scanner: %s", stdoutScanner.Err())
+				log.Printf("%s: the Base update to version %s failed", logtags.LogTagMWUpdateFailure, args.Version)
 				middleware.setBaseUpdateStateAndNotify(rpcmessages.UpdateFailed)
 				err := stderr.Close()
 				if err != nil {
@@ -916,6 +1296,7 @@ func (middleware *Middleware) UpdateBase(args rpcmessages.UpdateBaseArgs) rpcmes
 			rpcmessages.ErrorMenderUpdateNoVersion,
 		})
 
+		log.Printf("%s: the Base update to version %s failed: %s", logtags.LogTagMWUpdateFailure, args.Version, err)
 		middleware.setBaseUpdateStateAndNotify(rpcmessages.UpdateFailed)
 		return rpcmessages.ErrorResponse{
 			Success: false,
@@ -924,6 +1305,7 @@ func (middleware *Middleware) UpdateBase(args rpcmessages.UpdateBaseArgs) rpcmes
 		}
 	}
 
+	log.Printf("%s: the Base update to version %s was applied", logtags.LogTagMWUpdateSuccess, args.Version)
 	middleware.setBaseUpdateStateAndNotify(rpcmessages.UpdateRebooting)
 	resp := middleware.RebootBase()
 	if !resp.Success {
@@ -1131,51 +1513,132 @@ func (middleware *Middleware) GetBaseInfo() rpcmessages.GetBaseInfoResponse {
 	}
 }
 
+// GetFanStatus returns the fan control profile, the temperature and the fan PWM value reported by bbbfancontrol in a
+// GetFanStatusResponse. If bbbfancontrol can't read the temperature sensor, the profile and the PWM value are returned with
+// the SensorError flag set.
+func (middleware *Middleware) GetFanStatus() rpcmessages.GetFanStatusResponse {
+	profile, err := middleware.redisClient.GetString(redis.FanProfile)
+	if err != nil {
+		log.Printf("Error getting the fan profile. Error: %s", err.Error())
+		errResponse := middleware.redisClient.ConvertErrorToErrorResponse(err)
+		return rpcmessages.GetFanStatusResponse{ErrorResponse: &errResponse}
+	}
+
+	pwm, err := middleware.prometheusClient.GetInt(prometheus.FanPWM)
+	if err != nil {
+		log.Printf("Error getting the fan PWM value. Error: %s", err.Error())
+		errResponse := middleware.prometheusClient.ConvertErrorToErrorResponse(err)
+		return rpcmessages.GetFanStatusResponse{ErrorResponse: &errResponse}
+	}
+
+	sensorError, err := middleware.prometheusClient.GetInt(prometheus.FanSensorError)
+	if err != nil {
+		log.Printf("Error getting the fan sensor error. Error: %s", err.Error())
+		errResponse := middleware.prometheusClient.ConvertErrorToErrorResponse(err)
+		return rpcmessages.GetFanStatusResponse{ErrorResponse: &errResponse}
+	}
+
+	response := rpcmessages.GetFanStatusResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{
+			Success: true,
+		},
+		Profile:     profile,
+		PWM:         pwm,
+		SensorError: sensorError != 0,
+	}
+	if response.SensorError {
+		return response
+	}
+
+	// bbbfancontrol omits the temperature metric if the sensor can't be read
+	temperature, err := middleware.prometheusClient.GetFloat(prometheus.FanTemperature)
+	if err != nil {
+		log.Printf("Error getting the temperature. Error: %s", err.Error())
+		response.SensorError = true
+		return response
+	}
+	response.Temperature = temperature
+	return response
+}
+
 // GetServiceInfo returns the most recent information about services running on the Base such as for example bitcoind, electrs or lightningd.
 func (middleware *Middleware) GetServiceInfo() rpcmessages.GetServiceInfoResponse {
 	return middleware.serviceInfo
 }
 
-// GetServiceStatus returns the most recent status information of the base and a few of its services
+// GetServiceStatus returns the most recent status information of the base and a few of its services.
+// The overall status is computed from the service states, the initial block download, the disk space, the reachability of
+// redis and prometheus, the active HSM description codes and warnings. The problems causing it are returned as well.
 func (middleware *Middleware) GetServiceStatus() rpcmessages.GetServiceStatusResponse {
+	inputs := systemstate.StatusInputs{
+		SetupDone:      middleware.isBaseSetupDone,
+		ActiveServices: make(map[string]bool),
+	}
+
 	hostname, err := middleware.redisClient.GetString(redis.BaseHostname)
 	if err != nil {
 		log.Printf("Error getting hostname information. Error: %s", err.Error())
-		errResponse := middleware.redisClient.ConvertErrorToErrorResponse(err)
-		return rpcmessages.GetServiceStatusResponse{ErrorResponse: &errResponse}
+		inputs.RedisErr = err
 	}
 	isTorEnabled, err := middleware.redisClient.GetBool(redis.TorEnabled)
 	if err != nil {
 		log.Printf("Error getting isTorEnabled information. Error: %s", err.Error())
-		errResponse := middleware.redisClient.ConvertErrorToErrorResponse(err)
-		return rpcmessages.GetServiceStatusResponse{ErrorResponse: &errResponse}
+		inputs.RedisErr = err
 	}
-	bitcoindActive, err := middleware.checkSystemdServiceStatus("bitcoind")
+	inputs.DescriptionCodes, err = systemstate.GetActiveDescriptionCodes(middleware.redisClient)
 	if err != nil {
-		//only log, since information can still be relayed
-		log.Printf("Error getting lightingd active information from systemctl. Error: %s", err.Error())
+		log.Printf("Error getting the active description codes. Error: %s", err.Error())
+		inputs.RedisErr = err
 	}
-	lightningdActive, err := middleware.checkSystemdServiceStatus("lightningd")
+	inputs.FailedUnits, err = systemstate.GetFailedUnits(middleware.redisClient)
 	if err != nil {
-		// only log, since information can still be relayed
-		log.Printf("Error getting lightingd active information from systemctl. Error: %s", err.Error())
+		log.Printf("Error getting the failed units. Error: %s", err.Error())
+		inputs.RedisErr = err
 	}
-	electrsActive, err := middleware.checkSystemdServiceStatus("electrs")
+	inputs.Warnings, err = systemstate.GetWarnings(middleware.redisClient)
 	if err != nil {
-		// only log, since information can still be relayed
-		log.Printf("Error getting electrs active information from systemctl. Error: %s", err.Error())
+		log.Printf("Error getting the active warnings. Error: %s", err.Error())
+		inputs.RedisErr = err
+	}
+
+	for _, service := range []string{"bitcoind", "lightningd", "electrs"} {
+		active, err := middleware.checkSystemdServiceStatus(service)
+		if err != nil {
+			// only log, since information can still be relayed
+			log.Printf("Error getting %s active information from systemctl. Error: %s", service, err.Error())
+		}
+		inputs.ActiveServices[service] = active
+	}
+
+	ibd, err := middleware.prometheusClient.GetInt(prometheus.BitcoinIBD)
+	if err != nil {
+		log.Printf("Error getting bitcoindIBD information. Error: %s", err.Error())
+		inputs.PrometheusErr = err
+	}
+	inputs.IBD = ibd == 1
+	inputs.FreeDiskspace, err = middleware.prometheusClient.GetInt(prometheus.BaseFreeDiskspace)
+	if err != nil {
+		log.Printf("Error getting freeDiskspace information. Error: %s", err.Error())
+		inputs.PrometheusErr = err
+	}
+	inputs.TotalDiskspace, err = middleware.prometheusClient.GetInt(prometheus.BaseTotalDiskspace)
+	if err != nil {
+		log.Printf("Error getting totalDiskspace information. Error: %s", err.Error())
+		inputs.PrometheusErr = err
 	}
 
+	status, problems := systemstate.OverallStatus(inputs)
 	return rpcmessages.GetServiceStatusResponse{
 		ErrorResponse: &rpcmessages.ErrorResponse{
 			Success: true,
 		},
 		Hostname:         hostname,
-		Status:           "-PLACEHOLDER-", // FIXME: This is a placeholder.
+		Status:           status,
 		IsTorEnabled:     isTorEnabled,
-		BitcoindStatus:   bitcoindActive,
-		LightningdStatus: lightningdActive,
-		ElectrsStatus:    electrsActive,
+		BitcoindStatus:   inputs.ActiveServices["bitcoind"],
+		LightningdStatus: inputs.ActiveServices["lightningd"],
+		ElectrsStatus:    inputs.ActiveServices["electrs"],
+		Problems:         problems,
 	}
 }
 
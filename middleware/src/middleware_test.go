@@ -1,9 +1,14 @@
 package middleware_test
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	middleware "github.com/digitalbitbox/bitbox-base/middleware/src"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/authentication"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/configuration"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
 	"github.com/stretchr/testify/require"
@@ -15,6 +20,12 @@ func getToggleSettingArgs(enabled bool) rpcmessages.ToggleSettingArgs {
 
 // setupTestMiddleware middleware returns a middleware setup with testing arguments
 func setupTestMiddleware(t *testing.T) *middleware.Middleware {
+	return setupTestMiddlewareWithPrometheus(t, "http://localhost:9090")
+}
+
+// setupTestMiddlewareWithPrometheus returns a middleware setup with testing arguments, which queries the Prometheus server
+// at the given URL.
+func setupTestMiddlewareWithPrometheus(t *testing.T, prometheusURL string) *middleware.Middleware {
 	/* The config and cmd script are mocked with /bin/echo which just returns
 	the passed arguments. The real scripts can't be used here, because
 	- the absolute location of those is different on each host this is run on
@@ -31,7 +42,6 @@ func setupTestMiddleware(t *testing.T) *middleware.Middleware {
 		middlewareVersion         string = "0.0.1"
 		network                   string = "testnet"
 		notificationNamedPipePath string = "/tmp/middleware-notification.pipe"
-		prometheusURL             string = "http://localhost:9090"
 		redisMock                 bool   = true // Important: mock redis in the unit tests
 		redisPort                 string = "6379"
 	)
@@ -279,7 +289,9 @@ func TestUserAuthenticate(t *testing.T) {
 	authenticateAdminChanged := testMiddleware.UserAuthenticate(adminChangedArgs)
 
 	require.Equal(t, true, authenticateAdminChanged.ErrorResponse.Success)
-	require.NoError(t, testMiddleware.ValidateToken(authenticateAdmin.Token))
+	require.NoError(t, testMiddleware.ValidateToken(authenticateAdminChanged.Token))
+	// the tokens issued before the password change are revoked
+	require.Equal(t, authentication.ErrTokenRevoked, testMiddleware.ValidateToken(authenticateAdmin.Token))
 	setupStatus = testMiddleware.SetupStatus()
 	require.Equal(t, true, setupStatus.MiddlewarePasswordSet)
 
@@ -307,6 +319,65 @@ func TestUserAuthenticate(t *testing.T) {
 	require.Equal(t, "authentication unsuccessful, username not found", authenticateEmpty.ErrorResponse.Message)
 }
 
+func TestUserAuthenticateRateLimit(t *testing.T) {
+	testMiddleware := setupTestMiddleware(t)
+	now := time.Now()
+	testMiddleware.SetAttemptLimiterClock(func() time.Time { return now })
+
+	/* test that the first failed attempts are not limited */
+	wrongPasswordArgs := rpcmessages.UserAuthenticateArgs{Username: "admin", Password: "wrongpassword", ClientPubkey: "aabb"}
+	for i := 0; i < 4; i++ {
+		response := testMiddleware.UserAuthenticate(wrongPasswordArgs)
+		require.Equal(t, rpcmessages.ErrorAuthenticationPasswordIncorrect, response.ErrorResponse.Code)
+	}
+
+	/* test that further attempts, even with the correct password, have to wait */
+	adminArgs := rpcmessages.UserAuthenticateArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword(), ClientPubkey: "aabb"}
+	response := testMiddleware.UserAuthenticate(adminArgs)
+	require.Equal(t, false, response.ErrorResponse.Success)
+	require.Equal(t, rpcmessages.ErrorAuthenticationRateLimited, response.ErrorResponse.Code)
+	require.Equal(t, 1, response.RetryAfter)
+	require.Equal(t, "", response.Token)
+
+	/* test that the attempt succeeds after the backoff */
+	now = now.Add(time.Second)
+	response = testMiddleware.UserAuthenticate(adminArgs)
+	require.Equal(t, true, response.ErrorResponse.Success)
+	response = testMiddleware.UserAuthenticate(wrongPasswordArgs)
+	require.Equal(t, rpcmessages.ErrorAuthenticationPasswordIncorrect, response.ErrorResponse.Code)
+}
+
+func TestUserChangePasswordRateLimit(t *testing.T) {
+	testMiddleware := setupTestMiddleware(t)
+	now := time.Now()
+	testMiddleware.SetAttemptLimiterClock(func() time.Time { return now })
+
+	/* test that the first failed attempts are not limited */
+	wrongPasswordArgs := rpcmessages.UserChangePasswordArgs{Username: "admin", Password: "wrongpassword", NewPassword: "12345678", ClientPubkey: "aabb"}
+	for i := 0; i < 4; i++ {
+		response := testMiddleware.UserChangePassword(wrongPasswordArgs)
+		require.Equal(t, rpcmessages.ErrorPasswordChangePasswordIncorrect, response.Code)
+	}
+
+	/* test that further attempts, even with the correct password, have to wait */
+	adminArgs := rpcmessages.UserChangePasswordArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword(), NewPassword: "12345678", ClientPubkey: "aabb"}
+	response := testMiddleware.UserChangePassword(adminArgs)
+	require.Equal(t, false, response.Success)
+	require.Equal(t, rpcmessages.ErrorAuthenticationRateLimited, response.Code)
+	require.Equal(t, "authentication unsuccessful, too many failed attempts, retry after 1 seconds", response.Message)
+
+	/* test that the failed password changes also limit authentication attempts */
+	authenticateResponse := testMiddleware.UserAuthenticate(rpcmessages.UserAuthenticateArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword(), ClientPubkey: "ccdd"})
+	require.Equal(t, rpcmessages.ErrorAuthenticationRateLimited, authenticateResponse.ErrorResponse.Code)
+
+	/* test that the password change succeeds after the backoff */
+	now = now.Add(time.Second)
+	response = testMiddleware.UserChangePassword(adminArgs)
+	require.Equal(t, true, response.Success)
+	response = testMiddleware.UserChangePassword(wrongPasswordArgs)
+	require.Equal(t, rpcmessages.ErrorPasswordChangePasswordIncorrect, response.Code)
+}
+
 func TestUserChangePassword(t *testing.T) {
 	testMiddleware := setupTestMiddleware(t)
 
@@ -318,6 +389,12 @@ func TestUserChangePassword(t *testing.T) {
 	setupStatus := testMiddleware.SetupStatus()
 	require.Equal(t, false, setupStatus.MiddlewarePasswordSet)
 
+	/* test that unknown users and incorrect passwords can't be told apart */
+	incorrectArgs := rpcmessages.UserChangePasswordArgs{Username: "admin", Password: "notTheInitialPassword", NewPassword: "12345678"}
+	changepasswordIncorrect := testMiddleware.UserChangePassword(incorrectArgs)
+	require.Equal(t, rpcmessages.ErrorPasswordChangePasswordIncorrect, changepasswordIncorrect.Code)
+	require.Equal(t, changepasswordIncorrect, changepasswordValid)
+
 	/* test admin password change, this should set isMiddlewarePasswordSet == true */
 	newPassword := "123qwert567"
 	adminChangeArgs := rpcmessages.UserChangePasswordArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword(), NewPassword: newPassword}
@@ -342,6 +419,128 @@ func TestUserChangePassword(t *testing.T) {
 	require.Equal(t, "password change unsuccessful, the password needs to be at least 8 characters in length", changepasswordEmpty.Message)
 }
 
+func TestLogout(t *testing.T) {
+	testMiddleware := setupTestMiddleware(t)
+
+	adminArgs := rpcmessages.UserAuthenticateArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword()}
+	authenticateAdmin := testMiddleware.UserAuthenticate(adminArgs)
+	require.Equal(t, true, authenticateAdmin.ErrorResponse.Success)
+	authenticateAdmin2 := testMiddleware.UserAuthenticate(adminArgs)
+	require.Equal(t, true, authenticateAdmin2.ErrorResponse.Success)
+
+	/* test that only the tokens of the logout are revoked */
+	response := testMiddleware.Logout(rpcmessages.LogoutArgs{Token: authenticateAdmin.Token, RefreshToken: authenticateAdmin.RefreshToken})
+	require.Equal(t, true, response.Success)
+	require.Equal(t, authentication.ErrTokenRevoked, testMiddleware.ValidateToken(authenticateAdmin.Token))
+	require.NoError(t, testMiddleware.ValidateToken(authenticateAdmin2.Token))
+	refreshResponse := testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateAdmin.RefreshToken})
+	require.Equal(t, rpcmessages.ErrorRefreshTokenInvalid, refreshResponse.ErrorResponse.Code)
+
+	/* test that the refresh token of another user or client is not revoked */
+	authenticateAdmin3 := testMiddleware.UserAuthenticate(rpcmessages.UserAuthenticateArgs{
+		Username: "admin", Password: testMiddleware.InitialAdminPassword(), ClientPubkey: "aabb"})
+	require.Equal(t, true, authenticateAdmin3.ErrorResponse.Success)
+	require.Equal(t, true, testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "family", Password: "12345678", Role: "viewer"}).Success)
+	authenticateViewer := testMiddleware.UserAuthenticate(rpcmessages.UserAuthenticateArgs{Username: "family", Password: "12345678"})
+	require.Equal(t, true, authenticateViewer.ErrorResponse.Success)
+
+	response = testMiddleware.Logout(rpcmessages.LogoutArgs{Token: authenticateViewer.Token, RefreshToken: authenticateAdmin2.RefreshToken})
+	require.Equal(t, rpcmessages.ErrorLogoutFailed, response.Code)
+	response = testMiddleware.Logout(rpcmessages.LogoutArgs{Token: authenticateAdmin2.Token, RefreshToken: authenticateAdmin3.RefreshToken, ClientPubkey: "ccdd"})
+	require.Equal(t, rpcmessages.ErrorLogoutFailed, response.Code)
+	require.NoError(t, testMiddleware.ValidateToken(authenticateViewer.Token))
+	require.NoError(t, testMiddleware.ValidateToken(authenticateAdmin2.Token))
+	refreshResponse = testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateAdmin2.RefreshToken})
+	require.Equal(t, true, refreshResponse.ErrorResponse.Success)
+	refreshResponse = testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateAdmin3.RefreshToken, ClientPubkey: "aabb"})
+	require.Equal(t, true, refreshResponse.ErrorResponse.Success)
+
+	/* test logout with an already revoked token */
+	response = testMiddleware.Logout(rpcmessages.LogoutArgs{Token: authenticateAdmin.Token})
+	require.Equal(t, false, response.Success)
+	require.Equal(t, rpcmessages.ErrorLogoutFailed, response.Code)
+}
+
+func TestRefreshToken(t *testing.T) {
+	testMiddleware := setupTestMiddleware(t)
+
+	adminArgs := rpcmessages.UserAuthenticateArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword(), ClientPubkey: "aabb"}
+	authenticateAdmin := testMiddleware.UserAuthenticate(adminArgs)
+	require.Equal(t, true, authenticateAdmin.ErrorResponse.Success)
+	require.NotEmpty(t, authenticateAdmin.RefreshToken)
+	// the refresh token is not an access token
+	require.Error(t, testMiddleware.ValidateToken(authenticateAdmin.RefreshToken))
+
+	/* test refreshing from another client */
+	refreshResponse := testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateAdmin.RefreshToken, ClientPubkey: "ccdd"})
+	require.Equal(t, false, refreshResponse.ErrorResponse.Success)
+	require.Equal(t, rpcmessages.ErrorRefreshTokenInvalid, refreshResponse.ErrorResponse.Code)
+
+	/* test refreshing, the used refresh token is revoked */
+	refreshResponse = testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateAdmin.RefreshToken, ClientPubkey: "aabb"})
+	require.Equal(t, true, refreshResponse.ErrorResponse.Success)
+	require.NoError(t, testMiddleware.ValidateAdminToken(refreshResponse.Token))
+	refreshResponse2 := testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateAdmin.RefreshToken, ClientPubkey: "aabb"})
+	require.Equal(t, rpcmessages.ErrorRefreshTokenInvalid, refreshResponse2.ErrorResponse.Code)
+
+	/* test that the refresh tokens of a deleted user are revoked */
+	response := testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "family", Password: "12345678", Role: "viewer"})
+	require.Equal(t, true, response.Success)
+	authenticateViewer := testMiddleware.UserAuthenticate(rpcmessages.UserAuthenticateArgs{Username: "family", Password: "12345678", ClientPubkey: "aabb"})
+	require.Equal(t, true, authenticateViewer.ErrorResponse.Success)
+	response = testMiddleware.DeleteUser(rpcmessages.DeleteUserArgs{Username: "family"})
+	require.Equal(t, true, response.Success)
+	require.Error(t, testMiddleware.ValidateToken(authenticateViewer.Token))
+	refreshResponse = testMiddleware.RefreshToken(rpcmessages.RefreshTokenArgs{RefreshToken: authenticateViewer.RefreshToken, ClientPubkey: "aabb"})
+	require.Equal(t, rpcmessages.ErrorRefreshTokenInvalid, refreshResponse.ErrorResponse.Code)
+}
+
+func TestUserManagement(t *testing.T) {
+	testMiddleware := setupTestMiddleware(t)
+
+	listResponse := testMiddleware.ListUsers()
+	require.Equal(t, true, listResponse.ErrorResponse.Success)
+	require.Equal(t, []rpcmessages.UserInfo{{Username: "admin", Role: "admin"}}, listResponse.Users)
+
+	/* test invalid user creations */
+	response := testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "Family Member", Password: "12345678", Role: "viewer"})
+	require.Equal(t, rpcmessages.ErrorUserInvalidUsername, response.Code)
+	response = testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "family", Password: "12345678", Role: "root"})
+	require.Equal(t, rpcmessages.ErrorUserInvalidRole, response.Code)
+	response = testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "family", Password: "1234567", Role: "viewer"})
+	require.Equal(t, rpcmessages.ErrorPasswordTooShort, response.Code)
+	response = testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "admin", Password: "12345678", Role: "viewer"})
+	require.Equal(t, rpcmessages.ErrorUserAlreadyExists, response.Code)
+
+	/* test creating a viewer, which can authenticate but is not permitted to do admin actions */
+	response = testMiddleware.CreateUser(rpcmessages.CreateUserArgs{Username: "family", Password: "12345678", Role: "viewer"})
+	require.Equal(t, true, response.Success)
+	authenticateViewer := testMiddleware.UserAuthenticate(rpcmessages.UserAuthenticateArgs{Username: "family", Password: "12345678"})
+	require.Equal(t, true, authenticateViewer.ErrorResponse.Success)
+	require.NoError(t, testMiddleware.ValidateToken(authenticateViewer.Token))
+	require.Equal(t, authentication.ErrRoleNotPermitted, testMiddleware.ValidateAdminToken(authenticateViewer.Token))
+
+	authenticateAdmin := testMiddleware.UserAuthenticate(rpcmessages.UserAuthenticateArgs{Username: "admin", Password: testMiddleware.InitialAdminPassword()})
+	require.Equal(t, true, authenticateAdmin.ErrorResponse.Success)
+	require.NoError(t, testMiddleware.ValidateAdminToken(authenticateAdmin.Token))
+
+	/* test that a password change keeps the role */
+	response = testMiddleware.UserChangePassword(rpcmessages.UserChangePasswordArgs{Username: "family", Password: "12345678", NewPassword: "87654321"})
+	require.Equal(t, true, response.Success)
+	listResponse = testMiddleware.ListUsers()
+	require.Equal(t, []rpcmessages.UserInfo{{Username: "admin", Role: "admin"}, {Username: "family", Role: "viewer"}}, listResponse.Users)
+
+	/* test user deletion, the last admin can't be deleted */
+	response = testMiddleware.DeleteUser(rpcmessages.DeleteUserArgs{Username: "admin"})
+	require.Equal(t, rpcmessages.ErrorUserDeleteLastAdmin, response.Code)
+	response = testMiddleware.DeleteUser(rpcmessages.DeleteUserArgs{Username: "nobody"})
+	require.Equal(t, rpcmessages.ErrorUserNotFound, response.Code)
+	response = testMiddleware.DeleteUser(rpcmessages.DeleteUserArgs{Username: "family"})
+	require.Equal(t, true, response.Success)
+	listResponse = testMiddleware.ListUsers()
+	require.Equal(t, []rpcmessages.UserInfo{{Username: "admin", Role: "admin"}}, listResponse.Users)
+}
+
 func TestSetHostname(t *testing.T) {
 	testMiddleware := setupTestMiddleware(t)
 
@@ -382,6 +581,69 @@ func TestSetHostname(t *testing.T) {
 	require.Equal(t, "invalid hostname", response7.Message)
 }
 
+func TestSetFanProfile(t *testing.T) {
+	testMiddleware := setupTestMiddleware(t)
+
+	for _, profile := range []string{"silent", "balanced", "performance"} {
+		response := testMiddleware.SetFanProfile(rpcmessages.SetFanProfileArgs{Profile: profile})
+		require.Equal(t, true, response.Success)
+		require.Empty(t, response.Message)
+	}
+
+	for _, profile := range []string{"", "turbo", "Silent"} {
+		response := testMiddleware.SetFanProfile(rpcmessages.SetFanProfileArgs{Profile: profile})
+		require.Equal(t, false, response.Success)
+		require.Equal(t, rpcmessages.ErrorSetFanProfileInvalidValue, response.Code)
+	}
+}
+
+func TestGetFanStatus(t *testing.T) {
+	// metrics holds the values of the fake Prometheus server, queries of other metrics return an empty result
+	var metrics map[string]string
+	prometheusServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := "[]"
+		if value, ok := metrics[r.URL.Query().Get("query")]; ok {
+			result = fmt.Sprintf(`[{"metric":{},"value":[1575000000,"%s"]}]`, value)
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":%s}}`, result)
+	}))
+	defer prometheusServer.Close()
+	testMiddleware := setupTestMiddlewareWithPrometheus(t, prometheusServer.URL)
+
+	metrics = map[string]string{
+		"bbbfancontrol_temperature_celsius": "52.5",
+		"bbbfancontrol_fan_pwm":             "120",
+		"bbbfancontrol_sensor_error":        "0",
+	}
+	response := testMiddleware.GetFanStatus()
+	require.Equal(t, true, response.ErrorResponse.Success)
+	require.Equal(t, int64(120), response.PWM)
+	require.Equal(t, 52.5, response.Temperature)
+	require.Equal(t, false, response.SensorError)
+
+	/* test that a sensor error is reported with the PWM value, as the temperature metric is omitted then */
+	metrics = map[string]string{
+		"bbbfancontrol_fan_pwm":      "255",
+		"bbbfancontrol_sensor_error": "1",
+	}
+	response = testMiddleware.GetFanStatus()
+	require.Equal(t, true, response.ErrorResponse.Success)
+	require.Equal(t, int64(255), response.PWM)
+	require.Equal(t, float64(0), response.Temperature)
+	require.Equal(t, true, response.SensorError)
+
+	/* test that a missing temperature is reported as a sensor error */
+	metrics["bbbfancontrol_sensor_error"] = "0"
+	response = testMiddleware.GetFanStatus()
+	require.Equal(t, true, response.ErrorResponse.Success)
+	require.Equal(t, true, response.SensorError)
+
+	/* test that a missing PWM value fails */
+	metrics = map[string]string{}
+	response = testMiddleware.GetFanStatus()
+	require.Equal(t, false, response.ErrorResponse.Success)
+}
+
 func TestShutdownBase(t *testing.T) {
 	testMiddleware := setupTestMiddleware(t)
 
@@ -0,0 +1,10 @@
+package noisemanager
+
+// SetNonces sets the nonce counters of the session, so that the nonce exhaustion can be tested.
+func (session *NoiseSession) SetNonces(sendNonce, receiveNonce uint64) {
+	session.sendNonce = sendNonce
+	session.receiveNonce = receiveNonce
+}
+
+// MaxNonce exports maxNonce for testing.
+const MaxNonce = maxNonce
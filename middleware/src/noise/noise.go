@@ -8,8 +8,11 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/gorilla/websocket"
@@ -17,52 +20,111 @@ import (
 
 const (
 	opICanHasHandShaek          = "h"
+	opICanHasJSONRPCHandShaek   = "j"
 	responseSuccess             = "\x00"
 	responseFailure             = "\x01"
 	responseNeedsPairing        = "\x01"
 	opICanHasPairinVerificashun = byte('v')
 )
 
-// NoiseConfig holds the configuration options required to successfully pair through a noise handshake and subsequently encrypt traffic.
+const (
+	// defaultRekeyMessages is the default number of messages after which a sender rekeys its cipher state.
+	defaultRekeyMessages = 10000
+	// defaultRekeyInterval is the default duration after which a sender rekeys its cipher state.
+	defaultRekeyInterval = 30 * time.Minute
+	// maxNonce is the highest nonce that can be used. The nonce 2^64-1 is reserved by the noise specification.
+	maxNonce = math.MaxUint64 - 1
+)
+
+// ErrNonceExhausted is returned by Encrypt and Decrypt if the nonces of the cipher state ran out.
+// The connection needs to be closed and a new handshake done.
+var ErrNonceExhausted = errors.New("noise nonces exhausted")
+
+// NoiseConfig holds the configuration shared by all noise sessions. This is the middleware's static keypair and the store
+// of paired client static pubkeys, both persisted in the data directory. The per connection state lives in a NoiseSession.
 type NoiseConfig struct {
+	dataDir string
+
+	verifyPairing func(channelHash []byte) (bool, error)
+
+	// rekeyMessages and rekeyInterval define after how many messages or how much time a session rekeys its send cipher state.
+	rekeyMessages uint64
+	rekeyInterval time.Duration
+
+	// configMu guards the config file in the data directory, since multiple sessions can read and write it concurrently.
+	configMu sync.Mutex
+	// pairingMu serializes the pairing verification, since only one pairing code can be shown to the user at a time.
+	pairingMu sync.Mutex
+
+	// sessions holds the initialized sessions of the connected clients, so that they can be dropped if their pairing is revoked.
+	sessions   map[*NoiseSession]struct{}
+	sessionsMu sync.Mutex
+}
+
+// NoiseSession holds the noise state of a single client connection. Each websocket connection has its own cipher states,
+// channel hash and pairing state.
+type NoiseSession struct {
+	config                      *NoiseConfig
 	clientStaticPubkey          []byte
 	channelHash                 []byte
 	sendCipher, receiveCipher   *noise.CipherState
 	pairingVerificationRequired bool
 	initialized                 bool
-	dataDir                     string
-
-	verifyPairing func(channelHash []byte) (bool, error)
+	// jsonRPC is set if the client requested the JSON-RPC 2.0 codec for the rpc calls instead of gob during the handshake.
+	jsonRPC bool
+
+	// sendNonce and receiveNonce mirror the nonces of the cipher states, which are not exposed by the noise package.
+	sendNonce, receiveNonce uint64
+	// messagesSinceRekey and lastRekey track when the send cipher state needs to be rekeyed next.
+	messagesSinceRekey uint64
+	lastRekey          time.Time
+
+	// revoked is closed if the pairing of the client is revoked while it is connected.
+	revoked    chan struct{}
+	revokeOnce sync.Once
 }
 
 //NewNoiseConfig takes a directory path string as an argument and returns a NoiseConfig struct.
 func NewNoiseConfig(dataDir string, verifyPairing func([]byte) (bool, error)) *NoiseConfig {
 	noise := &NoiseConfig{
 		dataDir:       dataDir,
-		initialized:   false,
 		verifyPairing: verifyPairing,
+		rekeyMessages: defaultRekeyMessages,
+		rekeyInterval: defaultRekeyInterval,
+		sessions:      make(map[*NoiseSession]struct{}),
 	}
 	return noise
 }
 
+// SetRekeyLimits sets after how many sent messages or how much time the sessions rekey their send cipher state.
+// It only affects sessions created afterwards.
+func (noiseConfig *NoiseConfig) SetRekeyLimits(messages uint64, interval time.Duration) {
+	noiseConfig.rekeyMessages = messages
+	noiseConfig.rekeyInterval = interval
+}
+
+// RekeyInterval returns the duration after which a session rekeys its send cipher state.
+func (noiseConfig *NoiseConfig) RekeyInterval() time.Duration {
+	return noiseConfig.rekeyInterval
+}
+
+// NewSession returns a new, not yet initialized, NoiseSession for a client connection.
+func (noiseConfig *NoiseConfig) NewSession() *NoiseSession {
+	return &NoiseSession{
+		config:      noiseConfig,
+		initialized: false,
+		revoked:     make(chan struct{}),
+	}
+}
+
 // InitializeNoise sets up a new noise connection. First a fresh keypair is generated if none is locally found.
 // Afterwards a XX handshake is performed. This is a three part handshake required to authenticate both parties.
 // The resulting pairing code is then displayed to the user to check if it matches what is displayed on the other party's device.
-func (noiseConfig *NoiseConfig) InitializeNoise(ws *websocket.Conn) error {
+func (session *NoiseSession) InitializeNoise(ws *websocket.Conn) error {
 	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
-	keypair := noiseConfig.getMiddlewareNoiseStaticKeypair()
-	if keypair == nil {
-		if true {
-			kp, err := cipherSuite.GenerateKeypair(rand.Reader)
-			if err != nil {
-				return errors.New("failed to generate a new noise keypair")
-			}
-			keypair = &kp
-
-			if err := noiseConfig.setMiddlewareNoiseStaticKeypair(keypair); err != nil {
-				log.Println("could not store app noise static keypair")
-			}
-		}
+	keypair, err := session.config.getOrCreateMiddlewareNoiseStaticKeypair(cipherSuite)
+	if err != nil {
+		return err
 	}
 	handshake, err := noise.NewHandshakeState(noise.Config{
 		CipherSuite:   cipherSuite,
@@ -81,7 +143,12 @@ func (noiseConfig *NoiseConfig) InitializeNoise(ws *websocket.Conn) error {
 	if err != nil {
 		return errors.New("websocket failed to read noise handshake request")
 	}
-	if string(responseBytes) != string(opICanHasHandShaek) {
+	switch string(responseBytes) {
+	case opICanHasHandShaek:
+		session.jsonRPC = false
+	case opICanHasJSONRPCHandShaek:
+		session.jsonRPC = true
+	default:
 		return errors.New("initial response bytes did not match what we were expecting")
 	}
 	err = ws.WriteMessage(1, []byte(responseSuccess))
@@ -110,20 +177,20 @@ func (noiseConfig *NoiseConfig) InitializeNoise(ws *websocket.Conn) error {
 	if err != nil {
 		return errors.New("websocket failed to read third noise handshake message")
 	}
-	_, noiseConfig.sendCipher, noiseConfig.receiveCipher, err = handshake.ReadMessage(nil, responseBytes)
+	_, session.sendCipher, session.receiveCipher, err = handshake.ReadMessage(nil, responseBytes)
 	if err != nil {
 		return errors.New("noise failed to read the third noise handshake message")
 	}
 
 	// Check if the user already authenticated the channel binding hash
-	noiseConfig.clientStaticPubkey = handshake.PeerStatic()
-	if len(noiseConfig.clientStaticPubkey) != 32 {
+	session.clientStaticPubkey = handshake.PeerStatic()
+	if len(session.clientStaticPubkey) != 32 {
 		return errors.New("expected 32 byte remote static pubkey")
 	}
-	noiseConfig.pairingVerificationRequired = !noiseConfig.containsClientStaticPubkey(noiseConfig.clientStaticPubkey)
+	session.pairingVerificationRequired = !session.config.containsClientStaticPubkey(session.clientStaticPubkey)
 
 	// If the user has not authenticated, the connected client needs to ask for verification before being able to interact with the base
-	if noiseConfig.pairingVerificationRequired {
+	if session.pairingVerificationRequired {
 		err = ws.WriteMessage(websocket.BinaryMessage, []byte(responseNeedsPairing))
 		if err != nil {
 			return errors.New("websocket failed to write second noise handshake message")
@@ -134,16 +201,17 @@ func (noiseConfig *NoiseConfig) InitializeNoise(ws *websocket.Conn) error {
 			return errors.New("websocket failed to write second noise handshake message")
 		}
 	}
-	noiseConfig.channelHash = handshake.ChannelBinding()
-	noiseConfig.initialized = true
+	session.channelHash = handshake.ChannelBinding()
+	session.lastRekey = time.Now()
+	session.initialized = true
 
 	_, responseBytes, err = ws.ReadMessage()
 	if err != nil {
 		return errors.New("websocket failed to read verification request")
 	}
-	if responseBytes[0] == opICanHasPairinVerificashun {
+	if len(responseBytes) > 0 && responseBytes[0] == opICanHasPairinVerificashun {
 		log.Println("Need to verify pairing hash")
-		msg, err := noiseConfig.CheckVerification()
+		msg, err := session.CheckVerification()
 		if err != nil {
 			return err
 		}
@@ -152,50 +220,115 @@ func (noiseConfig *NoiseConfig) InitializeNoise(ws *websocket.Conn) error {
 			log.Println("Error, websocket failed to write channel hash verification message")
 		}
 	}
+	session.config.registerSession(session)
 	log.Println("Successfully completed noise handshake with client")
 
 	return nil
 }
 
 // CheckVerification displays the channel hash and returns the success or fail response byte array.
-func (noiseConfig *NoiseConfig) CheckVerification() ([]byte, error) {
-	accepted, err := noiseConfig.verifyPairing(noiseConfig.channelHash)
+func (session *NoiseSession) CheckVerification() ([]byte, error) {
+	session.config.pairingMu.Lock()
+	defer session.config.pairingMu.Unlock()
+
+	accepted, err := session.config.verifyPairing(session.channelHash)
 	if err != nil {
 		return nil, err
 	}
 	if accepted {
-		err = noiseConfig.addClientStaticPubkey(noiseConfig.clientStaticPubkey)
+		err = session.config.addClientStaticPubkey(session.clientStaticPubkey)
 		if err != nil {
 			log.Println("Pairing Successful, but unable to write baseNoiseStaticPubkey to file")
 		}
-		noiseConfig.pairingVerificationRequired = false
+		session.pairingVerificationRequired = false
 		return []byte(responseSuccess), nil
 	}
 	return []byte(responseFailure), nil
 }
 
-// Encrypt takes a (plaintext) byte array message as arguments and returns a noise encrypted byte array per the configuration in NoiseConfig
-// If the encryption fails the function returns an empty byte array and an error.
-func (noiseConfig *NoiseConfig) Encrypt(message []byte) []byte {
-	if !noiseConfig.initialized {
-		return []byte("Error: noise session not initialized")
+// ClientStaticPubkey returns the noise static pubkey of the client connected in this session.
+// It is nil if the session is not initialized yet.
+func (session *NoiseSession) ClientStaticPubkey() []byte {
+	return session.clientStaticPubkey
+}
+
+// JSONRPC returns true if the client requested the JSON-RPC 2.0 codec for the rpc calls during the handshake.
+// Otherwise the rpc calls are gob encoded.
+func (session *NoiseSession) JSONRPC() bool {
+	return session.jsonRPC
+}
+
+// Encrypt takes a (plaintext) byte array message as arguments and returns a noise encrypted byte array per the configuration in NoiseSession
+// If the nonces are exhausted the function returns ErrNonceExhausted and the connection needs to be closed.
+func (session *NoiseSession) Encrypt(message []byte) ([]byte, error) {
+	if !session.initialized {
+		return []byte("Error: noise session not initialized"), nil
 	}
-	if noiseConfig.pairingVerificationRequired {
+	if session.pairingVerificationRequired {
 		message = []byte("Error: encrypted connection not verified")
 	}
-	return noiseConfig.sendCipher.Encrypt(nil, nil, message)
+	return session.encrypt(message)
+}
+
+func (session *NoiseSession) encrypt(message []byte) ([]byte, error) {
+	if session.sendNonce > maxNonce {
+		return nil, ErrNonceExhausted
+	}
+	session.sendNonce++
+	session.messagesSinceRekey++
+	return session.sendCipher.Encrypt(nil, nil, message), nil
 }
 
-// Decrypt takes a (encrypted) byte array message as arguments and returns a noise decrypted byte array per the configuration in NoiseConfig.
+// Decrypt takes a (encrypted) byte array message as arguments and returns a noise decrypted byte array per the configuration in NoiseSession.
 // If the decryption fails the function returns an empty byte array and an error.
-func (noiseConfig *NoiseConfig) Decrypt(message []byte) ([]byte, error) {
-	if !noiseConfig.initialized {
+// A rekey message from the client rekeys the receive cipher state and is returned as an empty byte array, which should be ignored.
+func (session *NoiseSession) Decrypt(message []byte) ([]byte, error) {
+	if !session.initialized {
 		return []byte(""), errors.New("noise not initialized")
 	}
-	if noiseConfig.pairingVerificationRequired {
+	if session.pairingVerificationRequired {
 		return []byte(""), errors.New("pairing verification has not been done with this client")
 	}
-	return noiseConfig.receiveCipher.Decrypt(nil, nil, message)
+	if session.receiveNonce > maxNonce {
+		return []byte(""), ErrNonceExhausted
+	}
+	session.receiveNonce++
+	messageDecrypted, err := session.receiveCipher.Decrypt(nil, nil, message)
+	if err != nil {
+		return []byte(""), err
+	}
+	if len(messageDecrypted) == 0 {
+		// An empty payload is the rekey message. The client rekeys its send cipher state after sending it.
+		session.receiveCipher.Rekey()
+		log.Println("Rekeyed the noise receive cipher state on request of the client")
+	}
+	return messageDecrypted, nil
+}
+
+// RekeyRequired returns true if the send cipher state should be rekeyed, because either the number of
+// messages or the time since the handshake or the last rekey exceeded the configured limits.
+func (session *NoiseSession) RekeyRequired() bool {
+	if !session.initialized {
+		return false
+	}
+	return session.messagesSinceRekey >= session.config.rekeyMessages ||
+		time.Since(session.lastRekey) >= session.config.rekeyInterval
+}
+
+// Rekey returns the encrypted rekey message, which must be sent to the client next, and rekeys the send cipher state.
+// The rekey message is an encrypted empty payload, which no other message in the protocol uses.
+func (session *NoiseSession) Rekey() ([]byte, error) {
+	if !session.initialized {
+		return nil, errors.New("noise not initialized")
+	}
+	message, err := session.encrypt(nil)
+	if err != nil {
+		return nil, err
+	}
+	session.sendCipher.Rekey()
+	session.messagesSinceRekey = 0
+	session.lastRekey = time.Now()
+	return message, nil
 }
 
 const configFilename = "base.json"
@@ -205,9 +338,20 @@ type noiseKeypair struct {
 	Public  []byte `json:"public"`
 }
 
+// pairedClient is a client paired with the middleware. The timestamps are unix timestamps in seconds.
+type pairedClient struct {
+	Pubkey      []byte `json:"pubkey"`
+	Label       string `json:"label"`
+	FirstPaired int64  `json:"firstPaired"`
+	LastSeen    int64  `json:"lastSeen"`
+}
+
 type configuration struct {
-	MiddlewareNoiseStaticKeypair *noiseKeypair `json:"appNoiseStaticKeypair"`
-	ClientNoiseStaticPubkeys     [][]byte      `json:"deviceNoiseStaticPubkeys"`
+	MiddlewareNoiseStaticKeypair *noiseKeypair  `json:"appNoiseStaticKeypair"`
+	PairedClients                []pairedClient `json:"pairedClients"`
+	// LegacyClientNoiseStaticPubkeys holds the pubkeys of clients paired before labels and timestamps were recorded.
+	// They are migrated to PairedClients when the config is read.
+	LegacyClientNoiseStaticPubkeys [][]byte `json:"deviceNoiseStaticPubkeys,omitempty"`
 }
 
 func (noiseConfig *NoiseConfig) readConfig() *configuration {
@@ -219,34 +363,75 @@ func (noiseConfig *NoiseConfig) readConfig() *configuration {
 	if err := configFile.ReadJSON(&conf); err != nil {
 		return &configuration{}
 	}
+	for _, legacyPubkey := range conf.LegacyClientNoiseStaticPubkeys {
+		if conf.pairedClient(legacyPubkey) == nil {
+			conf.PairedClients = append(conf.PairedClients, pairedClient{Pubkey: legacyPubkey})
+		}
+	}
+	conf.LegacyClientNoiseStaticPubkeys = nil
 	return &conf
 }
 
+// pairedClient returns the paired client with the given pubkey or nil if it is not paired.
+func (conf *configuration) pairedClient(pubkey []byte) *pairedClient {
+	for i := range conf.PairedClients {
+		if bytes.Equal(conf.PairedClients[i].Pubkey, pubkey) {
+			return &conf.PairedClients[i]
+		}
+	}
+	return nil
+}
+
 func (noiseConfig *NoiseConfig) storeConfig(conf *configuration) error {
 	configFile := NewFile(noiseConfig.dataDir, configFilename)
 	return configFile.WriteJSON(conf)
 }
 
 func (noiseConfig *NoiseConfig) containsClientStaticPubkey(pubkey []byte) bool {
-	for _, configPubkey := range noiseConfig.readConfig().ClientNoiseStaticPubkeys {
-		if bytes.Equal(configPubkey, pubkey) {
-			return true
-		}
-	}
-	return false
+	noiseConfig.configMu.Lock()
+	defer noiseConfig.configMu.Unlock()
+
+	return noiseConfig.readConfig().pairedClient(pubkey) != nil
 }
 
 func (noiseConfig *NoiseConfig) addClientStaticPubkey(pubkey []byte) error {
-	if noiseConfig.containsClientStaticPubkey(pubkey) {
+	noiseConfig.configMu.Lock()
+	defer noiseConfig.configMu.Unlock()
+
+	config := noiseConfig.readConfig()
+	if config.pairedClient(pubkey) != nil {
 		// Don't add again if already present.
 		return nil
 	}
-
-	config := noiseConfig.readConfig()
-	config.ClientNoiseStaticPubkeys = append(config.ClientNoiseStaticPubkeys, pubkey)
+	now := time.Now().Unix()
+	config.PairedClients = append(config.PairedClients, pairedClient{
+		Pubkey:      pubkey,
+		FirstPaired: now,
+		LastSeen:    now,
+	})
 	return noiseConfig.storeConfig(config)
 }
 
+// getOrCreateMiddlewareNoiseStaticKeypair returns the middleware's static keypair. A new keypair is generated and stored
+// if none is found. This is done while holding the config lock, so that concurrent handshakes can't generate two keypairs.
+func (noiseConfig *NoiseConfig) getOrCreateMiddlewareNoiseStaticKeypair(cipherSuite noise.CipherSuite) (*noise.DHKey, error) {
+	noiseConfig.configMu.Lock()
+	defer noiseConfig.configMu.Unlock()
+
+	keypair := noiseConfig.getMiddlewareNoiseStaticKeypair()
+	if keypair != nil {
+		return keypair, nil
+	}
+	kp, err := cipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return nil, errors.New("failed to generate a new noise keypair")
+	}
+	if err := noiseConfig.setMiddlewareNoiseStaticKeypair(&kp); err != nil {
+		log.Println("could not store app noise static keypair")
+	}
+	return &kp, nil
+}
+
 func (noiseConfig *NoiseConfig) getMiddlewareNoiseStaticKeypair() *noise.DHKey {
 	key := noiseConfig.readConfig().MiddlewareNoiseStaticKeypair
 	if key == nil {
@@ -1,9 +1,18 @@
 package noisemanager_test
 
 import (
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	noisemanager "github.com/digitalbitbox/bitbox-base/middleware/src/noise"
+	"github.com/flynn/noise"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,7 +20,7 @@ func TestNoiseRejected(t *testing.T) {
 	noiseInstance := noisemanager.NewNoiseConfig(
 		".base",
 		func([]byte) (bool, error) { return false, nil },
-	)
+	).NewSession()
 	response, err := noiseInstance.CheckVerification()
 	require.NoError(t, err)
 	require.Equal(t, string(response), "\x01")
@@ -21,11 +30,12 @@ func TestNoise(t *testing.T) {
 	noiseInstance := noisemanager.NewNoiseConfig(
 		".base",
 		func([]byte) (bool, error) { return true, nil },
-	)
+	).NewSession()
 	response, err := noiseInstance.CheckVerification()
 	require.NoError(t, err)
 	require.Equal(t, string(response), "\x00")
-	msg := noiseInstance.Encrypt([]byte("test"))
+	msg, err := noiseInstance.Encrypt([]byte("test"))
+	require.NoError(t, err)
 	if string(msg) == "" {
 		t.Error("did not receive error when encrypting from uninitialized noise")
 	}
@@ -34,3 +44,252 @@ func TestNoise(t *testing.T) {
 		t.Error("did not receive error when decrypting from unitialized noise")
 	}
 }
+
+// newEchoServer returns a websocket server, which does the noise handshake with a client and echoes back all messages.
+// The server rekeys its send cipher state when required. The session is passed to setupSession after the handshake.
+func newEchoServer(t *testing.T, noiseConfig *noisemanager.NoiseConfig, setupSession func(*noisemanager.NoiseSession)) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the handler runs in the goroutine of the server, so failures are reported with t.Error instead of require
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+
+		session := noiseConfig.NewSession()
+		if err := session.InitializeNoise(ws); err != nil {
+			t.Error(err)
+			return
+		}
+		setupSession(session)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err = session.Decrypt(msg)
+			if err == noisemanager.ErrNonceExhausted {
+				_ = ws.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, err.Error()))
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(msg) == 0 {
+				continue
+			}
+			msg, err = session.Encrypt(msg)
+			if err == noisemanager.ErrNonceExhausted {
+				_ = ws.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, err.Error()))
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				t.Error(err)
+				return
+			}
+			if session.RekeyRequired() {
+				msg, err = session.Rekey()
+				if err == nil {
+					err = ws.WriteMessage(websocket.BinaryMessage, msg)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}))
+}
+
+// connectClient connects to the echo server and does the noise handshake and pairing as the client.
+func connectClient(t *testing.T, server *httptest.Server) (*websocket.Conn, *noise.CipherState, *noise.CipherState) {
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+server.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+
+	cipherSuite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	kp, err := cipherSuite.GenerateKeypair(rand.Reader)
+	require.NoError(t, err)
+	handshake, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		StaticKeypair: kp,
+		Prologue:      []byte("Noise_XX_25519_ChaChaPoly_SHA256"),
+		Initiator:     true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, []byte("h")))
+	_, responseBytes, err := ws.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "\x00", string(responseBytes))
+	msg, _, _, err := handshake.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, msg))
+	_, responseBytes, err = ws.ReadMessage()
+	require.NoError(t, err)
+	_, _, _, err = handshake.ReadMessage(nil, responseBytes)
+	require.NoError(t, err)
+	msg, receiveCipher, sendCipher, err := handshake.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, msg))
+	_, responseBytes, err = ws.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "\x01", string(responseBytes))
+
+	// pair
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, []byte("v")))
+	_, responseBytes, err = ws.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "\x00", string(responseBytes))
+	return ws, receiveCipher, sendCipher
+}
+
+func newTestNoiseConfig(t *testing.T) (*noisemanager.NoiseConfig, func()) {
+	noiseConfig, _, cleanup := newTestNoiseConfigWithDir(t)
+	return noiseConfig, cleanup
+}
+
+func newTestNoiseConfigWithDir(t *testing.T) (*noisemanager.NoiseConfig, string, func()) {
+	dataDir, err := ioutil.TempDir("", "middleware-noise-test")
+	require.NoError(t, err)
+	noiseConfig := noisemanager.NewNoiseConfig(
+		dataDir,
+		func([]byte) (bool, error) { return true, nil },
+	)
+	return noiseConfig, dataDir, func() { require.NoError(t, os.RemoveAll(dataDir)) }
+}
+
+func TestNoiseRekey(t *testing.T) {
+	noiseConfig, cleanup := newTestNoiseConfig(t)
+	defer cleanup()
+	// the server rekeys after every second message
+	noiseConfig.SetRekeyLimits(2, time.Hour)
+	server := newEchoServer(t, noiseConfig, func(*noisemanager.NoiseSession) {})
+	defer server.Close()
+
+	ws, receiveCipher, sendCipher := connectClient(t, server)
+	defer ws.Close()
+
+	serverRekeys := 0
+	for i := 0; i < 7; i++ {
+		message := []byte{byte('a' + i)}
+		// the client rekeys after every third message
+		if i > 0 && i%3 == 0 {
+			require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, sendCipher.Encrypt(nil, nil, nil)))
+			sendCipher.Rekey()
+		}
+		require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, sendCipher.Encrypt(nil, nil, message)))
+
+		for {
+			_, msg, err := ws.ReadMessage()
+			require.NoError(t, err)
+			msg, err = receiveCipher.Decrypt(nil, nil, msg)
+			require.NoError(t, err)
+			if len(msg) == 0 {
+				receiveCipher.Rekey()
+				serverRekeys++
+				continue
+			}
+			require.Equal(t, message, msg)
+			break
+		}
+	}
+	require.Equal(t, 3, serverRekeys)
+}
+
+func TestNoiseRekeyInterval(t *testing.T) {
+	noiseConfig, cleanup := newTestNoiseConfig(t)
+	defer cleanup()
+	noiseConfig.SetRekeyLimits(1000, time.Millisecond)
+	sessions := make(chan *noisemanager.NoiseSession, 1)
+	server := newEchoServer(t, noiseConfig, func(session *noisemanager.NoiseSession) { sessions <- session })
+	defer server.Close()
+
+	ws, _, _ := connectClient(t, server)
+	defer ws.Close()
+
+	session := <-sessions
+	time.Sleep(2 * time.Millisecond)
+	require.True(t, session.RekeyRequired())
+	_, err := session.Rekey()
+	require.NoError(t, err)
+}
+
+func TestNoiseNonceExhausted(t *testing.T) {
+	noiseConfig, cleanup := newTestNoiseConfig(t)
+	defer cleanup()
+	server := newEchoServer(t, noiseConfig, func(session *noisemanager.NoiseSession) {
+		// the next message received uses the last nonce, the reply can't be encrypted anymore
+		session.SetNonces(noisemanager.MaxNonce+1, noisemanager.MaxNonce)
+	})
+	defer server.Close()
+
+	ws, _, sendCipher := connectClient(t, server)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, sendCipher.Encrypt(nil, nil, []byte("test"))))
+	_, _, err := ws.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestPairedClients(t *testing.T) {
+	noiseConfig, cleanup := newTestNoiseConfig(t)
+	defer cleanup()
+	sessions := make(chan *noisemanager.NoiseSession, 1)
+	server := newEchoServer(t, noiseConfig, func(session *noisemanager.NoiseSession) { sessions <- session })
+	defer server.Close()
+
+	ws, _, _ := connectClient(t, server)
+	defer ws.Close()
+	session := <-sessions
+	pubkey := session.ClientStaticPubkey()
+
+	pairedClients := noiseConfig.PairedClients()
+	require.Len(t, pairedClients, 1)
+	require.Equal(t, pubkey, pairedClients[0].Pubkey)
+	require.NotZero(t, pairedClients[0].FirstPaired)
+	require.NotZero(t, pairedClients[0].LastSeen)
+	require.True(t, pairedClients[0].IsConnected)
+
+	require.NoError(t, noiseConfig.SetPairedClientLabel(pubkey, "phone"))
+	require.Equal(t, "phone", noiseConfig.PairedClients()[0].Label)
+	require.Equal(t, noisemanager.ErrLabelTooLong, noiseConfig.SetPairedClientLabel(pubkey, strings.Repeat("a", 65)))
+
+	unknownPubkey := make([]byte, 32)
+	require.Equal(t, noisemanager.ErrClientNotPaired, noiseConfig.SetPairedClientLabel(unknownPubkey, "phone"))
+	require.Equal(t, noisemanager.ErrClientNotPaired, noiseConfig.RevokePairedClient(unknownPubkey))
+
+	require.NoError(t, noiseConfig.RevokePairedClient(pubkey))
+	require.Empty(t, noiseConfig.PairedClients())
+	select {
+	case <-session.Revoked():
+	default:
+		t.Error("the session of the revoked client was not revoked")
+	}
+}
+
+func TestPairedClientsLegacyConfig(t *testing.T) {
+	noiseConfig, dataDir, cleanup := newTestNoiseConfigWithDir(t)
+	defer cleanup()
+
+	legacyPubkey := make([]byte, 32)
+	legacyPubkey[0] = 1
+	legacyConfig := map[string]interface{}{"deviceNoiseStaticPubkeys": [][]byte{legacyPubkey}}
+	require.NoError(t, noisemanager.NewFile(dataDir, "base.json").WriteJSON(legacyConfig))
+
+	pairedClients := noiseConfig.PairedClients()
+	require.Len(t, pairedClients, 1)
+	require.Equal(t, legacyPubkey, pairedClients[0].Pubkey)
+	require.Zero(t, pairedClients[0].FirstPaired)
+	require.False(t, pairedClients[0].IsConnected)
+}
@@ -0,0 +1,162 @@
+package noisemanager
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLabelLength is the maximum number of characters of a paired client label.
+const maxLabelLength = 64
+
+// ErrClientNotPaired is returned if no client with the given pubkey is paired.
+var ErrClientNotPaired = errors.New("no client with this pubkey is paired")
+
+// ErrLabelTooLong is returned if a label is longer than maxLabelLength characters.
+var ErrLabelTooLong = errors.New("the label can't be longer than 64 characters")
+
+// PairedClient holds information about a client paired with the middleware. The timestamps are unix timestamps in seconds.
+// They are zero if unknown, e.g. for clients paired before they were recorded.
+type PairedClient struct {
+	Pubkey      []byte
+	Label       string
+	FirstPaired int64
+	LastSeen    int64
+	IsConnected bool
+}
+
+// Revoked returns a channel, which is closed if the pairing of the client is revoked.
+// The connection to the client should then be closed.
+func (session *NoiseSession) Revoked() <-chan struct{} {
+	return session.revoked
+}
+
+func (session *NoiseSession) revoke() {
+	session.revokeOnce.Do(func() { close(session.revoked) })
+}
+
+// registerSession keeps track of an initialized session, so that it can be dropped if the pairing is revoked.
+func (noiseConfig *NoiseConfig) registerSession(session *NoiseSession) {
+	noiseConfig.sessionsMu.Lock()
+	noiseConfig.sessions[session] = struct{}{}
+	noiseConfig.sessionsMu.Unlock()
+	noiseConfig.updateLastSeen(session.clientStaticPubkey)
+}
+
+// RemoveSession stops tracking a session. It should be called once the connection of the session is closed.
+func (noiseConfig *NoiseConfig) RemoveSession(session *NoiseSession) {
+	noiseConfig.sessionsMu.Lock()
+	_, ok := noiseConfig.sessions[session]
+	delete(noiseConfig.sessions, session)
+	noiseConfig.sessionsMu.Unlock()
+	if ok {
+		noiseConfig.updateLastSeen(session.clientStaticPubkey)
+	}
+}
+
+// updateLastSeen sets the last seen timestamp of a paired client to now. Unpaired clients are ignored.
+func (noiseConfig *NoiseConfig) updateLastSeen(pubkey []byte) {
+	noiseConfig.configMu.Lock()
+	defer noiseConfig.configMu.Unlock()
+
+	config := noiseConfig.readConfig()
+	client := config.pairedClient(pubkey)
+	if client == nil {
+		return
+	}
+	client.LastSeen = time.Now().Unix()
+	if err := noiseConfig.storeConfig(config); err != nil {
+		log.Printf("Could not store the last seen timestamp of a paired client: %s", err)
+	}
+}
+
+// isConnected returns true if a client with the given pubkey is currently connected.
+func (noiseConfig *NoiseConfig) isConnected(pubkey []byte) bool {
+	noiseConfig.sessionsMu.Lock()
+	defer noiseConfig.sessionsMu.Unlock()
+
+	for session := range noiseConfig.sessions {
+		if bytes.Equal(session.clientStaticPubkey, pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// PairedClients returns all clients paired with the middleware.
+func (noiseConfig *NoiseConfig) PairedClients() []PairedClient {
+	noiseConfig.configMu.Lock()
+	config := noiseConfig.readConfig()
+	noiseConfig.configMu.Unlock()
+
+	pairedClients := make([]PairedClient, 0, len(config.PairedClients))
+	for _, client := range config.PairedClients {
+		pairedClients = append(pairedClients, PairedClient{
+			Pubkey:      client.Pubkey,
+			Label:       client.Label,
+			FirstPaired: client.FirstPaired,
+			LastSeen:    client.LastSeen,
+			IsConnected: noiseConfig.isConnected(client.Pubkey),
+		})
+	}
+	return pairedClients
+}
+
+// SetPairedClientLabel sets a human readable label for the paired client with the given noise static pubkey.
+// ErrLabelTooLong or ErrClientNotPaired is returned if the label is too long or the client is not paired.
+func (noiseConfig *NoiseConfig) SetPairedClientLabel(pubkey []byte, label string) error {
+	if utf8.RuneCountInString(label) > maxLabelLength {
+		return ErrLabelTooLong
+	}
+
+	noiseConfig.configMu.Lock()
+	defer noiseConfig.configMu.Unlock()
+
+	config := noiseConfig.readConfig()
+	client := config.pairedClient(pubkey)
+	if client == nil {
+		return ErrClientNotPaired
+	}
+	client.Label = label
+	return noiseConfig.storeConfig(config)
+}
+
+// RevokePairedClient removes the pairing of the client with the given noise static pubkey. The connections of the client
+// are dropped immediately and the client needs to be paired again on its next connection. ErrClientNotPaired is returned
+// if the client is not paired.
+func (noiseConfig *NoiseConfig) RevokePairedClient(pubkey []byte) error {
+	noiseConfig.configMu.Lock()
+	config := noiseConfig.readConfig()
+	found := false
+	for i, client := range config.PairedClients {
+		if bytes.Equal(client.Pubkey, pubkey) {
+			config.PairedClients = append(config.PairedClients[:i], config.PairedClients[i+1:]...)
+			found = true
+			break
+		}
+	}
+	var err error
+	if found {
+		err = noiseConfig.storeConfig(config)
+	}
+	noiseConfig.configMu.Unlock()
+
+	if !found {
+		return ErrClientNotPaired
+	}
+	if err != nil {
+		return err
+	}
+
+	noiseConfig.sessionsMu.Lock()
+	for session := range noiseConfig.sessions {
+		if bytes.Equal(session.clientStaticPubkey, pubkey) {
+			session.revoke()
+		}
+	}
+	noiseConfig.sessionsMu.Unlock()
+	log.Printf("Revoked the pairing of the client with the pubkey %x", pubkey)
+	return nil
+}
@@ -18,4 +18,7 @@ const (
 	LightningBlocks             BasePrometheusQuery = "lightning_node_blockheight"
 	ElectrsBlocks               BasePrometheusQuery = "electrs_index_height"
 	LightningActiveChannels     BasePrometheusQuery = "sum(lightning_peer_channels) or vector(0)"
+	FanTemperature              BasePrometheusQuery = "bbbfancontrol_temperature_celsius"
+	FanPWM                      BasePrometheusQuery = "bbbfancontrol_fan_pwm"
+	FanSensorError              BasePrometheusQuery = "bbbfancontrol_sensor_error"
 )
@@ -21,3 +21,38 @@ const (
 	BaseSSHDPasswordLogin BaseRedisKey = "base:sshd:passwordlogin"
 	BitcoindIBDClearnet   BaseRedisKey = "bitcoind:ibd-clearnet"
 )
+
+// Middleware redis keys for the JSON encoded json web token signing keys and revoked tokens.
+const (
+	MiddlewareJWTKeys        BaseRedisKey = "middleware:jwt:keys"
+	MiddlewareJWTRevocations BaseRedisKey = "middleware:jwt:revocations"
+)
+
+// Middleware redis key for the JSON encoded failed authentication attempts per user and client.
+const MiddlewareAuthAttempts BaseRedisKey = "middleware:auth:attempts"
+
+// Middleware redis keys for the JSON encoded event queue and the sequence numbers of the events delivered to each client.
+const (
+	MiddlewareEventQueue      BaseRedisKey = "middleware:events:queue"
+	MiddlewareEventsDelivered BaseRedisKey = "middleware:events:delivered"
+)
+
+// BaseDescriptionCodes is the redis sorted set holding the active HSM heartbeat description codes, e.g.
+// "INITIAL_BLOCK_SYNC", scored by their priority. The code with the highest priority is shown on the HSM.
+const BaseDescriptionCodes BaseRedisKey = "base:descriptioncodes"
+
+// SupervisorState is the redis key for the JSON encoded state of the supervisor, e.g. when the actions of its rules were
+// last executed. All supervisor keys are in the "supervisor:" namespace.
+const SupervisorState BaseRedisKey = "supervisor:state"
+
+// BaseFailedUnits is the redis sorted set holding the systemd units the supervisor stopped, because they exceeded their
+// restart budget. While a unit is failed, the HSM heartbeat is sent with the ERROR state code.
+const BaseFailedUnits BaseRedisKey = "base:failedunits"
+
+// FanProfile is the redis key for the fan control profile, e.g. "silent". bbbfancontrol applies changes of the "fan:"
+// keys live. Besides the profile, single values of it can be overridden, e.g. with "fan:tmin".
+const FanProfile BaseRedisKey = "fan:profile"
+
+// BaseWarnings is the redis sorted set holding the active warnings without a HSM description code, e.g. "CPU_THROTTLED".
+// While a warning is active, the HSM heartbeat is sent with at least the WARNING state code.
+const BaseWarnings BaseRedisKey = "base:warnings"
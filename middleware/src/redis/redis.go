@@ -3,6 +3,7 @@
 package redis
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
@@ -10,6 +11,12 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
+// ErrEmptySortedSet is returned by GetTopFromSortedSet if the sorted set is empty or does not exist.
+var ErrEmptySortedSet = errors.New("the sorted set is empty")
+
+// ErrKeyNotFound is returned by GetString if the key does not exist.
+var ErrKeyNotFound = errors.New("the key does not exist")
+
 // Redis is an interface representing a redis Client
 type Redis interface {
 	ConvertErrorToErrorResponse(error) rpcmessages.ErrorResponse
@@ -20,6 +27,7 @@ type Redis interface {
 	AddToSortedSet(BaseRedisKey, int, string) error
 	RemoveFromSortedSet(BaseRedisKey, string) error
 	GetTopFromSortedSet(BaseRedisKey) (string, error)
+	GetAllFromSortedSet(BaseRedisKey) ([]string, error)
 }
 
 // Client is a redis client
@@ -100,6 +108,9 @@ func (c Client) GetBool(key BaseRedisKey) (val bool, err error) {
 func (c Client) GetString(key BaseRedisKey) (val string, err error) {
 	conn := c.getConnection()
 	val, err = redis.String(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return "", ErrKeyNotFound
+	}
 	if err != nil {
 		return "", fmt.Errorf("could not get key %s as string: %s", key, err.Error())
 	}
@@ -142,13 +153,16 @@ func (c Client) RemoveFromSortedSet(key BaseRedisKey, element string) error {
 }
 
 // GetTopFromSortedSet gets the element with the hightest score from a Redis
-// sorted set.
+// sorted set. ErrEmptySortedSet is returned if the sorted set is empty.
 func (c Client) GetTopFromSortedSet(key BaseRedisKey) (string, error) {
 	conn := c.getConnection()
 	elements, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, 0))
 	if err != nil {
 		return "", fmt.Errorf("could not ZREVRANGE key %s: %w", key, err)
 	}
+	if len(elements) == 0 {
+		return "", ErrEmptySortedSet
+	}
 	// The redis call should only ever return one element for `ZREVRANGE <key> 0 0`
 	if len(elements) != 1 {
 		return "", fmt.Errorf("expected exactly one element, but got %d", len(elements))
@@ -157,6 +171,17 @@ func (c Client) GetTopFromSortedSet(key BaseRedisKey) (string, error) {
 	return elements[0], nil
 }
 
+// GetAllFromSortedSet gets all elements of a Redis sorted set, ordered from the
+// highest to the lowest score. An empty sorted set returns no elements.
+func (c Client) GetAllFromSortedSet(key BaseRedisKey) ([]string, error) {
+	conn := c.getConnection()
+	elements, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, -1))
+	if err != nil {
+		return nil, fmt.Errorf("could not ZREVRANGE key %s: %w", key, err)
+	}
+	return elements, nil
+}
+
 // ConvertErrorToErrorResponse converts an error returned by Redis to an ErrorResponse
 func (c Client) ConvertErrorToErrorResponse(err error) rpcmessages.ErrorResponse {
 	return rpcmessages.ErrorResponse{
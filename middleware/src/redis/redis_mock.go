@@ -1,7 +1,7 @@
 package redis
 
 import (
-	"log"
+	"sort"
 	"strconv"
 
 	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
@@ -10,13 +10,15 @@ import (
 // MockClient is a mock redis client
 type MockClient struct {
 	mockRedisMap map[string]string
+	// mockSortedSets maps the key of a sorted set to its elements and their scores.
+	mockSortedSets map[string]map[string]int
 }
 
 // NewMockClient returns a new redis client.
 // It does not ensure that the client has connectivity.
 func NewMockClient(port string) (mockClient *MockClient) {
 	mockRedisMap := setupTestData()
-	return &MockClient{mockRedisMap: mockRedisMap}
+	return &MockClient{mockRedisMap: mockRedisMap, mockSortedSets: make(map[string]map[string]int)}
 }
 
 // SetString sets a mock value to given key.
@@ -42,22 +44,50 @@ func (mc *MockClient) GetBool(key BaseRedisKey) (val bool, err error) {
 	return valAsInt == 1, err
 }
 
-// AddToSortedSet is a dummy that does nothing but printing the arguments.
+// AddToSortedSet adds an element with the score to a mock sorted set or updates the score of the element.
 func (mc *MockClient) AddToSortedSet(key BaseRedisKey, score int, element string) error {
-	log.Printf("AddToSortedSet dummy: key %q, score %q, element %q", key, score, element)
+	if _, ok := mc.mockSortedSets[string(key)]; !ok {
+		mc.mockSortedSets[string(key)] = make(map[string]int)
+	}
+	mc.mockSortedSets[string(key)][element] = score
 	return nil
 }
 
-// RemoveFromSortedSet is a dummy that does nothing but printing the arguments.
+// RemoveFromSortedSet removes an element from a mock sorted set if present.
 func (mc *MockClient) RemoveFromSortedSet(key BaseRedisKey, element string) error {
-	log.Printf("RemoveFromSortedSet dummy: key %q, element %q", key, element)
+	delete(mc.mockSortedSets[string(key)], element)
 	return nil
 }
 
-// GetTopFromSortedSet is a dummy that does nothing but printing the arguments.
+// GetTopFromSortedSet gets the element with the highest score from a mock sorted set. Like Redis, elements with the
+// same score are ordered lexicographically. ErrEmptySortedSet is returned if the sorted set is empty.
 func (mc *MockClient) GetTopFromSortedSet(key BaseRedisKey) (string, error) {
-	log.Printf("GetTopFromSortedSet dummy: key %q", key)
-	return "dummy mock", nil
+	top, topScore, found := "", 0, false
+	for element, score := range mc.mockSortedSets[string(key)] {
+		if !found || score > topScore || (score == topScore && element > top) {
+			top, topScore, found = element, score, true
+		}
+	}
+	if !found {
+		return "", ErrEmptySortedSet
+	}
+	return top, nil
+}
+
+// GetAllFromSortedSet gets all elements of a mock sorted set, ordered like Redis from the highest to the lowest score.
+func (mc *MockClient) GetAllFromSortedSet(key BaseRedisKey) ([]string, error) {
+	set := mc.mockSortedSets[string(key)]
+	elements := make([]string, 0, len(set))
+	for element := range set {
+		elements = append(elements, element)
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		if set[elements[i]] != set[elements[j]] {
+			return set[elements[i]] > set[elements[j]]
+		}
+		return elements[i] > elements[j]
+	})
+	return elements, nil
 }
 
 // GetString gets an string for a given key.
@@ -7,6 +7,10 @@ type ErrorCode string
 // if the token is invalid.
 const JSONWebTokenInvalid ErrorCode = "JSONWEBTOKEN_INVALID"
 
+// ErrorRoleNotPermitted is thrown when a valid json web token is used for a RPC its user role is not permitted to call.
+// For example a user with the "viewer" role calling an RPC that changes the Base.
+const ErrorRoleNotPermitted ErrorCode = "ROLE_NOT_PERMITTED"
+
 const (
 
 	// ExecutableNotFound is thrown when a executable is not found.
@@ -131,6 +135,12 @@ const (
 
 	// ErrorSetHostnameInvalidValue is thrown if the <value> is an invalid hostname according to this regex '^[a-z][a-z0-9-]{0,22}[a-z0-9]$'.
 	ErrorSetHostnameInvalidValue ErrorCode = "SET_HOSTNAME_INVALID_VALUE"
+
+	/* bbb-config.sh set fan_profile <value>
+	-----------------------------------------*/
+
+	// ErrorSetFanProfileInvalidValue is thrown if the <value> is not a fan control profile, i.e. silent, balanced or performance.
+	ErrorSetFanProfileInvalidValue ErrorCode = "SET_FANPROFILE_INVALID_VALUE"
 )
 
 const (
@@ -155,6 +165,16 @@ const (
 
 	// ErrorAuthenticationUsernameNotFound is thrown if the given username does not exist.
 	ErrorAuthenticationUsernameNotFound ErrorCode = "AUTHENTICATION_USERNAME_NOEXIST"
+
+	// ErrorAuthenticationRateLimited is thrown if the authentication is rejected, because of too many failed attempts of the user or
+	// client. The RetryAfter field of the response holds the number of seconds until the next attempt is allowed.
+	ErrorAuthenticationRateLimited ErrorCode = "AUTHENTICATION_RATE_LIMITED"
+
+	// ErrorLogoutFailed is thrown if the json web token could not be revoked on logout.
+	ErrorLogoutFailed ErrorCode = "LOGOUT_FAILED"
+
+	// ErrorRefreshTokenInvalid is thrown if the refresh token is invalid, expired, already used or issued to another client.
+	ErrorRefreshTokenInvalid ErrorCode = "REFRESH_TOKEN_INVALID"
 )
 
 const (
@@ -164,14 +184,47 @@ const (
 	// ErrorPasswordChangeFailed is thrown if the there is an internal system error with e.g. redis or json parsing
 	ErrorPasswordChangeFailed ErrorCode = "CHANGEPASSWORD_FAILED"
 
-	// ErrorPasswordChangeUsernameNotExist is thrown if the given username does not exist
-	ErrorPasswordChangeUsernameNotExist ErrorCode = "CHANGEPASSWORD_USERNAME_NOEXIST"
-
-	// ErrorPasswordChangePasswordIncorrect is thrown is the given password does not match the bcrypted password from redis
+	// ErrorPasswordChangePasswordIncorrect is thrown if the given username does not exist or the given password does not
+	// match the bcrypted password from redis. Both cases return the same error, so that usernames can't be discovered.
 	ErrorPasswordChangePasswordIncorrect ErrorCode = "CHANGEPASSWORD_PASSWORD_INCORRECT"
 )
 
+const (
+	// ErrorUserInvalidUsername is thrown if the username of a new user is invalid.
+	// Usernames have to match the regex '^[a-z][a-z0-9_-]{0,31}$'.
+	ErrorUserInvalidUsername ErrorCode = "USER_INVALID_USERNAME"
+
+	// ErrorUserInvalidRole is thrown if the role of a new user is neither "admin" nor "viewer".
+	ErrorUserInvalidRole ErrorCode = "USER_INVALID_ROLE"
+
+	// ErrorUserAlreadyExists is thrown if a user with the given username already exists.
+	ErrorUserAlreadyExists ErrorCode = "USER_ALREADY_EXISTS"
+
+	// ErrorUserNotFound is thrown if the user to be deleted does not exist.
+	ErrorUserNotFound ErrorCode = "USER_NOT_FOUND"
+
+	// ErrorUserDeleteLastAdmin is thrown if the last user with the "admin" role would be deleted.
+	ErrorUserDeleteLastAdmin ErrorCode = "USER_DELETE_LAST_ADMIN"
+
+	// ErrorUserStoreFailed is thrown if there is an internal system error with e.g. redis or json parsing while changing the users.
+	ErrorUserStoreFailed ErrorCode = "USER_STORE_FAILED"
+)
+
 const (
 	// ErrorSetLoginPasswordTooShort is thrown if the provided root password is too short.
 	ErrorSetLoginPasswordTooShort ErrorCode = "SET_LOGINPASSWORD_PASSWORD_TOO_SHORT"
 )
+
+const (
+	// ErrorPairedClientInvalidPubkey is thrown if the given noise static pubkey is not a hex encoded 32 byte pubkey.
+	ErrorPairedClientInvalidPubkey ErrorCode = "PAIREDCLIENT_INVALID_PUBKEY"
+
+	// ErrorPairedClientNotFound is thrown if no client with the given noise static pubkey is paired.
+	ErrorPairedClientNotFound ErrorCode = "PAIREDCLIENT_NOT_FOUND"
+
+	// ErrorPairedClientLabelTooLong is thrown if the label for a paired client is too long.
+	ErrorPairedClientLabelTooLong ErrorCode = "PAIREDCLIENT_LABEL_TOO_LONG"
+
+	// ErrorPairedClientStoreFailed is thrown if the paired clients could not be written to the data directory.
+	ErrorPairedClientStoreFailed ErrorCode = "PAIREDCLIENT_STORE_FAILED"
+)
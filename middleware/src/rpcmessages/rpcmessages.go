@@ -18,16 +18,40 @@ const (
 	OpBaseUpdateSuccess = "a"
 	// OpBaseUpdateFailure notifies when the Base image update failed.
 	OpBaseUpdateFailure = "b"
+	// OpServiceStatusChanged notifies when the overall Base status of the GetServiceStatus data changed.
+	OpServiceStatusChanged = "o"
 )
 
+// EventPayloadVersion is the version of the event payload encoding. Clients that enabled event payloads receive events carrying
+// a payload as the opcode, followed by this version byte and the JSON encoded payload.
+const EventPayloadVersion byte = 1
+
 /*
 Put Incoming Args below this line. They should have the format of 'RPC Method Name' + 'Args'.
 */
 
-// UserAuthenticateArgs is an struct that holds the arguments for the UserAuthenticate RPC call
+// UserAuthenticateArgs is an struct that holds the arguments for the UserAuthenticate RPC call.
+// The ClientPubkey is the hex encoded noise static pubkey of the connection. It is set by the rpc server and not by the client.
 type UserAuthenticateArgs struct {
-	Username string
-	Password string
+	Username     string
+	Password     string
+	ClientPubkey string
+}
+
+// RefreshTokenArgs is a struct that holds the arguments for the RefreshToken RPC call.
+// The ClientPubkey is the hex encoded noise static pubkey of the connection. It is set by the rpc server and not by the client.
+type RefreshTokenArgs struct {
+	RefreshToken string
+	ClientPubkey string
+}
+
+// LogoutArgs is a struct that holds the arguments for the Logout RPC call. The RefreshToken is optional and revoked as well, if set.
+// It has to be issued to the user of the Token and the client with the hex encoded noise static pubkey ClientPubkey, which is set by
+// the rpc server and not by the client.
+type LogoutArgs struct {
+	Token        string
+	RefreshToken string
+	ClientPubkey string
 }
 
 // AuthGenericRequest is a struct that acts as a generic request struct
@@ -36,11 +60,27 @@ type AuthGenericRequest struct {
 }
 
 // UserChangePasswordArgs is an struct that holds the arguments for the UserChangePassword RPC call
+// The ClientPubkey is set by the rpcserver to the hex encoded noise static pubkey of the client.
 type UserChangePasswordArgs struct {
-	Username    string
-	Password    string
-	NewPassword string
-	Token       string
+	Username     string
+	Password     string
+	NewPassword  string
+	Token        string
+	ClientPubkey string
+}
+
+// CreateUserArgs is a struct that holds the arguments for the CreateUser RPC call. The Role is either "admin" or "viewer".
+type CreateUserArgs struct {
+	Username string
+	Password string
+	Role     string
+	Token    string
+}
+
+// DeleteUserArgs is a struct that holds the arguments for the DeleteUser RPC call
+type DeleteUserArgs struct {
+	Username string
+	Token    string
 }
 
 // SetHostnameArgs is a struct that holds the to be set hostname
@@ -49,6 +89,12 @@ type SetHostnameArgs struct {
 	Token    string
 }
 
+// SetFanProfileArgs is a struct that holds the to be set fan control profile, e.g. "silent"
+type SetFanProfileArgs struct {
+	Profile string
+	Token   string
+}
+
 // SetLoginPasswordArgs is a struct that holds the to be set login password
 type SetLoginPasswordArgs struct {
 	LoginPassword string
@@ -67,6 +113,19 @@ type UpdateBaseArgs struct {
 	Token   string
 }
 
+// SetPairedClientLabelArgs is a struct that holds the noise static pubkey (hex encoded) of a paired client and the label to be set
+type SetPairedClientLabelArgs struct {
+	Pubkey string
+	Label  string
+	Token  string
+}
+
+// RevokePairedClientArgs is a struct that holds the noise static pubkey (hex encoded) of the paired client to be revoked
+type RevokePairedClientArgs struct {
+	Pubkey string
+	Token  string
+}
+
 /*
 Put Response structs below this line. They should have the format of 'RPC Method Name' + 'Response'.
 */
@@ -78,10 +137,14 @@ type SetupStatusResponse struct {
 	BaseSetup             bool
 }
 
-// UserAuthenticateResponse is the struct that gets sent by the rpc server during a UserAuthenticate call. It contains the session's jwt token.
+// UserAuthenticateResponse is the struct that gets sent by the rpc server during a UserAuthenticate or RefreshToken call.
+// It contains the session's short-lived jwt access token and the long-lived refresh token to get new tokens with.
 type UserAuthenticateResponse struct {
 	ErrorResponse *ErrorResponse
 	Token         string
+	RefreshToken  string
+	// RetryAfter is the number of seconds until the next attempt is allowed, if the error code is AUTHENTICATION_RATE_LIMITED.
+	RetryAfter int
 }
 
 // GetEnvResponse is the struct that gets sent by the rpc server during a GetSystemEnv call
@@ -159,11 +222,96 @@ type GetServiceInfoResponse struct {
 type GetServiceStatusResponse struct {
 	ErrorResponse    *ErrorResponse `json:"errorResponse"`
 	Hostname         string         `json:"hostname"`
-	Status           string         `json:"status"`
+	Status           BaseStatus     `json:"status"`
 	IsTorEnabled     bool           `json:"isTorEnabled"`
 	BitcoindStatus   bool           `json:"isBitcoindListening"`
 	LightningdStatus bool           `json:"lightningdStatus"`
 	ElectrsStatus    bool           `json:"electrsStatus"`
+	// Problems lists the current problems of the Base, which determine the Status together with the setup and sync state.
+	// They are omitted by the unauthenticated GetServiceStatus RPC call.
+	Problems []BaseProblem `json:"problems,omitempty"`
+}
+
+// GetBaseProblemsResponse is the struct that gets sent by the RPC server during a GetBaseProblems RPC call
+type GetBaseProblemsResponse struct {
+	ErrorResponse *ErrorResponse `json:"errorResponse"`
+	Status        BaseStatus     `json:"status"`
+	Problems      []BaseProblem  `json:"problems"`
+}
+
+// GetFanStatusResponse is the struct that gets sent by the RPC server during a GetFanStatus RPC call.
+// The Temperature is in °C and the PWM value of the fan is between 0 (off) and 255 (full speed).
+// SensorError is set if the temperature sensor can't be read. The Temperature is zero then.
+type GetFanStatusResponse struct {
+	ErrorResponse *ErrorResponse `json:"errorResponse"`
+	Profile       string         `json:"profile"`
+	Temperature   float64        `json:"temperature"`
+	PWM           int64          `json:"pwm"`
+	SensorError   bool           `json:"sensorError"`
+}
+
+// BaseStatus is the overall status of the Base
+type BaseStatus string
+
+// The overall statuses of the Base, ordered by their precedence from the highest to the lowest.
+const (
+	// BaseStatusError is set if at least one problem with the error severity exists.
+	BaseStatusError BaseStatus = "error"
+	// BaseStatusSetup is set while the Base setup is not finished.
+	BaseStatusSetup BaseStatus = "setup"
+	// BaseStatusWarning is set if at least one problem with the warning severity exists.
+	BaseStatusWarning BaseStatus = "warning"
+	// BaseStatusSyncing is set during the initial block download of bitcoind.
+	BaseStatusSyncing BaseStatus = "syncing"
+	// BaseStatusOK is set if the Base is set up, synced and has no problems.
+	BaseStatusOK BaseStatus = "ok"
+)
+
+// ProblemSeverity is the severity of a BaseProblem
+type ProblemSeverity string
+
+// The severities of a BaseProblem
+const (
+	ProblemSeverityWarning ProblemSeverity = "warning"
+	ProblemSeverityError   ProblemSeverity = "error"
+)
+
+// BaseProblem is a current problem of the Base returned by the GetBaseProblems RPC call.
+// The Code is machine readable, e.g. SERVICE_INACTIVE or an active HSM heartbeat description code like OUT_OF_DISK_SPACE.
+// The Service is set for problems of a single service, e.g. `bitcoind`.
+type BaseProblem struct {
+	Code     string          `json:"code"`
+	Severity ProblemSeverity `json:"severity"`
+	Service  string          `json:"service,omitempty"`
+	Message  string          `json:"message"`
+}
+
+// UserInfo holds the username and the role of a middleware user
+type UserInfo struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// ListUsersResponse is the struct that gets sent by the RPC server during a ListUsers RPC call
+type ListUsersResponse struct {
+	ErrorResponse *ErrorResponse `json:"errorResponse"`
+	Users         []UserInfo     `json:"users"`
+}
+
+// PairedClient holds information about a client paired with the Base over noise.
+// The timestamps are unix timestamps in seconds. They are zero if unknown, e.g. for clients paired before they were recorded.
+type PairedClient struct {
+	Pubkey      string `json:"pubkey"` // hex encoded noise static pubkey
+	Label       string `json:"label"`
+	FirstPaired int64  `json:"firstPaired"`
+	LastSeen    int64  `json:"lastSeen"`
+	IsConnected bool   `json:"isConnected"`
+}
+
+// ListPairedClientsResponse is the struct that gets sent by the RPC server during a ListPairedClients RPC call
+type ListPairedClientsResponse struct {
+	ErrorResponse *ErrorResponse `json:"errorResponse"`
+	PairedClients []PairedClient `json:"pairedClients"`
 }
 
 // ErrorResponse is a generic RPC response indicating if a RPC call was successful or not.
@@ -0,0 +1,204 @@
+package rpcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 error codes, see https://www.jsonrpc.org/specification#error_object
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCInternalError  = -32603
+)
+
+// jsonRPCVersion is the value of the "jsonrpc" member of every request and response.
+const jsonRPCVersion = "2.0"
+
+// jsonRPCServiceName is the name the RPCServer is registered under. A method called without it, e.g. "GetBaseInfo"
+// instead of "RPCServer.GetBaseInfo", is looked up on the RPCServer.
+const jsonRPCServiceName = "RPCServer"
+
+// jsonRPCRequest is a JSON-RPC 2.0 request. The ID is nil for notifications, which are not answered.
+type jsonRPCRequest struct {
+	JSONRPC string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+// jsonRPCError is the error object of a JSON-RPC 2.0 response.
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonRPCResponse is a JSON-RPC 2.0 response. Either Result or Error is set.
+type jsonRPCResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *jsonRPCError    `json:"error,omitempty"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+// jsonRPCCodec implements rpc.ServerCodec for JSON-RPC 2.0. Each websocket message carries exactly one request or
+// response, so the codec reads whole messages from the rpcConn instead of decoding a stream. Batch requests are not supported.
+type jsonRPCCodec struct {
+	conn *rpcConn
+
+	// params holds the params of the request whose header was read last, until its body is read.
+	params json.RawMessage
+
+	// seq is the sequence number of the last request. The net/rpc server uses it to match a response to its request.
+	seq uint64
+	// pending maps the sequence number of a request to its JSON-RPC id. The id is nil for notifications.
+	pending map[uint64]*json.RawMessage
+	// invalidParams holds the sequence numbers of the requests whose params could not be decoded.
+	invalidParams map[uint64]bool
+	mu            sync.Mutex
+}
+
+// newJSONRPCCodec returns a JSON-RPC 2.0 rpc.ServerCodec reading and writing the messages of the rpcConn.
+func newJSONRPCCodec(conn *rpcConn) *jsonRPCCodec {
+	return &jsonRPCCodec{
+		conn:          conn,
+		pending:       make(map[uint64]*json.RawMessage),
+		invalidParams: make(map[uint64]bool),
+	}
+}
+
+// ReadRequestHeader implements rpc.ServerCodec. Malformed requests are answered with an error right away and
+// the next message is read, since the net/rpc server stops serving the connection if reading a header fails.
+func (codec *jsonRPCCodec) ReadRequestHeader(request *rpc.Request) error {
+	for {
+		message := <-codec.conn.readChan
+
+		var jsonRequest jsonRPCRequest
+		if bytes.HasPrefix(bytes.TrimSpace(message), []byte("[")) {
+			codec.writeError(nil, jsonRPCInvalidRequest, "batch requests are not supported")
+			continue
+		}
+		if err := json.Unmarshal(message, &jsonRequest); err != nil {
+			codec.writeError(nil, jsonRPCParseError, "parse error: "+err.Error())
+			continue
+		}
+		if jsonRequest.JSONRPC != jsonRPCVersion || jsonRequest.Method == "" {
+			codec.writeError(jsonRequest.ID, jsonRPCInvalidRequest, "invalid request")
+			continue
+		}
+
+		method := jsonRequest.Method
+		if !strings.Contains(method, ".") {
+			method = jsonRPCServiceName + "." + method
+		}
+
+		codec.mu.Lock()
+		codec.seq++
+		codec.pending[codec.seq] = jsonRequest.ID
+		request.Seq = codec.seq
+		codec.mu.Unlock()
+
+		request.ServiceMethod = method
+		codec.params = jsonRequest.Params
+		return nil
+	}
+}
+
+// ReadRequestBody implements rpc.ServerCodec. The params are either the argument struct, e.g. the fields of
+// rpcmessages.UserAuthenticateArgs, or an array holding it as the only element. They can be omitted for RPCs without arguments.
+func (codec *jsonRPCCodec) ReadRequestBody(body interface{}) error {
+	params := codec.params
+	codec.params = nil
+	if body == nil || len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	err := decodeJSONRPCParams(params, body)
+	if err != nil {
+		codec.mu.Lock()
+		codec.invalidParams[codec.seq] = true
+		codec.mu.Unlock()
+	}
+	return err
+}
+
+// decodeJSONRPCParams decodes the by-name or by-position params of a request into the argument of the RPC.
+func decodeJSONRPCParams(params json.RawMessage, body interface{}) error {
+	if bytes.HasPrefix(bytes.TrimSpace(params), []byte("[")) {
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return err
+		}
+		switch len(positional) {
+		case 0:
+			return nil
+		case 1:
+			params = positional[0]
+		default:
+			return errors.New("expected at most one positional param")
+		}
+	}
+	return json.Unmarshal(params, body)
+}
+
+// WriteResponse implements rpc.ServerCodec. Responses to notifications are dropped.
+func (codec *jsonRPCCodec) WriteResponse(response *rpc.Response, body interface{}) error {
+	codec.mu.Lock()
+	id, ok := codec.pending[response.Seq]
+	invalidParams := codec.invalidParams[response.Seq]
+	delete(codec.pending, response.Seq)
+	delete(codec.invalidParams, response.Seq)
+	codec.mu.Unlock()
+
+	if !ok {
+		return errors.New("invalid sequence number in response")
+	}
+	if id == nil {
+		return nil
+	}
+	if response.Error != "" {
+		code := jsonRPCInternalError
+		switch {
+		case invalidParams:
+			code = jsonRPCInvalidParams
+		case strings.HasPrefix(response.Error, "rpc: can't find"):
+			code = jsonRPCMethodNotFound
+		}
+		return codec.write(jsonRPCResponse{JSONRPC: jsonRPCVersion, Error: &jsonRPCError{Code: code, Message: response.Error}, ID: id})
+	}
+	return codec.write(jsonRPCResponse{JSONRPC: jsonRPCVersion, Result: body, ID: id})
+}
+
+// writeError sends an error response for a request that is not passed on to the net/rpc server.
+func (codec *jsonRPCCodec) writeError(id *json.RawMessage, code int, message string) {
+	log.Printf("Received an invalid JSON-RPC request: %s", message)
+	err := codec.write(jsonRPCResponse{JSONRPC: jsonRPCVersion, Error: &jsonRPCError{Code: code, Message: message}, ID: id})
+	if err != nil {
+		log.Printf("Failed to write the JSON-RPC error response: %s", err)
+	}
+}
+
+// write encodes the response and sends it as a single message over the rpcConn.
+func (codec *jsonRPCCodec) write(response jsonRPCResponse) error {
+	if response.ID == nil {
+		null := json.RawMessage("null")
+		response.ID = &null
+	}
+	message, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = codec.conn.Write(message)
+	return err
+}
+
+// Close implements rpc.ServerCodec.
+func (codec *jsonRPCCodec) Close() error {
+	return codec.conn.Close()
+}
@@ -0,0 +1,97 @@
+package rpcserver_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
+	rpcserver "github.com/digitalbitbox/bitbox-base/middleware/src/rpcserver"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcserver/mocks"
+
+	"github.com/stretchr/testify/require"
+)
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	ID json.RawMessage `json:"id"`
+}
+
+func TestJSONRPC(t *testing.T) {
+	middlewareMock := &mocks.Middleware{}
+	middlewareMock.On("ValidateToken", "token").Return(nil)
+	middlewareMock.On("GetBaseInfo").Return(rpcmessages.GetBaseInfoResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		BaseVersion:   "0.0.1",
+	})
+	middlewareMock.On("UserAuthenticate", rpcmessages.UserAuthenticateArgs{Username: "admin", Password: "ICanHasPasword?", ClientPubkey: "aabb"}).Return(
+		rpcmessages.UserAuthenticateResponse{ErrorResponse: &rpcmessages.ErrorResponse{Success: true}, Token: "token"},
+	)
+
+	server := rpcserver.NewRPCServer(middlewareMock, &mocks.PairingStore{}, []byte{0xaa, 0xbb})
+	go server.ServeJSONRPC()
+
+	call := func(request string) jsonRPCResponse {
+		server.RPCConnection.ReadChan() <- []byte(request)
+		message := <-server.RPCConnection.WriteChan()
+		require.Equal(t, rpcmessages.OpRPCCall, string(message[:1]))
+		var response jsonRPCResponse
+		require.NoError(t, json.Unmarshal(message[1:], &response))
+		require.Equal(t, "2.0", response.JSONRPC)
+		return response
+	}
+
+	// params by name
+	response := call(`{"jsonrpc":"2.0","method":"UserAuthenticate","params":{"Username":"admin","Password":"ICanHasPasword?"},"id":1}`)
+	require.Nil(t, response.Error)
+	require.Equal(t, "1", string(response.ID))
+	var authResponse rpcmessages.UserAuthenticateResponse
+	require.NoError(t, json.Unmarshal(response.Result, &authResponse))
+	require.True(t, authResponse.ErrorResponse.Success)
+	require.Equal(t, "token", authResponse.Token)
+
+	// params by position with the service name
+	response = call(`{"jsonrpc":"2.0","method":"RPCServer.GetBaseInfo","params":[{"Token":"token"}],"id":"two"}`)
+	require.Nil(t, response.Error)
+	require.Equal(t, `"two"`, string(response.ID))
+	var baseInfo rpcmessages.GetBaseInfoResponse
+	require.NoError(t, json.Unmarshal(response.Result, &baseInfo))
+	require.Equal(t, "0.0.1", baseInfo.BaseVersion)
+
+	// notifications are not answered, the next response belongs to the next request
+	server.RPCConnection.ReadChan() <- []byte(`{"jsonrpc":"2.0","method":"GetBaseInfo","params":{"Token":"token"}}`)
+	response = call(`{"jsonrpc":"2.0","method":"GetBaseInfo","params":{"Token":"token"},"id":3}`)
+	require.Equal(t, "3", string(response.ID))
+
+	response = call(`{"jsonrpc":"2.0","method":"DoesNotExist","id":4}`)
+	require.Equal(t, -32601, response.Error.Code)
+	require.Equal(t, "4", string(response.ID))
+
+	response = call(`{"jsonrpc":"2.0","method":"GetBaseInfo","params":{"Token":1},"id":5}`)
+	require.Equal(t, -32602, response.Error.Code)
+	require.Equal(t, "5", string(response.ID))
+
+	response = call(`{"jsonrpc":"2.0","method":"GetBaseInfo","params":[{"Token":"token"},{}],"id":6}`)
+	require.Equal(t, -32602, response.Error.Code)
+
+	response = call(`{"method":"GetBaseInfo","id":7}`)
+	require.Equal(t, -32600, response.Error.Code)
+	require.Equal(t, "7", string(response.ID))
+
+	response = call(`[{"jsonrpc":"2.0","method":"GetBaseInfo","id":8}]`)
+	require.Equal(t, -32600, response.Error.Code)
+	require.Equal(t, "null", string(response.ID))
+
+	response = call(`{"jsonrpc":"2.0",`)
+	require.Equal(t, -32700, response.Error.Code)
+	require.Equal(t, "null", string(response.ID))
+
+	// the connection is still served after the invalid requests
+	response = call(`{"jsonrpc":"2.0","method":"GetBaseInfo","params":{"Token":"token"},"id":9}`)
+	require.Nil(t, response.Error)
+	require.Equal(t, "9", string(response.ID))
+}
@@ -40,6 +40,34 @@ func (_m *Middleware) BackupSysconfig() rpcmessages.ErrorResponse {
 	return r0
 }
 
+// CreateUser provides a mock function with given fields: _a0
+func (_m *Middleware) CreateUser(_a0 rpcmessages.CreateUserArgs) rpcmessages.ErrorResponse {
+	ret := _m.Called(_a0)
+
+	var r0 rpcmessages.ErrorResponse
+	if rf, ok := ret.Get(0).(func(rpcmessages.CreateUserArgs) rpcmessages.ErrorResponse); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(rpcmessages.ErrorResponse)
+	}
+
+	return r0
+}
+
+// DeleteUser provides a mock function with given fields: _a0
+func (_m *Middleware) DeleteUser(_a0 rpcmessages.DeleteUserArgs) rpcmessages.ErrorResponse {
+	ret := _m.Called(_a0)
+
+	var r0 rpcmessages.ErrorResponse
+	if rf, ok := ret.Get(0).(func(rpcmessages.DeleteUserArgs) rpcmessages.ErrorResponse); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(rpcmessages.ErrorResponse)
+	}
+
+	return r0
+}
+
 // EnableClearnetIBD provides a mock function with given fields: _a0
 func (_m *Middleware) EnableClearnetIBD(_a0 rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse {
 	ret := _m.Called(_a0)
@@ -180,6 +208,20 @@ func (_m *Middleware) GetBaseUpdateProgress() rpcmessages.GetBaseUpdateProgressR
 	return r0
 }
 
+// GetFanStatus provides a mock function with given fields:
+func (_m *Middleware) GetFanStatus() rpcmessages.GetFanStatusResponse {
+	ret := _m.Called()
+
+	var r0 rpcmessages.GetFanStatusResponse
+	if rf, ok := ret.Get(0).(func() rpcmessages.GetFanStatusResponse); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(rpcmessages.GetFanStatusResponse)
+	}
+
+	return r0
+}
+
 // GetServiceInfo provides a mock function with given fields:
 func (_m *Middleware) GetServiceInfo() rpcmessages.GetServiceInfoResponse {
 	ret := _m.Called()
@@ -222,6 +264,34 @@ func (_m *Middleware) IsBaseUpdateAvailable() rpcmessages.IsBaseUpdateAvailableR
 	return r0
 }
 
+// ListUsers provides a mock function with given fields:
+func (_m *Middleware) ListUsers() rpcmessages.ListUsersResponse {
+	ret := _m.Called()
+
+	var r0 rpcmessages.ListUsersResponse
+	if rf, ok := ret.Get(0).(func() rpcmessages.ListUsersResponse); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(rpcmessages.ListUsersResponse)
+	}
+
+	return r0
+}
+
+// Logout provides a mock function with given fields: _a0
+func (_m *Middleware) Logout(_a0 rpcmessages.LogoutArgs) rpcmessages.ErrorResponse {
+	ret := _m.Called(_a0)
+
+	var r0 rpcmessages.ErrorResponse
+	if rf, ok := ret.Get(0).(func(rpcmessages.LogoutArgs) rpcmessages.ErrorResponse); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(rpcmessages.ErrorResponse)
+	}
+
+	return r0
+}
+
 // RebootBase provides a mock function with given fields:
 func (_m *Middleware) RebootBase() rpcmessages.ErrorResponse {
 	ret := _m.Called()
@@ -236,6 +306,20 @@ func (_m *Middleware) RebootBase() rpcmessages.ErrorResponse {
 	return r0
 }
 
+// RefreshToken provides a mock function with given fields: _a0
+func (_m *Middleware) RefreshToken(_a0 rpcmessages.RefreshTokenArgs) rpcmessages.UserAuthenticateResponse {
+	ret := _m.Called(_a0)
+
+	var r0 rpcmessages.UserAuthenticateResponse
+	if rf, ok := ret.Get(0).(func(rpcmessages.RefreshTokenArgs) rpcmessages.UserAuthenticateResponse); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(rpcmessages.UserAuthenticateResponse)
+	}
+
+	return r0
+}
+
 // ReindexBitcoin provides a mock function with given fields:
 func (_m *Middleware) ReindexBitcoin() rpcmessages.ErrorResponse {
 	ret := _m.Called()
@@ -292,6 +376,20 @@ func (_m *Middleware) ResyncBitcoin() rpcmessages.ErrorResponse {
 	return r0
 }
 
+// SetFanProfile provides a mock function with given fields: _a0
+func (_m *Middleware) SetFanProfile(_a0 rpcmessages.SetFanProfileArgs) rpcmessages.ErrorResponse {
+	ret := _m.Called(_a0)
+
+	var r0 rpcmessages.ErrorResponse
+	if rf, ok := ret.Get(0).(func(rpcmessages.SetFanProfileArgs) rpcmessages.ErrorResponse); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(rpcmessages.ErrorResponse)
+	}
+
+	return r0
+}
+
 // SetHostname provides a mock function with given fields: _a0
 func (_m *Middleware) SetHostname(_a0 rpcmessages.SetHostnameArgs) rpcmessages.ErrorResponse {
 	ret := _m.Called(_a0)
@@ -362,6 +460,27 @@ func (_m *Middleware) SystemEnv() rpcmessages.GetEnvResponse {
 	return r0
 }
 
+// TokenUsername provides a mock function with given fields: token
+func (_m *Middleware) TokenUsername(token string) (string, error) {
+	ret := _m.Called(token)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(token)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(token)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // UpdateBase provides a mock function with given fields: _a0
 func (_m *Middleware) UpdateBase(_a0 rpcmessages.UpdateBaseArgs) rpcmessages.ErrorResponse {
 	ret := _m.Called(_a0)
@@ -404,6 +523,20 @@ func (_m *Middleware) UserChangePassword(_a0 rpcmessages.UserChangePasswordArgs)
 	return r0
 }
 
+// ValidateAdminToken provides a mock function with given fields: token
+func (_m *Middleware) ValidateAdminToken(token string) error {
+	ret := _m.Called(token)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(token)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // ValidateToken provides a mock function with given fields: token
 func (_m *Middleware) ValidateToken(token string) error {
 	ret := _m.Called(token)
@@ -1,9 +1,12 @@
 package rpcserver
 
 import (
+	"encoding/hex"
 	"log"
 	"net/rpc"
+	"sync"
 
+	"github.com/digitalbitbox/bitbox-base/middleware/src/authentication"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
 )
 
@@ -55,6 +58,8 @@ type Middleware interface {
 	/* --- RPCs --- */
 	BackupHSMSecret() rpcmessages.ErrorResponse
 	BackupSysconfig() rpcmessages.ErrorResponse
+	CreateUser(rpcmessages.CreateUserArgs) rpcmessages.ErrorResponse
+	DeleteUser(rpcmessages.DeleteUserArgs) rpcmessages.ErrorResponse
 	EnableClearnetIBD(rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse
 	EnableRootLogin(rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse
 	EnableSSHPasswordLogin(rpcmessages.ToggleSettingArgs) rpcmessages.ErrorResponse
@@ -65,14 +70,19 @@ type Middleware interface {
 	FinalizeSetupWizard() rpcmessages.ErrorResponse
 	GetBaseInfo() rpcmessages.GetBaseInfoResponse
 	GetBaseUpdateProgress() rpcmessages.GetBaseUpdateProgressResponse
+	GetFanStatus() rpcmessages.GetFanStatusResponse
 	GetServiceInfo() rpcmessages.GetServiceInfoResponse
 	GetServiceStatus() rpcmessages.GetServiceStatusResponse
 	IsBaseUpdateAvailable() rpcmessages.IsBaseUpdateAvailableResponse
+	ListUsers() rpcmessages.ListUsersResponse
+	Logout(rpcmessages.LogoutArgs) rpcmessages.ErrorResponse
 	RebootBase() rpcmessages.ErrorResponse
+	RefreshToken(rpcmessages.RefreshTokenArgs) rpcmessages.UserAuthenticateResponse
 	ReindexBitcoin() rpcmessages.ErrorResponse
 	RestoreHSMSecret() rpcmessages.ErrorResponse
 	RestoreSysconfig() rpcmessages.ErrorResponse
 	ResyncBitcoin() rpcmessages.ErrorResponse
+	SetFanProfile(rpcmessages.SetFanProfileArgs) rpcmessages.ErrorResponse
 	SetHostname(rpcmessages.SetHostnameArgs) rpcmessages.ErrorResponse
 	SetLoginPassword(rpcmessages.SetLoginPasswordArgs) rpcmessages.ErrorResponse
 	SetupStatus() rpcmessages.SetupStatusResponse
@@ -84,24 +94,47 @@ type Middleware interface {
 	/* --- RPCs end --- */
 
 	/* --- Authentication --- */
+	TokenUsername(token string) (string, error)
 	ValidateToken(token string) error
+	ValidateAdminToken(token string) error
 }
 
-// RPCServer provides rpc calls to the middleware
+// generate mocks for the interface that can be used for testing:
+//go:generate mockery -name PairingStore
+
+// PairingStore provides an interface to the store of clients paired over noise.
+type PairingStore interface {
+	ListPairedClients() rpcmessages.ListPairedClientsResponse
+	RevokePairedClient(rpcmessages.RevokePairedClientArgs) rpcmessages.ErrorResponse
+	SetPairedClientLabel(rpcmessages.SetPairedClientLabelArgs) rpcmessages.ErrorResponse
+}
+
+// RPCServer provides rpc calls to the middleware. Each connection has its own RPCServer.
 type RPCServer struct {
 	middleware    Middleware
+	pairingStore  PairingStore
 	RPCConnection *rpcConn
+	rpcServer     *rpc.Server
+	// clientPubkey is the hex encoded noise static pubkey of the client connected to this server.
+	clientPubkey string
+
+	// eventPayloadsEnabled is set if the client opted in to receive the events with their payloads.
+	eventPayloadsEnabled bool
+	eventPayloadsMu      sync.Mutex
 }
 
-// NewRPCServer returns a new RPCServer
-func NewRPCServer(middleware Middleware) *RPCServer {
+// NewRPCServer returns a new RPCServer for the connection of the client with the given noise static pubkey.
+func NewRPCServer(middleware Middleware, pairingStore PairingStore, clientPubkey []byte) *RPCServer {
 	server := &RPCServer{
-		middleware: middleware,
+		middleware:   middleware,
+		pairingStore: pairingStore,
+		clientPubkey: hex.EncodeToString(clientPubkey),
 
 		//RPCConnection accepts an io.ReadWriteCloser interface from newRPCConn()
 		RPCConnection: newRPCConn(),
+		rpcServer:     rpc.NewServer(),
 	}
-	err := rpc.Register(server)
+	err := server.rpcServer.Register(server)
 	if err != nil {
 		log.Println("Unable to register new rpc server")
 	}
@@ -116,10 +149,23 @@ func NewRPCServer(middleware Middleware) *RPCServer {
 // or prints a confusing warning. The arguments and the returned error are only
 // dummies.
 func (server *RPCServer) Serve(dummyArg bool, dummyPointer *bool) error {
-	rpc.ServeConn(server.RPCConnection)
+	server.rpcServer.ServeConn(server.RPCConnection)
 	return nil
 }
 
+// ServeJSONRPC starts a JSON-RPC 2.0 RPC Server for clients that requested it during the noise handshake.
+// The methods and their arguments and replies are the same as for the GOB RPC Server.
+func (server *RPCServer) ServeJSONRPC() {
+	server.rpcServer.ServeCodec(newJSONRPCCodec(server.RPCConnection))
+}
+
+// EventPayloadsEnabled returns true if the client opted in to receive the events with their payloads.
+func (server *RPCServer) EventPayloadsEnabled() bool {
+	server.eventPayloadsMu.Lock()
+	defer server.eventPayloadsMu.Unlock()
+	return server.eventPayloadsEnabled
+}
+
 func (server *RPCServer) formulateJWTError(name string) rpcmessages.ErrorResponse {
 	log.Printf("received rpc request to %s with invalid json web token", name)
 	return rpcmessages.ErrorResponse{
@@ -129,6 +175,25 @@ func (server *RPCServer) formulateJWTError(name string) rpcmessages.ErrorRespons
 	}
 }
 
+// validateAdminToken validates the token and checks that it belongs to a user with the admin role.
+// It returns nil if the token is valid, otherwise the ErrorResponse to be sent to the client.
+func (server *RPCServer) validateAdminToken(name string, token string) *rpcmessages.ErrorResponse {
+	err := server.middleware.ValidateAdminToken(token)
+	if err == authentication.ErrRoleNotPermitted {
+		log.Printf("received rpc request to %s with a json web token not permitted to call it", name)
+		return &rpcmessages.ErrorResponse{
+			Success: false,
+			Message: "the user role is not permitted to call " + name,
+			Code:    rpcmessages.ErrorRoleNotPermitted,
+		}
+	}
+	if err != nil {
+		errorResponse := server.formulateJWTError(name)
+		return &errorResponse
+	}
+	return nil
+}
+
 // GetSetupStatus send the middleware's setup status as a SetupStatusResponse over rpc.
 func (server *RPCServer) GetSetupStatus(dummyArg bool, reply *rpcmessages.SetupStatusResponse) error {
 	*reply = server.middleware.SetupStatus()
@@ -138,6 +203,23 @@ func (server *RPCServer) GetSetupStatus(dummyArg bool, reply *rpcmessages.SetupS
 
 /* --- Middleware RPCs start here --- */
 
+// EnableEventPayloads opts the connection in to receive the events with their payloads and sends an ErrorResponse over rpc.
+// Older clients, which don't call this RPC, only receive the event opcodes.
+func (server *RPCServer) EnableEventPayloads(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
+	err := server.middleware.ValidateToken(args.Token)
+	if err != nil {
+		*reply = server.formulateJWTError("EnableEventPayloads")
+		return nil
+	}
+
+	server.eventPayloadsMu.Lock()
+	server.eventPayloadsEnabled = true
+	server.eventPayloadsMu.Unlock()
+	*reply = rpcmessages.ErrorResponse{Success: true}
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "EnableEventPayloads", reply)
+	return nil
+}
+
 // GetSystemEnv sends the middleware's GetEnvResponse over rpc
 func (server *RPCServer) GetSystemEnv(args rpcmessages.AuthGenericRequest, reply *rpcmessages.GetEnvResponse) error {
 	err := server.middleware.ValidateToken(args.Token)
@@ -154,9 +236,8 @@ func (server *RPCServer) GetSystemEnv(args rpcmessages.AuthGenericRequest, reply
 
 // ReindexBitcoin sends the middleware's ErrorResponse over rpc
 func (server *RPCServer) ReindexBitcoin(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("ReindexBitcoin")
+	if errorResponse := server.validateAdminToken("ReindexBitcoin", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -167,9 +248,8 @@ func (server *RPCServer) ReindexBitcoin(args rpcmessages.AuthGenericRequest, rep
 
 // ResyncBitcoin sends the middleware's ErrorResponse over rpc
 func (server *RPCServer) ResyncBitcoin(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("ResyncBitcoin")
+	if errorResponse := server.validateAdminToken("ResyncBitcoin", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -180,9 +260,8 @@ func (server *RPCServer) ResyncBitcoin(args rpcmessages.AuthGenericRequest, repl
 
 // BackupSysconfig sends the middleware's ErrorResponse over rpc
 func (server *RPCServer) BackupSysconfig(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("BackupSysconfig")
+	if errorResponse := server.validateAdminToken("BackupSysconfig", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -193,9 +272,8 @@ func (server *RPCServer) BackupSysconfig(args rpcmessages.AuthGenericRequest, re
 
 // BackupHSMSecret sends the middleware's ErrorResponse over rpc
 func (server *RPCServer) BackupHSMSecret(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("BackupHSMSecret")
+	if errorResponse := server.validateAdminToken("BackupHSMSecret", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -206,9 +284,8 @@ func (server *RPCServer) BackupHSMSecret(args rpcmessages.AuthGenericRequest, re
 
 // RestoreSysconfig sends the middleware's ErrorResponse over rpc
 func (server *RPCServer) RestoreSysconfig(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("RestoreSysconfig")
+	if errorResponse := server.validateAdminToken("RestoreSysconfig", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -219,9 +296,8 @@ func (server *RPCServer) RestoreSysconfig(args rpcmessages.AuthGenericRequest, r
 
 // RestoreHSMSecret sends the middleware's ErrorResponse over rpc
 func (server *RPCServer) RestoreHSMSecret(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("RestoreHSMSecret")
+	if errorResponse := server.validateAdminToken("RestoreHSMSecret", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -233,31 +309,65 @@ func (server *RPCServer) RestoreHSMSecret(args rpcmessages.AuthGenericRequest, r
 // UserAuthenticate sends the middleware's ErrorResponse over rpc
 // Args given specify the username and the password
 func (server *RPCServer) UserAuthenticate(args *rpcmessages.UserAuthenticateArgs, reply *rpcmessages.UserAuthenticateResponse) error {
+	args.ClientPubkey = server.clientPubkey
 	*reply = server.middleware.UserAuthenticate(*args)
 	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "UserAuthenticate", reply)
 	return nil
 }
 
+// RefreshToken sends the middleware's UserAuthenticateResponse with new tokens over rpc
+// The refresh token is only accepted from the client it was issued to.
+func (server *RPCServer) RefreshToken(args *rpcmessages.RefreshTokenArgs, reply *rpcmessages.UserAuthenticateResponse) error {
+	args.ClientPubkey = server.clientPubkey
+	*reply = server.middleware.RefreshToken(*args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "RefreshToken", reply)
+	return nil
+}
+
 // UserChangePassword sends the middleware's ErrorResponse over rpc
-// The Arg given specify the username and the new password
+// The Arg given specify the current and the new password. The password of the user the token was issued to is changed,
+// only admins can change the password of another user by specifying the username.
 func (server *RPCServer) UserChangePassword(args *rpcmessages.UserChangePasswordArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
+	tokenUsername, err := server.middleware.TokenUsername(args.Token)
 	if err != nil {
 		*reply = server.formulateJWTError("UserChangePassword")
 		return nil
 	}
+	if args.Username == "" {
+		args.Username = tokenUsername
+	}
+	if args.Username != tokenUsername {
+		if errorResponse := server.validateAdminToken("UserChangePassword", args.Token); errorResponse != nil {
+			*reply = *errorResponse
+			return nil
+		}
+	}
 
+	args.ClientPubkey = server.clientPubkey
 	*reply = server.middleware.UserChangePassword(*args)
 	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "UserChangePassword", reply)
 	return nil
 }
 
+// Logout revokes the passed json web tokens and sends the middleware's ErrorResponse over rpc
+func (server *RPCServer) Logout(args rpcmessages.LogoutArgs, reply *rpcmessages.ErrorResponse) error {
+	err := server.middleware.ValidateToken(args.Token)
+	if err != nil {
+		*reply = server.formulateJWTError("Logout")
+		return nil
+	}
+
+	args.ClientPubkey = server.clientPubkey
+	*reply = server.middleware.Logout(args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "Logout", reply)
+	return nil
+}
+
 // SetHostname sends the middleware's ErrorResponse over rpc
 // The argument given specifies the hostname to be set
 func (server *RPCServer) SetHostname(args *rpcmessages.SetHostnameArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("setHostname")
+	if errorResponse := server.validateAdminToken("SetHostname", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -270,9 +380,8 @@ func (server *RPCServer) SetHostname(args *rpcmessages.SetHostnameArgs, reply *r
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableTor(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableTor")
+	if errorResponse := server.validateAdminToken("EnableTor", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -285,9 +394,8 @@ func (server *RPCServer) EnableTor(args rpcmessages.ToggleSettingArgs, reply *rp
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableTorMiddleware(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableTorMiddleware")
+	if errorResponse := server.validateAdminToken("EnableTorMiddleware", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -300,9 +408,8 @@ func (server *RPCServer) EnableTorMiddleware(args rpcmessages.ToggleSettingArgs,
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableTorElectrs(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableTorElectrs")
+	if errorResponse := server.validateAdminToken("EnableTorElectrs", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -315,9 +422,8 @@ func (server *RPCServer) EnableTorElectrs(args rpcmessages.ToggleSettingArgs, re
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableTorSSH(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableTorSSH")
+	if errorResponse := server.validateAdminToken("EnableTorSSH", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -330,9 +436,8 @@ func (server *RPCServer) EnableTorSSH(args rpcmessages.ToggleSettingArgs, reply
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableClearnetIBD(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableClearnetIBD")
+	if errorResponse := server.validateAdminToken("EnableClearnetIBD", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -344,9 +449,8 @@ func (server *RPCServer) EnableClearnetIBD(args rpcmessages.ToggleSettingArgs, r
 // ShutdownBase sends the middleware's ErrorResponse over rpc
 // The RPC calls the bbb-cmd.sh script which initialtes a `shutdown now`
 func (server *RPCServer) ShutdownBase(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("ShutdownBase")
+	if errorResponse := server.validateAdminToken("ShutdownBase", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -358,9 +462,8 @@ func (server *RPCServer) ShutdownBase(args rpcmessages.AuthGenericRequest, reply
 // RebootBase sends the middleware's ErrorResponse over rpc
 // The RPC calls the bbb-cmd.sh script which initialtes a `reboot`
 func (server *RPCServer) RebootBase(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("RebootBase")
+	if errorResponse := server.validateAdminToken("RebootBase", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -373,9 +476,8 @@ func (server *RPCServer) RebootBase(args rpcmessages.AuthGenericRequest, reply *
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableRootLogin(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableRootLogin")
+	if errorResponse := server.validateAdminToken("EnableRootLogin", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -388,9 +490,8 @@ func (server *RPCServer) EnableRootLogin(args rpcmessages.ToggleSettingArgs, rep
 // The boolean argument passed is used to for enabling and disabling.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) EnableSSHPasswordLogin(args rpcmessages.ToggleSettingArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("EnableSSHPasswordLogin")
+	if errorResponse := server.validateAdminToken("EnableSSHPasswordLogin", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -404,9 +505,8 @@ func (server *RPCServer) EnableSSHPasswordLogin(args rpcmessages.ToggleSettingAr
 // For Unicode passwords the number of unicode chars is counted and not the byte count.
 // It sends the middleware's ErrorResponse over rpc.
 func (server *RPCServer) SetLoginPassword(args rpcmessages.SetLoginPasswordArgs, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		*reply = server.formulateJWTError("SetLoginPassword")
+	if errorResponse := server.validateAdminToken("SetLoginPassword", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -430,6 +530,33 @@ func (server *RPCServer) GetBaseInfo(args rpcmessages.AuthGenericRequest, reply
 	return nil
 }
 
+// GetFanStatus sends the middleware's GetFanStatusResponse over rpc.
+// This includes the fan control profile, the temperature and the fan PWM value.
+func (server *RPCServer) GetFanStatus(args rpcmessages.AuthGenericRequest, reply *rpcmessages.GetFanStatusResponse) error {
+	err := server.middleware.ValidateToken(args.Token)
+	if err != nil {
+		errorResponse := server.formulateJWTError("GetFanStatus")
+		*reply = rpcmessages.GetFanStatusResponse{ErrorResponse: &errorResponse}
+		return nil
+	}
+
+	*reply = server.middleware.GetFanStatus()
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "GetFanStatus", reply)
+	return nil
+}
+
+// SetFanProfile sets the fan control profile, e.g. "silent" for a quiet Base, and sends the middleware's ErrorResponse over rpc.
+func (server *RPCServer) SetFanProfile(args rpcmessages.SetFanProfileArgs, reply *rpcmessages.ErrorResponse) error {
+	if errorResponse := server.validateAdminToken("SetFanProfile", args.Token); errorResponse != nil {
+		*reply = *errorResponse
+		return nil
+	}
+
+	*reply = server.middleware.SetFanProfile(args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "SetFanProfile", reply)
+	return nil
+}
+
 // GetServiceInfo sends the middleware's GetServiceInfoResponse over rpc.
 // This includes information about the Base and the Middleware.
 func (server *RPCServer) GetServiceInfo(args rpcmessages.AuthGenericRequest, reply *rpcmessages.GetServiceInfoResponse) error {
@@ -446,19 +573,37 @@ func (server *RPCServer) GetServiceInfo(args rpcmessages.AuthGenericRequest, rep
 }
 
 // GetServiceStatus sends the middleware's GetServiceStatusResponse over rpc.
-// Warning: This endpoint is not authenticated.
+// Warning: This endpoint is not authenticated, so the problems are omitted. They are sent by GetBaseProblems.
 func (server *RPCServer) GetServiceStatus(dummyArg bool, reply *rpcmessages.GetServiceStatusResponse) error {
 	*reply = server.middleware.GetServiceStatus()
+	reply.Problems = nil
 	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "GetServiceStatus", reply)
 	return nil
 }
 
-// UpdateBase updates the Base image and sends a ErrorResponse over RPC
-func (server *RPCServer) UpdateBase(args rpcmessages.UpdateBaseArgs, reply *rpcmessages.ErrorResponse) error {
+// GetBaseProblems sends the overall Base status and the problems causing it in a GetBaseProblemsResponse over rpc.
+func (server *RPCServer) GetBaseProblems(args rpcmessages.AuthGenericRequest, reply *rpcmessages.GetBaseProblemsResponse) error {
 	err := server.middleware.ValidateToken(args.Token)
 	if err != nil {
-		errorResponse := server.formulateJWTError("UpdateBase")
-		*reply = errorResponse
+		errorResponse := server.formulateJWTError("GetBaseProblems")
+		*reply = rpcmessages.GetBaseProblemsResponse{ErrorResponse: &errorResponse}
+		return nil
+	}
+
+	serviceStatus := server.middleware.GetServiceStatus()
+	*reply = rpcmessages.GetBaseProblemsResponse{
+		ErrorResponse: serviceStatus.ErrorResponse,
+		Status:        serviceStatus.Status,
+		Problems:      serviceStatus.Problems,
+	}
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "GetBaseProblems", reply)
+	return nil
+}
+
+// UpdateBase updates the Base image and sends a ErrorResponse over RPC
+func (server *RPCServer) UpdateBase(args rpcmessages.UpdateBaseArgs, reply *rpcmessages.ErrorResponse) error {
+	if errorResponse := server.validateAdminToken("UpdateBase", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -497,10 +642,8 @@ func (server *RPCServer) IsBaseUpdateAvailable(args rpcmessages.AuthGenericReque
 
 // FinalizeSetupWizard sends an ErrorResponse over RPC
 func (server *RPCServer) FinalizeSetupWizard(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ErrorResponse) error {
-	err := server.middleware.ValidateToken(args.Token)
-	if err != nil {
-		errorResponse := server.formulateJWTError("FinalizeSetupWizard")
-		*reply = errorResponse
+	if errorResponse := server.validateAdminToken("FinalizeSetupWizard", args.Token); errorResponse != nil {
+		*reply = *errorResponse
 		return nil
 	}
 
@@ -510,3 +653,84 @@ func (server *RPCServer) FinalizeSetupWizard(args rpcmessages.AuthGenericRequest
 }
 
 /* --- Middleware RPCs end here --- */
+
+/* --- User management RPCs start here --- */
+
+// CreateUser creates a new middleware user with the role "admin" or "viewer" and sends an ErrorResponse over RPC
+func (server *RPCServer) CreateUser(args rpcmessages.CreateUserArgs, reply *rpcmessages.ErrorResponse) error {
+	if errorResponse := server.validateAdminToken("CreateUser", args.Token); errorResponse != nil {
+		*reply = *errorResponse
+		return nil
+	}
+
+	*reply = server.middleware.CreateUser(args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "CreateUser", reply)
+	return nil
+}
+
+// DeleteUser deletes a middleware user and sends an ErrorResponse over RPC
+func (server *RPCServer) DeleteUser(args rpcmessages.DeleteUserArgs, reply *rpcmessages.ErrorResponse) error {
+	if errorResponse := server.validateAdminToken("DeleteUser", args.Token); errorResponse != nil {
+		*reply = *errorResponse
+		return nil
+	}
+
+	*reply = server.middleware.DeleteUser(args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "DeleteUser", reply)
+	return nil
+}
+
+// ListUsers sends a ListUsersResponse with the usernames and roles of all middleware users over RPC
+func (server *RPCServer) ListUsers(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ListUsersResponse) error {
+	if errorResponse := server.validateAdminToken("ListUsers", args.Token); errorResponse != nil {
+		*reply = rpcmessages.ListUsersResponse{ErrorResponse: errorResponse}
+		return nil
+	}
+
+	*reply = server.middleware.ListUsers()
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "ListUsers", reply)
+	return nil
+}
+
+/* --- User management RPCs end here --- */
+
+/* --- Pairing RPCs start here --- */
+
+// ListPairedClients sends a ListPairedClientsResponse with all clients paired over noise over RPC
+func (server *RPCServer) ListPairedClients(args rpcmessages.AuthGenericRequest, reply *rpcmessages.ListPairedClientsResponse) error {
+	if errorResponse := server.validateAdminToken("ListPairedClients", args.Token); errorResponse != nil {
+		*reply = rpcmessages.ListPairedClientsResponse{ErrorResponse: errorResponse}
+		return nil
+	}
+
+	*reply = server.pairingStore.ListPairedClients()
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "ListPairedClients", reply)
+	return nil
+}
+
+// SetPairedClientLabel sets a human readable label for a paired client and sends an ErrorResponse over RPC
+func (server *RPCServer) SetPairedClientLabel(args rpcmessages.SetPairedClientLabelArgs, reply *rpcmessages.ErrorResponse) error {
+	if errorResponse := server.validateAdminToken("SetPairedClientLabel", args.Token); errorResponse != nil {
+		*reply = *errorResponse
+		return nil
+	}
+
+	*reply = server.pairingStore.SetPairedClientLabel(args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "SetPairedClientLabel", reply)
+	return nil
+}
+
+// RevokePairedClient revokes the pairing of a client and sends an ErrorResponse over RPC.
+// Live connections of the revoked client are dropped.
+func (server *RPCServer) RevokePairedClient(args rpcmessages.RevokePairedClientArgs, reply *rpcmessages.ErrorResponse) error {
+	if errorResponse := server.validateAdminToken("RevokePairedClient", args.Token); errorResponse != nil {
+		*reply = *errorResponse
+		return nil
+	}
+
+	*reply = server.pairingStore.RevokePairedClient(args)
+	log.Printf("RPCServer sent reply for the %q RPC: %+v\n", "RevokePairedClient", reply)
+	return nil
+}
+
+/* --- Pairing RPCs end here --- */
@@ -1,10 +1,12 @@
 package rpcserver_test
 
 import (
+	"errors"
 	"net/rpc"
 	"sync"
 	"testing"
 
+	"github.com/digitalbitbox/bitbox-base/middleware/src/authentication"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
 	rpcserver "github.com/digitalbitbox/bitbox-base/middleware/src/rpcserver"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcserver/mocks"
@@ -42,6 +44,7 @@ type TestingRPCServer struct {
 	client          *rpc.Client
 	rpcServer       *rpcserver.RPCServer
 	middlewareMock  *mocks.Middleware
+	pairingMock     *mocks.PairingStore
 }
 
 func NewTestingRPCServer() TestingRPCServer {
@@ -64,8 +67,9 @@ func NewTestingRPCServer() TestingRPCServer {
 	// The mocks are generated with the following command in rpcserver.go:
 	//go:generate mockery -name Middleware
 	testingRPCServer.middlewareMock = &mocks.Middleware{}
+	testingRPCServer.pairingMock = &mocks.PairingStore{}
 
-	testingRPCServer.rpcServer = rpcserver.NewRPCServer(testingRPCServer.middlewareMock)
+	testingRPCServer.rpcServer = rpcserver.NewRPCServer(testingRPCServer.middlewareMock, testingRPCServer.pairingMock, []byte{0xaa, 0xbb})
 	testingRPCServer.serverWriteChan = testingRPCServer.rpcServer.RPCConnection.WriteChan()
 	testingRPCServer.serverReadChan = testingRPCServer.rpcServer.RPCConnection.ReadChan()
 
@@ -76,7 +80,14 @@ func NewTestingRPCServer() TestingRPCServer {
 	testingRPCServer.client = rpc.NewClient(&rpcConn{readChan: testingRPCServer.clientReadChan, writeChan: testingRPCServer.clientWriteChan})
 
 	// To test the rpcserver, the mocked middleware functions need to accept and return some values.
+	testingRPCServer.middlewareMock.On("TokenUsername", "").Return("admin", nil)
+	testingRPCServer.middlewareMock.On("TokenUsername", "viewer").Return("family", nil)
+	testingRPCServer.middlewareMock.On("TokenUsername", "invalid").Return("", errors.New("invalid jwt token received"))
 	testingRPCServer.middlewareMock.On("ValidateToken", "").Return(nil)
+	testingRPCServer.middlewareMock.On("ValidateToken", "invalid").Return(errors.New("invalid jwt token received"))
+	testingRPCServer.middlewareMock.On("ValidateAdminToken", "").Return(nil)
+	testingRPCServer.middlewareMock.On("ValidateAdminToken", "viewer").Return(authentication.ErrRoleNotPermitted)
+	testingRPCServer.middlewareMock.On("ValidateAdminToken", "invalid").Return(errors.New("invalid jwt token received"))
 	testingRPCServer.middlewareMock.On("SystemEnv").Return(rpcmessages.GetEnvResponse{})
 	testingRPCServer.middlewareMock.On("ResyncBitcoin").Return(rpcmessages.ErrorResponse{Success: true})
 	testingRPCServer.middlewareMock.On("ReindexBitcoin").Return(rpcmessages.ErrorResponse{Success: true})
@@ -95,13 +106,48 @@ func NewTestingRPCServer() TestingRPCServer {
 	testingRPCServer.middlewareMock.On("EnableRootLogin", rpcmessages.ToggleSettingArgs{ToggleSetting: true}).Return(rpcmessages.ErrorResponse{Success: true})
 	testingRPCServer.middlewareMock.On("EnableSSHPasswordLogin", rpcmessages.ToggleSettingArgs{ToggleSetting: true}).Return(rpcmessages.ErrorResponse{Success: true})
 	testingRPCServer.middlewareMock.On("GetBaseInfo").Return(rpcmessages.GetBaseInfoResponse{})
+	testingRPCServer.middlewareMock.On("GetFanStatus").Return(rpcmessages.GetFanStatusResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		Profile:       "balanced",
+		Temperature:   52.5,
+		PWM:           120,
+	})
+	testingRPCServer.middlewareMock.On("GetServiceStatus").Return(rpcmessages.GetServiceStatusResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		Status:        rpcmessages.BaseStatusWarning,
+		Problems: []rpcmessages.BaseProblem{{
+			Code:     "PROMETHEUS_UNREACHABLE",
+			Severity: rpcmessages.ProblemSeverityWarning,
+			Service:  "prometheus",
+			Message:  "connection refused",
+		}},
+	})
+	testingRPCServer.middlewareMock.On("SetFanProfile", rpcmessages.SetFanProfileArgs{Profile: "silent"}).Return(rpcmessages.ErrorResponse{Success: true})
 	testingRPCServer.middlewareMock.On("SetLoginPassword", rpcmessages.SetLoginPasswordArgs{}).Return(rpcmessages.ErrorResponse{Success: true})
-	testingRPCServer.middlewareMock.On("UserAuthenticate", rpcmessages.UserAuthenticateArgs{}).Return(
+	testingRPCServer.middlewareMock.On("UserAuthenticate", rpcmessages.UserAuthenticateArgs{ClientPubkey: "aabb"}).Return(
+		rpcmessages.UserAuthenticateResponse{ErrorResponse: &rpcmessages.ErrorResponse{Success: true}},
+	)
+	testingRPCServer.middlewareMock.On("UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "admin", ClientPubkey: "aabb"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "family", ClientPubkey: "aabb"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "family", Token: "viewer", ClientPubkey: "aabb"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("Logout", rpcmessages.LogoutArgs{ClientPubkey: "aabb"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("RefreshToken", rpcmessages.RefreshTokenArgs{RefreshToken: "refresh", ClientPubkey: "aabb"}).Return(
 		rpcmessages.UserAuthenticateResponse{ErrorResponse: &rpcmessages.ErrorResponse{Success: true}},
 	)
-	testingRPCServer.middlewareMock.On("UserChangePassword", rpcmessages.UserChangePasswordArgs{}).Return(rpcmessages.ErrorResponse{Success: true})
 	testingRPCServer.middlewareMock.On("IsBaseUpdateAvailable").Return(rpcmessages.IsBaseUpdateAvailableResponse{ErrorResponse: &rpcmessages.ErrorResponse{Success: true}})
 	testingRPCServer.middlewareMock.On("FinalizeSetupWizard").Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("CreateUser", rpcmessages.CreateUserArgs{Username: "family", Password: "12345678", Role: "viewer"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("DeleteUser", rpcmessages.DeleteUserArgs{Username: "family"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.middlewareMock.On("ListUsers").Return(rpcmessages.ListUsersResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		Users:         []rpcmessages.UserInfo{{Username: "admin", Role: "admin"}},
+	})
+	testingRPCServer.pairingMock.On("ListPairedClients").Return(rpcmessages.ListPairedClientsResponse{
+		ErrorResponse: &rpcmessages.ErrorResponse{Success: true},
+		PairedClients: []rpcmessages.PairedClient{{Pubkey: "00", Label: "phone"}},
+	})
+	testingRPCServer.pairingMock.On("SetPairedClientLabel", rpcmessages.SetPairedClientLabelArgs{Pubkey: "00", Label: "laptop"}).Return(rpcmessages.ErrorResponse{Success: true})
+	testingRPCServer.pairingMock.On("RevokePairedClient", rpcmessages.RevokePairedClientArgs{Pubkey: "00"}).Return(rpcmessages.ErrorResponse{Success: true})
 
 	return testingRPCServer
 }
@@ -197,15 +243,87 @@ func TestRPCServer(t *testing.T) {
 	testingRPCServer.RunRPCCall(t, "RPCServer.UserAuthenticate", userAuthenticateArg, &userAuthenticateReply)
 	require.Equal(t, true, userAuthenticateReply.ErrorResponse.Success)
 
+	// without a username, the password of the user the token was issued to is changed
 	userChangePasswordArg := rpcmessages.UserChangePasswordArgs{Username: "", NewPassword: ""}
 	var userChangePasswordReply rpcmessages.ErrorResponse
 	testingRPCServer.RunRPCCall(t, "RPCServer.UserChangePassword", userChangePasswordArg, &userChangePasswordReply)
 	require.Equal(t, true, userChangePasswordReply.Success)
 
+	var viewerChangePasswordReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.UserChangePassword", rpcmessages.UserChangePasswordArgs{Token: "viewer"}, &viewerChangePasswordReply)
+	require.Equal(t, true, viewerChangePasswordReply.Success)
+
+	var viewerChangeOwnPasswordReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "family", Token: "viewer"}, &viewerChangeOwnPasswordReply)
+	require.Equal(t, true, viewerChangeOwnPasswordReply.Success)
+
+	// only admins can change the password of another user
+	var adminChangeOtherPasswordReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "family"}, &adminChangeOtherPasswordReply)
+	require.Equal(t, true, adminChangeOtherPasswordReply.Success)
+
+	var viewerChangeOtherPasswordReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "admin", Token: "viewer"}, &viewerChangeOtherPasswordReply)
+	require.Equal(t, false, viewerChangeOtherPasswordReply.Success)
+	require.Equal(t, rpcmessages.ErrorRoleNotPermitted, viewerChangeOtherPasswordReply.Code)
+
+	var invalidChangePasswordReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.UserChangePassword", rpcmessages.UserChangePasswordArgs{Username: "admin", Token: "invalid"}, &invalidChangePasswordReply)
+	require.Equal(t, false, invalidChangePasswordReply.Success)
+	require.Equal(t, rpcmessages.JSONWebTokenInvalid, invalidChangePasswordReply.Code)
+
+	require.False(t, testingRPCServer.rpcServer.EventPayloadsEnabled())
+	var enableEventPayloadsReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.EnableEventPayloads", authArg, &enableEventPayloadsReply)
+	require.Equal(t, true, enableEventPayloadsReply.Success)
+	require.True(t, testingRPCServer.rpcServer.EventPayloadsEnabled())
+
+	var logoutReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.Logout", rpcmessages.LogoutArgs{}, &logoutReply)
+	require.Equal(t, true, logoutReply.Success)
+
+	// the client pubkey is set by the rpc server, a pubkey sent by the client is ignored
+	refreshTokenArg := rpcmessages.RefreshTokenArgs{RefreshToken: "refresh", ClientPubkey: "ccdd"}
+	var refreshTokenReply rpcmessages.UserAuthenticateResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.RefreshToken", refreshTokenArg, &refreshTokenReply)
+	require.Equal(t, true, refreshTokenReply.ErrorResponse.Success)
+
 	var shutdownBaseReply rpcmessages.ErrorResponse
 	testingRPCServer.RunRPCCall(t, "RPCServer.ShutdownBase", authArg, &shutdownBaseReply)
 	require.Equal(t, true, shutdownBaseReply.Success)
 
+	var getFanStatusReply rpcmessages.GetFanStatusResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.GetFanStatus", authArg, &getFanStatusReply)
+	require.Equal(t, true, getFanStatusReply.ErrorResponse.Success)
+	require.Equal(t, "balanced", getFanStatusReply.Profile)
+	require.Equal(t, int64(120), getFanStatusReply.PWM)
+
+	// the unauthenticated GetServiceStatus omits the problems
+	var getServiceStatusReply rpcmessages.GetServiceStatusResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.GetServiceStatus", true, &getServiceStatusReply)
+	require.Equal(t, rpcmessages.BaseStatusWarning, getServiceStatusReply.Status)
+	require.Empty(t, getServiceStatusReply.Problems)
+
+	var getBaseProblemsReply rpcmessages.GetBaseProblemsResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.GetBaseProblems", authArg, &getBaseProblemsReply)
+	require.Equal(t, true, getBaseProblemsReply.ErrorResponse.Success)
+	require.Equal(t, rpcmessages.BaseStatusWarning, getBaseProblemsReply.Status)
+	require.Equal(t, "PROMETHEUS_UNREACHABLE", getBaseProblemsReply.Problems[0].Code)
+
+	var invalidGetBaseProblemsReply rpcmessages.GetBaseProblemsResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.GetBaseProblems", rpcmessages.AuthGenericRequest{Token: "invalid"}, &invalidGetBaseProblemsReply)
+	require.Equal(t, rpcmessages.JSONWebTokenInvalid, invalidGetBaseProblemsReply.ErrorResponse.Code)
+	require.Empty(t, invalidGetBaseProblemsReply.Problems)
+
+	setFanProfileArg := rpcmessages.SetFanProfileArgs{Profile: "silent"}
+	var setFanProfileReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.SetFanProfile", setFanProfileArg, &setFanProfileReply)
+	require.Equal(t, true, setFanProfileReply.Success)
+
+	var viewerSetFanProfileReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.SetFanProfile", rpcmessages.SetFanProfileArgs{Profile: "silent", Token: "viewer"}, &viewerSetFanProfileReply)
+	require.Equal(t, rpcmessages.ErrorRoleNotPermitted, viewerSetFanProfileReply.Code)
+
 	var rebootBaseReply rpcmessages.ErrorResponse
 	testingRPCServer.RunRPCCall(t, "RPCServer.RebootBase", authArg, &rebootBaseReply)
 	require.Equal(t, true, rebootBaseReply.Success)
@@ -214,6 +332,55 @@ func TestRPCServer(t *testing.T) {
 	testingRPCServer.RunRPCCall(t, "RPCServer.IsBaseUpdateAvailable", authArg, &IsBaseUpdateAvailableReply)
 	require.Equal(t, true, IsBaseUpdateAvailableReply.ErrorResponse.Success)
 
+	createUserArg := rpcmessages.CreateUserArgs{Username: "family", Password: "12345678", Role: "viewer"}
+	var createUserReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.CreateUser", createUserArg, &createUserReply)
+	require.Equal(t, true, createUserReply.Success)
+
+	var listUsersReply rpcmessages.ListUsersResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.ListUsers", authArg, &listUsersReply)
+	require.Equal(t, true, listUsersReply.ErrorResponse.Success)
+	require.Equal(t, "admin", listUsersReply.Users[0].Username)
+
+	deleteUserArg := rpcmessages.DeleteUserArgs{Username: "family"}
+	var deleteUserReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.DeleteUser", deleteUserArg, &deleteUserReply)
+	require.Equal(t, true, deleteUserReply.Success)
+
+	// admin only RPCs are rejected for viewer and invalid tokens
+	var viewerRebootBaseReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.RebootBase", rpcmessages.AuthGenericRequest{Token: "viewer"}, &viewerRebootBaseReply)
+	require.Equal(t, false, viewerRebootBaseReply.Success)
+	require.Equal(t, rpcmessages.ErrorRoleNotPermitted, viewerRebootBaseReply.Code)
+
+	var viewerListUsersReply rpcmessages.ListUsersResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.ListUsers", rpcmessages.AuthGenericRequest{Token: "viewer"}, &viewerListUsersReply)
+	require.Equal(t, rpcmessages.ErrorRoleNotPermitted, viewerListUsersReply.ErrorResponse.Code)
+
+	var invalidEnableTorReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.EnableTor", rpcmessages.ToggleSettingArgs{ToggleSetting: true, Token: "invalid"}, &invalidEnableTorReply)
+	require.Equal(t, rpcmessages.JSONWebTokenInvalid, invalidEnableTorReply.Code)
+
+	var listPairedClientsReply rpcmessages.ListPairedClientsResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.ListPairedClients", authArg, &listPairedClientsReply)
+	require.Equal(t, true, listPairedClientsReply.ErrorResponse.Success)
+	require.Equal(t, "phone", listPairedClientsReply.PairedClients[0].Label)
+
+	var viewerListPairedClientsReply rpcmessages.ListPairedClientsResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.ListPairedClients", rpcmessages.AuthGenericRequest{Token: "viewer"}, &viewerListPairedClientsReply)
+	require.Equal(t, rpcmessages.ErrorRoleNotPermitted, viewerListPairedClientsReply.ErrorResponse.Code)
+	require.Empty(t, viewerListPairedClientsReply.PairedClients)
+
+	setPairedClientLabelArg := rpcmessages.SetPairedClientLabelArgs{Pubkey: "00", Label: "laptop"}
+	var setPairedClientLabelReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.SetPairedClientLabel", setPairedClientLabelArg, &setPairedClientLabelReply)
+	require.Equal(t, true, setPairedClientLabelReply.Success)
+
+	revokePairedClientArg := rpcmessages.RevokePairedClientArgs{Pubkey: "00"}
+	var revokePairedClientReply rpcmessages.ErrorResponse
+	testingRPCServer.RunRPCCall(t, "RPCServer.RevokePairedClient", revokePairedClientArg, &revokePairedClientReply)
+	require.Equal(t, true, revokePairedClientReply.Success)
+
 	/*
 		This can't be unit tested until there is a Prometheus mock.
 			var baseInfoReply rpcmessages.GetBaseInfoResponse
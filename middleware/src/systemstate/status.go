@@ -0,0 +1,168 @@
+package systemstate
+
+import (
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+)
+
+// Problem codes of the BaseProblems not derived from a DescriptionCode.
+const (
+	ProblemServiceInactive       = "SERVICE_INACTIVE"
+	ProblemServiceFailed         = "SERVICE_FAILED"
+	ProblemLowDiskSpace          = "LOW_DISK_SPACE"
+	ProblemRedisUnreachable      = "REDIS_UNREACHABLE"
+	ProblemPrometheusUnreachable = "PROMETHEUS_UNREACHABLE"
+)
+
+// The LOW_DISK_SPACE problem is a warning below lowDiskSpaceWarningPercentage and an error below lowDiskSpaceErrorPercentage
+// of free disk space.
+const (
+	lowDiskSpaceWarningPercentage = 10
+	lowDiskSpaceErrorPercentage   = 2
+)
+
+// StatusInputs holds the information the overall Base status is computed from.
+type StatusInputs struct {
+	SetupDone bool
+	// ActiveServices maps the systemd units, e.g. `bitcoind`, to true if they are active.
+	ActiveServices map[string]bool
+	IBD            bool
+	// FreeDiskspace and TotalDiskspace are in byte. The disk space is not checked if TotalDiskspace is zero.
+	FreeDiskspace  int64
+	TotalDiskspace int64
+	// RedisErr and PrometheusErr are set if redis or prometheus could not be queried.
+	RedisErr      error
+	PrometheusErr error
+	// DescriptionCodes are the active DescriptionCodes.
+	DescriptionCodes []messages.BitBoxBaseHeartbeatRequest_DescriptionCode
+	// FailedUnits are the units the supervisor stopped after exceeding their restart budget.
+	FailedUnits []string
+	// Warnings are the active warnings without a DescriptionCode, e.g. WarningCPUThrottled.
+	Warnings []string
+}
+
+// serviceSeverity defines the severity of an inactive service. Services stopped during the initial block download are
+// only checked once it is done.
+var serviceSeverity = []struct {
+	service          string
+	severity         rpcmessages.ProblemSeverity
+	stoppedDuringIBD bool
+}{
+	{"bitcoind", rpcmessages.ProblemSeverityError, false},
+	{"lightningd", rpcmessages.ProblemSeverityWarning, true},
+	{"electrs", rpcmessages.ProblemSeverityWarning, true},
+}
+
+// OverallStatus computes the overall Base status and returns it together with the current problems.
+// Problems with the error severity result in BaseStatusError, regardless of the setup and sync state.
+func OverallStatus(inputs StatusInputs) (rpcmessages.BaseStatus, []rpcmessages.BaseProblem) {
+	problems := []rpcmessages.BaseProblem{}
+
+	if inputs.RedisErr != nil {
+		problems = append(problems, rpcmessages.BaseProblem{
+			Code:     ProblemRedisUnreachable,
+			Severity: rpcmessages.ProblemSeverityError,
+			Service:  "redis",
+			Message:  inputs.RedisErr.Error(),
+		})
+	}
+	if inputs.PrometheusErr != nil {
+		problems = append(problems, rpcmessages.BaseProblem{
+			Code:     ProblemPrometheusUnreachable,
+			Severity: rpcmessages.ProblemSeverityWarning,
+			Service:  "prometheus",
+			Message:  inputs.PrometheusErr.Error(),
+		})
+	}
+
+	ibd := inputs.IBD
+	for _, code := range inputs.DescriptionCodes {
+		if code == messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC {
+			ibd = true
+		}
+	}
+
+	failed := make(map[string]bool, len(inputs.FailedUnits))
+	for _, unit := range inputs.FailedUnits {
+		failed[unit] = true
+		problems = append(problems, rpcmessages.BaseProblem{
+			Code:     ProblemServiceFailed,
+			Severity: rpcmessages.ProblemSeverityError,
+			Service:  unit,
+			Message:  fmt.Sprintf("the service %s was stopped by the supervisor after too many restarts", unit),
+		})
+	}
+
+	if inputs.SetupDone {
+		for _, s := range serviceSeverity {
+			if inputs.ActiveServices[s.service] || (ibd && s.stoppedDuringIBD) || failed[s.service] {
+				continue
+			}
+			problems = append(problems, rpcmessages.BaseProblem{
+				Code:     ProblemServiceInactive,
+				Severity: s.severity,
+				Service:  s.service,
+				Message:  fmt.Sprintf("the service %s is not active", s.service),
+			})
+		}
+	}
+
+	if inputs.TotalDiskspace > 0 {
+		freePercentage := inputs.FreeDiskspace * 100 / inputs.TotalDiskspace
+		if freePercentage < lowDiskSpaceWarningPercentage {
+			severity := rpcmessages.ProblemSeverityWarning
+			if freePercentage < lowDiskSpaceErrorPercentage {
+				severity = rpcmessages.ProblemSeverityError
+			}
+			problems = append(problems, rpcmessages.BaseProblem{
+				Code:     ProblemLowDiskSpace,
+				Severity: severity,
+				Message:  fmt.Sprintf("only %d%% of the disk space are free", freePercentage),
+			})
+		}
+	}
+
+	for _, warning := range inputs.Warnings {
+		problems = append(problems, rpcmessages.BaseProblem{
+			Code:     warning,
+			Severity: rpcmessages.ProblemSeverityWarning,
+			Message:  fmt.Sprintf("the warning %s is active", warning),
+		})
+	}
+
+	for _, code := range inputs.DescriptionCodes {
+		var severity rpcmessages.ProblemSeverity
+		switch MapDescriptionCodeStateCode[code] {
+		case messages.BitBoxBaseHeartbeatRequest_WARNING:
+			severity = rpcmessages.ProblemSeverityWarning
+		case messages.BitBoxBaseHeartbeatRequest_ERROR:
+			severity = rpcmessages.ProblemSeverityError
+		default:
+			continue
+		}
+		problems = append(problems, rpcmessages.BaseProblem{
+			Code:     code.String(),
+			Severity: severity,
+			Message:  fmt.Sprintf("the description code %s is active", code),
+		})
+	}
+
+	hasWarning := false
+	for _, problem := range problems {
+		if problem.Severity == rpcmessages.ProblemSeverityError {
+			return rpcmessages.BaseStatusError, problems
+		}
+		hasWarning = true
+	}
+	switch {
+	case !inputs.SetupDone:
+		return rpcmessages.BaseStatusSetup, problems
+	case hasWarning:
+		return rpcmessages.BaseStatusWarning, problems
+	case ibd:
+		return rpcmessages.BaseStatusSyncing, problems
+	}
+	return rpcmessages.BaseStatusOK, problems
+}
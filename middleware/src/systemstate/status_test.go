@@ -0,0 +1,140 @@
+package systemstate_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/rpcmessages"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+
+	"github.com/stretchr/testify/require"
+)
+
+func allServicesActive() map[string]bool {
+	return map[string]bool{"bitcoind": true, "lightningd": true, "electrs": true}
+}
+
+func TestOverallStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		inputs         systemstate.StatusInputs
+		expectedStatus rpcmessages.BaseStatus
+		expectedCodes  []string
+	}{
+		{
+			name:           "ok",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: allServicesActive(), FreeDiskspace: 50, TotalDiskspace: 100},
+			expectedStatus: rpcmessages.BaseStatusOK,
+		},
+		{
+			name:           "setup ignores inactive services",
+			inputs:         systemstate.StatusInputs{ActiveServices: map[string]bool{}},
+			expectedStatus: rpcmessages.BaseStatusSetup,
+		},
+		{
+			name: "syncing with lightningd and electrs stopped",
+			inputs: systemstate.StatusInputs{
+				SetupDone:      true,
+				ActiveServices: map[string]bool{"bitcoind": true},
+				IBD:            true,
+			},
+			expectedStatus: rpcmessages.BaseStatusSyncing,
+		},
+		{
+			name: "syncing from the description code",
+			inputs: systemstate.StatusInputs{
+				SetupDone:        true,
+				ActiveServices:   allServicesActive(),
+				DescriptionCodes: []messages.BitBoxBaseHeartbeatRequest_DescriptionCode{messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC},
+			},
+			expectedStatus: rpcmessages.BaseStatusSyncing,
+		},
+		{
+			name:           "inactive electrs",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: map[string]bool{"bitcoind": true, "lightningd": true}},
+			expectedStatus: rpcmessages.BaseStatusWarning,
+			expectedCodes:  []string{systemstate.ProblemServiceInactive},
+		},
+		{
+			name:           "electrs stopped by the supervisor",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: map[string]bool{"bitcoind": true, "lightningd": true}, FailedUnits: []string{"electrs"}},
+			expectedStatus: rpcmessages.BaseStatusError,
+			expectedCodes:  []string{systemstate.ProblemServiceFailed},
+		},
+		{
+			name:           "cpu throttled",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: allServicesActive(), Warnings: []string{systemstate.WarningCPUThrottled}},
+			expectedStatus: rpcmessages.BaseStatusWarning,
+			expectedCodes:  []string{systemstate.WarningCPUThrottled},
+		},
+		{
+			name:           "inactive bitcoind",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: map[string]bool{"lightningd": true, "electrs": true}, IBD: true},
+			expectedStatus: rpcmessages.BaseStatusError,
+			expectedCodes:  []string{systemstate.ProblemServiceInactive},
+		},
+		{
+			name:           "low disk space",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: allServicesActive(), FreeDiskspace: 5, TotalDiskspace: 100},
+			expectedStatus: rpcmessages.BaseStatusWarning,
+			expectedCodes:  []string{systemstate.ProblemLowDiskSpace},
+		},
+		{
+			name:           "very low disk space",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: allServicesActive(), FreeDiskspace: 1, TotalDiskspace: 100},
+			expectedStatus: rpcmessages.BaseStatusError,
+			expectedCodes:  []string{systemstate.ProblemLowDiskSpace},
+		},
+		{
+			name:           "redis and prometheus unreachable",
+			inputs:         systemstate.StatusInputs{SetupDone: true, ActiveServices: allServicesActive(), RedisErr: errors.New("redis"), PrometheusErr: errors.New("prometheus")},
+			expectedStatus: rpcmessages.BaseStatusError,
+			expectedCodes:  []string{systemstate.ProblemRedisUnreachable, systemstate.ProblemPrometheusUnreachable},
+		},
+		{
+			name:           "prometheus unreachable during setup",
+			inputs:         systemstate.StatusInputs{PrometheusErr: errors.New("prometheus")},
+			expectedStatus: rpcmessages.BaseStatusSetup,
+			expectedCodes:  []string{systemstate.ProblemPrometheusUnreachable},
+		},
+		{
+			name: "description codes",
+			inputs: systemstate.StatusInputs{
+				SetupDone:      true,
+				ActiveServices: allServicesActive(),
+				DescriptionCodes: []messages.BitBoxBaseHeartbeatRequest_DescriptionCode{
+					messages.BitBoxBaseHeartbeatRequest_UPDATE_FAILED,
+					messages.BitBoxBaseHeartbeatRequest_DOWNLOAD_UPDATE,
+				},
+			},
+			expectedStatus: rpcmessages.BaseStatusWarning,
+			expectedCodes:  []string{"UPDATE_FAILED"},
+		},
+		{
+			name: "error description code",
+			inputs: systemstate.StatusInputs{
+				SetupDone:        true,
+				ActiveServices:   allServicesActive(),
+				DescriptionCodes: []messages.BitBoxBaseHeartbeatRequest_DescriptionCode{messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE},
+			},
+			expectedStatus: rpcmessages.BaseStatusError,
+			expectedCodes:  []string{"OUT_OF_DISK_SPACE"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, problems := systemstate.OverallStatus(test.inputs)
+			require.Equal(t, test.expectedStatus, status)
+			codes := []string{}
+			for _, problem := range problems {
+				codes = append(codes, problem.Code)
+			}
+			if test.expectedCodes == nil {
+				test.expectedCodes = []string{}
+			}
+			require.Equal(t, test.expectedCodes, codes)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Package systemstate defines the Base system states and peripherals of those. The active states are kept in redis by
+// the supervisor and the Middleware, and the one with the highest priority is sent to the HSM with each heartbeat.
+package systemstate
+
+import (
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+)
+
+// MapDescriptionCodePriority defines the priority of the DescriptionCode.
+var MapDescriptionCodePriority = map[messages.BitBoxBaseHeartbeatRequest_DescriptionCode]int{
+	messages.BitBoxBaseHeartbeatRequest_EMPTY:                 0,
+	messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC:    1200,
+	messages.BitBoxBaseHeartbeatRequest_DOWNLOAD_UPDATE:       1400,
+	messages.BitBoxBaseHeartbeatRequest_UPDATE_FAILED:         2300,
+	messages.BitBoxBaseHeartbeatRequest_NO_NETWORK_CONNECTION: 2400,
+	messages.BitBoxBaseHeartbeatRequest_REBOOT:                2500,
+	messages.BitBoxBaseHeartbeatRequest_SHUTDOWN:              2510,
+	messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE:     3400,
+	messages.BitBoxBaseHeartbeatRequest_REDIS_ERROR:           3900,
+}
+
+// MapDescriptionCodeStateCode maps a DescriptionCode to the corresponding StateCode.
+var MapDescriptionCodeStateCode = map[messages.BitBoxBaseHeartbeatRequest_DescriptionCode]messages.BitBoxBaseHeartbeatRequest_StateCode{
+	messages.BitBoxBaseHeartbeatRequest_EMPTY:                 messages.BitBoxBaseHeartbeatRequest_IDLE,
+	messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC:    messages.BitBoxBaseHeartbeatRequest_WORKING,
+	messages.BitBoxBaseHeartbeatRequest_DOWNLOAD_UPDATE:       messages.BitBoxBaseHeartbeatRequest_WORKING,
+	messages.BitBoxBaseHeartbeatRequest_REBOOT:                messages.BitBoxBaseHeartbeatRequest_WARNING,
+	messages.BitBoxBaseHeartbeatRequest_SHUTDOWN:              messages.BitBoxBaseHeartbeatRequest_WARNING,
+	messages.BitBoxBaseHeartbeatRequest_UPDATE_FAILED:         messages.BitBoxBaseHeartbeatRequest_WARNING,
+	messages.BitBoxBaseHeartbeatRequest_NO_NETWORK_CONNECTION: messages.BitBoxBaseHeartbeatRequest_WARNING,
+	messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE:     messages.BitBoxBaseHeartbeatRequest_ERROR,
+	messages.BitBoxBaseHeartbeatRequest_REDIS_ERROR:           messages.BitBoxBaseHeartbeatRequest_ERROR,
+}
+
+// SetDescriptionCode activates the DescriptionCode by adding it with its priority to the redis sorted set of active codes.
+func SetDescriptionCode(redisClient redis.Redis, code messages.BitBoxBaseHeartbeatRequest_DescriptionCode) error {
+	priority, ok := MapDescriptionCodePriority[code]
+	if !ok {
+		return fmt.Errorf("no priority defined for the description code %s", code)
+	}
+	return redisClient.AddToSortedSet(redis.BaseDescriptionCodes, priority, code.String())
+}
+
+// ClearDescriptionCode deactivates the DescriptionCode by removing it from the redis sorted set of active codes.
+func ClearDescriptionCode(redisClient redis.Redis, code messages.BitBoxBaseHeartbeatRequest_DescriptionCode) error {
+	return redisClient.RemoveFromSortedSet(redis.BaseDescriptionCodes, code.String())
+}
+
+// GetTopDescriptionCode returns the active DescriptionCode with the highest priority and its StateCode.
+// If no code is active, EMPTY and IDLE are returned.
+func GetTopDescriptionCode(redisClient redis.Redis) (messages.BitBoxBaseHeartbeatRequest_DescriptionCode, messages.BitBoxBaseHeartbeatRequest_StateCode, error) {
+	element, err := redisClient.GetTopFromSortedSet(redis.BaseDescriptionCodes)
+	if err == redis.ErrEmptySortedSet {
+		return messages.BitBoxBaseHeartbeatRequest_EMPTY, messages.BitBoxBaseHeartbeatRequest_IDLE, nil
+	}
+	if err != nil {
+		return messages.BitBoxBaseHeartbeatRequest_EMPTY, messages.BitBoxBaseHeartbeatRequest_IDLE, err
+	}
+
+	value, ok := messages.BitBoxBaseHeartbeatRequest_DescriptionCode_value[element]
+	if !ok {
+		return messages.BitBoxBaseHeartbeatRequest_EMPTY, messages.BitBoxBaseHeartbeatRequest_IDLE, fmt.Errorf("unknown description code %q", element)
+	}
+	code := messages.BitBoxBaseHeartbeatRequest_DescriptionCode(value)
+	stateCode, ok := MapDescriptionCodeStateCode[code]
+	if !ok {
+		return messages.BitBoxBaseHeartbeatRequest_EMPTY, messages.BitBoxBaseHeartbeatRequest_IDLE, fmt.Errorf("no state code defined for the description code %s", code)
+	}
+	return code, stateCode, nil
+}
+
+// GetActiveDescriptionCodes returns all active DescriptionCodes, ordered from the highest to the lowest priority.
+// Unknown codes are skipped.
+func GetActiveDescriptionCodes(redisClient redis.Redis) ([]messages.BitBoxBaseHeartbeatRequest_DescriptionCode, error) {
+	elements, err := redisClient.GetAllFromSortedSet(redis.BaseDescriptionCodes)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]messages.BitBoxBaseHeartbeatRequest_DescriptionCode, 0, len(elements))
+	for _, element := range elements {
+		value, ok := messages.BitBoxBaseHeartbeatRequest_DescriptionCode_value[element]
+		if !ok {
+			continue
+		}
+		codes = append(codes, messages.BitBoxBaseHeartbeatRequest_DescriptionCode(value))
+	}
+	return codes, nil
+}
+
+// SetUnitFailed marks a systemd unit, e.g. `electrs`, as failed after it has been stopped for exceeding its restart budget.
+func SetUnitFailed(redisClient redis.Redis, unit string) error {
+	return redisClient.AddToSortedSet(redis.BaseFailedUnits, 0, unit)
+}
+
+// ClearUnitFailed removes the failed mark of a systemd unit.
+func ClearUnitFailed(redisClient redis.Redis, unit string) error {
+	return redisClient.RemoveFromSortedSet(redis.BaseFailedUnits, unit)
+}
+
+// GetFailedUnits returns the systemd units marked as failed.
+func GetFailedUnits(redisClient redis.Redis) ([]string, error) {
+	return redisClient.GetAllFromSortedSet(redis.BaseFailedUnits)
+}
+
+// Warnings without a DescriptionCode, set by the supervisor.
+const (
+	WarningCPUThrottled = "CPU_THROTTLED"
+)
+
+// SetWarning activates a warning, e.g. WarningCPUThrottled.
+func SetWarning(redisClient redis.Redis, warning string) error {
+	return redisClient.AddToSortedSet(redis.BaseWarnings, 0, warning)
+}
+
+// ClearWarning deactivates a warning.
+func ClearWarning(redisClient redis.Redis, warning string) error {
+	return redisClient.RemoveFromSortedSet(redis.BaseWarnings, warning)
+}
+
+// GetWarnings returns the active warnings.
+func GetWarnings(redisClient redis.Redis) ([]string, error) {
+	return redisClient.GetAllFromSortedSet(redis.BaseWarnings)
+}
+
+// GetHeartbeatCodes returns the codes sent with the HSM heartbeat. These are the active DescriptionCode with the highest
+// priority and its StateCode. While a unit is failed, the StateCode is ERROR, as there is no DescriptionCode for a
+// failed unit. While a warning is active, the StateCode is at least WARNING.
+func GetHeartbeatCodes(redisClient redis.Redis) (messages.BitBoxBaseHeartbeatRequest_DescriptionCode, messages.BitBoxBaseHeartbeatRequest_StateCode, error) {
+	descriptionCode, stateCode, err := GetTopDescriptionCode(redisClient)
+	if err != nil {
+		return descriptionCode, stateCode, err
+	}
+	failedUnits, err := GetFailedUnits(redisClient)
+	if err != nil {
+		return messages.BitBoxBaseHeartbeatRequest_EMPTY, messages.BitBoxBaseHeartbeatRequest_IDLE, err
+	}
+	warnings, err := GetWarnings(redisClient)
+	if err != nil {
+		return messages.BitBoxBaseHeartbeatRequest_EMPTY, messages.BitBoxBaseHeartbeatRequest_IDLE, err
+	}
+	switch {
+	case len(failedUnits) > 0:
+		stateCode = messages.BitBoxBaseHeartbeatRequest_ERROR
+	case len(warnings) > 0 && stateCode != messages.BitBoxBaseHeartbeatRequest_ERROR:
+		stateCode = messages.BitBoxBaseHeartbeatRequest_WARNING
+	}
+	return descriptionCode, stateCode, nil
+}
@@ -0,0 +1,100 @@
+package systemstate_test
+
+import (
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescriptionCodes(t *testing.T) {
+	redisClient := redis.NewMockClient("")
+
+	descriptionCode, stateCode, err := systemstate.GetTopDescriptionCode(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_EMPTY, descriptionCode)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_IDLE, stateCode)
+
+	require.NoError(t, systemstate.SetDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC))
+	descriptionCode, stateCode, err = systemstate.GetTopDescriptionCode(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC, descriptionCode)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_WORKING, stateCode)
+
+	// the code with the higher priority is shown, regardless of the order it was set in
+	require.NoError(t, systemstate.SetDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE))
+	require.NoError(t, systemstate.SetDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_DOWNLOAD_UPDATE))
+	descriptionCode, stateCode, err = systemstate.GetTopDescriptionCode(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE, descriptionCode)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_ERROR, stateCode)
+
+	require.NoError(t, systemstate.ClearDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE))
+	descriptionCode, _, err = systemstate.GetTopDescriptionCode(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_DOWNLOAD_UPDATE, descriptionCode)
+
+	// clearing a code that is not set is not an error
+	require.NoError(t, systemstate.ClearDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_REBOOT))
+
+	require.NoError(t, redisClient.AddToSortedSet(redis.BaseDescriptionCodes, 10000, "UNKNOWN_CODE"))
+	_, _, err = systemstate.GetTopDescriptionCode(redisClient)
+	require.Error(t, err)
+}
+
+func TestFailedUnits(t *testing.T) {
+	redisClient := redis.NewMockClient("")
+	require.NoError(t, systemstate.SetDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC))
+
+	descriptionCode, stateCode, err := systemstate.GetHeartbeatCodes(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC, descriptionCode)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_WORKING, stateCode)
+
+	require.NoError(t, systemstate.SetUnitFailed(redisClient, "electrs"))
+	failedUnits, err := systemstate.GetFailedUnits(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, []string{"electrs"}, failedUnits)
+
+	// the description code stays, but the state code is raised to ERROR
+	descriptionCode, stateCode, err = systemstate.GetHeartbeatCodes(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC, descriptionCode)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_ERROR, stateCode)
+
+	require.NoError(t, systemstate.ClearUnitFailed(redisClient, "electrs"))
+	_, stateCode, err = systemstate.GetHeartbeatCodes(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_WORKING, stateCode)
+}
+
+func TestWarnings(t *testing.T) {
+	redisClient := redis.NewMockClient("")
+	require.NoError(t, systemstate.SetDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC))
+
+	require.NoError(t, systemstate.SetWarning(redisClient, systemstate.WarningCPUThrottled))
+	warnings, err := systemstate.GetWarnings(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, []string{systemstate.WarningCPUThrottled}, warnings)
+
+	// the description code stays, but the state code is raised to WARNING
+	descriptionCode, stateCode, err := systemstate.GetHeartbeatCodes(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC, descriptionCode)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_WARNING, stateCode)
+
+	// an ERROR state code is not lowered
+	require.NoError(t, systemstate.SetDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE))
+	_, stateCode, err = systemstate.GetHeartbeatCodes(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_ERROR, stateCode)
+	require.NoError(t, systemstate.ClearDescriptionCode(redisClient, messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE))
+
+	require.NoError(t, systemstate.ClearWarning(redisClient, systemstate.WarningCPUThrottled))
+	_, stateCode, err = systemstate.GetHeartbeatCodes(redisClient)
+	require.NoError(t, err)
+	require.Equal(t, messages.BitBoxBaseHeartbeatRequest_WORKING, stateCode)
+}
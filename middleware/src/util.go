@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/digitalbitbox/bitbox-base/middleware/src/authentication"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/handlers"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/prometheus"
 	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
@@ -209,6 +210,17 @@ func (middleware *Middleware) didServiceInfoChange() (changed bool) {
 	return false
 }
 
+// didServiceStatusChange returns the up-to-date GetServiceStatusResponse and true if the overall Base status changed.
+func (middleware *Middleware) didServiceStatusChange() (rpcmessages.GetServiceStatusResponse, bool) {
+	serviceStatus := middleware.GetServiceStatus()
+	if serviceStatus.Status == middleware.baseStatus {
+		return serviceStatus, false
+	}
+	log.Printf("the overall Base status changed from %q to %q, problems: %+v", middleware.baseStatus, serviceStatus.Status, serviceStatus.Problems)
+	middleware.baseStatus = serviceStatus.Status
+	return serviceStatus, true
+}
+
 // getServiceInfo returns a up-to-date GetServiceInfoResponse with information about `bitcoind`, `lightningd` and `electrs`.
 func (middleware *Middleware) getServiceInfo() rpcmessages.GetServiceInfoResponse {
 	bitcoindBlocks, err := middleware.prometheusClient.GetInt(prometheus.BitcoinBlockCount)
@@ -317,12 +329,30 @@ func parseBaseUpdateStdout(outputLine string) (containsUpdateProgressInfo bool,
 	return true, percentage, downloadedKiB
 }
 
+// setBaseUpdateStateAndNotify sets the update state and notifies the connected clients. The progress changes with every
+// downloaded percent, so the event is not queued. A reconnecting client gets the current progress with the GetBaseUpdateProgress RPC.
 func (middleware *Middleware) setBaseUpdateStateAndNotify(state rpcmessages.BaseUpdateState) {
 	middleware.baseUpdateProgress.State = state
-	middleware.events <- handlers.Event{
-		Identifier:      []byte(rpcmessages.OpBaseUpdateProgressChanged),
-		QueueIfNoClient: true,
+	middleware.events <- middleware.newEvent(rpcmessages.OpBaseUpdateProgressChanged, middleware.baseUpdateProgress, false)
+}
+
+// newEvent returns an event with the JSON encoded payload. A nil payload is omitted. If the payload can't be encoded, the event
+// is returned without it, since the clients can still get the data with the corresponding RPC. Queued events are added to the
+// event queue, so that they are delivered exactly once to each client, even if it is not connected right now.
+func (middleware *Middleware) newEvent(identifier string, payload interface{}, queued bool) handlers.Event {
+	event := handlers.Event{Identifier: []byte(identifier)}
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Could not encode the payload of the event %q: %s", identifier, err)
+		} else {
+			event.Payload = payloadBytes
+		}
+	}
+	if queued {
+		event.Seq = middleware.eventQueue.Add(event.Identifier, event.Payload)
 	}
+	return event
 }
 
 // checkMiddlewareSetup checks if the middleware password has been set yet and if the user is done with the base
@@ -357,9 +387,26 @@ func (middleware *Middleware) getAuthStructure() (map[string]UserAuthStruct, err
 		log.Println("Did not receive json from redis's authentication structure")
 		return usersMap, err
 	}
+	for username, user := range usersMap {
+		// users stored before roles were introduced are admins
+		if user.Role == "" {
+			user.Role = authentication.RoleAdmin
+			usersMap[username] = user
+		}
+	}
 	return usersMap, nil
 }
 
+// storeAuthStructure writes the user authentication data map with the username as a key and the UserAuthStruct as a value to redis.
+func (middleware *Middleware) storeAuthStructure(usersMap map[string]UserAuthStruct) error {
+	authStructureString, err := json.Marshal(usersMap)
+	if err != nil {
+		log.Println("Failed marshaling the user data for redis")
+		return err
+	}
+	return middleware.redisClient.SetString(redis.MiddlewareAuth, string(authStructureString))
+}
+
 // getBaseUpdateInfo GETs a JSON file over HTTP which includes information about the update.
 func getBaseUpdateInfo(url string) (updateInfo rpcmessages.UpdateInfo, err error) {
 	client := http.Client{
@@ -23,14 +23,11 @@
 package main
 
 import (
-	"bufio"
-	"errors"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"regexp"
-	"strings"
 
 	"github.com/gomodule/redigo/redis"
 )
@@ -39,6 +36,10 @@ import (
 var (
 	templateArg  = flag.String("template", "", "input template config file")
 	outputArg    = flag.String("output", "", "output config file")
+	manifestArg  = flag.String("manifest", "", "manifest file listing templates to render in one batch, '-' for stdin")
+	jsonArg      = flag.Bool("json", false, "print the output files and whether they changed as JSON")
+	exitCodeArg  = flag.Bool("exit-code", false, "exit with code 2 if any output file changed, 3 if it failed after")
+	strictArg    = flag.Bool("strict", false, "fail if a placeholder is not resolved or has an unknown option")
 	redisAddrArg = flag.String("redis-addr", "localhost:6379", "redis connection address")
 	redisPassArg = flag.String("redis-pass", "", "redis password")
 	redisDbArg   = flag.Int("redis-db", 0, "redis database number")
@@ -47,13 +48,27 @@ var (
 	helpArg      = flag.Bool("help", false, "show help")
 )
 
+// exit codes with --exit-code argument, if any output file changed, and if it failed after output files changed
+const (
+	exitCodeChanged      = 2
+	exitCodeChangedError = 3
+)
+
 // Help text for --help option
 const (
 	helpText = `generates configuration files from a template, substituting placeholders with Redis values
 
+Usage:
+  bbbconfgen [arguments]
+  bbbconfgen lint [--keys file,...] template...
+
 Command-line arguments:
   --template      input template config file
   --output        output config file
+  --manifest      manifest file listing templates to render in one batch, '-' for stdin
+  --json          print the output files and whether they changed as JSON
+  --exit-code     exit with code 2 if any output file changed, 3 if it failed after
+  --strict        fail if a placeholder is not resolved or has an unknown option
   --redis-addr    redis connection address  (default "localhost:6379")
   --redis-db      redis database number     (default 0)
   --redis-pass    redis password
@@ -66,6 +81,17 @@ This line will be dropped and only used if no --output argument is supplied.
 
   {{ #output: /tmp/output.conf }}
 
+With --manifest, multiple templates are rendered from the same Redis values, read at once.
+Each line of the manifest contains a template file, optionally followed by the output file.
+Empty lines and lines starting with '#' are ignored, relative paths are relative to the manifest.
+
+  /opt/shift/config/templates/bitcoin.conf.template
+  torrc.template  /etc/tor/torrc
+
+Output files are replaced atomically and keep their mode and owner. Unchanged files are not written.
+Whether output files changed is reported with --json, also after an error, or --exit-code (0: unchanged, 1: error,
+2: changed, 3: error after output files changed).
+
 Placeholders in the template file are defined as follows.
 Make sure to respect spaces between arguments.
 
@@ -79,6 +105,43 @@ The #rmLineTrue and #rmLineFalse functions allows to drop a line conditionally.
   {{ key #rmLineTrue }}         drop line if a key is set to '1', 'true', 'yes' or 'y'
   {{ key #rmLineFalse }}        drop line if a key is set to '0', 'false', 'no', 'n' or not at all
 
+Filters transform the value, separated by ' | ' after the key and applied in order.
+Filters are applied to the Redis value and to the default value.
+
+  {{ key | quote }}             puts the value in double quotes, escaping special characters
+  {{ key | lower }}             converts the value to lower case
+  {{ key | int }}               aborts if the value is not an integer
+  {{ key | int 1 65535 }}       ...or if it is not within the range 1 to 65535
+  {{ key | lower | quote #default: Some Val }}
+
+Blocks span multiple lines, each directive must be on its own line. Blocks can be nested.
+
+  {{ #if key }}                 keeps the following lines if a key is not set to '0', 'false', 'no', 'n' or not at all
+  {{ #if !key }}                ...if a key is set to '0', 'false', 'no', 'n' or not at all
+  {{ #if key == some val }}     ...if a key is set to 'some val'
+  {{ #if key != some val }}     ...if a key is not set to 'some val'
+  {{ #else }}                   keeps the following lines otherwise (optional)
+  {{ #end }}
+
+  {{ #range key }}              repeats the following lines for each element of a Redis list, set or hash
+  {{ .value }}                  ...is replaced by the element, or the value of a hash field
+  {{ .key }}                    ...is replaced by the name of a hash field
+  {{ .index }}                  ...is replaced by the position of the element, starting at 0
+  {{ #end }}
+
+Lists are iterated in order, sets and hashes sorted by member or field name.
+Within nested blocks, .value, .key and .index refer to the innermost #range.
+
+The lint subcommand checks templates without connecting to Redis, for unbalanced blocks,
+malformed placeholders, unknown options and filters, and invalid default values.
+With --keys, it also reports Redis keys that are not listed in one of the comma-separated key manifests:
+Go files with string constants, like middleware/src/redis/keys.go, or text files with one key or
+Redis command per line, like armbian/base/config/redis/factorysettings.txt.
+The Base templates are checked with these two and tools/bbbconfgen/optional-keys.txt, listing the
+optional keys that are not set by default. It exits with code 1 if any problems are found.
+
+  bbbconfgen lint --keys middleware/src/redis/keys.go,armbian/base/config/redis/factorysettings.txt,tools/bbbconfgen/optional-keys.txt armbian/base/config/templates/*.template
+
 `
 )
 
@@ -92,13 +155,21 @@ func initialize(versionNum float64) {
 	if *versionArg || *helpArg {
 		log.Println("bbbconfgen version", versionNum)
 		if *helpArg {
-			fmt.Println(helpText)
+			fmt.Print(helpText)
 		}
 		os.Exit(0)
 	}
 
-	if len(*templateArg) == 0 {
-		log.Fatalln("No input template file specified using --template argument.")
+	// lint subcommand checks templates offline, without connecting to Redis
+	if flag.Arg(0) == "lint" {
+		os.Exit(lint(flag.Args()[1:]))
+	}
+
+	if len(*templateArg) == 0 && len(*manifestArg) == 0 {
+		log.Fatalln("No input template file specified using --template or --manifest argument.")
+	}
+	if len(*manifestArg) > 0 && (len(*templateArg) > 0 || len(*outputArg) > 0) {
+		log.Fatalln("The --manifest argument cannot be combined with --template or --output.")
 	}
 }
 
@@ -117,178 +188,11 @@ func connectRedis() (r redis.Conn, err error) {
 	return r, err
 }
 
-// open template configuration file
-func openTemplateFile() (fp *os.File, err error) {
-	fp, err = os.Open(*templateArg)
-	return
-}
-
-// open output file, path provided either by cli or read it from template file
-func openOutputFile() (filepointer *os.File, filename string, err error) {
-
-	if len(*outputArg) > 0 {
-		filename = *outputArg
-
-	} else {
-		// if no cli outputFile provided,
-		templateFile, err := os.Open(*templateArg)
-		if err != nil {
-			return nil, "", errors.New("cannot open templateFile " + *templateArg)
-		}
-		defer templateFile.Close()
-
-		// match outputFile pattern, e.g. {{ #output: /tmp/output.txt }}
-		outputFilePattern := regexp.MustCompile("{{[ ]{0,}#output: (.+?)}}")
-
-		// read first line and extract outputFile pattern
-		scannerOutputFile := bufio.NewScanner(templateFile)
-		scannerOutputFile.Scan()
-		firstLine := scannerOutputFile.Text()
-		firstLineGroups := outputFilePattern.FindStringSubmatch(firstLine)
-
-		// if successful, use it as *outputArg, otherwise abort
-		if len(firstLineGroups) > 0 && len(firstLineGroups[1]) > 0 {
-			filename = strings.Trim(firstLineGroups[1], " ")
-		} else {
-			return nil, "", errors.New("no output file specified, specify either --output argument or within template")
-		}
-	}
-
-	filepointer, err = os.Create(filename)
-	if err != nil {
-		return nil, "", errors.New("cannot create outputFile " + filename)
-	}
-	return
-}
-
-// parse template config file and replace placeholders with Redis values
-// also, count number of replacements
-func parseTemplate(redisConn redis.Conn, templateFile *os.File, outputFile *os.File) (err error) {
-
-	var (
-		countLines      int
-		countReplace    int
-		countKeep       int
-		countRm         int
-		countRmLine     int
-		countCheckTrue  int
-		countCheckFalse int
-		countDefault    int
-	)
-
-	// Read template file line by line
-	scanner := bufio.NewScanner(templateFile)
-	placeholderPattern := regexp.MustCompile("{{(.+?)}}")
-
-	for scanner.Scan() {
-		var (
-			outputLine   string     // current line of template file that will be written to outputFile
-			placeholders [][]string // contains placeholders of a single line, each with a key and optionally a fallback part
-			printLine    = true     // print line if true, set to 'false' when fallback is #rmLine
-		)
-
-		outputLine = scanner.Text()
-		placeholders = placeholderPattern.FindAllStringSubmatch(outputLine, -1)
-
-		// replace individual placeholder
-		for i := range placeholders {
-			var (
-				placeholder       string   // current placeholder
-				placeholderFields []string // individual fields of placeholder, separated by a space (" ")
-				redisKey          string   // Redis key of a placeholder
-				redisVal          string   // value fetched from Redis for a placeholder
-				option            string   // option like #rm or #rmLineTrue
-			)
-
-			// Redis GET
-			placeholder = placeholders[i][0]
-			placeholderFields = strings.Fields(placeholders[i][1])
-			redisKey = placeholderFields[0]
-
-			// skip line with outputFile specifier
-			if strings.ToLower(redisKey) == "#output:" {
-				printLine = false
-				break
-			}
-
-			// get placeholder option, if present
-			if len(placeholderFields) > 1 {
-				option = placeholderFields[1]
-			}
-
-			redisVal, _ = redis.String(redisConn.Do("GET", redisKey))
-
-			if option == "#check" || option == "#rmLineFalse" {
-				// if key value is 'false' or empty, drop line
-				if redisVal == "0" || strings.EqualFold(redisVal, "false") || strings.EqualFold(redisVal, "no") || strings.EqualFold(redisVal, "n") || len(redisVal) == 0 {
-					printLine = false
-					countCheckFalse++
-				} else {
-					outputLine = strings.Replace(outputLine, placeholder, "", -1)
-					countCheckTrue++
-				}
-
-			} else if option == "#rmLineTrue" {
-				// if key value is 'true', drop line
-				if redisVal == "1" || strings.EqualFold(redisVal, "true") || strings.EqualFold(redisVal, "yes") || strings.EqualFold(redisVal, "y") {
-					printLine = false
-					countCheckFalse++
-				} else {
-					outputLine = strings.Replace(outputLine, placeholder, "", -1)
-					countCheckTrue++
-				}
-
-			} else if len(redisVal) > 0 {
-				// replace placeholder if Redis key is found
-				outputLine = strings.Replace(outputLine, placeholder, redisVal, -1)
-				countReplace++
-
-			} else {
-				// if specified, use fallback options if Redis key is not found
-				switch strings.ToLower(option) {
-				case "#rm":
-					outputLine = strings.Replace(outputLine, placeholder, "", -1)
-					countRm++
-				case "#rmline":
-					printLine = false
-					countRmLine++
-				case "#default:":
-					defaultValue := strings.Join(placeholderFields[2:], " ")
-					outputLine = strings.Replace(outputLine, placeholder, defaultValue, -1)
-					countDefault++
-				default:
-					countKeep++
-				}
-			}
-		}
-
-		// write processed line to outputFile
-		if printLine {
-			fmt.Fprintln(outputFile, outputLine)
-			countLines++
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-
-	if !*quietArg {
-		log.Printf("written %v lines\n", countLines)
-		log.Printf("placeholders: %v replaced, %v kept, %v deleted, %v lines deleted, %v set to default\n", countReplace, countKeep, countRm, countRmLine, countDefault)
-		log.Printf("checks: %v lines dropped, %v lines kept\n\n", countCheckFalse, countCheckTrue)
-	}
-	return nil
-
-}
-
 func main() {
 	var (
-		versionNum = 1.0
+		versionNum = 1.3
 		redisConn  redis.Conn
+		jobs       []*job
 		err        error
 	)
 
@@ -305,30 +209,48 @@ func main() {
 		log.Println("connected to Redis")
 	}
 
-	// open template file
-	templateFile, err := openTemplateFile()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer templateFile.Close()
-	if !*quietArg {
-		log.Println("opened template config file", *templateArg)
+	// templates to render, either from manifest or a single template from cli
+	if len(*manifestArg) > 0 {
+		jobs, err = readManifest(*manifestArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !*quietArg {
+			log.Printf("read %v templates from manifest %v\n", len(jobs), *manifestArg)
+		}
+	} else {
+		jobs = []*job{{Template: *templateArg, Output: *outputArg}}
 	}
 
-	// open outputFile, either from cli or from template file
-	outputFile, outputFilename, err := openOutputFile()
-	if err != nil {
-		log.Fatal(err)
+	// render templates and write output files, the changed ones are reported even if a later one failed
+	generateErr := generateFiles(redisConn, jobs)
+
+	changed := false
+	for _, j := range jobs {
+		changed = changed || j.Changed
 	}
-	defer outputFile.Close()
-	if !*quietArg {
-		log.Println("writing into output file", outputFilename)
+
+	if *jsonArg {
+		result := struct {
+			Changed bool   `json:"changed"`
+			Files   []*job `json:"files"`
+		}{changed, jobs}
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// parse temlateFile
-	err = parseTemplate(redisConn, templateFile, outputFile)
-	if err != nil {
-		log.Fatal(err)
+	if generateErr != nil {
+		log.Print(generateErr)
+		redisConn.Close()
+		if *exitCodeArg && changed {
+			os.Exit(exitCodeChangedError)
+		}
+		os.Exit(1)
 	}
 
+	if *exitCodeArg && changed {
+		redisConn.Close()
+		os.Exit(exitCodeChanged)
+	}
 }
@@ -0,0 +1,625 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var update = flag.Bool("update", false, "update the reference files in test/")
+
+// fakeRedis is an in-memory redis.Conn, supporting the commands used by bbbconfgen
+type fakeRedis struct {
+	strings map[string]string
+	lists   map[string][]string
+	sets    map[string]map[string]bool
+	hashes  map[string]map[string]string
+
+	queue [][]interface{} // commands queued with MULTI
+	execs int             // number of transactions
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: map[string]string{},
+		lists:   map[string][]string{},
+		sets:    map[string]map[string]bool{},
+		hashes:  map[string]map[string]string{},
+	}
+}
+
+// importFile runs the commands of a Redis mass insertion file, as used with `redis-cli --pipe`
+func (f *fakeRedis) importFile(t *testing.T, filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	readLine := func(prefix string) string {
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, prefix) {
+			t.Fatalf("invalid import file %v: %q", filename, line)
+		}
+		return strings.TrimSuffix(line[len(prefix):], "\r\n")
+	}
+	for {
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		count, err := strconv.Atoi(readLine("*"))
+		if err != nil || count < 1 {
+			t.Fatalf("invalid import file %v", filename)
+		}
+		args := make([]interface{}, count-1)
+		readLine("$")
+		command := readLine("")
+		for i := range args {
+			readLine("$")
+			args[i] = readLine("")
+		}
+		if _, err := f.Do(command, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (f *fakeRedis) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName == "EXEC" {
+		return f.exec()
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = fmt.Sprint(arg)
+	}
+	key := values[0]
+
+	switch commandName {
+	case "SET":
+		f.strings[key] = values[1]
+		return "OK", nil
+	case "RPUSH":
+		f.lists[key] = append(f.lists[key], values[1:]...)
+		return int64(len(f.lists[key])), nil
+	case "SADD":
+		if f.sets[key] == nil {
+			f.sets[key] = map[string]bool{}
+		}
+		for _, member := range values[1:] {
+			f.sets[key][member] = true
+		}
+		return int64(len(f.sets[key])), nil
+	case "HSET":
+		if f.hashes[key] == nil {
+			f.hashes[key] = map[string]string{}
+		}
+		for i := 1; i+1 < len(values); i += 2 {
+			f.hashes[key][values[i]] = values[i+1]
+		}
+		return int64(len(f.hashes[key])), nil
+	case "GET":
+		if value, ok := f.strings[key]; ok {
+			return []byte(value), nil
+		}
+		if f.keyType(key) != "none" {
+			return nil, redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		return nil, nil
+	case "TYPE":
+		return f.keyType(key), nil
+	case "LRANGE":
+		return bulkStrings(f.lists[key]), nil
+	case "SMEMBERS":
+		var members []string
+		for member := range f.sets[key] {
+			members = append(members, member)
+		}
+		return bulkStrings(members), nil
+	case "HGETALL":
+		var fields []string
+		for field, value := range f.hashes[key] {
+			fields = append(fields, field, value)
+		}
+		return bulkStrings(fields), nil
+	}
+	return nil, fmt.Errorf("unsupported command %v", commandName)
+}
+
+func (f *fakeRedis) keyType(key string) string {
+	if _, ok := f.strings[key]; ok {
+		return "string"
+	}
+	switch {
+	case f.lists[key] != nil:
+		return "list"
+	case f.sets[key] != nil:
+		return "set"
+	case f.hashes[key] != nil:
+		return "hash"
+	}
+	return "none"
+}
+
+func bulkStrings(values []string) []interface{} {
+	reply := make([]interface{}, len(values))
+	for i, value := range values {
+		reply[i] = []byte(value)
+	}
+	return reply
+}
+
+func (f *fakeRedis) Send(commandName string, args ...interface{}) error {
+	if commandName == "MULTI" {
+		f.queue = [][]interface{}{}
+		return nil
+	}
+	if f.queue == nil {
+		return errors.New("only supported within MULTI")
+	}
+	f.queue = append(f.queue, append([]interface{}{commandName}, args...))
+	return nil
+}
+
+// exec runs the queued commands like EXEC, with errors of single commands as part of the reply
+func (f *fakeRedis) exec() (interface{}, error) {
+	if f.queue == nil {
+		return nil, redis.Error("ERR EXEC without MULTI")
+	}
+	replies := make([]interface{}, len(f.queue))
+	for i, command := range f.queue {
+		reply, err := f.Do(command[0].(string), command[1:]...)
+		if redisErr, ok := err.(redis.Error); ok {
+			reply = redisErr
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	f.queue = nil
+	f.execs++
+	return replies, nil
+}
+
+func (f *fakeRedis) Close() error { return nil }
+func (f *fakeRedis) Err() error   { return nil }
+func (f *fakeRedis) Flush() error { return errors.New("not implemented") }
+func (f *fakeRedis) Receive() (reply interface{}, err error) {
+	return nil, errors.New("not implemented")
+}
+
+// TestGenerateFiles renders test/<name>-template.conf with the Redis values of test/<name>-redisimport.txt and
+// compares the output with test/<name>-reference.conf. All templates are rendered in one batch from a manifest.
+func TestGenerateFiles(t *testing.T) {
+	*quietArg = true
+
+	names := []string{"test", "bitcoin", "blocks"}
+	outputDir, err := ioutil.TempDir("", "bbbconfgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	testDir, err := filepath.Abs("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisConn := newFakeRedis()
+	manifest := "# golden file tests\n\n"
+	for _, name := range names {
+		redisConn.importFile(t, filepath.Join("test", name+"-redisimport.txt"))
+		manifest += fmt.Sprintf("%v %v-output.conf\n", filepath.Join(testDir, name+"-template.conf"), name)
+	}
+	manifestFilename := filepath.Join(outputDir, "manifest.txt")
+	if err := ioutil.WriteFile(manifestFilename, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing output file keeps its mode
+	existingFilename := filepath.Join(outputDir, "bitcoin-output.conf")
+	if err := ioutil.WriteFile(existingFilename, []byte("previous content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(existingFilename, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := readManifest(manifestFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generateFiles(redisConn, jobs); err != nil {
+		t.Fatal(err)
+	}
+	if redisConn.execs != 1 {
+		t.Errorf("expected all values to be read in one transaction, got %v", redisConn.execs)
+	}
+
+	for i, name := range names {
+		if jobs[i].Template != filepath.Join(testDir, name+"-template.conf") || jobs[i].Output != filepath.Join(outputDir, name+"-output.conf") || !jobs[i].Changed {
+			t.Errorf("unexpected result %+v", jobs[i])
+		}
+
+		output, err := ioutil.ReadFile(jobs[i].Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		referenceFilename := filepath.Join("test", name+"-reference.conf")
+		if *update {
+			if err := ioutil.WriteFile(referenceFilename, output, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reference, err := ioutil.ReadFile(referenceFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != string(reference) {
+			t.Errorf("output differs from %v:\n%v", referenceFilename, string(output))
+		}
+	}
+
+	info, err := os.Stat(existingFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected mode 0640 of existing output file, got %v", info.Mode().Perm())
+	}
+
+	// unchanged output files are reported, and no temporary files are left behind
+	if err := generateFiles(redisConn, jobs); err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		if j.Changed {
+			t.Errorf("expected output file %v to be unchanged", j.Output)
+		}
+	}
+	redisConn.strings["bitcoind:mainnet"] = "0"
+	if err := generateFiles(redisConn, jobs); err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].Changed || !jobs[1].Changed || jobs[2].Changed {
+		t.Errorf("expected only the bitcoin output file to be changed, got %+v %+v %+v", jobs[0], jobs[1], jobs[2])
+	}
+	files, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(names)+1 {
+		t.Errorf("expected the manifest and %v output files, got %v files", len(names), len(files))
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	manifestFile, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(manifestFile.Name())
+	dir := filepath.Dir(manifestFile.Name())
+
+	_, err = manifestFile.WriteString("# comment\n\n  a.template\n/abs/b.template   b.conf\nc.template /abs/c.conf\nd e f\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestFile.Close()
+
+	_, err = readManifest(manifestFile.Name())
+	if err == nil || !strings.HasSuffix(err.Error(), "line 6: expected a template file, optionally followed by the output file") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err := ioutil.WriteFile(manifestFile.Name(), []byte("# comment\n\n  a.template\n/abs/b.template   b.conf\nc.template /abs/c.conf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := readManifest(manifestFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []job{
+		{Template: filepath.Join(dir, "a.template")},
+		{Template: "/abs/b.template", Output: filepath.Join(dir, "b.conf")},
+		{Template: filepath.Join(dir, "c.template"), Output: "/abs/c.conf"},
+	}
+	if len(jobs) != len(expected) {
+		t.Fatalf("expected %v jobs, got %v", len(expected), len(jobs))
+	}
+	for i := range expected {
+		if *jobs[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], *jobs[i])
+		}
+	}
+
+	if err := ioutil.WriteFile(manifestFile.Name(), []byte("# nothing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readManifest(manifestFile.Name()); err == nil {
+		t.Error("expected error for an empty manifest")
+	}
+}
+
+func TestGenerateFilesErrors(t *testing.T) {
+	*quietArg = true
+
+	tests := []struct {
+		name        string
+		template    string
+		expectedErr string
+	}{
+		{"#end without #if", "line\n{{ #end }}", "line 2: #end without #if or #range"},
+		{"#if without #end", "{{ #if key }}\nline", "line 1: #if without #end"},
+		{"#range without #end", "{{ #range list }}\n{{ #if key }}\n{{ #end }}", "line 1: #range without #end"},
+		{"#else without #if", "{{ #range list }}\n{{ #else }}\n{{ #end }}", "line 2: #else without #if"},
+		{"second #else", "{{ #if key }}\n{{ #else }}\n{{ #else }}\n{{ #end }}", "line 3: #else without #if"},
+		{"#if without key", "{{ #if }}\n{{ #end }}", "line 1: #if needs a key, optionally compared with == or != to a value"},
+		{"#if with invalid operator", "{{ #if key = 1 }}\n{{ #end }}", "line 1: #if needs a key, optionally compared with == or != to a value"},
+		{"#range without key", "{{ #range }}\n{{ #end }}", "line 1: #range needs exactly one key"},
+		{"#range over string", "{{ #range string }}\n{{ #end }}", "line 1: cannot iterate over key string of type string"},
+		{"variable outside of #range", "value={{ .value }}", "line 1: .value used outside of #range"},
+		{"unknown filter", "value={{ string | upper }}", "line 1: unknown filter upper"},
+		{"missing filter", "value={{ string | }}", "line 1: missing filter after '|'"},
+		{"not an integer", "value={{ string | int }}", "line 1: key string: value 'some text' is not an integer"},
+		{"integer out of range", "value={{ port | int 1 1024 }}", "line 1: key port: value 8080 is out of range 1 to 1024"},
+		{"default out of range", "value={{ key | int 1 1024 #default: 0 }}", "line 1: default value of key key: value 0 is out of range 1 to 1024"},
+		{"invalid range", "value={{ port | int 1 }}", "line 1: key port: filter int needs no arguments, or min and max"},
+		{"quote with arguments", "value={{ string | quote x }}", "line 1: key string: filter quote has no arguments"},
+	}
+
+	dir, err := ioutil.TempDir("", "bbbconfgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templateFilename := filepath.Join(dir, "error.template")
+	outputFilename := filepath.Join(dir, "error.conf")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redisConn := newFakeRedis()
+			redisConn.strings["string"] = "some text"
+			redisConn.strings["port"] = "8080"
+			redisConn.lists["list"] = []string{"a", "b"}
+
+			if err := ioutil.WriteFile(templateFilename, []byte(test.template), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := generateFiles(redisConn, []*job{{Template: templateFilename, Output: outputFilename}})
+			expectedErr := templateFilename + ": " + test.expectedErr
+			if err == nil || err.Error() != expectedErr {
+				t.Errorf("expected error %q, got %v", expectedErr, err)
+			}
+
+			// no output file is written if a template fails
+			if _, err := os.Stat(outputFilename); !os.IsNotExist(err) {
+				t.Errorf("expected no output file, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGenerateFilesWriteError(t *testing.T) {
+	*quietArg = true
+
+	dir, err := ioutil.TempDir("", "bbbconfgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templateFilename := filepath.Join(dir, "value.template")
+	if err := ioutil.WriteFile(templateFilename, []byte("value={{ string }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputFilename := filepath.Join(dir, "value.conf")
+	if err := ioutil.WriteFile(outputFilename, []byte("value=old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second output file cannot be written, so the first one is not replaced either
+	redisConn := newFakeRedis()
+	redisConn.strings["string"] = "new"
+	jobs := []*job{
+		{Template: templateFilename, Output: outputFilename},
+		{Template: templateFilename, Output: filepath.Join(dir, "missing", "value.conf")},
+	}
+	if err := generateFiles(redisConn, jobs); err == nil {
+		t.Fatal("expected an error")
+	}
+	if jobs[0].Changed || jobs[1].Changed {
+		t.Errorf("expected no changed output file, got %+v %+v", jobs[0], jobs[1])
+	}
+	content, err := ioutil.ReadFile(outputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "value=old" {
+		t.Errorf("expected the output file to be unchanged, got %q", content)
+	}
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected the template and the output file, got %v files", len(files))
+	}
+}
+
+func TestGenerateFilesStrict(t *testing.T) {
+	*quietArg = true
+	defer func() { *strictArg = false }()
+
+	dir, err := ioutil.TempDir("", "bbbconfgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templateFilename := filepath.Join(dir, "strict.template")
+	outputFilename := filepath.Join(dir, "strict.conf")
+
+	tests := []struct {
+		name        string
+		template    string
+		expectedErr string
+	}{
+		{"resolved", "a={{ string }}\nb={{ missing #rm }}\nc={{ missing #default: c }}\n{{ missing #rmLine }}", ""},
+		{"unresolved", "a={{ string }}\nb={{ missing }}", "line 2: key missing not found"},
+		{"unresolved loop variable", "{{ #range list }}\n{{ .key }}\n{{ #end }}", "line 2: key .key not found"},
+		{"unknown option", "a={{ string #remove }}", "line 1: unknown option #remove"},
+		{"unknown option in skipped block", "{{ #if missing }}\na={{ string #remove }}\n{{ #end }}", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redisConn := newFakeRedis()
+			redisConn.strings["string"] = "some text"
+			redisConn.lists["list"] = []string{"a", "b"}
+			if err := ioutil.WriteFile(templateFilename, []byte(test.template), 0644); err != nil {
+				t.Fatal(err)
+			}
+			jobs := []*job{{Template: templateFilename, Output: outputFilename}}
+
+			// without --strict, unresolved placeholders are kept
+			*strictArg = false
+			if err := generateFiles(redisConn, jobs); err != nil {
+				t.Fatal(err)
+			}
+
+			*strictArg = true
+			err := generateFiles(redisConn, jobs)
+			if len(test.expectedErr) == 0 {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			expectedErr := templateFilename + ": " + test.expectedErr
+			if err == nil || err.Error() != expectedErr {
+				t.Errorf("expected error %q, got %v", expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestLintBaseTemplates(t *testing.T) {
+	keys, err := readKeyManifests([]string{
+		"../../middleware/src/redis/keys.go",
+		"../../armbian/base/config/redis/factorysettings.txt",
+		"optional-keys.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := filepath.Glob("../../armbian/base/config/templates/*.template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) == 0 {
+		t.Fatal("no Base templates found")
+	}
+	for _, filename := range templates {
+		problems, err := lintTemplate(filename, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, problem := range problems {
+			t.Error(problem)
+		}
+	}
+}
+
+func TestLintTemplate(t *testing.T) {
+	keys, err := readKeyManifests([]string{filepath.Join("test", "lint-keys.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKeys := map[string]bool{"base:hostname": true, "bitcoind:rpcport": true, "tor:services": true}
+	if fmt.Sprint(keys) != fmt.Sprint(expectedKeys) {
+		t.Errorf("expected keys %v, got %v", expectedKeys, keys)
+	}
+
+	filename := filepath.Join("test", "lint-template.conf")
+	problems, err := lintTemplate(filename, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"4: key base:unknown not in key manifest",
+		"5: unknown option #remove",
+		"6: unknown filter upper",
+		"7: default value of key bitcoind:rpcport: value 8332 is out of range 1 to 1024",
+		"8: missing key before #rmLine",
+		"9: malformed placeholder, missing '{{' or '}}'",
+		"10: malformed placeholder, missing '{{' or '}}'",
+		"11: malformed placeholder {{ base:hostname {{ base:hostname }}",
+		"12: .value used outside of #range",
+		"15: unknown loop variable .name",
+		"20: key base:unknown not in key manifest",
+		"21: #output: is only allowed on the first line",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %v problems, got %v:\n%v", len(expected), len(problems), strings.Join(problems, "\n"))
+	}
+	for i := range expected {
+		if problems[i] != filename+":"+expected[i] {
+			t.Errorf("expected problem %q, got %q", filename+":"+expected[i], problems[i])
+		}
+	}
+
+	// without key manifest, keys are not checked
+	problems, err = lintTemplate(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != len(expected)-2 {
+		t.Errorf("expected %v problems, got %v", len(expected)-2, len(problems))
+	}
+
+	// the key manifest can be a Go file with string constants
+	goKeys, err := readKeyManifests([]string{filepath.Join("..", "..", "middleware", "src", "redis", "keys.go")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !goKeys["base:hostname"] || !goKeys["tor:base:enabled"] || goKeys["redis"] {
+		t.Errorf("unexpected keys from keys.go: %v", goKeys)
+	}
+
+	// unbalanced blocks are reported as error
+	unbalancedFile, err := ioutil.TempFile("", "unbalanced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(unbalancedFile.Name())
+	if _, err := unbalancedFile.WriteString("{{ #if key }}\nline\n"); err != nil {
+		t.Fatal(err)
+	}
+	unbalancedFile.Close()
+	if _, err := lintTemplate(unbalancedFile.Name(), nil); err == nil || err.Error() != "line 1: #if without #end" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
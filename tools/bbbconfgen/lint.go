@@ -0,0 +1,197 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// string constant in a Go file, e.g. `BaseHostname BaseRedisKey = "base:hostname"`
+var goKeyPattern = regexp.MustCompile(`^\s*(?:const\s+)?\w+(?:\s+\w+)?\s*=\s*"([^"]+)"`)
+
+// Redis commands in key manifests, e.g. `SET base:hostname bitbox-base` in factorysettings.txt
+var redisCommands = map[string]bool{
+	"SET": true, "SETNX": true, "HSET": true, "HMSET": true, "SADD": true, "RPUSH": true, "LPUSH": true, "ZADD": true,
+	"DEL": true, "SAVE": true,
+}
+
+// loop variables set by #range blocks
+var loopVariables = map[string]bool{".value": true, ".key": true, ".index": true}
+
+// lint runs the lint subcommand with its arguments and returns the exit code
+func lint(args []string) int {
+	lintFlags := flag.NewFlagSet("lint", flag.ExitOnError)
+	keysArg := lintFlags.String("keys", "", "comma-separated key manifests, Go files with string constants or text files with one key or Redis command per line")
+	if err := lintFlags.Parse(args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if lintFlags.NArg() == 0 {
+		log.Println("No template files specified, usage: bbbconfgen lint [--keys file,...] template...")
+		return 1
+	}
+
+	var keys map[string]bool
+	if len(*keysArg) > 0 {
+		var err error
+		keys, err = readKeyManifests(strings.Split(*keysArg, ","))
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	count := 0
+	for _, filename := range lintFlags.Args() {
+		problems, err := lintTemplate(filename, keys)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", filename, err))
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		count += len(problems)
+	}
+
+	if !*quietArg {
+		log.Printf("checked %v templates: %v problems\n", lintFlags.NArg(), count)
+	}
+	if count > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readKeyManifests returns the Redis keys listed in the key manifests
+func readKeyManifests(filenames []string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, filename := range filenames {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasSuffix(filename, ".go") {
+				if groups := goKeyPattern.FindStringSubmatch(line); groups != nil {
+					keys[groups[1]] = true
+				}
+				continue
+			}
+
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+			case redisCommands[fields[0]]:
+				if len(fields) > 1 {
+					keys[fields[1]] = true
+				}
+			default:
+				keys[fields[0]] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// lintTemplate checks a template file and returns the problems found, prefixed with file name and line number.
+// If keys is not nil, Redis keys not contained in it are reported.
+func lintTemplate(filename string, keys map[string]bool) ([]string, error) {
+	templateFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer templateFile.Close()
+
+	nodes, err := parseBlocks(templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	report := func(number int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%v:%v: %v", filename, number, fmt.Sprintf(format, args...)))
+	}
+	checkKey := func(number int, key string, inRange bool) {
+		switch {
+		case strings.HasPrefix(key, "."):
+			if !loopVariables[key] {
+				report(number, "unknown loop variable %v", key)
+			} else if !inRange {
+				report(number, "%v used outside of #range", key)
+			}
+		case strings.HasPrefix(key, "#"):
+			report(number, "missing key before %v", key)
+		case keys != nil && !keys[key]:
+			report(number, "key %v not in key manifest", key)
+		}
+	}
+
+	var walk func(nodes []node, inRange bool)
+	walk = func(nodes []node, inRange bool) {
+		for _, n := range nodes {
+			switch n := n.(type) {
+			case *lineNode:
+				// text left after removing the placeholders must not contain braces of a placeholder
+				if rest := placeholderPattern.ReplaceAllString(n.text, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+					report(n.number, "malformed placeholder, missing '{{' or '}}'")
+				}
+
+				for _, match := range placeholderPattern.FindAllStringSubmatch(n.text, -1) {
+					if strings.Contains(match[1], "{{") {
+						report(n.number, "malformed placeholder %v", match[0])
+						continue
+					}
+					p, err := parsePlaceholder(match[1])
+					if err != nil {
+						report(n.number, "%v", err)
+						continue
+					}
+					if strings.ToLower(p.key) == "#output:" {
+						if n.number != 1 {
+							report(n.number, "#output: is only allowed on the first line")
+						}
+						continue
+					}
+					checkKey(n.number, p.key, inRange)
+					if len(p.option) > 0 && !isKnownOption(p.option) {
+						report(n.number, "unknown option %v", p.option)
+					}
+					if strings.ToLower(p.option) == "#default:" {
+						if _, err := p.applyFilters(p.defaultValue); err != nil {
+							report(n.number, "default value of key %v: %v", p.key, err)
+						}
+					}
+				}
+
+			case *ifNode:
+				checkKey(n.number, n.key, inRange)
+				walk(n.then, inRange)
+				walk(n.otherwise, inRange)
+
+			case *rangeNode:
+				checkKey(n.number, n.key, inRange)
+				walk(n.body, true)
+			}
+		}
+	}
+	walk(nodes, false)
+	return problems, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// job renders a template into an output file, Changed is set if the content of the output file changed
+type job struct {
+	Template string `json:"template"`
+	Output   string `json:"output"`
+	Changed  bool   `json:"changed"`
+}
+
+// readManifest reads the templates to render from a manifest file, or from stdin if the filename is "-".
+// Each line contains a template file, optionally followed by the output file, separated by whitespace.
+// Empty lines and lines starting with '#' are ignored. Relative paths are relative to the manifest file.
+func readManifest(filename string) ([]*job, error) {
+	var (
+		manifest io.Reader = os.Stdin
+		dir                = "."
+	)
+	if filename != "-" {
+		manifestFile, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer manifestFile.Close()
+		manifest = manifestFile
+		dir = filepath.Dir(filename)
+	}
+
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	var (
+		jobs   []*job
+		number int
+	)
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		number++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch len(fields) {
+		case 1:
+			jobs = append(jobs, &job{Template: resolve(fields[0])})
+		case 2:
+			jobs = append(jobs, &job{Template: resolve(fields[0]), Output: resolve(fields[1])})
+		default:
+			return nil, fmt.Errorf("manifest %v, line %v: expected a template file, optionally followed by the output file", filename, number)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("manifest %v contains no templates", filename)
+	}
+	return jobs, nil
+}
+
+// generateFiles renders the templates and writes the output files. The Redis values of all templates are read at once,
+// and all output files are written into temporary files before the first one is replaced, so that no output file is
+// changed if any template or write fails. The jobs record which output files changed, even if an error is returned.
+func generateFiles(redisConn redis.Conn, jobs []*job) error {
+	templates := make([][]node, len(jobs))
+	valueKeys := map[string]bool{}
+	itemKeys := map[string]bool{}
+
+	for i, j := range jobs {
+		j.Changed = false
+		if len(j.Output) == 0 {
+			output, err := outputFilename(j.Template)
+			if err != nil {
+				return err
+			}
+			j.Output = output
+		}
+
+		templateFile, err := os.Open(j.Template)
+		if err != nil {
+			return err
+		}
+		templates[i], err = parseBlocks(templateFile)
+		templateFile.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", j.Template, err)
+		}
+		if err := collectKeys(templates[i], valueKeys, itemKeys); err != nil {
+			return fmt.Errorf("%v: %v", j.Template, err)
+		}
+	}
+
+	values, err := takeSnapshot(redisConn, sortedKeys(valueKeys), sortedKeys(itemKeys))
+	if err != nil {
+		return err
+	}
+
+	outputs := make([][]byte, len(jobs))
+	for i, j := range jobs {
+		var output bytes.Buffer
+		r := &renderer{values: values, outputFile: &output, strict: *strictArg}
+		if err := r.render(templates[i]); err != nil {
+			return fmt.Errorf("%v: %v", j.Template, err)
+		}
+		outputs[i] = output.Bytes()
+
+		if !*quietArg {
+			log.Printf("rendered template %v\n", j.Template)
+			r.stats.log()
+		}
+	}
+
+	// all output files are staged before the first one is replaced, so that a failed write changes none of them
+	staged := make([]*stagedFile, len(jobs))
+	for i, j := range jobs {
+		staged[i], err = stageFile(j.Output, outputs[i])
+		if err != nil {
+			for _, s := range staged[:i] {
+				if s != nil {
+					s.discard()
+				}
+			}
+			return fmt.Errorf("cannot write outputFile %v: %v", j.Output, err)
+		}
+	}
+
+	// if replacing a file fails, the files replaced before are reported as changed
+	for i, j := range jobs {
+		if staged[i] != nil {
+			if err := staged[i].commit(); err != nil {
+				for _, s := range staged[i+1:] {
+					if s != nil {
+						s.discard()
+					}
+				}
+				return fmt.Errorf("cannot write outputFile %v: %v", j.Output, err)
+			}
+			j.Changed = true
+		}
+		if !*quietArg {
+			if j.Changed {
+				log.Println("changed output file", j.Output)
+			} else {
+				log.Println("unchanged output file", j.Output)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// mode of newly created output files
+const defaultFileMode = 0644
+
+// match outputFile pattern, e.g. {{ #output: /tmp/output.txt }}
+var outputFilePattern = regexp.MustCompile("{{[ ]{0,}#output: (.+?)}}")
+
+// outputFilename reads the output file specified on the first line of the template
+func outputFilename(templateFilename string) (string, error) {
+	templateFile, err := os.Open(templateFilename)
+	if err != nil {
+		return "", errors.New("cannot open templateFile " + templateFilename)
+	}
+	defer templateFile.Close()
+
+	// read first line and extract outputFile pattern
+	scannerOutputFile := bufio.NewScanner(templateFile)
+	scannerOutputFile.Scan()
+	firstLine := scannerOutputFile.Text()
+	firstLineGroups := outputFilePattern.FindStringSubmatch(firstLine)
+
+	if len(firstLineGroups) > 0 && len(firstLineGroups[1]) > 0 {
+		return strings.Trim(firstLineGroups[1], " "), nil
+	}
+	return "", errors.New("no output file specified in " + templateFilename + ", specify either --output argument or within template")
+}
+
+// stagedFile is an output file whose new content has been written into a temporary file in the same directory.
+type stagedFile struct {
+	filename    string
+	tmpFilename string
+}
+
+// stageFile writes the new content of the file into a temporary file in the same directory, which replaces the file
+// on commit, so that the file is either unchanged or completely written, even if the program crashes. An existing
+// file keeps its mode and owner, and a symlink is followed to replace its target. It returns nil if the content is
+// unchanged, in which case the file is not written at all.
+func stageFile(filename string, content []byte) (*stagedFile, error) {
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+
+	mode := os.FileMode(defaultFileMode)
+	uid, gid := -1, -1
+	info, err := os.Stat(filename)
+	switch {
+	case err == nil:
+		current, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(current, content) {
+			return nil, nil
+		}
+		mode = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedFile{filename: filename, tmpFilename: tmpFile.Name()}
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		staged.discard()
+		return nil, err
+	}
+	if err := tmpFile.Chmod(mode); err != nil {
+		tmpFile.Close()
+		staged.discard()
+		return nil, err
+	}
+	if uid != -1 && (uid != os.Getuid() || gid != os.Getgid()) {
+		if err := tmpFile.Chown(uid, gid); err != nil {
+			tmpFile.Close()
+			staged.discard()
+			return nil, err
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		staged.discard()
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		staged.discard()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// commit replaces the file with the temporary file.
+func (s *stagedFile) commit() error {
+	if err := os.Rename(s.tmpFilename, s.filename); err != nil {
+		s.discard()
+		return err
+	}
+	return nil
+}
+
+// discard removes the temporary file, leaving the file unchanged.
+func (s *stagedFile) discard() {
+	os.Remove(s.tmpFilename)
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// item is an element of a Redis list, set or hash, iterated over by a #range block
+type item struct {
+	index int
+	key   string // field name, only set for hashes
+	value string
+}
+
+// variables returns the loop variables of an item, used as {{ .value }}, {{ .key }} and {{ .index }}
+func (i item) variables() map[string]string {
+	variables := map[string]string{
+		".index": strconv.Itoa(i.index),
+		".value": i.value,
+	}
+	if len(i.key) > 0 {
+		variables[".key"] = i.key
+	}
+	return variables
+}
+
+// snapshot holds the Redis values used by one or more templates. All values are read within a single MULTI / EXEC
+// transaction, so that templates rendered together see the same state, even if keys are changed in the meantime.
+type snapshot struct {
+	values     map[string]string
+	items      map[string][]item
+	itemErrors map[string]error
+}
+
+// takeSnapshot reads the string values of valueKeys and the elements of itemKeys
+func takeSnapshot(redisConn redis.Conn, valueKeys []string, itemKeys []string) (*snapshot, error) {
+	s := &snapshot{
+		values:     map[string]string{},
+		items:      map[string][]item{},
+		itemErrors: map[string]error{},
+	}
+	if len(valueKeys) == 0 && len(itemKeys) == 0 {
+		return s, nil
+	}
+
+	// the type of an item key is not known before, so all commands are queued and the reply matching the type is used
+	itemCommands := []string{"TYPE", "LRANGE", "SMEMBERS", "HGETALL"}
+	if err := redisConn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, key := range valueKeys {
+		if err := redisConn.Send("GET", key); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range itemKeys {
+		for _, command := range itemCommands {
+			args := []interface{}{key}
+			if command == "LRANGE" {
+				args = append(args, 0, -1)
+			}
+			if err := redisConn.Send(command, args...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	replies, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) != len(valueKeys)+len(itemKeys)*len(itemCommands) {
+		return nil, fmt.Errorf("unexpected number of replies from Redis: %v", len(replies))
+	}
+
+	for i, key := range valueKeys {
+		value, err := redis.String(replies[i], nil)
+		if err == nil {
+			s.values[key] = value
+		} else if _, ok := err.(redis.Error); !ok && err != redis.ErrNil {
+			return nil, err
+		}
+		// a key that is not found or not a string, e.g. WRONGTYPE, is handled like an empty value
+	}
+
+	replies = replies[len(valueKeys):]
+	for i, key := range itemKeys {
+		reply := replies[i*len(itemCommands) : (i+1)*len(itemCommands)]
+		s.items[key], s.itemErrors[key] = parseItems(key, reply[0], reply[1], reply[2], reply[3])
+	}
+	return s, nil
+}
+
+// parseItems returns the elements of a Redis list in order, the members of a set sorted, or the fields of a hash sorted
+// by field name, depending on the type of the key. A key that is not found has no elements.
+func parseItems(key string, typeReply, listReply, setReply, hashReply interface{}) ([]item, error) {
+	keyType, err := redis.String(typeReply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	switch keyType {
+	case "none":
+		return nil, nil
+	case "list":
+		values, err = redis.Strings(listReply, nil)
+	case "set":
+		values, err = redis.Strings(setReply, nil)
+		sort.Strings(values)
+	case "hash":
+		fields, err := redis.StringMap(hashReply, nil)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items := make([]item, len(names))
+		for i, name := range names {
+			items[i] = item{index: i, key: name, value: fields[name]}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("cannot iterate over key %v of type %v", key, keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]item, len(values))
+	for i, value := range values {
+		items[i] = item{index: i, value: value}
+	}
+	return items, nil
+}
+
+// value returns the value of a Redis key, or an empty string if the key is not found or not a string
+func (s *snapshot) value(key string) string {
+	return s.values[key]
+}
+
+// itemsOf returns the elements of a Redis list, set or hash
+func (s *snapshot) itemsOf(key string) ([]item, error) {
+	return s.items[key], s.itemErrors[key]
+}
@@ -0,0 +1,520 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// placeholder within a line, e.g. {{ key #rm }}
+	placeholderPattern = regexp.MustCompile("{{(.+?)}}")
+
+	// block directive on its own line, e.g. {{ #if key }}
+	directivePattern = regexp.MustCompile(`^\s*{{\s*#(if|else|end|range)\b(.*?)}}\s*$`)
+)
+
+// node is a parsed part of a template: a *lineNode, *ifNode or *rangeNode
+type node interface{}
+
+// lineNode is a single template line with placeholders
+type lineNode struct {
+	number int
+	text   string
+}
+
+// ifNode is a conditional block, {{ #if key }}, {{ #if !key }}, {{ #if key == value }} or {{ #if key != value }}
+type ifNode struct {
+	number    int
+	key       string
+	negate    bool
+	operator  string // empty, "==" or "!="
+	value     string
+	then      []node
+	otherwise []node
+}
+
+// rangeNode is a block repeated for each element of a Redis list, set or hash, {{ #range key }}
+type rangeNode struct {
+	number int
+	key    string
+	body   []node
+}
+
+// block is an open #if or #range block while parsing
+type block struct {
+	directive string
+	number    int
+	nodes     *[]node // nodes of the block the following lines are added to
+	ifNode    *ifNode
+	hasElse   bool
+}
+
+// parseBlocks reads the template and splits it into lines and blocks
+func parseBlocks(templateFile io.Reader) ([]node, error) {
+	var (
+		root   []node
+		open   []*block
+		number int
+	)
+	current := &root
+
+	scanner := bufio.NewScanner(templateFile)
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+
+		groups := directivePattern.FindStringSubmatch(line)
+		if groups == nil {
+			*current = append(*current, &lineNode{number: number, text: line})
+			continue
+		}
+
+		args := strings.Fields(groups[2])
+		switch groups[1] {
+		case "if":
+			condition, err := parseCondition(number, args)
+			if err != nil {
+				return nil, err
+			}
+			*current = append(*current, condition)
+			open = append(open, &block{directive: "if", number: number, nodes: &condition.then, ifNode: condition})
+			current = &condition.then
+
+		case "range":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("line %v: #range needs exactly one key", number)
+			}
+			loop := &rangeNode{number: number, key: args[0]}
+			*current = append(*current, loop)
+			open = append(open, &block{directive: "range", number: number, nodes: &loop.body})
+			current = &loop.body
+
+		case "else":
+			if len(args) > 0 {
+				return nil, fmt.Errorf("line %v: #else has no arguments", number)
+			}
+			if len(open) == 0 || open[len(open)-1].directive != "if" || open[len(open)-1].hasElse {
+				return nil, fmt.Errorf("line %v: #else without #if", number)
+			}
+			top := open[len(open)-1]
+			top.hasElse = true
+			top.nodes = &top.ifNode.otherwise
+			current = top.nodes
+
+		case "end":
+			if len(args) > 0 {
+				return nil, fmt.Errorf("line %v: #end has no arguments", number)
+			}
+			if len(open) == 0 {
+				return nil, fmt.Errorf("line %v: #end without #if or #range", number)
+			}
+			open = open[:len(open)-1]
+			current = &root
+			if len(open) > 0 {
+				current = open[len(open)-1].nodes
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(open) > 0 {
+		top := open[len(open)-1]
+		return nil, fmt.Errorf("line %v: #%v without #end", top.number, top.directive)
+	}
+	return root, nil
+}
+
+// parseCondition parses the arguments of an #if directive
+func parseCondition(number int, args []string) (*ifNode, error) {
+	condition := &ifNode{number: number}
+	switch {
+	case len(args) == 1:
+		condition.key = args[0]
+		if strings.HasPrefix(condition.key, "!") {
+			condition.negate = true
+			condition.key = condition.key[1:]
+		}
+	case len(args) > 2 && (args[1] == "==" || args[1] == "!="):
+		condition.key = args[0]
+		condition.operator = args[1]
+		condition.value = strings.Join(args[2:], " ")
+	default:
+		return nil, fmt.Errorf("line %v: #if needs a key, optionally compared with == or != to a value", number)
+	}
+	if len(condition.key) == 0 {
+		return nil, fmt.Errorf("line %v: #if needs a key", number)
+	}
+	return condition, nil
+}
+
+// placeholder is a parsed placeholder, {{ key | filter args #option default value }}
+type placeholder struct {
+	key          string
+	filters      [][]string // filter name followed by its arguments
+	option       string
+	defaultValue string
+}
+
+// parsePlaceholder splits the content of a placeholder into its fields
+func parsePlaceholder(content string) (p placeholder, err error) {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return p, errors.New("empty placeholder")
+	}
+	p.key = fields[0]
+
+	i := 1
+	for i < len(fields) && fields[i] == "|" {
+		i++
+		if i == len(fields) {
+			return p, errors.New("missing filter after '|'")
+		}
+		if _, ok := filters[fields[i]]; !ok {
+			return p, fmt.Errorf("unknown filter %v", fields[i])
+		}
+		filter := []string{fields[i]}
+		for i++; i < len(fields) && fields[i] != "|" && !strings.HasPrefix(fields[i], "#"); i++ {
+			filter = append(filter, fields[i])
+		}
+		p.filters = append(p.filters, filter)
+	}
+
+	if i < len(fields) {
+		p.option = fields[i]
+		if strings.ToLower(p.option) == "#default:" {
+			p.defaultValue = strings.Join(fields[i+1:], " ")
+		}
+	}
+	return p, nil
+}
+
+// isKnownOption returns true for the placeholder options, e.g. #rm
+func isKnownOption(option string) bool {
+	switch option {
+	case "#check", "#rmLineTrue", "#rmLineFalse":
+		return true
+	}
+	switch strings.ToLower(option) {
+	case "#rm", "#rmline", "#default:":
+		return true
+	}
+	return false
+}
+
+// filters transform the value of a placeholder, e.g. {{ key | quote }}
+var filters = map[string]func(value string, args []string) (string, error){
+	// quote puts the value in double quotes, escaping quotes and special characters
+	"quote": func(value string, args []string) (string, error) {
+		if len(args) > 0 {
+			return "", errors.New("filter quote has no arguments")
+		}
+		return strconv.Quote(value), nil
+	},
+	// lower converts the value to lower case
+	"lower": func(value string, args []string) (string, error) {
+		if len(args) > 0 {
+			return "", errors.New("filter lower has no arguments")
+		}
+		return strings.ToLower(value), nil
+	},
+	// int checks that the value is an integer, optionally within the range given by min and max
+	"int": func(value string, args []string) (string, error) {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("value '%v' is not an integer", value)
+		}
+		switch len(args) {
+		case 0:
+			return value, nil
+		case 2:
+			min, errMin := strconv.Atoi(args[0])
+			max, errMax := strconv.Atoi(args[1])
+			if errMin != nil || errMax != nil {
+				return "", fmt.Errorf("invalid range %v to %v of filter int", args[0], args[1])
+			}
+			if number < min || number > max {
+				return "", fmt.Errorf("value %v is out of range %v to %v", number, min, max)
+			}
+			return value, nil
+		}
+		return "", errors.New("filter int needs no arguments, or min and max")
+	},
+}
+
+// applyFilters runs the value through the filters of a placeholder, in order
+func (p placeholder) applyFilters(value string) (string, error) {
+	for _, filter := range p.filters {
+		var err error
+		value, err = filters[filter[0]](value, filter[1:])
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// isTrue returns true for the values '1', 'true', 'yes' and 'y'
+func isTrue(value string) bool {
+	return value == "1" || strings.EqualFold(value, "true") || strings.EqualFold(value, "yes") || strings.EqualFold(value, "y")
+}
+
+// isFalse returns true for the values '0', 'false', 'no', 'n' and an empty value
+func isFalse(value string) bool {
+	return value == "0" || strings.EqualFold(value, "false") || strings.EqualFold(value, "no") || strings.EqualFold(value, "n") || len(value) == 0
+}
+
+// templateStats counts the processed lines, placeholders and blocks
+type templateStats struct {
+	lines      int
+	replace    int
+	keep       int
+	rm         int
+	rmLine     int
+	checkTrue  int
+	checkFalse int
+	defaults   int
+	ifTrue     int
+	ifFalse    int
+	iterations int
+}
+
+func (stats templateStats) log() {
+	log.Printf("written %v lines\n", stats.lines)
+	log.Printf("placeholders: %v replaced, %v kept, %v deleted, %v lines deleted, %v set to default\n", stats.replace, stats.keep, stats.rm, stats.rmLine, stats.defaults)
+	log.Printf("checks: %v lines dropped, %v lines kept\n", stats.checkFalse, stats.checkTrue)
+	log.Printf("blocks: %v conditions true, %v false, %v loop iterations\n\n", stats.ifTrue, stats.ifFalse, stats.iterations)
+}
+
+// collectKeys adds the Redis keys used by the parsed template to valueKeys, for string values, and to itemKeys, for
+// #range blocks. Loop variables like .value are not read from Redis.
+func collectKeys(nodes []node, valueKeys map[string]bool, itemKeys map[string]bool) error {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *lineNode:
+			for _, match := range placeholderPattern.FindAllStringSubmatch(n.text, -1) {
+				p, err := parsePlaceholder(match[1])
+				if err != nil {
+					return fmt.Errorf("line %v: %v", n.number, err)
+				}
+				if strings.ToLower(p.key) == "#output:" {
+					break
+				}
+				if !strings.HasPrefix(p.key, ".") {
+					valueKeys[p.key] = true
+				}
+			}
+		case *ifNode:
+			if !strings.HasPrefix(n.key, ".") {
+				valueKeys[n.key] = true
+			}
+			if err := collectKeys(n.then, valueKeys, itemKeys); err != nil {
+				return err
+			}
+			if err := collectKeys(n.otherwise, valueKeys, itemKeys); err != nil {
+				return err
+			}
+		case *rangeNode:
+			itemKeys[n.key] = true
+			if err := collectKeys(n.body, valueKeys, itemKeys); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a set in a stable order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// renderer writes the parsed template to the output file, substituting placeholders with Redis values
+type renderer struct {
+	values     *snapshot
+	outputFile io.Writer
+	strict     bool                // fail on unresolved placeholders and unknown options, instead of keeping them
+	scopes     []map[string]string // loop variables of the enclosing #range blocks, innermost last
+	stats      templateStats
+}
+
+// lookup returns the value of a loop variable like .value, or of a Redis key
+func (r *renderer) lookup(key string) (string, error) {
+	if strings.HasPrefix(key, ".") {
+		if len(r.scopes) == 0 {
+			return "", fmt.Errorf("%v used outside of #range", key)
+		}
+		return r.scopes[len(r.scopes)-1][key], nil
+	}
+	return r.values.value(key), nil
+}
+
+func (r *renderer) render(nodes []node) error {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *lineNode:
+			if err := r.renderLine(n); err != nil {
+				return err
+			}
+
+		case *ifNode:
+			value, err := r.lookup(n.key)
+			if err != nil {
+				return fmt.Errorf("line %v: %v", n.number, err)
+			}
+			var result bool
+			switch n.operator {
+			case "==":
+				result = value == n.value
+			case "!=":
+				result = value != n.value
+			default:
+				result = !isFalse(value) != n.negate
+			}
+			if result {
+				r.stats.ifTrue++
+				err = r.render(n.then)
+			} else {
+				r.stats.ifFalse++
+				err = r.render(n.otherwise)
+			}
+			if err != nil {
+				return err
+			}
+
+		case *rangeNode:
+			items, err := r.values.itemsOf(n.key)
+			if err != nil {
+				return fmt.Errorf("line %v: %v", n.number, err)
+			}
+			for _, item := range items {
+				r.scopes = append(r.scopes, item.variables())
+				err := r.render(n.body)
+				r.scopes = r.scopes[:len(r.scopes)-1]
+				if err != nil {
+					return err
+				}
+				r.stats.iterations++
+			}
+		}
+	}
+	return nil
+}
+
+// renderLine replaces the placeholders of a single line and writes it, unless it is dropped
+func (r *renderer) renderLine(n *lineNode) error {
+	outputLine := n.text
+	printLine := true // set to 'false' when fallback is #rmLine or a check fails
+
+	for _, match := range placeholderPattern.FindAllStringSubmatch(outputLine, -1) {
+		placeholder := match[0]
+		p, err := parsePlaceholder(match[1])
+		if err != nil {
+			return fmt.Errorf("line %v: %v", n.number, err)
+		}
+
+		// skip line with outputFile specifier
+		if strings.ToLower(p.key) == "#output:" {
+			printLine = false
+			break
+		}
+
+		if r.strict && len(p.option) > 0 && !isKnownOption(p.option) {
+			return fmt.Errorf("line %v: unknown option %v", n.number, p.option)
+		}
+
+		redisVal, err := r.lookup(p.key)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", n.number, err)
+		}
+
+		if p.option == "#check" || p.option == "#rmLineFalse" {
+			// if key value is 'false' or empty, drop line
+			if isFalse(redisVal) {
+				printLine = false
+				r.stats.checkFalse++
+			} else {
+				outputLine = strings.Replace(outputLine, placeholder, "", -1)
+				r.stats.checkTrue++
+			}
+
+		} else if p.option == "#rmLineTrue" {
+			// if key value is 'true', drop line
+			if isTrue(redisVal) {
+				printLine = false
+				r.stats.checkFalse++
+			} else {
+				outputLine = strings.Replace(outputLine, placeholder, "", -1)
+				r.stats.checkTrue++
+			}
+
+		} else if len(redisVal) > 0 {
+			// replace placeholder if Redis key is found
+			value, err := p.applyFilters(redisVal)
+			if err != nil {
+				return fmt.Errorf("line %v: key %v: %v", n.number, p.key, err)
+			}
+			outputLine = strings.Replace(outputLine, placeholder, value, -1)
+			r.stats.replace++
+
+		} else {
+			// if specified, use fallback options if Redis key is not found
+			switch strings.ToLower(p.option) {
+			case "#rm":
+				outputLine = strings.Replace(outputLine, placeholder, "", -1)
+				r.stats.rm++
+			case "#rmline":
+				printLine = false
+				r.stats.rmLine++
+			case "#default:":
+				value, err := p.applyFilters(p.defaultValue)
+				if err != nil {
+					return fmt.Errorf("line %v: default value of key %v: %v", n.number, p.key, err)
+				}
+				outputLine = strings.Replace(outputLine, placeholder, value, -1)
+				r.stats.defaults++
+			default:
+				if r.strict {
+					return fmt.Errorf("line %v: key %v not found", n.number, p.key)
+				}
+				r.stats.keep++
+			}
+		}
+	}
+
+	// write processed line to outputFile
+	if printLine {
+		if _, err := fmt.Fprintln(r.outputFile, outputLine); err != nil {
+			return err
+		}
+		r.stats.lines++
+	}
+	return nil
+}
@@ -20,43 +20,100 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"strconv"
+	"reflect"
 	"strings"
 	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbfancontrol/fancontrol"
 )
 
-func readValueFile(filepath string) (value string, err error) {
-	data, err := ioutil.ReadFile(filepath)
+// writeMetrics writes the current state into a Prometheus textfile, which is collected by the node_exporter.
+// The file is written to a temporary file first and then renamed, so that the node_exporter never reads a partial file.
+// The temperature is omitted if it couldn't be read.
+func writeMetrics(filepath string, state fancontrol.State) {
+	var metrics strings.Builder
+	if state.SensorErr == nil {
+		fmt.Fprintf(&metrics, `# HELP bbbfancontrol_temperature_celsius Current system temperature in °C.
+# TYPE bbbfancontrol_temperature_celsius gauge
+bbbfancontrol_temperature_celsius %.1f
+`, state.Temp)
+	}
+	fmt.Fprintf(&metrics, `# HELP bbbfancontrol_fan_pwm Current fan PWM value, from 0 (off) to 255 (max).
+# TYPE bbbfancontrol_fan_pwm gauge
+bbbfancontrol_fan_pwm %d
+# HELP bbbfancontrol_cooldown 1 if the fan is cooling down to the cooldown temperature, 0 otherwise.
+# TYPE bbbfancontrol_cooldown gauge
+bbbfancontrol_cooldown %d
+# HELP bbbfancontrol_sensor_error 1 if the temperature couldn't be read and the fan runs at full speed, 0 otherwise.
+# TYPE bbbfancontrol_sensor_error gauge
+bbbfancontrol_sensor_error %d
+`, state.PWM, boolToInt(state.Running), boolToInt(state.SensorErr != nil))
+
+	tmpFilepath := filepath + ".tmp"
+	err := ioutil.WriteFile(tmpFilepath, []byte(metrics.String()), 0644)
+	if err != nil {
+		log.Printf("could not write metrics: %v", err)
+		return
+	}
+	err = os.Rename(tmpFilepath, filepath)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("could not write metrics: %v", err)
 	}
-	value = string(data)
-	return value, err
 }
 
-func writeValueFile(filepath string, value string) (err error) {
-	output := []byte(value)
-	err = ioutil.WriteFile(filepath, output, 0644)
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// applySettings applies the redis settings, on top of the command line arguments, if they change the configuration.
+// Invalid settings are logged and ignored.
+func applySettings(fan *fancontrol.Fan, flagSettings map[string]string, redisSettings map[string]string) {
+	settings := make(map[string]string)
+	for name, value := range flagSettings {
+		settings[name] = value
+	}
+	for name, value := range redisSettings {
+		if value != "" {
+			settings[name] = value
+		}
+	}
+	config, err := fancontrol.ConfigFromSettings(settings)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ignoring the invalid fan settings from redis: %v", err)
+		return
+	}
+	if reflect.DeepEqual(config, fan.Config()) {
+		return
+	}
+	if err := fan.SetConfig(config); err != nil {
+		log.Printf("ignoring the invalid fan settings from redis: %v", err)
+		return
 	}
-	return err
+	log.Printf("applied the fan settings from redis: %+v", redisSettings)
 }
 
 func main() {
 
-	versionNum := 1.0
+	versionNum := 2.0
 
 	// parse command line arguments
 	tempFile := flag.String("temp", "/sys/class/thermal/thermal_zone0/temp", "filepath to temperature value file")
-	tempMin := flag.Int("tmin", 45, "minimum temperature in °C for fan control, no fan below")
-	tempMax := flag.Int("tmax", 60, "maximum temperature in °C for fan control, max fan above")
-	tempCooldown := flag.Int("cooldown", 40, "temperature to cool down to in °C when stepping out of min / max temp zone")
+	profile := flag.String("profile", fancontrol.ProfileBalanced, "fan control profile ("+strings.Join(fancontrol.ProfileNames(), ", ")+")")
+	flag.String("controller", "", "fan controller (linear, curve, pid), overrides the controller of the profile")
+	flag.Int("tmin", 0, "minimum temperature in °C for fan control, no fan below, overrides the profile")
+	flag.Int("tmax", 0, "maximum temperature in °C for fan control, max fan above, overrides the profile")
+	flag.Int("cooldown", 0, "temperature to cool down to in °C when stepping out of min / max temp zone, overrides the profile")
+	flag.Int("target", 0, "target temperature in °C of the pid controller, overrides the profile")
 	fanFile := flag.String("fan", "/sys/class/hwmon/hwmon0/pwm1", "filepath to fan control file")
-	fanMin := flag.Int("fmin", 120, "minimum value for fan control")
-	fanMax := flag.Int("fmax", 255, "maximum value for fan control")
+	flag.Int("fmin", 0, "minimum value for fan control, overrides the profile")
+	flag.Int("fmax", 0, "maximum value for fan control, overrides the profile")
 	fanKickstart := flag.Int("kickstart", 0, "seconds to kickstart fan with full power (default 0 = off)")
 	cycle := flag.Int("cycle", 10, "length of sleep cycle in seconds after each temperature check")
+	redisPort := flag.String("redisport", "6379", "port of the local redis server to read the settings from (empty = off)")
+	metricsFile := flag.String("metrics", "/var/lib/prometheus/node-exporter/bbbfancontrol.prom", "filepath to Prometheus textfile for status metrics (empty = off)")
 	verbose := flag.Bool("v", false, "verbose, log internal data to stdout")
 	version := flag.Bool("version", false, "return program version")
 	flag.Parse()
@@ -66,79 +123,85 @@ func main() {
 		os.Exit(0)
 	}
 
+	// explicitly supplied arguments override the profile
+	flagSettings := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range fancontrol.SettingNames {
+			if f.Name == name {
+				flagSettings[name] = f.Value.String()
+			}
+		}
+	})
+	config, err := fancontrol.ConfigFromSettings(flagSettings)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n\n", err)
+		os.Exit(1)
+	}
+
 	// sanity check for arguments
-	if *tempCooldown > *tempMin || *tempMin > *tempMax {
-		fmt.Printf("ERROR: inconsistent temperature range supplied.\n")
-		fmt.Printf("       cooldown (%v) must be <= tmin (%v) must be < tmax (%v)\n\n", *tempCooldown, *tempMin, *tempMax)
+	fan, err := fancontrol.NewFan(*tempFile, *fanFile, time.Duration(*fanKickstart)*time.Second, config)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n\n", err)
 		os.Exit(1)
 	}
 
+	// the settings stored in redis are applied live and take precedence over the command line arguments
+	redisSettings := make(chan map[string]string)
+	if *redisPort != "" {
+		go watchRedisSettings(*redisPort, redisSettings)
+	}
+
 	fmt.Println("BitBoxBase fan control, version", versionNum)
 	if *verbose {
-		fmt.Println("temp:     ", *tempFile)
-		fmt.Println("tmin:     ", *tempMin)
-		fmt.Println("tmax:     ", *tempMax)
-		fmt.Println("cooldown: ", *tempCooldown)
-		fmt.Println("fan:      ", *fanFile)
-		fmt.Println("fmin:     ", *fanMin)
-		fmt.Println("fmax:     ", *fanMax)
-		fmt.Println("kickstart:", *fanKickstart)
-		fmt.Println("cycle:    ", *cycle)
+		fmt.Println("temp:      ", *tempFile)
+		fmt.Println("profile:   ", *profile)
+		fmt.Println("redisport: ", *redisPort)
+		fmt.Println("controller:", config.Controller)
+		fmt.Println("tmin:      ", config.TempMin)
+		fmt.Println("tmax:      ", config.TempMax)
+		fmt.Println("cooldown:  ", config.TempCooldown)
+		fmt.Println("fan:       ", *fanFile)
+		fmt.Println("fmin:      ", config.FanMin)
+		fmt.Println("fmax:      ", config.FanMax)
+		fmt.Println("kickstart: ", *fanKickstart)
+		fmt.Println("cycle:     ", *cycle)
+		fmt.Println("metrics:   ", *metricsFile)
 	}
 
-	cooldown := false
+	cycleDuration := time.Duration(*cycle) * time.Second
+	running := false
 	for {
-		// read current temperature
-		tempStr, _ := readValueFile(*tempFile)
-		tempCur, err := strconv.Atoi(strings.TrimSpace(tempStr))
-		tempCur = tempCur / 1000
+		state, err := fan.Step(cycleDuration)
 		if err != nil {
-			log.Fatal(err)
+			// only log, the fan is set again in the next cycle
+			log.Println(err)
 		}
-
-		// linear PWM increase beteween tempMin and tempMax, from fanMin to fanMax
-		fanPWM := *fanMin + ((*fanMax-*fanMin)/(*tempMax-*tempMin))*(tempCur-*tempMin)
-
-		// upper cap fanPWM to fanMax
-		if fanPWM > *fanMax {
-			fanPWM = *fanMax
+		if state.SensorErr != nil {
+			log.Printf("%v, running fan at full speed", state.SensorErr)
 		}
-
-		if cooldown {
-			// keep fanPWM at fanMin during cooldown
-			if fanPWM < *fanMin {
-				fanPWM = *fanMin
-			}
-
-			// cooldown period finished, fan off
-			if tempCur < *tempCooldown {
-				fanPWM = 0
-				cooldown = false
+		if state.Running != running {
+			running = state.Running
+			if running {
+				fmt.Println("Fan turned ON.")
+			} else {
 				fmt.Println("Fan turned OFF.")
 			}
+		}
 
-		} else if tempCur >= *tempMin {
-			// tempMin exeeded, start fan
-			cooldown = true
-			fmt.Println("Fan turned ON.")
-
-			if *fanKickstart > 0 {
-				if *verbose {
-					fmt.Printf("Kickstart for %v seconds!\n", *fanKickstart)
-				}
-				writeValueFile(*fanFile, strconv.Itoa(*fanMax))
-				time.Sleep(time.Duration(*fanKickstart) * time.Second)
-			}
-		} else {
-			fanPWM = 0
+		// report the current state, e.g. for the middleware fan status
+		if *metricsFile != "" {
+			writeMetrics(*metricsFile, state)
 		}
-		// adjust fan speed
-		writeValueFile(*fanFile, strconv.Itoa(fanPWM))
 
 		if *verbose {
-			fmt.Printf("temperature: %v / fan set to: %v / kickstart: %v / cooldown: %v\n", tempCur, fanPWM, *fanKickstart, cooldown)
+			fmt.Printf("temperature: %.1f / fan set to: %v / kickstart: %v / cooldown: %v\n", state.Temp, state.PWM, *fanKickstart, state.Running)
 		}
 
-		time.Sleep(time.Duration(*cycle) * time.Second)
+		select {
+		case settings := <-redisSettings:
+			// the new settings are used in the next cycle, which starts immediately
+			applySettings(fan, flagSettings, settings)
+		case <-time.After(cycleDuration):
+		}
 	}
 }
@@ -0,0 +1,137 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fancontrol controls the fan speed according to the system temperature. The fan PWM value is calculated by a
+// pluggable Controller, while the Fan switches the fan on and off with a hysteresis.
+package fancontrol
+
+import (
+	"math"
+	"time"
+)
+
+// Controller calculates the fan PWM value for the current temperature while the fan is running.
+type Controller interface {
+	// PWM returns the fan PWM value for the temperature in °C. It is called once per cycle, with the cycle length.
+	PWM(temp float64, cycle time.Duration) int
+	// Reset clears the internal state of the controller, e.g. when the fan is turned off.
+	Reset()
+}
+
+// Linear increases the PWM value linearly from FanMin at TempMin to FanMax at TempMax.
+type Linear struct {
+	TempMin float64
+	TempMax float64
+	FanMin  int
+	FanMax  int
+}
+
+// PWM implements Controller.
+func (l *Linear) PWM(temp float64, cycle time.Duration) int {
+	slope := float64(l.FanMax-l.FanMin) / (l.TempMax - l.TempMin)
+	return clamp(int(math.Round(float64(l.FanMin)+slope*(temp-l.TempMin))), l.FanMin, l.FanMax)
+}
+
+// Reset implements Controller. The linear controller has no state.
+func (l *Linear) Reset() {}
+
+// Point is a point of a Curve, mapping a temperature in °C to a fan PWM value.
+type Point struct {
+	Temp float64 `json:"temp"`
+	PWM  int     `json:"pwm"`
+}
+
+// Curve interpolates the PWM value linearly between its points, which are sorted by temperature. Below the first and
+// above the last point, the PWM value of that point is used.
+type Curve struct {
+	Points []Point
+}
+
+// PWM implements Controller.
+func (c *Curve) PWM(temp float64, cycle time.Duration) int {
+	if len(c.Points) == 0 {
+		return 0
+	}
+	if temp <= c.Points[0].Temp {
+		return c.Points[0].PWM
+	}
+	for i := 1; i < len(c.Points); i++ {
+		lower, upper := c.Points[i-1], c.Points[i]
+		if temp <= upper.Temp {
+			slope := float64(upper.PWM-lower.PWM) / (upper.Temp - lower.Temp)
+			return int(math.Round(float64(lower.PWM) + slope*(temp-lower.Temp)))
+		}
+	}
+	return c.Points[len(c.Points)-1].PWM
+}
+
+// Reset implements Controller. The curve controller has no state.
+func (c *Curve) Reset() {}
+
+// PID keeps the temperature at the Target temperature by adjusting the PWM value, starting from FanMin, with a
+// proportional, integral and derivative term. The integral is limited to the PWM range, so that it doesn't wind up while
+// the fan runs at FanMin or FanMax.
+type PID struct {
+	Target float64
+	Kp     float64
+	Ki     float64
+	Kd     float64
+	FanMin int
+	FanMax int
+
+	integral  float64
+	lastError float64
+	started   bool
+}
+
+// PWM implements Controller.
+func (p *PID) PWM(temp float64, cycle time.Duration) int {
+	seconds := cycle.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+	err := temp - p.Target
+
+	derivative := 0.0
+	if p.started {
+		derivative = (err - p.lastError) / seconds
+	}
+	p.lastError = err
+	p.started = true
+
+	if p.Ki != 0 {
+		limit := float64(p.FanMax-p.FanMin) / p.Ki
+		p.integral = math.Max(-limit, math.Min(limit, p.integral+err*seconds))
+	}
+
+	output := float64(p.FanMin) + p.Kp*err + p.Ki*p.integral + p.Kd*derivative
+	return clamp(int(math.Round(output)), p.FanMin, p.FanMax)
+}
+
+// Reset implements Controller.
+func (p *PID) Reset() {
+	p.integral = 0
+	p.lastError = 0
+	p.started = false
+}
+
+func clamp(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
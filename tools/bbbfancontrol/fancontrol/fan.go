@@ -0,0 +1,136 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fancontrol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PWMFull is the PWM value for full fan speed.
+const PWMFull = 255
+
+// State is the result of a control cycle.
+type State struct {
+	// Temp is the temperature in °C. It is zero if it couldn't be read.
+	Temp float64
+	// PWM is the PWM value written to the fan control file.
+	PWM int
+	// Running is true while the fan runs until the temperature cooled down to TempCooldown.
+	Running bool
+	// SensorErr is set if the temperature couldn't be read. The fan then runs at full speed.
+	SensorErr error
+}
+
+// Fan controls the fan with the controller of its configuration. The fan is turned on at TempMin and turned off again
+// below TempCooldown. If the temperature can't be read, the fan runs at full speed, as the system might be overheating.
+type Fan struct {
+	tempFile   string
+	fanFile    string
+	kickstart  time.Duration
+	config     Config
+	controller Controller
+	running    bool
+}
+
+// NewFan returns a fan reading the temperature from tempFile, in °C * 1000, and writing the PWM value to fanFile.
+// If kickstart is not zero, the fan runs at full speed for this duration when it is turned on.
+func NewFan(tempFile string, fanFile string, kickstart time.Duration, config Config) (*Fan, error) {
+	controller, err := config.NewController()
+	if err != nil {
+		return nil, err
+	}
+	return &Fan{
+		tempFile:   tempFile,
+		fanFile:    fanFile,
+		kickstart:  kickstart,
+		config:     config,
+		controller: controller,
+	}, nil
+}
+
+// Config returns the current configuration.
+func (f *Fan) Config() Config {
+	return f.config
+}
+
+// SetConfig replaces the configuration while the fan control is running. The fan keeps running, if it is, and the new
+// controller takes over in the next cycle.
+func (f *Fan) SetConfig(config Config) error {
+	controller, err := config.NewController()
+	if err != nil {
+		return err
+	}
+	f.config = config
+	f.controller = controller
+	return nil
+}
+
+// Step reads the temperature, calculates the PWM value and writes it to the fan control file. The returned error is set
+// if the PWM value couldn't be written.
+func (f *Fan) Step(cycle time.Duration) (State, error) {
+	temp, err := ReadTemperature(f.tempFile)
+	if err != nil {
+		// safe fallback: the fan keeps running at full speed until the temperature can be read again
+		f.running = true
+		f.controller.Reset()
+		return State{PWM: PWMFull, Running: true, SensorErr: err}, f.writePWM(PWMFull)
+	}
+
+	state := State{Temp: temp}
+	switch {
+	case f.running && temp < f.config.TempCooldown:
+		f.running = false
+		f.controller.Reset()
+	case !f.running && temp >= f.config.TempMin:
+		f.running = true
+		if f.kickstart > 0 {
+			if err := f.writePWM(PWMFull); err != nil {
+				return state, err
+			}
+			time.Sleep(f.kickstart)
+		}
+	}
+
+	if f.running {
+		state.PWM = clamp(f.controller.PWM(temp, cycle), f.config.FanMin, f.config.FanMax)
+	}
+	state.Running = f.running
+	return state, f.writePWM(state.PWM)
+}
+
+func (f *Fan) writePWM(pwm int) error {
+	err := ioutil.WriteFile(f.fanFile, []byte(strconv.Itoa(pwm)), 0644)
+	if err != nil {
+		return fmt.Errorf("writing the fan PWM value failed: %v", err)
+	}
+	return nil
+}
+
+// ReadTemperature reads a temperature in °C * 1000, e.g. `45000` for 45°C, and returns it in °C.
+func ReadTemperature(filepath string) (float64, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return 0, fmt.Errorf("reading the temperature failed: %v", err)
+	}
+	milliCelsius, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing the temperature failed: %v", err)
+	}
+	return float64(milliCelsius) / 1000, nil
+}
@@ -0,0 +1,335 @@
+package fancontrol_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbfancontrol/fancontrol"
+
+	"github.com/stretchr/testify/require"
+)
+
+const cycle = 10 * time.Second
+
+// fakeSysfs creates a temporary temperature and fan control file, like the ones in /sys/class.
+func fakeSysfs(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "fancontrol")
+	require.NoError(t, err)
+	tempFile := filepath.Join(dir, "temp")
+	fanFile := filepath.Join(dir, "pwm1")
+	require.NoError(t, ioutil.WriteFile(fanFile, []byte("0"), 0644))
+	return tempFile, fanFile, func() { os.RemoveAll(dir) }
+}
+
+func readPWM(t *testing.T, fanFile string) int {
+	data, err := ioutil.ReadFile(fanFile)
+	require.NoError(t, err)
+	pwm, err := strconv.Atoi(string(data))
+	require.NoError(t, err)
+	return pwm
+}
+
+func TestLinear(t *testing.T) {
+	// the slope is 135 / 15 = 9 per °C, which was truncated to 9 by integer division before
+	linear := &fancontrol.Linear{TempMin: 60, TempMax: 75, FanMin: 120, FanMax: 255}
+	tests := []struct {
+		temp        float64
+		expectedPWM int
+	}{
+		{temp: 55, expectedPWM: 120},
+		{temp: 60, expectedPWM: 120},
+		{temp: 67.5, expectedPWM: 188},
+		{temp: 75, expectedPWM: 255},
+		{temp: 90, expectedPWM: 255},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expectedPWM, linear.PWM(test.temp, cycle), "temp %v", test.temp)
+	}
+
+	// 135 / 20 = 6.75 per °C was truncated to 6
+	linear = &fancontrol.Linear{TempMin: 45, TempMax: 65, FanMin: 120, FanMax: 255}
+	require.Equal(t, 188, linear.PWM(55, cycle))
+}
+
+func TestCurve(t *testing.T) {
+	curve := &fancontrol.Curve{Points: []fancontrol.Point{{Temp: 50, PWM: 100}, {Temp: 60, PWM: 150}, {Temp: 70, PWM: 255}}}
+	tests := []struct {
+		temp        float64
+		expectedPWM int
+	}{
+		{temp: 40, expectedPWM: 100},
+		{temp: 50, expectedPWM: 100},
+		{temp: 55, expectedPWM: 125},
+		{temp: 60, expectedPWM: 150},
+		{temp: 65, expectedPWM: 203},
+		{temp: 80, expectedPWM: 255},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expectedPWM, curve.PWM(test.temp, cycle), "temp %v", test.temp)
+	}
+}
+
+func TestPID(t *testing.T) {
+	pid := &fancontrol.PID{Target: 50, Kp: 10, Ki: 0.1, Kd: 0, FanMin: 100, FanMax: 255}
+
+	// at the target, the fan runs at FanMin
+	require.Equal(t, 100, pid.PWM(50, cycle))
+	// above the target, the proportional and integral terms speed it up
+	require.Equal(t, 155, pid.PWM(55, cycle))
+	// the integral keeps increasing the speed while the temperature stays above the target
+	require.Equal(t, 160, pid.PWM(55, cycle))
+	// the output is limited to FanMax
+	require.Equal(t, 255, pid.PWM(90, cycle))
+
+	pid.Reset()
+	require.Equal(t, 100, pid.PWM(40, cycle))
+}
+
+func TestPIDAntiWindup(t *testing.T) {
+	pid := &fancontrol.PID{Target: 50, Kp: 0, Ki: 1, FanMin: 100, FanMax: 255}
+	for i := 0; i < 100; i++ {
+		require.Equal(t, 255, pid.PWM(90, cycle))
+	}
+	// the integral is limited, so the speed decreases right after the temperature dropped below the target
+	require.Less(t, pid.PWM(40, cycle), 255)
+}
+
+func TestProfiles(t *testing.T) {
+	require.Equal(t, []string{"balanced", "performance", "silent"}, fancontrol.ProfileNames())
+	for _, name := range fancontrol.ProfileNames() {
+		config, err := fancontrol.Profile(name)
+		require.NoError(t, err)
+		require.NoError(t, config.Validate(), name)
+	}
+	_, err := fancontrol.Profile("turbo")
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	balanced, err := fancontrol.Profile(fancontrol.ProfileBalanced)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(*fancontrol.Config)
+		valid  bool
+	}{
+		{name: "balanced", modify: func(c *fancontrol.Config) {}, valid: true},
+		{name: "cooldown above tmin", modify: func(c *fancontrol.Config) { c.TempCooldown = 65 }},
+		{name: "tmin above tmax", modify: func(c *fancontrol.Config) { c.TempMin = 80 }},
+		{name: "fmax above 255", modify: func(c *fancontrol.Config) { c.FanMax = 300 }},
+		{name: "fmin above fmax", modify: func(c *fancontrol.Config) { c.FanMin = 200; c.FanMax = 150 }},
+		{name: "unknown controller", modify: func(c *fancontrol.Config) { c.Controller = "bangbang" }},
+		{name: "curve without points", modify: func(c *fancontrol.Config) { c.Controller = fancontrol.ControllerCurve }},
+		{
+			name: "unsorted curve",
+			modify: func(c *fancontrol.Config) {
+				c.Controller = fancontrol.ControllerCurve
+				c.Points = []fancontrol.Point{{Temp: 70, PWM: 200}, {Temp: 60, PWM: 120}}
+			},
+		},
+		{name: "negative pid gain", modify: func(c *fancontrol.Config) { c.Controller = fancontrol.ControllerPID; c.Ki = -1 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := balanced
+			test.modify(&config)
+			if test.valid {
+				require.NoError(t, config.Validate())
+			} else {
+				require.Error(t, config.Validate())
+			}
+		})
+	}
+}
+
+func TestFanHysteresis(t *testing.T) {
+	tempFile, fanFile, cleanup := fakeSysfs(t)
+	defer cleanup()
+
+	config, err := fancontrol.Profile(fancontrol.ProfileBalanced)
+	require.NoError(t, err)
+	fan, err := fancontrol.NewFan(tempFile, fanFile, 0, config)
+	require.NoError(t, err)
+
+	steps := []struct {
+		temp            string
+		expectedPWM     int
+		expectedRunning bool
+	}{
+		{temp: "45000", expectedPWM: 0, expectedRunning: false},
+		{temp: "59999", expectedPWM: 0, expectedRunning: false},
+		// turned on at tmin
+		{temp: "60000", expectedPWM: 120, expectedRunning: true},
+		{temp: "70000\n", expectedPWM: 210, expectedRunning: true},
+		// keeps running at fmin until cooled down
+		{temp: "56000", expectedPWM: 120, expectedRunning: true},
+		{temp: "55000", expectedPWM: 120, expectedRunning: true},
+		// turned off below cooldown
+		{temp: "54999", expectedPWM: 0, expectedRunning: false},
+		{temp: "58000", expectedPWM: 0, expectedRunning: false},
+	}
+	for _, step := range steps {
+		require.NoError(t, ioutil.WriteFile(tempFile, []byte(step.temp), 0644))
+		state, err := fan.Step(cycle)
+		require.NoError(t, err)
+		require.NoError(t, state.SensorErr)
+		require.Equal(t, step.expectedPWM, state.PWM, "temp %s", step.temp)
+		require.Equal(t, step.expectedRunning, state.Running, "temp %s", step.temp)
+		require.Equal(t, step.expectedPWM, readPWM(t, fanFile))
+	}
+}
+
+func TestFanSensorError(t *testing.T) {
+	tests := []struct {
+		name string
+		// temp is written into the temperature file, which is missing if it is empty
+		temp string
+	}{
+		{name: "missing sensor", temp: ""},
+		{name: "invalid value", temp: "hot"},
+		{name: "empty value", temp: "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tempFile, fanFile, cleanup := fakeSysfs(t)
+			defer cleanup()
+			if test.temp != "" {
+				require.NoError(t, ioutil.WriteFile(tempFile, []byte(test.temp), 0644))
+			}
+
+			config, err := fancontrol.Profile(fancontrol.ProfileSilent)
+			require.NoError(t, err)
+			fan, err := fancontrol.NewFan(tempFile, fanFile, 0, config)
+			require.NoError(t, err)
+
+			state, err := fan.Step(cycle)
+			require.NoError(t, err)
+			require.Error(t, state.SensorErr)
+			require.Equal(t, fancontrol.PWMFull, state.PWM)
+			require.Equal(t, fancontrol.PWMFull, readPWM(t, fanFile))
+
+			// once the sensor works again, the fan keeps running until it cooled down
+			require.NoError(t, ioutil.WriteFile(tempFile, []byte("60000"), 0644))
+			state, err = fan.Step(cycle)
+			require.NoError(t, err)
+			require.NoError(t, state.SensorErr)
+			require.Equal(t, config.FanMin, state.PWM)
+			require.True(t, state.Running)
+		})
+	}
+}
+
+func TestFanWriteError(t *testing.T) {
+	tempFile, fanFile, cleanup := fakeSysfs(t)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(tempFile, []byte("70000"), 0644))
+
+	config, err := fancontrol.Profile(fancontrol.ProfileBalanced)
+	require.NoError(t, err)
+	fan, err := fancontrol.NewFan(tempFile, filepath.Join(fanFile, "missing", "pwm1"), 0, config)
+	require.NoError(t, err)
+
+	state, err := fan.Step(cycle)
+	require.Error(t, err)
+	require.Equal(t, 210, state.PWM)
+}
+
+func TestNewFanInvalidConfig(t *testing.T) {
+	_, err := fancontrol.NewFan("temp", "pwm1", 0, fancontrol.Config{Controller: fancontrol.ControllerLinear})
+	require.Error(t, err)
+}
+
+func TestConfigFromSettings(t *testing.T) {
+	balanced, err := fancontrol.Profile(fancontrol.ProfileBalanced)
+	require.NoError(t, err)
+	silent, err := fancontrol.Profile(fancontrol.ProfileSilent)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		settings       map[string]string
+		expectedConfig func() fancontrol.Config
+		expectedErr    bool
+	}{
+		{
+			name:           "no settings",
+			settings:       map[string]string{},
+			expectedConfig: func() fancontrol.Config { return balanced },
+		},
+		{
+			name:           "empty settings are ignored",
+			settings:       map[string]string{"profile": "", "tmin": ""},
+			expectedConfig: func() fancontrol.Config { return balanced },
+		},
+		{
+			name:           "profile",
+			settings:       map[string]string{"profile": "silent"},
+			expectedConfig: func() fancontrol.Config { return silent },
+		},
+		{
+			name:     "overrides",
+			settings: map[string]string{"profile": "balanced", "tmin": "62.5", "tmax": "80", "cooldown": "50", "fmin": "90", "fmax": "200"},
+			expectedConfig: func() fancontrol.Config {
+				config := balanced
+				config.TempMin, config.TempMax, config.TempCooldown, config.FanMin, config.FanMax = 62.5, 80, 50, 90, 200
+				return config
+			},
+		},
+		{
+			name:     "controller",
+			settings: map[string]string{"controller": "pid", "target": "55"},
+			expectedConfig: func() fancontrol.Config {
+				config := balanced
+				config.Controller, config.Target = fancontrol.ControllerPID, 55
+				return config
+			},
+		},
+		{name: "unknown profile", settings: map[string]string{"profile": "turbo"}, expectedErr: true},
+		{name: "invalid number", settings: map[string]string{"tmin": "hot"}, expectedErr: true},
+		{name: "inconsistent values", settings: map[string]string{"tmin": "90"}, expectedErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := fancontrol.ConfigFromSettings(test.settings)
+			if test.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expectedConfig(), config)
+		})
+	}
+}
+
+func TestFanSetConfig(t *testing.T) {
+	tempFile, fanFile, cleanup := fakeSysfs(t)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(tempFile, []byte("62000"), 0644))
+
+	balanced, err := fancontrol.Profile(fancontrol.ProfileBalanced)
+	require.NoError(t, err)
+	fan, err := fancontrol.NewFan(tempFile, fanFile, 0, balanced)
+	require.NoError(t, err)
+	state, err := fan.Step(cycle)
+	require.NoError(t, err)
+	require.Equal(t, 138, state.PWM)
+
+	// the silent profile runs the fan slower and keeps it running until it cooled down to 58°C
+	silent, err := fancontrol.Profile(fancontrol.ProfileSilent)
+	require.NoError(t, err)
+	require.NoError(t, fan.SetConfig(silent))
+	require.Equal(t, silent, fan.Config())
+	state, err = fan.Step(cycle)
+	require.NoError(t, err)
+	require.True(t, state.Running)
+	require.Equal(t, 100, state.PWM)
+
+	// an invalid configuration is rejected and the current one kept
+	require.Error(t, fan.SetConfig(fancontrol.Config{Controller: "bangbang"}))
+	require.Equal(t, silent, fan.Config())
+}
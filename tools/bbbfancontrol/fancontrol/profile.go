@@ -0,0 +1,156 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fancontrol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The types of the controllers.
+const (
+	ControllerLinear = "linear"
+	ControllerCurve  = "curve"
+	ControllerPID    = "pid"
+)
+
+// Config configures the fan control.
+type Config struct {
+	// Controller is the type of the controller, e.g. ControllerLinear.
+	Controller string
+	// TempMin is the temperature in °C at which the fan is turned on, and TempCooldown the temperature it needs to cool
+	// down to before it is turned off again.
+	TempMin      float64
+	TempCooldown float64
+	// TempMax is the temperature in °C at which the linear controller runs the fan at FanMax.
+	TempMax float64
+	// FanMin and FanMax limit the PWM value while the fan is running.
+	FanMin int
+	FanMax int
+	// Points are the points of the curve controller.
+	Points []Point
+	// Target, Kp, Ki and Kd are the target temperature in °C and the gains of the PID controller.
+	Target float64
+	Kp     float64
+	Ki     float64
+	Kd     float64
+}
+
+// The names of the profiles.
+const (
+	ProfileSilent      = "silent"
+	ProfileBalanced    = "balanced"
+	ProfilePerformance = "performance"
+)
+
+// Profiles are the predefined configurations.
+//   - silent: runs the fan slowly along a curve and only turns it on at higher temperatures.
+//   - balanced: the linear curve the BitBoxBase always used.
+//   - performance: keeps the temperature low with a PID controller.
+var Profiles = map[string]Config{
+	ProfileSilent: {
+		Controller:   ControllerCurve,
+		TempMin:      65,
+		TempCooldown: 58,
+		TempMax:      82,
+		FanMin:       100,
+		FanMax:       255,
+		Points:       []Point{{Temp: 65, PWM: 100}, {Temp: 72, PWM: 140}, {Temp: 78, PWM: 200}, {Temp: 82, PWM: 255}},
+	},
+	ProfileBalanced: {
+		Controller:   ControllerLinear,
+		TempMin:      60,
+		TempCooldown: 55,
+		TempMax:      75,
+		FanMin:       120,
+		FanMax:       255,
+	},
+	ProfilePerformance: {
+		Controller:   ControllerPID,
+		TempMin:      45,
+		TempCooldown: 40,
+		TempMax:      60,
+		FanMin:       120,
+		FanMax:       255,
+		Target:       50,
+		Kp:           12,
+		Ki:           0.2,
+		Kd:           20,
+	},
+}
+
+// ProfileNames returns the sorted names of the profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the configuration of a profile.
+func Profile(name string) (Config, error) {
+	config, ok := Profiles[name]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown profile %q", name)
+	}
+	return config, nil
+}
+
+// Validate checks that the configuration is consistent.
+func (c Config) Validate() error {
+	if c.TempCooldown > c.TempMin || c.TempMin >= c.TempMax {
+		return fmt.Errorf("inconsistent temperature range: cooldown (%v) must be <= tmin (%v) must be < tmax (%v)",
+			c.TempCooldown, c.TempMin, c.TempMax)
+	}
+	if c.FanMin < 0 || c.FanMin > c.FanMax || c.FanMax > 255 {
+		return fmt.Errorf("inconsistent fan range: 0 <= fmin (%v) <= fmax (%v) <= 255", c.FanMin, c.FanMax)
+	}
+	switch c.Controller {
+	case ControllerLinear:
+	case ControllerCurve:
+		if len(c.Points) < 2 {
+			return errors.New("the curve needs at least two points")
+		}
+		for i := 1; i < len(c.Points); i++ {
+			if c.Points[i].Temp <= c.Points[i-1].Temp {
+				return errors.New("the curve points need to be sorted by temperature")
+			}
+		}
+	case ControllerPID:
+		if c.Kp < 0 || c.Ki < 0 || c.Kd < 0 {
+			return errors.New("the PID gains must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown controller %q", c.Controller)
+	}
+	return nil
+}
+
+// NewController returns the controller of the configuration.
+func (c Config) NewController() (Controller, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Controller {
+	case ControllerCurve:
+		return &Curve{Points: c.Points}, nil
+	case ControllerPID:
+		return &PID{Target: c.Target, Kp: c.Kp, Ki: c.Ki, Kd: c.Kd, FanMin: c.FanMin, FanMax: c.FanMax}, nil
+	}
+	return &Linear{TempMin: c.TempMin, TempMax: c.TempMax, FanMin: c.FanMin, FanMax: c.FanMax}, nil
+}
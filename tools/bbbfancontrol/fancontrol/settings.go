@@ -0,0 +1,87 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fancontrol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The names of the settings, used as command line arguments and, with the "fan:" prefix, as redis keys.
+const (
+	SettingProfile    = "profile"
+	SettingController = "controller"
+	SettingTempMin    = "tmin"
+	SettingTempMax    = "tmax"
+	SettingCooldown   = "cooldown"
+	SettingTarget     = "target"
+	SettingFanMin     = "fmin"
+	SettingFanMax     = "fmax"
+)
+
+// SettingNames are the names of all settings.
+var SettingNames = []string{
+	SettingProfile, SettingController, SettingTempMin, SettingTempMax, SettingCooldown, SettingTarget, SettingFanMin, SettingFanMax,
+}
+
+// ConfigFromSettings returns the configuration of the profile setting, or of the balanced profile if it is not set,
+// with the other settings overriding single values of the profile. Empty settings are ignored.
+func ConfigFromSettings(settings map[string]string) (Config, error) {
+	profile := settings[SettingProfile]
+	if profile == "" {
+		profile = ProfileBalanced
+	}
+	config, err := Profile(profile)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if controller := settings[SettingController]; controller != "" {
+		config.Controller = controller
+	}
+	floats := map[string]*float64{
+		SettingTempMin:  &config.TempMin,
+		SettingTempMax:  &config.TempMax,
+		SettingCooldown: &config.TempCooldown,
+		SettingTarget:   &config.Target,
+	}
+	for name, value := range floats {
+		if settings[name] == "" {
+			continue
+		}
+		*value, err = strconv.ParseFloat(settings[name], 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid value %q for %s", settings[name], name)
+		}
+	}
+	ints := map[string]*int{
+		SettingFanMin: &config.FanMin,
+		SettingFanMax: &config.FanMax,
+	}
+	for name, value := range ints {
+		if settings[name] == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(settings[name])
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid value %q for %s", settings[name], name)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
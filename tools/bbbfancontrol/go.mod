@@ -1,3 +1,8 @@
 module github.com/digitalbitbox/bitbox-base/tools/bbbfancontrol
 
 go 1.13
+
+require (
+	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/stretchr/testify v1.4.0
+)
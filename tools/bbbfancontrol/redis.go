@@ -0,0 +1,96 @@
+// Copyright 2019 Shift Cryptosecurity AG, Switzerland.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbfancontrol/fancontrol"
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisKeyPrefix is the prefix of the redis keys of the settings, e.g. "fan:profile".
+const redisKeyPrefix = "fan:"
+
+// redisKeyspaceChannel is the pattern of the keyspace notification channels of the settings keys. The notifications
+// need to be enabled in the redis config with `notify-keyspace-events K$g`.
+const redisKeyspaceChannel = "__keyspace@0__:" + redisKeyPrefix + "*"
+
+// redisRetryDelay is the delay before reconnecting to redis after an error.
+const redisRetryDelay = 30 * time.Second
+
+// watchRedisSettings sends the settings stored in redis to the channel, once after connecting and again whenever one of
+// the keys changes. Missing keys are sent as empty settings. If redis is not reachable, it retries after redisRetryDelay.
+// It never returns.
+func watchRedisSettings(port string, settings chan<- map[string]string) {
+	for {
+		err := subscribeRedisSettings("localhost:"+port, settings)
+		log.Printf("redis: %v, retrying in %v", err, redisRetryDelay)
+		time.Sleep(redisRetryDelay)
+	}
+}
+
+// subscribeRedisSettings subscribes to the keyspace notifications of the settings keys and sends the settings until an
+// error occurs.
+func subscribeRedisSettings(address string, settings chan<- map[string]string) error {
+	// a subscribed connection can't run other commands, so the settings are read with a second connection
+	conn, err := redis.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	subscription := redis.PubSubConn{Conn: conn}
+	if err := subscription.PSubscribe(redisKeyspaceChannel); err != nil {
+		return err
+	}
+
+	readConn, err := redis.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer readConn.Close()
+
+	for {
+		switch message := subscription.Receive().(type) {
+		case error:
+			return message
+		case redis.Subscription, redis.Message:
+			// the settings are read once the subscription is confirmed, so that no change is missed
+			values, err := readRedisSettings(readConn)
+			if err != nil {
+				return err
+			}
+			settings <- values
+		}
+	}
+}
+
+// readRedisSettings reads the values of all settings keys.
+func readRedisSettings(conn redis.Conn) (map[string]string, error) {
+	keys := make([]interface{}, len(fancontrol.SettingNames))
+	for i, name := range fancontrol.SettingNames {
+		keys[i] = redisKeyPrefix + name
+	}
+	values, err := redis.Strings(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(values))
+	for i, name := range fancontrol.SettingNames {
+		settings[name] = values[i]
+	}
+	return settings, nil
+}
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/supervisor"
 )
 
 const (
 	helpText = `
-	Watches systemd logs (via journalctl) and queries Prometheus to detect potential issues and take action.
+	Watches systemd logs (via journalctl), the state of systemd units and queries Prometheus to detect potential issues and take action.
 
 	Command-line arguments:
 	--help
 	--redis-port   			redis port (default 6379)
 	--prometheus-port   prometheus port (default 9090)
+	--rules             path to the JSON rule file (default /etc/bbbsupervisor/rules.json)
+	--reset-state       clear the state persisted in redis, e.g. when the actions of the rules were last executed
+	--middleware-pipe   named pipe for IPC notifications to the middleware (default /tmp/middleware-notification.pipe)
+	--history           print the restart and escalation decision history as JSON and exit
   --version
 	`
 
@@ -28,13 +34,26 @@ var (
 	helpArg        = flag.Bool("help", false, "show help")
 	redisPort      = flag.String("redis-port", "6379", "redis server port")
 	prometheusPort = flag.String("prometheus-port", "9090", "prometheus sever port")
+	rulesFile      = flag.String("rules", "/etc/bbbsupervisor/rules.json", "path to the JSON rule file")
+	resetStateArg  = flag.Bool("reset-state", false, "clear the supervisor state persisted in redis")
+	middlewarePipe = flag.String("middleware-pipe", "/tmp/middleware-notification.pipe", "named pipe for IPC notifications to the middleware")
+	historyArg     = flag.Bool("history", false, "print the decision history and exit")
 	versionArg     = flag.Bool("version", false, "prints the version")
 )
 
 func main() {
 	flag.Parse()
 	handleFlags()
-	s := supervisor.New(*redisPort, *prometheusPort)
+	config, err := rules.Load(*rulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %d rules from %s\n", len(config.Rules), *rulesFile)
+	s := supervisor.New(*redisPort, *prometheusPort, config, *middlewarePipe, *resetStateArg)
+	if *historyArg {
+		printHistory(s)
+		return
+	}
 	s.Start()
 	s.Loop()
 }
@@ -48,4 +67,16 @@ func handleFlags() {
 		}
 		os.Exit(0)
 	}
+	if *historyArg && *resetStateArg {
+		log.Fatal("--history can't be combined with --reset-state, as the reset clears the decision history")
+	}
+}
+
+// printHistory prints the decision history of the supervisor as JSON
+func printHistory(s *supervisor.Supervisor) {
+	history, err := json.MarshalIndent(s.DecisionHistory(), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(history))
 }
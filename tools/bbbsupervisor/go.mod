@@ -5,5 +5,9 @@ go 1.13
 require (
 	github.com/digitalbitbox/bitbox-base/middleware v0.0.0-20191204153728-1128dd782517
 	github.com/digitalbitbox/bitbox02-api-go v0.0.0-20191204135529-eb28ed7e9cbd
+	github.com/stretchr/testify v1.4.0
 	github.com/tidwall/gjson v1.3.4
 )
+
+// The systemstate package and the redis sorted set helpers are shared with the middleware in this repository.
+replace github.com/digitalbitbox/bitbox-base/middleware => ../../middleware
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -34,8 +35,9 @@ func (c Client) queryJSON(expression string) (string, error) {
 		Timeout: 5 * time.Second,
 	}
 
-	url := "http://" + host + ":" + c.port + "/api/v1/query?query=" + expression
-	httpResp, err := client.Get(url)
+	// the expression can contain characters like braces, quotes or spaces, e.g. in label matchers
+	queryURL := "http://" + host + ":" + c.port + "/api/v1/query?query=" + url.QueryEscape(expression)
+	httpResp, err := client.Get(queryURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to perform a get GET on the prometheus server: %s", err.Error())
 	}
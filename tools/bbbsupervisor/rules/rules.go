@@ -0,0 +1,374 @@
+// Package rules implements the declarative rules of the supervisor. A rule matches either the systemd log lines of a unit,
+// a Prometheus expression or the state of a systemd unit and names the actions to take when it matches. The rules are loaded from a JSON rule file,
+// so that behaviour can be added to the supervisor without changing its code.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+)
+
+// The types of the actions a rule can take.
+const (
+	// ActionRestartUnit restarts the systemd unit `Unit`.
+	ActionRestartUnit = "restart-unit"
+	// ActionSetConfig sets the `Key` to the `Value` via `bbb-config.sh set`.
+	ActionSetConfig = "set-config"
+	// ActionSetHeartbeatCode activates or deactivates the HSM heartbeat description code `Code`.
+	ActionSetHeartbeatCode = "set-heartbeat-code"
+	// ActionRunCommand runs the `Command` with the `Args`.
+	ActionRunCommand = "run-command"
+	// ActionBuiltin runs the built-in `Handler` of the supervisor, for logic that can't be expressed in a rule.
+	ActionBuiltin = "builtin"
+	// ActionReboot gracefully reboots the Base for the `Reason`, within the reboot budget.
+	ActionReboot = "reboot"
+	// ActionThrottleCPU limits the CPU frequency to `Percent` of the maximum if `Active` is true, and removes the limit
+	// otherwise.
+	ActionThrottleCPU = "throttle-cpu"
+)
+
+// The reasons of an ActionReboot. Each reason is logged with its own logtag before rebooting.
+const (
+	RebootReasonOutOfMemory = "out-of-memory"
+	RebootReasonZramFailure = "zram-failure"
+)
+
+// KernelLog is the unit of rules with a LogMatcher that watch the kernel log instead of the log of a systemd unit.
+const KernelLog = "kernel"
+
+// BuiltinDisableIBDState is the built-in handler that disables the IBD state of the Base once the block height is plausible.
+const BuiltinDisableIBDState = "disable-ibd-state"
+
+// Duration is a time.Duration that is read from a JSON string like "30s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LogMatcher matches the systemd log lines of the unit of a rule, either by a substring or by a regular expression.
+type LogMatcher struct {
+	Contains string `json:"contains,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Matches returns true if the log line matches.
+func (m *LogMatcher) Matches(line string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(line)
+	}
+	return strings.Contains(line, m.Contains)
+}
+
+// PrometheusMatcher periodically queries a Prometheus expression and compares the value with a threshold.
+// The rule matches each time the comparison becomes true, including the first query.
+type PrometheusMatcher struct {
+	Expression string   `json:"expression"`
+	Interval   Duration `json:"interval"`
+	// Operator is one of ==, !=, <, <=, > and >=.
+	Operator  string  `json:"operator"`
+	Threshold float64 `json:"threshold"`
+}
+
+// Matches returns true if the measured value compared with the threshold is true.
+func (m *PrometheusMatcher) Matches(value float64) bool {
+	switch m.Operator {
+	case "==":
+		return value == m.Threshold
+	case "!=":
+		return value != m.Threshold
+	case "<":
+		return value < m.Threshold
+	case "<=":
+		return value <= m.Threshold
+	case ">":
+		return value > m.Threshold
+	case ">=":
+		return value >= m.Threshold
+	}
+	return false
+}
+
+// SystemdMatcher periodically polls the ActiveState of the unit of a rule. The rule matches on each poll the unit is in
+// one of the States, e.g. "failed" or "inactive".
+type SystemdMatcher struct {
+	States   []string `json:"states"`
+	Interval Duration `json:"interval"`
+}
+
+// Matches returns true if the state is one of the matched states.
+func (m *SystemdMatcher) Matches(state string) bool {
+	for _, matched := range m.States {
+		if state == matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Action is an action taken when a rule matches. Only the fields of its Type are used.
+type Action struct {
+	Type string `json:"type"`
+	// Unit is the systemd unit for ActionRestartUnit.
+	Unit string `json:"unit,omitempty"`
+	// Key and Value are the bbb-config.sh arguments for ActionSetConfig.
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Code is the HSM heartbeat description code, e.g. "INITIAL_BLOCK_SYNC", and Active is true to set it and false to
+	// clear it for ActionSetHeartbeatCode. Active is also used by ActionThrottleCPU.
+	Code   string `json:"code,omitempty"`
+	Active bool   `json:"active,omitempty"`
+	// Command and Args are the executable and its arguments for ActionRunCommand.
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	// Handler is the name of the built-in handler for ActionBuiltin.
+	Handler string `json:"handler,omitempty"`
+	// Reason is the reason for ActionReboot, e.g. "out-of-memory".
+	Reason string `json:"reason,omitempty"`
+	// Percent is the maximum CPU frequency in percent of the hardware maximum for an active ActionThrottleCPU.
+	Percent int `json:"percent,omitempty"`
+}
+
+// DescriptionCode returns the HSM heartbeat description code of an ActionSetHeartbeatCode.
+func (a *Action) DescriptionCode() messages.BitBoxBaseHeartbeatRequest_DescriptionCode {
+	return messages.BitBoxBaseHeartbeatRequest_DescriptionCode(messages.BitBoxBaseHeartbeatRequest_DescriptionCode_value[a.Code])
+}
+
+// Rule defines when the supervisor takes which actions. Exactly one of Log, Prometheus and Systemd is set.
+type Rule struct {
+	// Name identifies the rule, e.g. in the logs and in the supervisor state.
+	Name string `json:"name"`
+	// Unit is the systemd unit the rule belongs to. The log or state of this unit is watched for the rules with a
+	// LogMatcher or SystemdMatcher. The KernelLog unit watches the kernel log. It is optional for rules with a
+	// PrometheusMatcher.
+	Unit       string             `json:"unit"`
+	Log        *LogMatcher        `json:"log,omitempty"`
+	Prometheus *PrometheusMatcher `json:"prometheus,omitempty"`
+	Systemd    *SystemdMatcher    `json:"systemd,omitempty"`
+	Actions    []Action           `json:"actions"`
+	// FloodDelay is the minimal delay between two executions of the actions of the rule.
+	FloodDelay Duration `json:"floodDelay"`
+}
+
+// RestartBudget limits how often the restart-unit actions may restart a unit. If the unit was already restarted
+// MaxRestarts times within the Window, the supervisor escalates instead: it stops the unit, marks it as failed, which
+// sets the ERROR state code in the HSM heartbeat, and notifies the Middleware.
+type RestartBudget struct {
+	Unit        string   `json:"unit"`
+	MaxRestarts int      `json:"maxRestarts"`
+	Window      Duration `json:"window"`
+}
+
+// DefaultRestartBudget is the restart budget of the units without a restart budget in the rule file.
+var DefaultRestartBudget = RestartBudget{MaxRestarts: 5, Window: Duration(time.Hour)}
+
+// RebootBudget limits how often the reboot actions may reboot the Base. A reboot exceeding the budget is not done.
+type RebootBudget struct {
+	MaxReboots int      `json:"maxReboots"`
+	Window     Duration `json:"window"`
+}
+
+// DefaultRebootBudget is the reboot budget if the rule file does not define one.
+var DefaultRebootBudget = RebootBudget{MaxReboots: 2, Window: Duration(24 * time.Hour)}
+
+// Config is the content of the JSON rule file.
+type Config struct {
+	Rules          []Rule          `json:"rules"`
+	RestartBudgets []RestartBudget `json:"restartBudgets"`
+	RebootBudget   *RebootBudget   `json:"rebootBudget,omitempty"`
+}
+
+// RestartBudget returns the restart budget of a unit.
+func (config *Config) RestartBudget(unit string) RestartBudget {
+	for _, budget := range config.RestartBudgets {
+		if budget.Unit == unit {
+			return budget
+		}
+	}
+	budget := DefaultRestartBudget
+	budget.Unit = unit
+	return budget
+}
+
+// GetRebootBudget returns the reboot budget of the rule file or the DefaultRebootBudget.
+func (config *Config) GetRebootBudget() RebootBudget {
+	if config.RebootBudget == nil {
+		return DefaultRebootBudget
+	}
+	return *config.RebootBudget
+}
+
+// Load reads and validates the JSON rule file at path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the rule file: %v", err)
+	}
+	config, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Parse parses and validates a JSON encoded rule file.
+func Parse(data []byte) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d (%q): %v", i, rule.Name, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %d: the name %q is not unique", i, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	units := make(map[string]bool)
+	for i, budget := range config.RestartBudgets {
+		if budget.Unit == "" || units[budget.Unit] {
+			return nil, fmt.Errorf("restart budget %d: the unit %q is missing or not unique", i, budget.Unit)
+		}
+		if budget.MaxRestarts < 0 || budget.Window <= 0 {
+			return nil, fmt.Errorf("restart budget %d (%q): maxRestarts can't be negative and the window needs to be positive", i, budget.Unit)
+		}
+		units[budget.Unit] = true
+	}
+	if config.RebootBudget != nil && (config.RebootBudget.MaxReboots < 0 || config.RebootBudget.Window <= 0) {
+		return nil, errors.New("reboot budget: maxReboots can't be negative and the window needs to be positive")
+	}
+	return &config, nil
+}
+
+// validate checks the rule and compiles the regular expression of its LogMatcher.
+func (rule *Rule) validate() error {
+	if rule.Name == "" {
+		return errors.New("the name is missing")
+	}
+	matchers := 0
+	for _, isSet := range []bool{rule.Log != nil, rule.Prometheus != nil, rule.Systemd != nil} {
+		if isSet {
+			matchers++
+		}
+	}
+	if matchers != 1 {
+		return errors.New("exactly one of log, prometheus and systemd needs to be set")
+	}
+	if rule.Unit == "" && rule.Prometheus == nil {
+		return errors.New("the unit is missing")
+	}
+	if rule.Log != nil {
+		if (rule.Log.Contains == "") == (rule.Log.Regex == "") {
+			return errors.New("exactly one of contains and regex needs to be set for log")
+		}
+		if rule.Log.Regex != "" {
+			regex, err := regexp.Compile(rule.Log.Regex)
+			if err != nil {
+				return fmt.Errorf("invalid regex: %v", err)
+			}
+			rule.Log.regex = regex
+		}
+	}
+	if rule.Prometheus != nil {
+		if rule.Prometheus.Expression == "" {
+			return errors.New("the prometheus expression is missing")
+		}
+		if rule.Prometheus.Interval <= 0 {
+			return errors.New("the prometheus interval needs to be positive")
+		}
+		switch rule.Prometheus.Operator {
+		case "==", "!=", "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("unknown prometheus operator %q", rule.Prometheus.Operator)
+		}
+	}
+	if rule.Systemd != nil {
+		if len(rule.Systemd.States) == 0 {
+			return errors.New("the systemd states are missing")
+		}
+		for _, state := range rule.Systemd.States {
+			switch state {
+			case "active", "reloading", "inactive", "failed", "activating", "deactivating":
+			default:
+				return fmt.Errorf("unknown systemd state %q", state)
+			}
+		}
+		if rule.Systemd.Interval <= 0 {
+			return errors.New("the systemd interval needs to be positive")
+		}
+	}
+	if len(rule.Actions) == 0 {
+		return errors.New("no actions defined")
+	}
+	for i, action := range rule.Actions {
+		if err := action.validate(); err != nil {
+			return fmt.Errorf("action %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// validate checks that the fields required by the action type are set.
+func (a *Action) validate() error {
+	switch a.Type {
+	case ActionRestartUnit:
+		if a.Unit == "" {
+			return errors.New("the unit is missing")
+		}
+	case ActionSetConfig:
+		if a.Key == "" || a.Value == "" {
+			return errors.New("the key or value is missing")
+		}
+	case ActionSetHeartbeatCode:
+		if _, ok := messages.BitBoxBaseHeartbeatRequest_DescriptionCode_value[a.Code]; !ok {
+			return fmt.Errorf("unknown description code %q", a.Code)
+		}
+	case ActionRunCommand:
+		if a.Command == "" {
+			return errors.New("the command is missing")
+		}
+	case ActionBuiltin:
+		if a.Handler != BuiltinDisableIBDState {
+			return fmt.Errorf("unknown built-in handler %q", a.Handler)
+		}
+	case ActionReboot:
+		if a.Reason != RebootReasonOutOfMemory && a.Reason != RebootReasonZramFailure {
+			return fmt.Errorf("unknown reboot reason %q", a.Reason)
+		}
+	case ActionThrottleCPU:
+		if a.Active && (a.Percent <= 0 || a.Percent >= 100) {
+			return fmt.Errorf("the percent %d is not between 0 and 100", a.Percent)
+		}
+	default:
+		return fmt.Errorf("unknown action type %q", a.Type)
+	}
+	return nil
+}
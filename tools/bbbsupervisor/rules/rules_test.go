@@ -0,0 +1,129 @@
+package rules_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
+	"github.com/stretchr/testify/require"
+)
+
+// shippedRuleFile is the rule file installed on the Base.
+const shippedRuleFile = "../../../armbian/base/rootfs/etc/bbbsupervisor/rules.json"
+
+func TestLoadShippedRules(t *testing.T) {
+	config, err := rules.Load(shippedRuleFile)
+	require.NoError(t, err)
+	require.NotEmpty(t, config.Rules)
+}
+
+func TestParse(t *testing.T) {
+	config, err := rules.Parse([]byte(`{
+		"rules": [
+			{
+				"name": "electrsRegex",
+				"unit": "electrs",
+				"log": { "regex": "reconnecting to bitcoind: .*" },
+				"actions": [ { "type": "restart-unit", "unit": "electrs" } ],
+				"floodDelay": "30s"
+			},
+			{
+				"name": "ibd",
+				"prometheus": { "expression": "bitcoin_ibd", "interval": "10s", "operator": "==", "threshold": 1 },
+				"actions": [ { "type": "set-heartbeat-code", "code": "INITIAL_BLOCK_SYNC", "active": true } ],
+				"floodDelay": "0s"
+			}
+		],
+		"restartBudgets": [ { "unit": "electrs", "maxRestarts": 3, "window": "10m" } ]
+	}`))
+	require.NoError(t, err)
+	require.Len(t, config.Rules, 2)
+	require.Equal(t, rules.Duration(30*time.Second), config.Rules[0].FloodDelay)
+	require.True(t, config.Rules[0].Log.Matches("WARN - reconnecting to bitcoind: no reply from daemon"))
+	require.False(t, config.Rules[0].Log.Matches("finished full compaction"))
+	require.Equal(t, "INITIAL_BLOCK_SYNC", config.Rules[1].Actions[0].DescriptionCode().String())
+
+	require.Equal(t, rules.RestartBudget{Unit: "electrs", MaxRestarts: 3, Window: rules.Duration(10 * time.Minute)}, config.RestartBudget("electrs"))
+	require.Equal(t, rules.DefaultRestartBudget.MaxRestarts, config.RestartBudget("bitcoind").MaxRestarts)
+	require.Equal(t, "bitcoind", config.RestartBudget("bitcoind").Unit)
+	require.Equal(t, rules.DefaultRebootBudget, config.GetRebootBudget())
+}
+
+func TestParseInvalid(t *testing.T) {
+	// wrap places a rule into a rule file
+	wrap := func(rule string) string {
+		return `{ "rules": [ ` + rule + ` ] }`
+	}
+	const restart = `"actions": [ { "type": "restart-unit", "unit": "electrs" } ]`
+
+	tests := []struct {
+		name     string
+		ruleFile string
+	}{
+		{"invalid json", `{ "rules": [`},
+		{"invalid duration", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, ` + restart + `, "floodDelay": "30" }`)},
+		{"missing name", wrap(`{ "unit": "electrs", "log": { "contains": "x" }, ` + restart + ` }`)},
+		{"no matcher", wrap(`{ "name": "a", "unit": "electrs", ` + restart + ` }`)},
+		{"two matchers", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "systemd": { "states": ["failed"], "interval": "30s" }, ` + restart + ` }`)},
+		{"missing unit", wrap(`{ "name": "a", "log": { "contains": "x" }, ` + restart + ` }`)},
+		{"contains and regex", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x", "regex": "x" }, ` + restart + ` }`)},
+		{"invalid regex", wrap(`{ "name": "a", "unit": "electrs", "log": { "regex": "(" }, ` + restart + ` }`)},
+		{"missing expression", wrap(`{ "name": "a", "prometheus": { "interval": "10s", "operator": "==" }, ` + restart + ` }`)},
+		{"missing interval", wrap(`{ "name": "a", "prometheus": { "expression": "x", "operator": "==" }, ` + restart + ` }`)},
+		{"unknown operator", wrap(`{ "name": "a", "prometheus": { "expression": "x", "interval": "10s", "operator": "=" }, ` + restart + ` }`)},
+		{"missing systemd states", wrap(`{ "name": "a", "unit": "electrs", "systemd": { "interval": "30s" }, ` + restart + ` }`)},
+		{"unknown systemd state", wrap(`{ "name": "a", "unit": "electrs", "systemd": { "states": ["crashed"], "interval": "30s" }, ` + restart + ` }`)},
+		{"missing systemd interval", wrap(`{ "name": "a", "unit": "electrs", "systemd": { "states": ["failed"] }, ` + restart + ` }`)},
+		{"no actions", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [] }`)},
+		{"unknown action", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [ { "type": "explode" } ] }`)},
+		{"restart without unit", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [ { "type": "restart-unit" } ] }`)},
+		{"set-config without value", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [ { "type": "set-config", "key": "bitcoin_ibd" } ] }`)},
+		{"unknown description code", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [ { "type": "set-heartbeat-code", "code": "PANIC" } ] }`)},
+		{"run-command without command", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [ { "type": "run-command" } ] }`)},
+		{"unknown builtin", wrap(`{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, "actions": [ { "type": "builtin", "handler": "x" } ] }`)},
+		{"unknown reboot reason", wrap(`{ "name": "a", "unit": "kernel", "log": { "contains": "x" }, "actions": [ { "type": "reboot", "reason": "x" } ] }`)},
+		{"throttle percent", wrap(`{ "name": "a", "prometheus": { "expression": "x", "interval": "10s", "operator": ">" }, "actions": [ { "type": "throttle-cpu", "active": true, "percent": 100 } ] }`)},
+		{"duplicate name", `{ "rules": [
+			{ "name": "a", "unit": "electrs", "log": { "contains": "x" }, ` + restart + ` },
+			{ "name": "a", "unit": "electrs", "log": { "contains": "y" }, ` + restart + ` }
+		] }`},
+		{"restart budget without unit", `{ "restartBudgets": [ { "maxRestarts": 3, "window": "1h" } ] }`},
+		{"duplicate restart budget", `{ "restartBudgets": [ { "unit": "electrs", "maxRestarts": 3, "window": "1h" }, { "unit": "electrs", "maxRestarts": 1, "window": "1h" } ] }`},
+		{"restart budget without window", `{ "restartBudgets": [ { "unit": "electrs", "maxRestarts": 3 } ] }`},
+		{"negative reboot budget", `{ "rebootBudget": { "maxReboots": -1, "window": "1h" } }`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := rules.Parse([]byte(test.ruleFile))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    float64
+		matches  bool
+	}{
+		{"==", 1, true},
+		{"==", 0, false},
+		{"!=", 0, true},
+		{"<", 0.5, true},
+		{"<", 1, false},
+		{"<=", 1, true},
+		{">", 1, false},
+		{">", 2, true},
+		{">=", 1, true},
+		{">=", 0, false},
+	}
+	for _, test := range tests {
+		matcher := rules.PrometheusMatcher{Operator: test.operator, Threshold: 1}
+		require.Equal(t, test.matches, matcher.Matches(test.value), "%v %v 1", test.value, test.operator)
+	}
+
+	systemdMatcher := rules.SystemdMatcher{States: []string{"failed", "inactive"}}
+	require.True(t, systemdMatcher.Matches("failed"))
+	require.True(t, systemdMatcher.Matches("inactive"))
+	require.False(t, systemdMatcher.Matches("active"))
+}
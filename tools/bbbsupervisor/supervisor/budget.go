@@ -0,0 +1,22 @@
+package supervisor
+
+import "time"
+
+/* This file includes the sliding window budgets, which limit the restarts of a unit and the reboots of the Base. */
+
+// takeFromBudget prunes the timestamps outside of the window ending now. If less than max timestamps remain, the budget
+// allows another execution: now is appended and ok is true. The remaining timestamps are returned in both cases, so
+// that the caller can store them.
+func takeFromBudget(timestamps []int64, max int, window time.Duration, now time.Time) (remaining []int64, ok bool) {
+	windowStart := now.Add(-window).Unix()
+	remaining = []int64{}
+	for _, timestamp := range timestamps {
+		if timestamp > windowStart {
+			remaining = append(remaining, timestamp)
+		}
+	}
+	if len(remaining) >= max {
+		return remaining, false
+	}
+	return append(remaining, now.Unix()), true
+}
@@ -0,0 +1,37 @@
+package supervisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTakeFromBudget(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) int64 {
+		return now.Add(-d).Unix()
+	}
+
+	tests := []struct {
+		name       string
+		timestamps []int64
+		max        int
+		remaining  []int64
+		ok         bool
+	}{
+		{"empty", nil, 2, []int64{now.Unix()}, true},
+		{"within budget", []int64{ago(10 * time.Minute)}, 2, []int64{ago(10 * time.Minute), now.Unix()}, true},
+		{"budget used up", []int64{ago(20 * time.Minute), ago(10 * time.Minute)}, 2, []int64{ago(20 * time.Minute), ago(10 * time.Minute)}, false},
+		{"outside of the window", []int64{ago(2 * time.Hour), ago(time.Hour), ago(10 * time.Minute)}, 2, []int64{ago(10 * time.Minute), now.Unix()}, true},
+		{"all outside of the window", []int64{ago(3 * time.Hour), ago(2 * time.Hour)}, 1, []int64{now.Unix()}, true},
+		{"no budget", nil, 0, []int64{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remaining, ok := takeFromBudget(test.timestamps, test.max, time.Hour, now)
+			require.Equal(t, test.ok, ok)
+			require.Equal(t, test.remaining, remaining)
+		})
+	}
+}
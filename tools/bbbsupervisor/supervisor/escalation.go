@@ -0,0 +1,176 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+)
+
+/* This file includes the restart budgets of the units and the escalation when a unit exceeds its budget. */
+
+// The decisions taken for a restart-unit action.
+const (
+	DecisionRestart = "restart"
+	DecisionStop    = "stop"
+	DecisionNotify  = "notify"
+)
+
+// maxDecisions is the number of decisions kept in the decision history.
+const maxDecisions = 100
+
+// Decision records a restart, escalation or reboot decision of the supervisor.
+type Decision struct {
+	Time     int64  `json:"time"`
+	Unit     string `json:"unit"`
+	Rule     string `json:"rule"`
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DecisionHistory returns the latest restart, escalation and reboot decisions, ordered from the oldest to the newest.
+func (s *Supervisor) DecisionHistory() []Decision {
+	if s.state.Decisions == nil {
+		return []Decision{}
+	}
+	return s.state.Decisions
+}
+
+// recordDecision adds a decision to the decision history. The state is saved by the caller.
+func (s *Supervisor) recordDecision(decision Decision) {
+	decision.Time = time.Now().Unix()
+	log.Printf("Decision for unit %s (rule %s): %s, %s\n", decision.Unit, decision.Rule, decision.Decision, decision.Reason)
+	s.state.Decisions = append(s.state.Decisions, decision)
+	if len(s.state.Decisions) > maxDecisions {
+		s.state.Decisions = s.state.Decisions[len(s.state.Decisions)-maxDecisions:]
+	}
+}
+
+// restartUnitWithinBudget restarts a unit, if it was restarted less than its restart budget allows within the budget
+// window. Otherwise it escalates: the unit is stopped and marked as failed, which sets the ERROR state code in the HSM
+// heartbeat, and the middleware is notified.
+func (s *Supervisor) restartUnitWithinBudget(ruleName string, unit string) error {
+	budget := s.config.RestartBudget(unit)
+	restarts, ok := takeFromBudget(s.state.UnitRestarts[unit], budget.MaxRestarts, time.Duration(budget.Window), time.Now())
+	s.state.UnitRestarts[unit] = restarts
+	defer s.saveState()
+
+	if ok {
+		decision := Decision{
+			Unit:     unit,
+			Rule:     ruleName,
+			Decision: DecisionRestart,
+			Reason:   fmt.Sprintf("restart %d of %d within %v", len(restarts), budget.MaxRestarts, time.Duration(budget.Window)),
+		}
+		err := s.restartUnit(unit)
+		if err != nil {
+			decision.Error = err.Error()
+		}
+		s.recordDecision(decision)
+		return err
+	}
+
+	reason := fmt.Sprintf("restart budget of %d restarts within %v exceeded", budget.MaxRestarts, time.Duration(budget.Window))
+	stopDecision := Decision{Unit: unit, Rule: ruleName, Decision: DecisionStop, Reason: reason}
+	stopErr := s.stopUnit(unit)
+	if stopErr == nil {
+		stopErr = systemstate.SetUnitFailed(s.redis, unit)
+	}
+	if stopErr != nil {
+		stopDecision.Error = stopErr.Error()
+	}
+	s.recordDecision(stopDecision)
+
+	// the middleware is notified even if stopping the unit failed, so that the user learns about the crash loop
+	notifyDecision := Decision{Unit: unit, Rule: ruleName, Decision: DecisionNotify, Reason: reason}
+	notifyErr := s.notifyMiddleware(unit, reason)
+	if notifyErr != nil {
+		notifyDecision.Error = notifyErr.Error()
+	}
+	s.recordDecision(notifyDecision)
+
+	if stopErr != nil {
+		return fmt.Errorf("escalating unit %s failed: %v", unit, stopErr)
+	}
+	if notifyErr != nil {
+		return fmt.Errorf("escalating unit %s failed: %v", unit, notifyErr)
+	}
+	return nil
+}
+
+// isUnitFailed returns true if the unit was stopped after exceeding its restart budget
+func (s *Supervisor) isUnitFailed(unit string) bool {
+	failedUnits, err := systemstate.GetFailedUnits(s.redis)
+	if err != nil {
+		log.Printf("Warning: could not get the failed units: %s", err)
+		return false
+	}
+	for _, failedUnit := range failedUnits {
+		if failedUnit == unit {
+			return true
+		}
+	}
+	return false
+}
+
+// resetFailedUnits removes the failed mark of the units that are active again, e.g. after a reboot or a manual start.
+func (s *Supervisor) resetFailedUnits() {
+	failedUnits, err := systemstate.GetFailedUnits(s.redis)
+	if err != nil {
+		log.Printf("Warning: could not get the failed units: %s", err)
+		return
+	}
+	for _, unit := range failedUnits {
+		if !s.isUnitActive(unit) {
+			log.Printf("Unit %s is still failed.\n", unit)
+			continue
+		}
+		s.clearUnitFailed(unit)
+	}
+}
+
+// clearUnitFailed removes the failed mark of a unit, which is active again.
+func (s *Supervisor) clearUnitFailed(unit string) {
+	err := systemstate.ClearUnitFailed(s.redis, unit)
+	if err != nil {
+		log.Printf("Warning: could not clear the failed unit %s: %s", unit, err)
+		return
+	}
+	log.Printf("Cleared the failed unit %s, as it is active again.\n", unit)
+}
+
+// ipcNotification is an IPC notification as read by the middleware from its named pipe.
+type ipcNotification struct {
+	Version int         `json:"version"`
+	Topic   string      `json:"topic"`
+	Payload interface{} `json:"payload"`
+}
+
+// notifyMiddleware sends a `supervisor-escalation` IPC notification for the escalated unit to the middleware.
+// The named pipe is opened non-blocking, so that an error is returned instead of blocking, if the middleware does not read
+// from the pipe, e.g. because it is the escalated unit.
+func (s *Supervisor) notifyMiddleware(unit string, reason string) error {
+	notification, err := json.Marshal(ipcNotification{
+		Version: 1,
+		Topic:   "supervisor-escalation",
+		Payload: map[string]string{"unit": unit, "reason": reason},
+	})
+	if err != nil {
+		return err
+	}
+	pipe, err := os.OpenFile(s.middlewarePipe, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		return fmt.Errorf("could not open the middleware named pipe %s: %v", s.middlewarePipe, err)
+	}
+	defer pipe.Close()
+	_, err = pipe.Write(append(notification, '\n'))
+	if err != nil {
+		return fmt.Errorf("could not write to the middleware named pipe %s: %v", s.middlewarePipe, err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSystemctl replaces systemctl with a script that logs its arguments and exits with the exit code. It returns the
+// function reading the logged calls and the function restoring systemctl.
+func fakeSystemctl(t *testing.T, dir string, exitCode int) (func() []string, func()) {
+	logFile := filepath.Join(dir, "systemctl.log")
+	script := filepath.Join(dir, "systemctl")
+	content := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexit %d\n", logFile, exitCode)
+	require.NoError(t, ioutil.WriteFile(script, []byte(content), 0755))
+
+	previous := systemctl
+	systemctl = script
+	calls := func() []string {
+		content, err := ioutil.ReadFile(logFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+	return calls, func() { systemctl = previous }
+}
+
+// decisions returns the decisions of the decision history.
+func decisions(s *Supervisor) []string {
+	result := []string{}
+	for _, decision := range s.DecisionHistory() {
+		result = append(result, decision.Decision)
+	}
+	return result
+}
+
+const escalationRuleFile = `{
+	"rules": [
+		{
+			"name": "electrsFailed",
+			"unit": "electrs",
+			"systemd": { "states": ["failed"], "interval": "30s" },
+			"actions": [ { "type": "restart-unit", "unit": "electrs" } ],
+			"floodDelay": "0s"
+		}
+	],
+	"restartBudgets": [ { "unit": "electrs", "maxRestarts": 2, "window": "1h" } ]
+}`
+
+func TestRestartUnitWithinBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	calls, restore := fakeSystemctl(t, dir, 0)
+	defer restore()
+
+	s := newTestSupervisor(t, escalationRuleFile)
+	s.middlewarePipe = filepath.Join(dir, "middleware.pipe")
+	require.NoError(t, ioutil.WriteFile(s.middlewarePipe, nil, 0600))
+
+	// restarts outside of the budget window don't count
+	s.state.UnitRestarts["electrs"] = []int64{time.Now().Add(-2 * time.Hour).Unix()}
+	require.NoError(t, s.restartUnitWithinBudget("electrsFailed", "electrs"))
+	require.NoError(t, s.restartUnitWithinBudget("electrsFailed", "electrs"))
+	require.Equal(t, []string{"restart electrs", "restart electrs"}, calls())
+	require.Len(t, s.state.UnitRestarts["electrs"], 2)
+	require.False(t, s.isUnitFailed("electrs"))
+
+	// exceeding the budget escalates: the unit is stopped and marked as failed, then the middleware is notified
+	require.NoError(t, s.restartUnitWithinBudget("electrsFailed", "electrs"))
+	require.Equal(t, []string{"restart electrs", "restart electrs", "stop electrs"}, calls())
+	require.True(t, s.isUnitFailed("electrs"))
+	require.Equal(t, []string{DecisionRestart, DecisionRestart, DecisionStop, DecisionNotify}, decisions(s))
+
+	notification, err := ioutil.ReadFile(s.middlewarePipe)
+	require.NoError(t, err)
+	var parsed ipcNotification
+	require.NoError(t, json.Unmarshal(notification, &parsed))
+	require.Equal(t, "supervisor-escalation", parsed.Topic)
+	require.Equal(t, "electrs", parsed.Payload.(map[string]interface{})["unit"])
+
+	// the failed unit is not restarted anymore, until the systemd watcher sees it active again
+	rule, ok := s.rule("electrsFailed")
+	require.True(t, ok)
+	require.NoError(t, s.handleRule(rule, watcher.Event{Unit: "electrs", Rule: rule.Name, State: "failed"}))
+	require.Len(t, calls(), 3)
+	require.NoError(t, s.handleRule(rule, watcher.Event{Unit: "electrs", Rule: rule.Name, State: "active"}))
+	require.False(t, s.isUnitFailed("electrs"))
+}
+
+func TestRestartUnitWithinBudgetErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, restore := fakeSystemctl(t, dir, 1)
+	defer restore()
+
+	s := newTestSupervisor(t, escalationRuleFile)
+	s.middlewarePipe = filepath.Join(dir, "missing.pipe")
+
+	// a failed restart counts against the budget and is recorded with its error
+	require.Error(t, s.restartUnitWithinBudget("electrsFailed", "electrs"))
+	require.Len(t, s.state.UnitRestarts["electrs"], 1)
+	require.NotEmpty(t, s.DecisionHistory()[0].Error)
+
+	// the middleware notification is attempted even if the unit could not be stopped
+	require.Error(t, s.restartUnitWithinBudget("electrsFailed", "electrs"))
+	require.Error(t, s.restartUnitWithinBudget("electrsFailed", "electrs"))
+	require.Equal(t, []string{DecisionRestart, DecisionRestart, DecisionStop, DecisionNotify}, decisions(s))
+	require.False(t, s.isUnitFailed("electrs"))
+	for _, decision := range s.DecisionHistory()[2:] {
+		require.NotEmpty(t, decision.Error)
+	}
+}
+
+func TestResetFailedUnits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, restore := fakeSystemctl(t, dir, 0)
+	defer restore()
+
+	s := newTestSupervisor(t, escalationRuleFile)
+	require.NoError(t, systemstate.SetUnitFailed(s.redis, "electrs"))
+	s.resetFailedUnits()
+	require.False(t, s.isUnitFailed("electrs"))
+}
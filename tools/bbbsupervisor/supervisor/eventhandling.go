@@ -5,12 +5,17 @@ import (
 	"log"
 	"time"
 
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
-	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/trigger"
 )
 
 /* This file includes the event parsing and handling code for the bbbsupervisor. */
 
+// builtinHandlers maps the built-in handlers, which can be run by rules with the builtin action, to their implementation.
+var builtinHandlers = map[string]func(s *Supervisor) error{
+	rules.BuiltinDisableIBDState: (*Supervisor).disableBaseIBDState,
+}
+
 // eventLoop loops indefinitely and processes incoming events
 func (s *Supervisor) eventLoop() {
 	for {
@@ -31,124 +36,118 @@ func (s *Supervisor) eventHandler() {
 	case err := <-s.errors:
 		panic(fmt.Errorf("watcher error: %v", err))
 	case event := <-s.events:
-		var err error
-		switch {
-		case event.Trigger == trigger.ElectrsFullySynced:
-			err = s.handleElectrsFullySynced(event)
-		case event.Trigger == trigger.ElectrsNoBitcoindConnectivity:
-			err = s.handleElectrsNoBitcoindConnectivity(event)
-		case event.Trigger == trigger.MiddlewareNoBitcoindConnectivity:
-			err = s.handleMiddlewareNoBitcoindConnectivity(event)
-		case event.Trigger == trigger.PrometheusBitcoindIBD:
-			err = s.handleBitcoindIBD(event)
-		default:
-			panic(fmt.Errorf("trigger %d is unhandled", event.Trigger))
+		rule, ok := s.rule(event.Rule)
+		if !ok {
+			panic(fmt.Errorf("rule %s is unhandled", event.Rule))
 		}
+		err := s.handleRule(rule, event)
 		if err != nil {
-			panic(fmt.Errorf("could not trigger %s: %s", event.Trigger.String(), err))
+			panic(fmt.Errorf("could not handle rule %s: %s", rule.Name, err))
 		}
 	}
 }
 
-// handleElectrsNoBitcoindConnectivity handles the triggerElectrsNoBitcoindConnectivity
-// by restarting electrs which copies the current .cookie file and reloads authorization
-func (s *Supervisor) handleElectrsNoBitcoindConnectivity(event watcher.Event) error {
-	t := event.Trigger
-	err := t.IsFlooding(30*time.Second, s.state.TriggerLastExecuted[t])
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Handling trigger %s: restarting electrs to recreate the bitcoind `.cookie` file.\n", t.String())
-	err = s.restartUnit("electrs")
-	if err != nil {
-		return fmt.Errorf("Handling trigger %s: Restarting electrs failed: %v", t.String(), err)
+// rule returns the rule with the passed name
+func (s *Supervisor) rule(name string) (rules.Rule, bool) {
+	for _, rule := range s.config.Rules {
+		if rule.Name == name {
+			return rule, true
+		}
 	}
-	s.state.TriggerLastExecuted[t] = time.Now().Unix()
-	return nil
+	return rules.Rule{}, false
 }
 
-// handleMiddlewareNoBitcoindConnectivity handles the triggerMiddlewareNoBitcoindConnectivity
-// by restarting bbbmiddleware which copies the current .cookie file and reloads authorization
-func (s *Supervisor) handleMiddlewareNoBitcoindConnectivity(event watcher.Event) error {
-	t := event.Trigger
-	err := t.IsFlooding(30*time.Second, s.state.TriggerLastExecuted[t])
-	if err != nil {
-		return err
+// handleRule takes the actions of a rule which matched an event.
+// The actions of a rule with a prometheus matcher are only taken when the matcher becomes true, e.g. when the IBD starts,
+// and not for every measurement while it stays true.
+// The actions of a rule with a systemd matcher are taken on every poll the unit is in a matched state, rate-limited by
+// the flood delay of the rule and the restart budget of the unit. They are not taken for units the supervisor stopped
+// after exceeding their restart budget, until the unit is seen active again, e.g. after a manual start.
+func (s *Supervisor) handleRule(rule rules.Rule, event watcher.Event) error {
+	if rule.Systemd != nil {
+		if event.State == "active" && s.isUnitFailed(rule.Unit) {
+			s.clearUnitFailed(rule.Unit)
+		}
+		if !rule.Systemd.Matches(event.State) {
+			return nil
+		}
+		if s.isUnitFailed(rule.Unit) {
+			log.Printf("Not handling rule %s: unit %s was stopped after exceeding its restart budget.\n", rule.Name, rule.Unit)
+			return nil
+		}
 	}
-
-	log.Printf("Handling trigger %s: restarting bbbmiddleware to recreate the bitcoind `.cookie` file.\n", t.String())
-	err = s.restartUnit("bbbmiddleware")
-	if err != nil {
-		return fmt.Errorf("Handling trigger %s: Restarting bbbmiddleware failed: %v", t.String(), err)
+	if rule.Prometheus != nil {
+		matches := rule.Prometheus.Matches(event.Value)
+		lastMatched, known := s.state.PrometheusLastResult[rule.Name]
+		if known && lastMatched == matches {
+			// result did not change, do nothing
+			return nil
+		}
+		if !matches {
+			s.state.PrometheusLastResult[rule.Name] = false
+			s.saveState()
+			return nil
+		}
 	}
-	s.state.TriggerLastExecuted[t] = time.Now().Unix()
-	return nil
-}
 
-// handleElectrsFullySynced restarts electrs after the initial sync is complete
-func (s *Supervisor) handleElectrsFullySynced(event watcher.Event) error {
-	t := event.Trigger
-	err := t.IsFlooding(30*time.Second, s.state.TriggerLastExecuted[t])
+	err := isFlooding(rule, s.state.RuleLastExecuted[rule.Name])
 	if err != nil {
+		if rule.Systemd != nil {
+			// the state is polled again, so that the actions are taken once the flood delay passed
+			log.Printf("Postponing rule %s: %v\n", rule.Name, err)
+			return nil
+		}
 		return err
 	}
-	log.Printf("Handling trigger %s: restarting Electrs.\n", t.String())
-	err = s.restartUnit("electrs")
-	if err != nil {
-		return fmt.Errorf("Handling trigger %s: Restarting electrs failed: %v", t.String(), err)
-	}
-	s.state.TriggerLastExecuted[t] = time.Now().Unix()
-	return nil
-}
 
-// handleBitcoindIBD handles the triggerPrometheusBitcoindIBD
-// by setting (true) or unsetting (false) `bitcoin_ibd` via bbb-config.sh
-func (s *Supervisor) handleBitcoindIBD(event watcher.Event) error {
-	t := event.Trigger
-	wasActive, isActive := s.state.PrometheusLastStateIBD, event.Value
-	// check if isActive is valid (either 1 or 0)
-	if isActive != 1 && isActive != 0 {
-		return fmt.Errorf("Handling trigger %s: isActive (%f) is invalid. Should be either 1 (IBD active) or 0 (IBD inactive)", t.String(), isActive)
+	log.Printf("Handling rule %s (unit %s).\n", rule.Name, event.Unit)
+	for _, action := range rule.Actions {
+		err := s.runAction(rule, action)
+		if err != nil {
+			return fmt.Errorf("Handling rule %s: %v", rule.Name, err)
+		}
 	}
-
-	if wasActive == isActive {
-		// state did not change, do nothing
-		return nil
+	s.state.RuleLastExecuted[rule.Name] = time.Now().Unix()
+	if rule.Prometheus != nil {
+		s.state.PrometheusLastResult[rule.Name] = true
 	}
+	s.saveState()
+	return nil
+}
 
-	if wasActive == -1 { // There is no prior state. Set `bitcoin_ibd` via bbbconfig.sh to true or false (depending on the new state) just to be sure.
-		log.Println("Setting bitcoin_ibd since no prior state exists.")
-		if isActive == 1 {
-			err := s.setBBBConfigValue("bitcoin_ibd", "true")
-			if err != nil {
-				return fmt.Errorf("Handling trigger %s: Initial set. Setting BBB config value to `true` failed: %v", t.String(), err)
-			}
-		} else {
-			err := s.disableBaseIBDState()
-			if err != nil {
-				return fmt.Errorf("Handling trigger %s: Initial state set. %s", t.String(), err.Error())
-			}
+// runAction runs a single action of a rule
+func (s *Supervisor) runAction(rule rules.Rule, action rules.Action) error {
+	switch action.Type {
+	case rules.ActionRestartUnit:
+		return s.restartUnitWithinBudget(rule.Name, action.Unit)
+	case rules.ActionSetConfig:
+		return s.setBBBConfigValue(action.Key, action.Value)
+	case rules.ActionSetHeartbeatCode:
+		return s.setDescriptionCode(action.DescriptionCode(), action.Active)
+	case rules.ActionRunCommand:
+		return s.runCommand(action.Command, action.Args)
+	case rules.ActionBuiltin:
+		handler, ok := builtinHandlers[action.Handler]
+		if !ok {
+			return fmt.Errorf("unknown built-in handler %s", action.Handler)
 		}
-		s.state.PrometheusLastStateIBD = isActive // set the initial value for the state
-		return nil
+		return handler(s)
+	case rules.ActionReboot:
+		return s.rebootBase(rule, action.Reason)
+	case rules.ActionThrottleCPU:
+		return s.throttleCPU(action.Active, action.Percent)
 	}
+	return fmt.Errorf("unknown action type %s", action.Type)
+}
 
-	if wasActive == 1 && isActive == 0 { // IBD finished
-		log.Println("Setting bitcoin_ibd since the IBD finished.")
-		err := s.disableBaseIBDState()
-		if err != nil {
-			return fmt.Errorf("Handling trigger %s: %s", t.String(), err.Error())
-		}
-		s.state.PrometheusLastStateIBD = isActive
-	} else if wasActive == 0 && isActive == 1 { // IBD (re)started
-		log.Println("Setting bitcoin_ibd since the IBD (re)started.")
-		err := s.setBBBConfigValue("bitcoin_ibd", "true")
-		if err != nil {
-			return fmt.Errorf("Handling trigger %s: setting BBB config value to `true` failed: %v", t.String(), err)
-		}
-		s.state.PrometheusLastStateIBD = isActive
+// isFlooding checks if a rule is flooding
+// returns an error if the actions of the rule were executed under its `FloodDelay` ago
+func isFlooding(rule rules.Rule, lastTimeExecuted int64) error {
+	minDelay := time.Duration(rule.FloodDelay)
+	timeSinceLastExecution := time.Since(time.Unix(lastTimeExecuted, 0))
+	if timeSinceLastExecution < minDelay {
+		// last execution less than `minDelay` ago
+		return fmt.Errorf("rule %s is flooding. Last executed %v ago (minDelay %v)", rule.Name, timeSinceLastExecution, minDelay)
 	}
-
 	return nil
 }
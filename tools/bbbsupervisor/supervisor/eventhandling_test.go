@@ -0,0 +1,233 @@
+package supervisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSupervisor returns a supervisor with the rules of the rule file and a mocked redis.
+func newTestSupervisor(t *testing.T, ruleFile string) *Supervisor {
+	config, err := rules.Parse([]byte(ruleFile))
+	require.NoError(t, err)
+	return &Supervisor{
+		state:  newSupervisorState(),
+		config: config,
+		redis:  redis.NewMockClient(""),
+	}
+}
+
+// isCodeActive returns true if the HSM heartbeat description code is set.
+func isCodeActive(t *testing.T, s *Supervisor, code messages.BitBoxBaseHeartbeatRequest_DescriptionCode) bool {
+	codes, err := systemstate.GetActiveDescriptionCodes(s.redis)
+	require.NoError(t, err)
+	for _, activeCode := range codes {
+		if activeCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+const testRuleFile = `{
+	"rules": [
+		{
+			"name": "ibd",
+			"prometheus": { "expression": "bitcoin_ibd", "interval": "10s", "operator": "==", "threshold": 1 },
+			"actions": [ { "type": "set-heartbeat-code", "code": "INITIAL_BLOCK_SYNC", "active": true } ],
+			"floodDelay": "1h"
+		},
+		{
+			"name": "electrsFailed",
+			"unit": "electrs",
+			"systemd": { "states": ["failed"], "interval": "30s" },
+			"actions": [ { "type": "set-heartbeat-code", "code": "INITIAL_BLOCK_SYNC", "active": true } ],
+			"floodDelay": "1h"
+		}
+	]
+}`
+
+func TestHandleRulePrometheus(t *testing.T) {
+	const code = messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC
+
+	// each step sends a measurement and checks whether the actions were taken
+	type step struct {
+		value float64
+		// flooded keeps the time the actions were last executed, otherwise it is cleared before the step
+		flooded     bool
+		actionTaken bool
+		err         bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "first measurement matches",
+			steps: []step{{value: 1, actionTaken: true}},
+		},
+		{
+			name:  "first measurement does not match",
+			steps: []step{{value: 0}, {value: 0}},
+		},
+		{
+			name:  "stays true",
+			steps: []step{{value: 1, actionTaken: true}, {value: 1}, {value: 1}},
+		},
+		{
+			name:  "true, false, true",
+			steps: []step{{value: 1, actionTaken: true}, {value: 0}, {value: 1, actionTaken: true}},
+		},
+		{
+			name: "flooding is retried with the next measurement",
+			steps: []step{
+				{value: 1, actionTaken: true},
+				{value: 0, flooded: true},
+				{value: 1, flooded: true, err: true},
+				{value: 1, actionTaken: true},
+				{value: 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestSupervisor(t, testRuleFile)
+			rule, ok := s.rule("ibd")
+			require.True(t, ok)
+			for i, step := range test.steps {
+				if !step.flooded {
+					s.state.RuleLastExecuted[rule.Name] = 0
+				}
+				require.NoError(t, systemstate.ClearDescriptionCode(s.redis, code))
+				err := s.handleRule(rule, watcher.Event{Rule: rule.Name, Value: step.value})
+				if step.err {
+					require.Error(t, err, "step %d", i)
+				} else {
+					require.NoError(t, err, "step %d", i)
+				}
+				require.Equal(t, step.actionTaken, isCodeActive(t, s, code), "step %d", i)
+			}
+		})
+	}
+}
+
+func TestHandleRuleSystemd(t *testing.T) {
+	const code = messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC
+	s := newTestSupervisor(t, testRuleFile)
+	rule, ok := s.rule("electrsFailed")
+	require.True(t, ok)
+	handle := func(state string) bool {
+		require.NoError(t, systemstate.ClearDescriptionCode(s.redis, code))
+		require.NoError(t, s.handleRule(rule, watcher.Event{Unit: "electrs", Rule: rule.Name, State: state}))
+		return isCodeActive(t, s, code)
+	}
+
+	require.False(t, handle("active"))
+	require.True(t, handle("failed"))
+
+	// the rule matches again while the unit stays failed, but is postponed within the flood delay
+	require.False(t, handle("failed"))
+	s.state.RuleLastExecuted[rule.Name] = time.Now().Add(-2 * time.Hour).Unix()
+	require.True(t, handle("failed"))
+
+	// units stopped after exceeding their restart budget are not handled
+	s.state.RuleLastExecuted[rule.Name] = 0
+	require.NoError(t, systemstate.SetUnitFailed(s.redis, "electrs"))
+	require.False(t, handle("failed"))
+}
+
+// shippedRuleFile is the rule file installed on the Base.
+const shippedRuleFile = "../../../armbian/base/rootfs/etc/bbbsupervisor/rules.json"
+
+func TestHandleRuleDiskSpace(t *testing.T) {
+	const code = messages.BitBoxBaseHeartbeatRequest_OUT_OF_DISK_SPACE
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the commands of the shipped disk rules are replaced with a script logging its arguments
+	logFile := filepath.Join(dir, "bbb-cmd.log")
+	script := filepath.Join(dir, "bbb-cmd.sh")
+	require.NoError(t, ioutil.WriteFile(script, []byte(fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", logFile)), 0755))
+	calls := func() []string {
+		content, err := ioutil.ReadFile(logFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		require.NoError(t, err)
+		result := strings.Split(strings.TrimSpace(string(content)), "\n")
+		require.NoError(t, os.Remove(logFile))
+		return result
+	}
+	config, err := rules.Load(shippedRuleFile)
+	require.NoError(t, err)
+	for i := range config.Rules {
+		for j := range config.Rules[i].Actions {
+			if config.Rules[i].Actions[j].Type == rules.ActionRunCommand {
+				config.Rules[i].Actions[j].Command = script
+			}
+		}
+	}
+	s := &Supervisor{state: newSupervisorState(), config: config, redis: redis.NewMockClient("")}
+
+	// measure passes the percentage of free disk space to all disk rules
+	diskRules := []string{"rootfsLowDiskSpace", "ssdLowDiskSpace", "outOfDiskSpace", "diskSpaceRecovered"}
+	measure := func(freePercent float64) {
+		for _, name := range diskRules {
+			rule, ok := s.rule(name)
+			require.True(t, ok, name)
+			require.NoError(t, s.handleRule(rule, watcher.Event{Rule: name, Value: freePercent}))
+		}
+	}
+
+	measure(50)
+	require.Empty(t, calls())
+	require.False(t, isCodeActive(t, s, code))
+
+	// below 10%, the cleanups run once
+	measure(8)
+	require.Equal(t, []string{"cleanup rootfs", "cleanup ssd"}, calls())
+	measure(8)
+	require.Empty(t, calls())
+	require.False(t, isCodeActive(t, s, code))
+
+	// below 2%, OUT_OF_DISK_SPACE is set and the cleanups run again
+	measure(1)
+	require.Equal(t, []string{"cleanup rootfs", "cleanup ssd"}, calls())
+	require.True(t, isCodeActive(t, s, code))
+
+	// OUT_OF_DISK_SPACE is only cleared at or above 5%
+	measure(3)
+	require.True(t, isCodeActive(t, s, code))
+	measure(5)
+	require.False(t, isCodeActive(t, s, code))
+	require.Empty(t, calls())
+
+	// a cleanup that is flooding is not run again
+	for i := range s.config.Rules {
+		if s.config.Rules[i].Name == "rootfsLowDiskSpace" {
+			s.config.Rules[i].FloodDelay = rules.Duration(time.Hour)
+		}
+	}
+	rule, ok := s.rule("rootfsLowDiskSpace")
+	require.True(t, ok)
+	require.NoError(t, s.handleRule(rule, watcher.Event{Rule: rule.Name, Value: 50}))
+	require.Error(t, s.handleRule(rule, watcher.Event{Rule: rule.Name, Value: 8}))
+	require.Empty(t, calls())
+
+	// it is run with the next measurement after the flood delay
+	s.state.RuleLastExecuted[rule.Name] = time.Now().Add(-2 * time.Hour).Unix()
+	require.NoError(t, s.handleRule(rule, watcher.Event{Rule: rule.Name, Value: 8}))
+	require.Equal(t, []string{"cleanup rootfs"}, calls())
+}
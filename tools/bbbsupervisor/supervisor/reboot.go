@@ -0,0 +1,83 @@
+package supervisor
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/logtags"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+)
+
+/* This file includes the rate-limited reboot of the Base, e.g. when no memory is left. */
+
+// DecisionReboot is the decision taken for a reboot action.
+const DecisionReboot = "reboot"
+
+// rebootDelay is the delay between setting the REBOOT description code and rebooting, so that the Middleware sends it
+// to the HSM with at least one heartbeat. It is shortened in the tests.
+var rebootDelay = 10 * time.Second
+
+// rebootLogTags maps the reboot reasons to the logtags logged before rebooting.
+var rebootLogTags = map[string]string{
+	rules.RebootReasonOutOfMemory: logtags.LogTagSVRebootOutOfMemory,
+	rules.RebootReasonZramFailure: logtags.LogTagSVRebootZramFailure,
+}
+
+// rebootBase gracefully reboots the Base via systemd, if the reboot budget allows it. Before rebooting, the logtag of the
+// reason is logged and the REBOOT description code is set, which is cleared on the next start of the supervisor.
+// The reboot is scheduled after the rebootDelay, so that the event loop keeps handling events meanwhile.
+// A reboot exceeding the budget is not an error, so that the rule is handled like after a reboot. The refusal is recorded
+// in the decision history once per budget window, so that repeated refusals don't flood it.
+func (s *Supervisor) rebootBase(rule rules.Rule, reason string) error {
+	if atomic.LoadInt32(&s.rebootScheduled) == 1 {
+		log.Printf("Not rebooting for %s (rule %s): a reboot is already scheduled\n", reason, rule.Name)
+		return nil
+	}
+
+	budget := s.config.GetRebootBudget()
+	window := time.Duration(budget.Window)
+	now := time.Now()
+	reboots, ok := takeFromBudget(s.state.Reboots, budget.MaxReboots, window, now)
+	s.state.Reboots = reboots
+
+	decision := Decision{Unit: rule.Unit, Rule: rule.Name, Decision: DecisionReboot}
+	if !ok {
+		log.Printf("Not rebooting for %s (rule %s): the reboot budget of %d reboots within %v is exceeded\n", reason, rule.Name, budget.MaxReboots, window)
+		if now.Sub(time.Unix(s.state.RebootRefused, 0)) < window {
+			return nil
+		}
+		decision.Reason = fmt.Sprintf("%s, but the reboot budget of %d reboots within %v is exceeded", reason, budget.MaxReboots, window)
+		decision.Error = "reboot budget exceeded"
+		s.recordDecision(decision)
+		s.state.RebootRefused = now.Unix()
+		s.saveState()
+		return nil
+	}
+
+	decision.Reason = fmt.Sprintf("%s, reboot %d of %d within %v", reason, len(reboots), budget.MaxReboots, window)
+	// the reboot is recorded before rebooting, as the supervisor is stopped by the reboot
+	s.recordDecision(decision)
+	s.saveState()
+
+	log.Printf("%s: rebooting the Base (rule %s)\n", rebootLogTags[reason], rule.Name)
+	err := s.setDescriptionCode(messages.BitBoxBaseHeartbeatRequest_REBOOT, true)
+	if err != nil {
+		log.Println(err)
+	}
+
+	atomic.StoreInt32(&s.rebootScheduled, 1)
+	command := systemctl
+	time.AfterFunc(rebootDelay, func() {
+		err := exec.Command(command, "reboot").Run()
+		if err != nil {
+			log.Printf("Command systemctl reboot threw an error %v\n", err)
+			// allow the next reboot action to retry it
+			atomic.StoreInt32(&s.rebootScheduled, 0)
+		}
+	})
+	return nil
+}
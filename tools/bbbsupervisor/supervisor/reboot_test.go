@@ -0,0 +1,134 @@
+package supervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebootBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	calls, restore := fakeSystemctl(t, dir, 0)
+	defer restore()
+	previousDelay := rebootDelay
+	rebootDelay = 0
+	defer func() { rebootDelay = previousDelay }()
+
+	s := newTestSupervisor(t, `{
+		"rules": [
+			{
+				"name": "kernelOutOfMemory",
+				"unit": "kernel",
+				"log": { "contains": "Out of memory: Killed process" },
+				"actions": [ { "type": "reboot", "reason": "out-of-memory" } ],
+				"floodDelay": "0s"
+			}
+		],
+		"rebootBudget": { "maxReboots": 1, "window": "24h" }
+	}`)
+	rule, ok := s.rule("kernelOutOfMemory")
+	require.True(t, ok)
+
+	// a reboot outside of the budget window doesn't count
+	s.state.Reboots = []int64{time.Now().Add(-25 * time.Hour).Unix()}
+	require.NoError(t, s.rebootBase(rule, "out-of-memory"))
+	require.Eventually(t, func() bool { return len(calls()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"reboot"}, calls())
+	require.True(t, isCodeActive(t, s, messages.BitBoxBaseHeartbeatRequest_REBOOT))
+	require.Len(t, s.state.Reboots, 1)
+	require.Equal(t, []string{DecisionReboot}, decisions(s))
+	require.Empty(t, s.DecisionHistory()[0].Error)
+
+	// no further reboot is scheduled while one is scheduled
+	require.NoError(t, s.rebootBase(rule, "out-of-memory"))
+	require.Len(t, s.state.Reboots, 1)
+	require.Equal(t, []string{DecisionReboot}, decisions(s))
+
+	// a reboot exceeding the budget is not done, but recorded once per budget window
+	atomic.StoreInt32(&s.rebootScheduled, 0)
+	require.NoError(t, s.rebootBase(rule, "out-of-memory"))
+	require.NoError(t, s.rebootBase(rule, "out-of-memory"))
+	require.Equal(t, []string{"reboot"}, calls())
+	require.Len(t, s.state.Reboots, 1)
+	require.Equal(t, []string{DecisionReboot, DecisionReboot}, decisions(s))
+	require.Equal(t, "reboot budget exceeded", s.DecisionHistory()[1].Error)
+
+	// the decisions survive a restart of the supervisor
+	restarted := &Supervisor{state: newSupervisorState(), config: s.config, redis: s.redis}
+	restarted.loadState()
+	require.Equal(t, s.DecisionHistory(), restarted.DecisionHistory())
+	require.Equal(t, s.state.Reboots, restarted.state.Reboots)
+	require.NoError(t, restarted.rebootBase(rule, "out-of-memory"))
+	require.Len(t, restarted.DecisionHistory(), 2)
+}
+
+func TestRebootBaseFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	calls, restore := fakeSystemctl(t, dir, 1)
+	defer restore()
+	previousDelay := rebootDelay
+	rebootDelay = 0
+	defer func() { rebootDelay = previousDelay }()
+
+	s := newTestSupervisor(t, `{
+		"rules": [
+			{
+				"name": "kernelOutOfMemory",
+				"unit": "kernel",
+				"log": { "contains": "Out of memory: Killed process" },
+				"actions": [ { "type": "reboot", "reason": "out-of-memory" } ],
+				"floodDelay": "0s"
+			}
+		],
+		"rebootBudget": { "maxReboots": 2, "window": "24h" }
+	}`)
+	rule, ok := s.rule("kernelOutOfMemory")
+	require.True(t, ok)
+
+	// the next reboot action retries a failed reboot
+	require.NoError(t, s.rebootBase(rule, "out-of-memory"))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&s.rebootScheduled) == 0 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.rebootBase(rule, "out-of-memory"))
+	require.Eventually(t, func() bool { return len(calls()) == 2 }, time.Second, 10*time.Millisecond)
+	require.Len(t, s.state.Reboots, 2)
+}
+
+func TestHandleRuleRebootBudgetExceeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	calls, restore := fakeSystemctl(t, dir, 0)
+	defer restore()
+
+	s := newTestSupervisor(t, `{
+		"rules": [
+			{
+				"name": "noMemoryLeft",
+				"prometheus": { "expression": "memory_available", "interval": "30s", "operator": "<", "threshold": 2 },
+				"actions": [ { "type": "reboot", "reason": "out-of-memory" } ],
+				"floodDelay": "0s"
+			}
+		],
+		"rebootBudget": { "maxReboots": 1, "window": "24h" }
+	}`)
+	s.state.Reboots = []int64{time.Now().Unix()}
+
+	// the refused reboot is recorded once and not retried on every poll while the memory stays low
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.handleRule(s.config.Rules[0], watcher.Event{Rule: "noMemoryLeft", Value: 1}))
+	}
+	require.Empty(t, calls())
+	require.Equal(t, []string{DecisionReboot}, decisions(s))
+	require.Equal(t, "reboot budget exceeded", s.DecisionHistory()[0].Error)
+	require.True(t, s.state.PrometheusLastResult["noMemoryLeft"])
+}
@@ -0,0 +1,72 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+)
+
+// supervisorState implements a current state for the supervisor.
+// the state values are filled over time and persisted in redis, so that they survive restarts of the supervisor.
+type supervisorState struct {
+	RuleLastExecuted     map[string]int64   `json:"ruleLastExecuted"`     // implements a state (timestamps) when the actions of a rule were executed (to mitigate rule flooding)
+	PrometheusLastResult map[string]bool    `json:"prometheusLastResult"` // implements a state for the last result of the prometheus matcher of a rule (to only act when it becomes true)
+	UnitRestarts         map[string][]int64 `json:"unitRestarts"`         // implements a state (timestamps) of the restarts of a unit within its restart budget window
+	Decisions            []Decision         `json:"decisions"`            // implements a history of the latest restart, escalation and reboot decisions
+	Reboots              []int64            `json:"reboots"`              // implements a state (timestamps) of the reboots within the reboot budget window
+	RebootRefused        int64              `json:"rebootRefused"`        // implements a state (timestamp) when a reboot exceeding the reboot budget was last recorded (to record it once per window)
+}
+
+func newSupervisorState() supervisorState {
+	return supervisorState{
+		RuleLastExecuted:     make(map[string]int64),
+		PrometheusLastResult: make(map[string]bool),
+		UnitRestarts:         make(map[string][]int64),
+	}
+}
+
+// loadState loads the persisted state from redis. The state of rules that no longer exist is dropped.
+// If no state is persisted or it can't be read, the supervisor starts with an empty state.
+func (s *Supervisor) loadState() {
+	stateString, err := s.redis.GetString(redis.SupervisorState)
+	if err != nil {
+		log.Printf("Warning: could not load the supervisor state from redis: %s", err)
+		return
+	}
+	if stateString == "" {
+		return
+	}
+	state := newSupervisorState()
+	if err := json.Unmarshal([]byte(stateString), &state); err != nil {
+		log.Printf("Warning: could not parse the supervisor state from redis: %s", err)
+		return
+	}
+	for _, rule := range s.config.Rules {
+		if lastExecuted, ok := state.RuleLastExecuted[rule.Name]; ok {
+			s.state.RuleLastExecuted[rule.Name] = lastExecuted
+		}
+		if lastResult, ok := state.PrometheusLastResult[rule.Name]; ok {
+			s.state.PrometheusLastResult[rule.Name] = lastResult
+		}
+	}
+	for unit, restarts := range state.UnitRestarts {
+		s.state.UnitRestarts[unit] = restarts
+	}
+	s.state.Decisions = state.Decisions
+	s.state.Reboots = state.Reboots
+	s.state.RebootRefused = state.RebootRefused
+	log.Printf("Loaded the supervisor state from redis key %s.\n", redis.SupervisorState)
+}
+
+// saveState persists the state in redis. A failure is only logged, as the state is kept in memory as well.
+func (s *Supervisor) saveState() {
+	stateBytes, err := json.Marshal(s.state)
+	if err != nil {
+		log.Printf("Warning: could not encode the supervisor state: %s", err)
+		return
+	}
+	if err := s.redis.SetString(redis.SupervisorState, string(stateBytes)); err != nil {
+		log.Printf("Warning: could not save the supervisor state to redis: %s", err)
+	}
+}
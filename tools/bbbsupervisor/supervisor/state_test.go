@@ -0,0 +1,95 @@
+package supervisor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
+	"github.com/stretchr/testify/require"
+)
+
+// unreadableRedis is a redis client that fails to read any key.
+type unreadableRedis struct {
+	redis.Redis
+}
+
+func (unreadableRedis) GetString(key redis.BaseRedisKey) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+// restartTestSupervisor returns a new supervisor with the config and redis of the passed one, like after a restart.
+func restartTestSupervisor(s *Supervisor, resetState bool) *Supervisor {
+	restarted := &Supervisor{state: newSupervisorState(), config: s.config, redis: s.redis}
+	restarted.initState(resetState)
+	return restarted
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	s := newTestSupervisor(t, testRuleFile)
+	now := time.Now().Unix()
+	s.state.RuleLastExecuted["ibd"] = now
+	s.state.RuleLastExecuted["removedRule"] = now
+	s.state.PrometheusLastResult["ibd"] = true
+	s.state.UnitRestarts["electrs"] = []int64{now - 60, now}
+	s.state.Reboots = []int64{now}
+	s.state.RebootRefused = now
+	s.recordDecision(Decision{Unit: "electrs", Rule: "electrsFailed", Decision: DecisionRestart})
+	s.saveState()
+
+	// the state of rules that no longer exist is dropped
+	restarted := restartTestSupervisor(s, false)
+	expected := s.state
+	expected.RuleLastExecuted = map[string]int64{"ibd": now}
+	require.Equal(t, expected, restarted.state)
+}
+
+func TestStateReset(t *testing.T) {
+	s := newTestSupervisor(t, testRuleFile)
+	s.state.RuleLastExecuted["ibd"] = time.Now().Unix()
+	s.recordDecision(Decision{Unit: "electrs", Rule: "electrsFailed", Decision: DecisionRestart})
+	s.saveState()
+
+	restarted := restartTestSupervisor(s, true)
+	require.Equal(t, newSupervisorState(), restarted.state)
+	stateString, err := s.redis.GetString(redis.SupervisorState)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"ruleLastExecuted": {}, "prometheusLastResult": {}, "unitRestarts": {}, "decisions": null, "reboots": null, "rebootRefused": 0}`, stateString)
+
+	// the reset state is loaded on the next start
+	require.Equal(t, newSupervisorState(), restartTestSupervisor(s, false).state)
+}
+
+func TestStateRuleNotRunAgainAfterRestart(t *testing.T) {
+	const code = messages.BitBoxBaseHeartbeatRequest_INITIAL_BLOCK_SYNC
+	s := newTestSupervisor(t, testRuleFile)
+	rule, ok := s.rule("ibd")
+	require.True(t, ok)
+	require.NoError(t, s.handleRule(rule, watcher.Event{Rule: rule.Name, Value: 1}))
+	require.True(t, isCodeActive(t, s, code))
+
+	// the IBD is still running after the restart, so the actions are not taken again
+	require.NoError(t, systemstate.ClearDescriptionCode(s.redis, code))
+	restarted := restartTestSupervisor(s, false)
+	require.NoError(t, restarted.handleRule(rule, watcher.Event{Rule: rule.Name, Value: 1}))
+	require.False(t, isCodeActive(t, restarted, code))
+
+	// after a reset, the actions are taken again
+	restarted = restartTestSupervisor(s, true)
+	require.NoError(t, restarted.handleRule(rule, watcher.Event{Rule: rule.Name, Value: 1}))
+	require.True(t, isCodeActive(t, restarted, code))
+}
+
+func TestStateLoadFallback(t *testing.T) {
+	// a corrupt state is ignored
+	s := newTestSupervisor(t, testRuleFile)
+	require.NoError(t, s.redis.SetString(redis.SupervisorState, `{"ruleLastExecuted": {"ibd": "yesterday"`))
+	require.Equal(t, newSupervisorState(), restartTestSupervisor(s, false).state)
+
+	// a state that can't be read is ignored
+	s.redis = unreadableRedis{s.redis}
+	require.Equal(t, newSupervisorState(), restartTestSupervisor(s, false).state)
+}
@@ -14,7 +14,8 @@
 
 // BitBoxBase Supervisor
 // ----------------------
-// Watches systemd logs (via journalctl) and queries Prometheus to detect potential issues and take action.
+// Watches systemd logs (via journalctl), the state of systemd units and queries Prometheus to detect potential issues and
+// take action.
 //
 // Functionality to implement:
 // * System
@@ -50,36 +51,64 @@ import (
 
 	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/prometheus"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/logwatcher"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/prometheuswatcher"
-	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/trigger"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/systemdwatcher"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
 )
 
-// supervisorState implements a current state for the supervisor.
-// the state values are filled over time
-type supervisorState struct {
-	TriggerLastExecuted    map[trigger.Trigger]int64 // implements a state (timestamps) when a trigger was fired (to mitigate trigger flooding)
-	PrometheusLastStateIBD float64                   // implements a state for the last `bitcoin_ibd` measurement value (to detect switches ibd <-> no-ibd)
-}
-
 type Supervisor struct {
-	state      supervisorState
-	redis      redis.Client
-	prometheus prometheus.Client
-	events     chan watcher.Event
-	errors     chan error
-	watchers   []watcher.Watcher
+	state          supervisorState
+	config         *rules.Config
+	redis          redis.Redis
+	prometheus     prometheus.Client
+	events         chan watcher.Event
+	errors         chan error
+	watchers       []watcher.Watcher
+	middlewarePipe string // named pipe the middleware reads IPC notifications from
+	// rebootScheduled is set to 1 while a reboot is scheduled, so that further reboot actions don't schedule another
+	// one. It is accessed atomically, as it is reset if the scheduled reboot fails.
+	rebootScheduled int32
 }
 
-// setupWatchers sets up prometheusWatchers and logWatchers and returns them
+// setupWatchers sets up a logWatcher for each unit with log rules, a prometheusWatcher for each prometheus rule and a
+// systemdWatcher for each systemd rule
 func (s *Supervisor) setupWatchers() {
-	s.watchers = []watcher.Watcher{
-		logwatcher.LogWatcher{Unit: "bitcoind", Events: s.events, Errors: s.errors},
-		logwatcher.LogWatcher{Unit: "lightningd", Events: s.events, Errors: s.errors},
-		logwatcher.LogWatcher{Unit: "electrs", Events: s.events, Errors: s.errors},
-		logwatcher.LogWatcher{Unit: "bbbmiddleware", Events: s.events, Errors: s.errors},
-		prometheuswatcher.PrometheusWatcher{Unit: "bitcoind", PClient: s.prometheus, Expression: "bitcoin_ibd", Interval: 10 * time.Second, Trigger: trigger.PrometheusBitcoindIBD, Events: s.events, Errors: s.errors},
+	s.watchers = []watcher.Watcher{}
+	logRules := make(map[string][]rules.Rule)
+	var units []string
+	for _, rule := range s.config.Rules {
+		if rule.Log != nil {
+			if _, ok := logRules[rule.Unit]; !ok {
+				units = append(units, rule.Unit)
+			}
+			logRules[rule.Unit] = append(logRules[rule.Unit], rule)
+			continue
+		}
+		if rule.Systemd != nil {
+			s.watchers = append(s.watchers, &systemdwatcher.SystemdWatcher{
+				Unit:     rule.Unit,
+				Rule:     rule.Name,
+				Interval: time.Duration(rule.Systemd.Interval),
+				Events:   s.events,
+				Errors:   s.errors,
+			})
+			continue
+		}
+		s.watchers = append(s.watchers, prometheuswatcher.PrometheusWatcher{
+			Unit:       rule.Unit,
+			PClient:    s.prometheus,
+			Expression: rule.Prometheus.Expression,
+			Interval:   time.Duration(rule.Prometheus.Interval),
+			Rule:       rule.Name,
+			Events:     s.events,
+			Errors:     s.errors,
+		})
+	}
+	for _, unit := range units {
+		s.watchers = append(s.watchers, logwatcher.LogWatcher{Unit: unit, Rules: logRules[unit], Events: s.events, Errors: s.errors})
 	}
 }
 
@@ -91,27 +120,57 @@ func (s *Supervisor) startWatchers() {
 	}
 }
 
-func New(redisPort string, prometheusPort string) *Supervisor {
+// New returns a supervisor which takes the actions of the rules in the passed config and notifies the middleware via
+// the passed named pipe. Its state is loaded from redis, unless resetState is true. Then the persisted state is cleared.
+func New(redisPort string, prometheusPort string, config *rules.Config, middlewarePipe string, resetState bool) *Supervisor {
 	s := Supervisor{
-		state: supervisorState{
-			TriggerLastExecuted:    make(map[trigger.Trigger]int64, 0),
-			PrometheusLastStateIBD: -1,
-		},
-		redis:      redis.NewClient(redisPort),
-		prometheus: prometheus.NewClient(prometheusPort),
-		events:     make(chan watcher.Event), // channel to process events a watcher detects
-		errors:     make(chan error),         // channel to process errors from watchers
+		state:          newSupervisorState(),
+		config:         config,
+		middlewarePipe: middlewarePipe,
+		redis:          redis.NewClient(redisPort),
+		prometheus:     prometheus.NewClient(prometheusPort),
+		events:         make(chan watcher.Event), // channel to process events a watcher detects
+		errors:         make(chan error),         // channel to process errors from watchers
 	}
 
+	s.initState(resetState)
+
 	return &s
 }
 
+// initState loads the persisted state from redis, unless resetState is true. Then the persisted state is replaced
+// with the empty state.
+func (s *Supervisor) initState(resetState bool) {
+	if resetState {
+		log.Println("Resetting the supervisor state.")
+		s.saveState()
+		return
+	}
+	s.loadState()
+}
+
 func (s *Supervisor) Start() {
 	log.Println("starting bbbsupervisor")
+	s.resetDescriptionCodes()
+	s.resetFailedUnits()
+	s.resetCPUThrottling()
 	s.setupWatchers()
 	s.startWatchers()
 }
 
+// resetDescriptionCodes clears the REBOOT and SHUTDOWN description codes, which are only active until the Base is back up.
+func (s *Supervisor) resetDescriptionCodes() {
+	for _, code := range []messages.BitBoxBaseHeartbeatRequest_DescriptionCode{
+		messages.BitBoxBaseHeartbeatRequest_REBOOT,
+		messages.BitBoxBaseHeartbeatRequest_SHUTDOWN,
+	} {
+		err := s.setDescriptionCode(code, false)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func (s *Supervisor) Loop() {
 	log.Println("starting supervisor event loop")
 	s.eventLoop()
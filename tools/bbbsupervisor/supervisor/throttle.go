@@ -0,0 +1,130 @@
+package supervisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
+)
+
+/* This file includes the CPU throttling via cpufreq, e.g. when the fan can't keep the Base cool. */
+
+// cpufreqPolicies matches the cpufreq policy directories. The ROCKPro64 has one policy for the little and one for the
+// big CPU cores. It is replaced in the tests.
+var cpufreqPolicies = "/sys/devices/system/cpu/cpufreq/policy*"
+
+// throttleCPU limits the maximum frequency of all CPU cores to the given percent of their hardware maximum and sets the
+// CPU_THROTTLED warning, which raises the HSM heartbeat state code to WARNING. If active is false, the limit is removed
+// and the warning cleared.
+func (s *Supervisor) throttleCPU(active bool, percent int) error {
+	policies, err := filepath.Glob(cpufreqPolicies)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return fmt.Errorf("no cpufreq policies found in %s", cpufreqPolicies)
+	}
+	for _, policy := range policies {
+		maxFreq, err := readFrequency(filepath.Join(policy, "cpuinfo_max_freq"))
+		if err != nil {
+			return err
+		}
+		freq := maxFreq
+		if active {
+			freq = throttledFrequency(policy, maxFreq*percent/100)
+		}
+		err = ioutil.WriteFile(filepath.Join(policy, "scaling_max_freq"), []byte(strconv.Itoa(freq)), 0644)
+		if err != nil {
+			return fmt.Errorf("setting the maximum frequency of %s failed: %v", policy, err)
+		}
+		log.Printf("Set the maximum frequency of %s to %d kHz.\n", policy, freq)
+	}
+
+	if active {
+		err = systemstate.SetWarning(s.redis, systemstate.WarningCPUThrottled)
+	} else {
+		err = systemstate.ClearWarning(s.redis, systemstate.WarningCPUThrottled)
+	}
+	if err != nil {
+		return fmt.Errorf("setting the warning %s failed: %v", systemstate.WarningCPUThrottled, err)
+	}
+	return nil
+}
+
+// throttledFrequency returns the highest available frequency of a cpufreq policy at or below the target frequency.
+// If the available frequencies are unknown or all above the target, the target itself is returned and the kernel
+// picks the next lower frequency.
+func throttledFrequency(policy string, target int) int {
+	content, err := ioutil.ReadFile(filepath.Join(policy, "scaling_available_frequencies"))
+	if err != nil {
+		return target
+	}
+	best := 0
+	for _, field := range strings.Fields(string(content)) {
+		freq, err := strconv.Atoi(field)
+		if err == nil && freq <= target && freq > best {
+			best = freq
+		}
+	}
+	if best == 0 {
+		return target
+	}
+	return best
+}
+
+// isCPUThrottled returns true if the maximum frequency of any CPU core is limited below its hardware maximum.
+func isCPUThrottled() bool {
+	policies, _ := filepath.Glob(cpufreqPolicies)
+	for _, policy := range policies {
+		maxFreq, err := readFrequency(filepath.Join(policy, "cpuinfo_max_freq"))
+		if err != nil {
+			continue
+		}
+		scalingMaxFreq, err := readFrequency(filepath.Join(policy, "scaling_max_freq"))
+		if err != nil {
+			continue
+		}
+		if scalingMaxFreq < maxFreq {
+			return true
+		}
+	}
+	return false
+}
+
+// resetCPUThrottling clears the CPU_THROTTLED warning if the CPU is not throttled anymore, e.g. after a reboot. The
+// last result of the rules throttling the CPU is forgotten as well, so that they throttle it again if it is still too hot.
+func (s *Supervisor) resetCPUThrottling() {
+	if isCPUThrottled() {
+		return
+	}
+	err := systemstate.ClearWarning(s.redis, systemstate.WarningCPUThrottled)
+	if err != nil {
+		log.Printf("Warning: clearing the warning %s failed: %v", systemstate.WarningCPUThrottled, err)
+	}
+	for _, rule := range s.config.Rules {
+		for _, action := range rule.Actions {
+			if action.Type == rules.ActionThrottleCPU && action.Active {
+				delete(s.state.PrometheusLastResult, rule.Name)
+			}
+		}
+	}
+	s.saveState()
+}
+
+// readFrequency reads a frequency in kHz from a cpufreq file.
+func readFrequency(file string) (int, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	freq, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing the frequency in %s failed: %v", file, err)
+	}
+	return freq, nil
+}
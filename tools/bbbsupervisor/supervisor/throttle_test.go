@@ -0,0 +1,135 @@
+package supervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCpufreq creates cpufreq policy directories with the files of the policies in dir and points cpufreqPolicies to them.
+// It returns the function restoring cpufreqPolicies.
+func fakeCpufreq(t *testing.T, dir string, policies map[string]map[string]string) func() {
+	for policy, files := range policies {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, policy), 0755))
+		for name, content := range files {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, policy, name), []byte(content), 0644))
+		}
+	}
+	previous := cpufreqPolicies
+	cpufreqPolicies = filepath.Join(dir, "policy*")
+	return func() { cpufreqPolicies = previous }
+}
+
+// readTestFrequency reads a frequency from a fake cpufreq file.
+func readTestFrequency(t *testing.T, file string) int {
+	freq, err := readFrequency(file)
+	require.NoError(t, err)
+	return freq
+}
+
+func TestThrottledFrequency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer fakeCpufreq(t, dir, map[string]map[string]string{
+		"policy0": {"scaling_available_frequencies": "408000 600000 816000 1008000 1200000 1416000 \n"},
+		"policy4": {},
+	})()
+
+	tests := []struct {
+		policy   string
+		target   int
+		expected int
+	}{
+		{"policy0", 849600, 816000},
+		{"policy0", 816000, 816000},
+		{"policy0", 2000000, 1416000},
+		// all available frequencies are above the target
+		{"policy0", 100000, 100000},
+		// the available frequencies are unknown
+		{"policy4", 1080000, 1080000},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, throttledFrequency(filepath.Join(dir, test.policy), test.target), "%s %d", test.policy, test.target)
+	}
+}
+
+func TestThrottleCPU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer fakeCpufreq(t, dir, map[string]map[string]string{
+		"policy0": {
+			"cpuinfo_max_freq":              "1416000\n",
+			"scaling_max_freq":              "1416000\n",
+			"scaling_available_frequencies": "408000 600000 816000 1008000 1200000 1416000\n",
+		},
+		"policy4": {
+			"cpuinfo_max_freq": "1800000\n",
+			"scaling_max_freq": "1800000\n",
+		},
+	})()
+
+	s := newTestSupervisor(t, `{
+		"rules": [
+			{
+				"name": "cpuThrottle",
+				"prometheus": { "expression": "max(node_thermal_zone_temp)", "interval": "30s", "operator": ">=", "threshold": 80 },
+				"actions": [ { "type": "throttle-cpu", "active": true, "percent": 60 } ],
+				"floodDelay": "1m"
+			}
+		]
+	}`)
+	isWarningSet := func() bool {
+		warnings, err := systemstate.GetWarnings(s.redis)
+		require.NoError(t, err)
+		return len(warnings) == 1 && warnings[0] == systemstate.WarningCPUThrottled
+	}
+	require.False(t, isCPUThrottled())
+
+	require.NoError(t, s.throttleCPU(true, 60))
+	require.Equal(t, 816000, readTestFrequency(t, filepath.Join(dir, "policy0", "scaling_max_freq")))
+	require.Equal(t, 1080000, readTestFrequency(t, filepath.Join(dir, "policy4", "scaling_max_freq")))
+	require.True(t, isCPUThrottled())
+	require.True(t, isWarningSet())
+
+	// the throttling and the result of the throttling rule are kept while the CPU is throttled
+	s.state.PrometheusLastResult["cpuThrottle"] = true
+	s.resetCPUThrottling()
+	require.True(t, isWarningSet())
+	require.True(t, s.state.PrometheusLastResult["cpuThrottle"])
+
+	require.NoError(t, s.throttleCPU(false, 0))
+	require.Equal(t, 1416000, readTestFrequency(t, filepath.Join(dir, "policy0", "scaling_max_freq")))
+	require.Equal(t, 1800000, readTestFrequency(t, filepath.Join(dir, "policy4", "scaling_max_freq")))
+	require.False(t, isCPUThrottled())
+	require.False(t, isWarningSet())
+
+	// after a reboot the kernel removed the limit, so the warning and the result of the throttling rule are reset
+	require.NoError(t, systemstate.SetWarning(s.redis, systemstate.WarningCPUThrottled))
+	s.resetCPUThrottling()
+	require.False(t, isWarningSet())
+	_, known := s.state.PrometheusLastResult["cpuThrottle"]
+	require.False(t, known)
+}
+
+func TestThrottleCPUErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restore := fakeCpufreq(t, dir, nil)
+	s := newTestSupervisor(t, `{}`)
+
+	// no cpufreq policies
+	require.Error(t, s.throttleCPU(true, 60))
+	restore()
+
+	// an unreadable maximum frequency
+	defer fakeCpufreq(t, dir, map[string]map[string]string{"policy0": {"cpuinfo_max_freq": "fast\n"}})()
+	require.Error(t, s.throttleCPU(true, 60))
+	require.False(t, isCPUThrottled())
+}
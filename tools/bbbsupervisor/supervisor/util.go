@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/digitalbitbox/bitbox-base/middleware/src/redis"
+	"github.com/digitalbitbox/bitbox-base/middleware/src/systemstate"
+	"github.com/digitalbitbox/bitbox02-api-go/api/firmware/messages"
 )
 
 // unsetClearnetIDB unsets (0 - download blocks over Tor) the ibdClearnetRedisKey if set.
@@ -26,10 +28,32 @@ func (s *Supervisor) unsetClearnetIDB() (err error) {
 	return
 }
 
+// setDescriptionCode activates or deactivates a HSM heartbeat description code in redis.
+// The Middleware sends the active code with the highest priority to the HSM.
+func (s *Supervisor) setDescriptionCode(code messages.BitBoxBaseHeartbeatRequest_DescriptionCode, active bool) error {
+	if active {
+		err := systemstate.SetDescriptionCode(s.redis, code)
+		if err != nil {
+			return fmt.Errorf("setting the description code %s failed: %v", code, err)
+		}
+		log.Printf("Set the description code %s.\n", code)
+		return nil
+	}
+	err := systemstate.ClearDescriptionCode(s.redis, code)
+	if err != nil {
+		return fmt.Errorf("clearing the description code %s failed: %v", code, err)
+	}
+	log.Printf("Cleared the description code %s.\n", code)
+	return nil
+}
+
+// systemctl is the path of the systemctl executable. It is replaced in the tests.
+var systemctl = "/bin/systemctl"
+
 // restartUnit restarts a systemd unit
 func (s *Supervisor) restartUnit(unit string) error {
 	args := []string{"restart", unit}
-	cmd := exec.Command("/bin/systemctl", args...)
+	cmd := exec.Command(systemctl, args...)
 	cmdAsString := "systemctl " + strings.Join(args, " ")
 	err := cmd.Run()
 	if err != nil {
@@ -39,6 +63,36 @@ func (s *Supervisor) restartUnit(unit string) error {
 	return nil
 }
 
+// stopUnit stops a systemd unit
+func (s *Supervisor) stopUnit(unit string) error {
+	args := []string{"stop", unit}
+	cmd := exec.Command(systemctl, args...)
+	cmdAsString := "systemctl " + strings.Join(args, " ")
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("command %s threw an error %v", cmdAsString, err)
+	}
+	log.Printf("stopUnit: command '%v' executed.\n", cmdAsString)
+	return nil
+}
+
+// isUnitActive returns true if `systemctl is-active` reports the systemd unit as active
+func (s *Supervisor) isUnitActive(unit string) bool {
+	return exec.Command(systemctl, "is-active", "--quiet", unit).Run() == nil
+}
+
+// runCommand runs an executable with the passed arguments
+func (s *Supervisor) runCommand(executable string, args []string) error {
+	cmd := exec.Command(executable, args...)
+	cmdAsString := executable + " " + strings.Join(args, " ")
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("command %s threw an error %v", cmdAsString, err)
+	}
+	log.Printf("runCommand: command '%v' executed.\n", cmdAsString)
+	return nil
+}
+
 // setBBBConfigValue calls `bbb-config.sh set <argument> <value>`
 func (s *Supervisor) setBBBConfigValue(argument string, value string) error {
 	args := []string{"set", argument, value}
@@ -6,13 +6,14 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/rules"
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
-	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/trigger"
 )
 
 // LogWatcher watches systemd service logs.
 type LogWatcher struct {
-	Unit   string             // systemd unit to watch, e.g 'bitcoind'
+	Unit   string             // systemd unit to watch, e.g 'bitcoind', or 'kernel' to watch the kernel log
+	Rules  []rules.Rule       // rules with a log matcher for the unit
 	Events chan watcher.Event // channel for passing service Events (e.g. a systemd log entry)
 	Errors chan error         // channel for passing errors (e.g. stderr outputs)
 }
@@ -26,6 +27,7 @@ type ErrorWriter struct {
 type EventWriter struct {
 	events chan watcher.Event
 	unit   string
+	rules  []rules.Rule
 }
 
 // Write implements the io.Writer interface by sending the content as a parsed event through the event channel.
@@ -33,9 +35,8 @@ func (ew EventWriter) Write(p []byte) (int, error) {
 	// sometimes multiple log lines are read as one
 	logLines := strings.Split(strings.TrimSuffix(string(p), "\n"), "\n")
 	for _, line := range logLines {
-		event := ew.parseEvent(line, ew.unit)
-		if event != nil {
-			ew.events <- *event
+		for _, event := range ew.parseEvents(line) {
+			ew.events <- event
 		}
 	}
 
@@ -48,7 +49,7 @@ func (ew ErrorWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-// Watch indefinitely watches/follows systemd logs for a specified unit.
+// Watch indefinitely watches/follows systemd logs for a specified unit, or the kernel log for the unit rules.KernelLog.
 // It passes any systemd log output on to the event channel.
 // If there are errors running the journalctl command or if there is any
 // output to stderr, the errors are passed on in the error channel `errs`.
@@ -57,14 +58,17 @@ func (lw LogWatcher) Watch() {
 		"--since=now",
 		"--quiet",
 		"--follow",
-		"--unit",
-		lw.Unit,
+	}
+	if lw.Unit == rules.KernelLog {
+		systemdArgs = append(systemdArgs, "--dmesg")
+	} else {
+		systemdArgs = append(systemdArgs, "--unit", lw.Unit)
 	}
 
 	cmdAsString := "journalctl " + strings.Join(systemdArgs, " ")
 	cmd := exec.Command("/bin/journalctl", systemdArgs...)
 
-	eveWriter := EventWriter{lw.Events, lw.Unit}
+	eveWriter := EventWriter{lw.Events, lw.Unit, lw.Rules}
 	errWriter := ErrorWriter{lw.Errors}
 
 	cmd.Stdout = eveWriter // stdout of journalctl is written into the events channel
@@ -77,18 +81,13 @@ func (lw LogWatcher) Watch() {
 	errWriter.Write([]byte(fmt.Sprintf("command %v unexpectedly exited", cmdAsString)))
 }
 
-// parseEvent checks a string for relevant events and potentially returns an event type
-func (ew EventWriter) parseEvent(line string, unit string) *watcher.Event {
-	switch {
-	// fully synched electrs
-	case strings.Contains(line, "finished full compaction"):
-		return &watcher.Event{Unit: unit, Trigger: trigger.ElectrsFullySynced}
-	// electrs unable to connect bitcoind
-	case strings.Contains(line, "WARN - reconnecting to bitcoind: no reply from daemon"):
-		return &watcher.Event{Unit: unit, Trigger: trigger.ElectrsNoBitcoindConnectivity}
-	// bbbmiddleware unable to connect bitcoind
-	case strings.Contains(line, "GetBlockChainInfo rpc call failed"):
-		return &watcher.Event{Unit: unit, Trigger: trigger.MiddlewareNoBitcoindConnectivity}
+// parseEvents checks a string against the log matchers of the rules and returns an event for each matching rule
+func (ew EventWriter) parseEvents(line string) []watcher.Event {
+	var events []watcher.Event
+	for _, rule := range ew.rules {
+		if rule.Log.Matches(line) {
+			events = append(events, watcher.Event{Unit: ew.unit, Rule: rule.Name})
+		}
 	}
-	return nil
+	return events
 }
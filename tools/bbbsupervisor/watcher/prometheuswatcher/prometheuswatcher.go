@@ -6,7 +6,6 @@ import (
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/prometheus"
 
 	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
-	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/trigger"
 )
 
 // PrometheusWatcher watches metrics exposed by a Prometheus server
@@ -14,7 +13,7 @@ type PrometheusWatcher struct {
 	Unit       string // unit is the systemd unit that the expression belongs to (e.g. 'bitcoind')
 	Expression string // expression is the PQL expression to query for.
 	PClient    prometheus.Client
-	Trigger    trigger.Trigger    // trigger is the trigger to fire when a expression has been read by this watcher
+	Rule       string             // rule is the name of the rule the expression has been read for
 	Interval   time.Duration      // interval query interval
 	Events     chan watcher.Event // channel for passing service Events (e.g. a systemd log entry)
 	Errors     chan error         // channel for passing errors (e.g. stderr outputs)
@@ -36,5 +35,5 @@ func (pw PrometheusWatcher) watchHandler() {
 		return
 	}
 
-	pw.Events <- watcher.Event{Unit: pw.Unit, Trigger: pw.Trigger, Measure: pw.Expression, Value: measuredValue}
+	pw.Events <- watcher.Event{Unit: pw.Unit, Rule: pw.Rule, Measure: pw.Expression, Value: measuredValue}
 }
@@ -0,0 +1,57 @@
+package systemdwatcher
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
+)
+
+// systemctl is the path of the systemctl executable. It is replaced in the tests.
+var systemctl = "/bin/systemctl"
+
+// SystemdWatcher watches the state of a systemd unit by polling `systemctl show`
+type SystemdWatcher struct {
+	Unit     string             // systemd unit to watch, e.g 'bitcoind'
+	Rule     string             // rule is the name of the rule the unit state is watched for
+	Interval time.Duration      // interval polling interval
+	Events   chan watcher.Event // channel for passing service Events (e.g. a unit state change)
+	Errors   chan error         // channel for passing errors (e.g. a failed systemctl call)
+}
+
+// Watch implements watcher.Watch() interface by calling the watchHandler repeatedly.
+func (sw *SystemdWatcher) Watch() {
+	for {
+		sw.watchHandler()
+		<-time.After(sw.Interval)
+	}
+}
+
+// watchHandler passes an event with the ActiveState of the unit into the events channel. The state is passed on every
+// poll, not only when it changes to a matched state, so that a unit which stays failed, e.g. because a restart was
+// rejected by the flood control or the unit crashed again, is handled again. The rules rate-limit their actions with the
+// flood delay and the restart budget of the unit instead.
+func (sw *SystemdWatcher) watchHandler() {
+	state, err := activeState(sw.Unit)
+	if err != nil {
+		sw.Errors <- err
+		return
+	}
+	sw.Events <- watcher.Event{Unit: sw.Unit, Rule: sw.Rule, Measure: "ActiveState", State: state}
+}
+
+// activeState returns the ActiveState of a systemd unit, e.g. 'active', 'inactive' or 'failed'.
+func activeState(unit string) (string, error) {
+	args := []string{"show", "--property=ActiveState", unit}
+	out, err := exec.Command(systemctl, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("command systemctl %s threw an error %v", strings.Join(args, " "), err)
+	}
+	state := strings.TrimPrefix(strings.TrimSpace(string(out)), "ActiveState=")
+	if state == "" {
+		return "", fmt.Errorf("could not read the ActiveState of unit %s from %q", unit, out)
+	}
+	return state, nil
+}
@@ -0,0 +1,80 @@
+package systemdwatcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSystemctl replaces systemctl with a script that prints the output and exits with the exit code. It returns the
+// function restoring systemctl.
+func fakeSystemctl(t *testing.T, dir string, output string, exitCode int) func() {
+	script := filepath.Join(dir, "systemctl")
+	content := fmt.Sprintf("#!/bin/sh\nprintf '%s'\nexit %d\n", output, exitCode)
+	require.NoError(t, ioutil.WriteFile(script, []byte(content), 0755))
+
+	previous := systemctl
+	systemctl = script
+	return func() { systemctl = previous }
+}
+
+func TestActiveState(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+		state    string
+		err      bool
+	}{
+		{name: "failed", output: `ActiveState=failed\n`, state: "failed"},
+		{name: "inactive", output: `ActiveState=inactive\n`, state: "inactive"},
+		{name: "without newline", output: `ActiveState=active`, state: "active"},
+		{name: "no value", output: `ActiveState=\n`, err: true},
+		{name: "no output", output: ``, err: true},
+		{name: "systemctl error", output: `ActiveState=failed\n`, exitCode: 1, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bbbsupervisor")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			defer fakeSystemctl(t, dir, test.output, test.exitCode)()
+
+			state, err := activeState("electrs")
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.state, state)
+		})
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbbsupervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer fakeSystemctl(t, dir, `ActiveState=failed\n`, 0)()
+
+	sw := &SystemdWatcher{
+		Unit:     "electrs",
+		Rule:     "electrsFailed",
+		Interval: time.Second,
+		Events:   make(chan watcher.Event, 2),
+		Errors:   make(chan error, 2),
+	}
+	// the state is passed on every poll, also if it did not change
+	sw.watchHandler()
+	sw.watchHandler()
+	expected := watcher.Event{Unit: "electrs", Rule: "electrsFailed", Measure: "ActiveState", State: "failed"}
+	require.Equal(t, expected, <-sw.Events)
+	require.Equal(t, expected, <-sw.Events)
+	require.Empty(t, sw.Errors)
+}
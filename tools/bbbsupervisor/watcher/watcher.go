@@ -1,7 +1,5 @@
 package watcher
 
-import "github.com/digitalbitbox/bitbox-base/tools/bbbsupervisor/watcher/trigger"
-
 type Watcher interface {
 	Watch()
 }
@@ -9,8 +7,9 @@ type Watcher interface {
 // Event represents an event triggered by a watcher
 // e.g. that bitcoin or electrs has fully synced, or a service is not reachable
 type Event struct {
-	Unit    string          // unit represents systemd unit name, e.g. 'bitcoind'
-	Trigger trigger.Trigger // trigger could be e.g. 'triggerElectrsNoBitcoindConnectivity' or 'triggerPrometheusBitcoindIBD'
-	Measure string          // measure is something that is measured by the prometheusWatcher
-	Value   float64         // value is the value that has been measured
+	Unit    string  // unit represents systemd unit name, e.g. 'bitcoind'
+	Rule    string  // rule is the name of the matched rule, e.g. 'electrsNoBitcoindConnectivity' or 'bitcoindIBDStarted'
+	Measure string  // measure is something that is measured by the prometheusWatcher
+	Value   float64 // value is the value that has been measured
+	State   string  // state is the systemd unit state read by the systemdWatcher, e.g. 'failed'
 }